@@ -1,59 +1,154 @@
 package advanced
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/draw"
 	_ "image/jpeg"
-	"image/png"
+	_ "image/png"
 	"io"
 	"io/ioutil"
-	"sort"
+	"math"
+	"sync/atomic"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	_ "github.com/DimitarPetrov/stegify/formats/bmp"
+	_ "github.com/DimitarPetrov/stegify/formats/tiff"
+	"github.com/DimitarPetrov/stegify/steg"
 )
 
 const (
 	headerSize = 8 // Size in bytes for storing message length
+	// orderedFlag is set in the header of carriers whose pixels of equal cost are selected
+	// in the order of their position. Carriers without it were encoded by earlier versions,
+	// which selected them in the order sort.Slice left them in.
+	orderedFlag = 1 << 63
 )
 
-// AdvancedEncode implements the Edge-Adaptive LSB Matching algorithm
+// Algorithm is the name of the edge-adaptive algorithm in steg.Options.
+// Importing this package registers it, so the context aware functions of steg can use it.
+const Algorithm = "advanced"
+
+func init() {
+	steg.RegisterAlgorithm(Algorithm, encodeContext, decodeContext)
+	steg.RegisterAlgorithm(JPEGAlgorithm, encodeJPEGContext, decodeJPEGContext)
+}
+
+// AdvancedEncode implements the Edge-Adaptive LSB Matching algorithm.
+// The result keeps the carrier's format if it is lossless and is PNG encoded otherwise.
+// Ancillary chunks of PNG carriers, e.g. text, colour profile and timestamps, are kept.
 func AdvancedEncode(carrier io.Reader, data io.Reader, result io.Writer) error {
-	// 1. Load and prepare image
-	img, format, err := getImageAsRGBA(carrier)
+	return AdvancedEncodeWithFormat(carrier, data, result, "")
+}
+
+// AdvancedEncodeWithFormat is AdvancedEncode writing the result in the given format.
+// An empty format keeps the carrier's format if it is lossless and falls back to PNG otherwise.
+func AdvancedEncodeWithFormat(carrier io.Reader, data io.Reader, result io.Writer, format string) error {
+	options := steg.Options{Algorithm: Algorithm, EncodeOptions: steg.EncodeOptions{Format: format}}
+	return steg.EncodeContext(context.Background(), carrier, data, result, options)
+}
+
+// encodeContext is the steg.EncodeFunc of Algorithm
+func encodeContext(ctx context.Context, carrier io.Reader, data io.Reader, result io.Writer, options steg.Options) error {
+	format := options.Format
+	if options.Alpha {
+		return fmt.Errorf("the %s algorithm hides data in the red channel only and does not support the alpha option", Algorithm)
+	}
+
+	// 1. Load and prepare image, keeping the metadata of PNG carriers and, when
+	//    requested, the EXIF data and ICC profile of JPEG carriers
+	carrierBytes, err := ioutil.ReadAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error reading carrier: %w", err)
+	}
+	src, carrierFormat, err := decodeImage(bytes.NewReader(carrierBytes))
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+	metadata, err := formats.ReadMetadata(carrierBytes, carrierFormat, options.JPEGMetadata)
 	if err != nil {
-		return fmt.Errorf("error parsing carrier image: %v", err)
+		return fmt.Errorf("error reading carrier metadata: %w", err)
+	}
+	img := toRGBA(src)
+	nrgba := toNRGBA(src)
+
+	resultFormat, err := formats.Resolve(carrierFormat, format)
+	if err != nil {
+		return err
 	}
 
 	// Read all data
 	dataBytes, err := ioutil.ReadAll(data)
 	if err != nil {
-		return fmt.Errorf("error reading data: %v", err)
+		return fmt.Errorf("error reading data: %w", err)
 	}
 
 	// 2. Calculate embedding costs
 	//    We use the GREEN channel (1) for costs,
 	//    because we embed in the RED channel (0).
 	//    This prevents the decoder from desyncing.
+	//    Fully transparent pixels are excluded, modifying them is easy to spot.
 	bounds := img.Bounds()
 	costs := CalculateCosts(img, 1) // 1 = Green Channel
+	capacity := excludeTransparent(costs, src)
 
 	// 3. Prepare data payload
 	header := make([]byte, headerSize)
-	binary.BigEndian.PutUint64(header, uint64(len(dataBytes)))
+	binary.BigEndian.PutUint64(header, uint64(len(dataBytes))|orderedFlag)
 	fullData := append(header, dataBytes...)
 
 	// 4. Check capacity
-	capacity := bounds.Dx() * bounds.Dy()
 	if len(fullData)*8 > capacity {
-		return fmt.Errorf("data is too large for the carrier image: %d bits needed, %d available", len(fullData)*8, capacity)
+		return &steg.CapacityError{Needed: int64(len(fullData)), Available: int64(capacity / 8)}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 16-bit carriers are embedded at full sample depth, so a change is 1/65535
+	// instead of 1/255, when the result format keeps 16 bits per sample.
+	// Costs still come from the 8-bit Green channel above.
+	if is16Bit(src) && formats.IsDeep(resultFormat) {
+		img64 := toNRGBA64(src)
+
+		// 5. Get flat pixel data (only from the Red channel)
+		pixels := make([]uint16, bounds.Dx()*bounds.Dy())
+		idx := 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				pixels[idx] = img64.NRGBA64At(x, y).R
+				idx++
+			}
+		}
+
+		// 6. Apply optimal changes using LSB Matching
+		modifiedPixels := getOptimalChanges(pixels, fullData, costs, math.MaxUint16)
+
+		// 7. Update the Red channel in place
+		idx = 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := img64.NRGBA64At(x, y)
+				c.R = modifiedPixels[idx]
+				img64.SetNRGBA64(x, y, c)
+				idx++
+			}
+		}
+
+		// 8. Encode in the resolved lossless format
+		return formats.EncodeWithMetadata(result, img64, resultFormat, metadata)
 	}
 
 	// 5. Get flat pixel data (only from the Red channel)
-	pixels := make([]byte, capacity)
+	pixels := make([]byte, bounds.Dx()*bounds.Dy())
 	idx := 0
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixels[idx] = img.RGBAAt(x, y).R
+			pixels[idx] = nrgba.NRGBAAt(x, y).R
 			idx++
 		}
 	}
@@ -61,129 +156,256 @@ func AdvancedEncode(carrier io.Reader, data io.Reader, result io.Writer) error {
 	// 6. Apply optimal changes using LSB Matching
 	modifiedPixels := GetOptimalChanges(pixels, fullData, costs)
 
-	// 7. Create result image
-	result_img := image.NewRGBA(bounds)
+	// 7. Update the Red channel in place, colours are not premultiplied
 	idx = 0
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			c := img.RGBAAt(x, y)      // Get original G, B, A
-			c.R = modifiedPixels[idx]  // Use modified R
-			result_img.Set(x, y, c)
+			c := nrgba.NRGBAAt(x, y)  // Get original G, B, A
+			c.R = modifiedPixels[idx] // Use modified R
+			nrgba.SetNRGBA(x, y, c)
 			idx++
 		}
 	}
 
-	// 8. Encode as PNG
-	switch format {
-	case "png", "jpeg":
-		return png.Encode(result, result_img)
-	default:
-		return fmt.Errorf("unsupported carrier format")
-	}
+	// 8. Encode in the resolved lossless format
+	return formats.EncodeWithMetadata(result, nrgba, resultFormat, metadata)
 }
 
 // AdvancedDecode extracts the hidden message using the advanced algorithm
 func AdvancedDecode(carrier io.Reader, result io.Writer) error {
+	return steg.DecodeContext(context.Background(), carrier, result, steg.Options{Algorithm: Algorithm})
+}
+
+// decodeContext is the steg.DecodeFunc of Algorithm
+func decodeContext(ctx context.Context, carrier io.Reader, result io.Writer, _ steg.Options) error {
 	// 1. Load and prepare image
-	img, _, err := getImageAsRGBA(carrier)
+	src, _, err := decodeImage(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+	return DecodeFromImage(ctx, src, result)
+}
+
+// DecodeFromImage extracts the message hidden with Algorithm from an already decoded image.
+// Headers claiming more than the image holds return steg.ErrCorruptHeader.
+func DecodeFromImage(ctx context.Context, src image.Image, result io.Writer) error {
+	// 2. - 5. Re-calculate the costs and read the header
+	c, err := readCarrier(src)
 	if err != nil {
-		return fmt.Errorf("error parsing carrier image: %v", err)
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 6. Get message length, checked against the capacity before it is
+	//    converted to bits, which would overflow for crafted headers
+	messageLength := c.messageLength()
+	if !c.fits(messageLength) {
+		return fmt.Errorf("%w: invalid message length %d", steg.ErrCorruptHeader, messageLength)
+	}
+	totalHeaderBits := uint64(headerSize * 8)
+	totalDataBits := messageLength * 8
+	totalBits := totalHeaderBits + totalDataBits
+
+	// 7. Extract the actual data bits from the *next* pixels in the selection
+	positions := c.positions(int(totalBits))
+	dataBits := make([]byte, totalDataBits)
+	for i := range dataBits {
+		dataBits[i] = c.pixels[positions[i+int(totalHeaderBits)]] & 1
 	}
 
+	// 8. Convert data bits to bytes
+	data := make([]byte, messageLength)
+	for i := 0; i < int(messageLength); i++ {
+		for j := 0; j < 8; j++ {
+			if dataBits[i*8+j] == 1 {
+				data[i] |= 1 << uint(7-j)
+			}
+		}
+	}
+
+	// 9. Write the extracted data
+	_, err = result.Write(data)
+	return err
+}
+
+// ProbeHeader reads the message length from the header of Algorithm in an image without
+// extracting the message, and returns it with the capacity of the image in bits, header included.
+// The header of an image without a message holds random bits, whose length hardly ever fits.
+func ProbeHeader(src image.Image) (uint64, int, error) {
+	c, err := readCarrier(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.messageLength(), c.capacity, nil
+}
+
+// carrierBits holds the costs of a carrier, the number of usable pixels and the Red samples
+// carrying the LSBs, together with the header bits read from the lowest-cost ones.
+// legacy holds all positions in the selection order of earlier versions when the header
+// lacks orderedFlag.
+type carrierBits struct {
+	costs    *CostMap
+	capacity int
+	pixels   []byte
+	header   []byte
+	legacy   []int
+}
+
+func readCarrier(src image.Image) (*carrierBits, error) {
+	img := toRGBA(src)
+
 	// 2. Re-calculate embedding costs
 	//    CRITICAL: We MUST use the *exact same* logic as the encoder.
 	//    We use the GREEN channel (1), which was not modified.
 	bounds := img.Bounds()
 	costs := CalculateCosts(img, 1) // 1 = Green Channel
+	capacity := excludeTransparent(costs, src)
 
 	// 3. Get flat pixel data (only from the Red channel)
-	capacity := bounds.Dx() * bounds.Dy()
-	pixels := make([]byte, capacity)
+	//    For 16-bit carriers the low byte of the sample carries the LSB.
+	var img64 *image.NRGBA64
+	var nrgba *image.NRGBA
+	if is16Bit(src) {
+		img64 = toNRGBA64(src)
+	} else {
+		nrgba = toNRGBA(src)
+	}
+	pixels := make([]byte, bounds.Dx()*bounds.Dy())
 	idx := 0
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixels[idx] = img.RGBAAt(x, y).R
+			if img64 != nil {
+				pixels[idx] = byte(img64.NRGBA64At(x, y).R)
+			} else {
+				pixels[idx] = nrgba.NRGBAAt(x, y).R
+			}
 			idx++
 		}
 	}
 
-	// 4. Create a slice of all pixels with their costs
-	allPixelCosts := make([]pixelCost, capacity)
-	for i := 0; i < capacity; i++ {
-		allPixelCosts[i] = pixelCost{
-			pos:  i,
-			cost: costs.costs[i],
-		}
-	}
-
-	// 5. Sort the pixels by cost, from lowest to highest
-	//    This now perfectly mirrors the encoder's sort order.
-	sort.Slice(allPixelCosts, func(i, j int) bool {
-		return allPixelCosts[i].cost < allPixelCosts[j].cost
-	})
-
-	// 6. Extract the header (first 64 bits)
+	// 4. Select the lowest-cost pixels for the header (first 64 bits)
+	//    This mirrors the encoder's selection order.
 	if capacity < headerSize*8 {
-		return fmt.Errorf("image is too small to contain a header")
+		return nil, fmt.Errorf("%w: image is too small to contain a header", steg.ErrNoPayload)
 	}
-	headerBits := make([]byte, headerSize*8)
-	for i := 0; i < headerSize*8; i++ {
-		pixelPos := allPixelCosts[i].pos
-		headerBits[i] = pixels[pixelPos] & 1
+	c := &carrierBits{costs: costs, capacity: capacity, pixels: pixels}
+	c.header = c.readHeader(lowestCosts(costs.costs, headerSize*8))
+
+	// 5. Without a plausible header of the current version, read the header
+	//    of earlier versions. Random header bits hardly ever pass for one.
+	if length := binary.BigEndian.Uint64(c.header); length&orderedFlag == 0 || !c.fits(length&^orderedFlag) {
+		c.legacy = legacyLowestCosts(costs.costs)
+		c.header = c.readHeader(c.legacy[:headerSize*8])
 	}
+	return c, nil
+}
 
-	// 7. Convert header bits to bytes
+// readHeader reads the header bits from the LSBs of the pixels at the positions
+func (c *carrierBits) readHeader(positions []int) []byte {
 	header := make([]byte, headerSize)
-	for i := 0; i < headerSize; i++ {
-		for j := 0; j < 8; j++ {
-			if headerBits[i*8+j] == 1 {
-				header[i] |= 1 << uint(7-j)
-			}
-		}
+	for i, pixelPos := range positions {
+		header[i/8] |= (c.pixels[pixelPos] & 1) << uint(7-i%8)
 	}
+	return header
+}
 
-	// 8. Get message length
-	messageLength := binary.BigEndian.Uint64(header)
-	totalHeaderBits := uint64(headerSize * 8)
-	totalDataBits := uint64(messageLength * 8)
-	totalBits := totalHeaderBits + totalDataBits
+// fits reports whether a message of the length fits the carrier after the header
+func (c *carrierBits) fits(length uint64) bool {
+	return length > 0 && length <= uint64(c.capacity-headerSize*8)/8
+}
 
-	if messageLength == 0 || totalBits > uint64(capacity) {
-		return fmt.Errorf("invalid or corrupt message length: %d", messageLength)
+// positions returns the positions of the k lowest-cost pixels in the selection order of the header's version
+func (c *carrierBits) positions(k int) []int {
+	if c.legacy != nil {
+		return c.legacy[:k]
 	}
+	return lowestCosts(c.costs.costs, k)
+}
 
-	// 9. Extract the actual data bits
-	dataBits := make([]byte, totalDataBits)
-	for i := 0; i < int(totalDataBits); i++ {
-		// Read from the *next* pixels in the sorted cost list
-		pixelPos := allPixelCosts[i+int(totalHeaderBits)].pos
-		dataBits[i] = pixels[pixelPos] & 1
+func (c *carrierBits) messageLength() uint64 {
+	length := binary.BigEndian.Uint64(c.header)
+	if c.legacy == nil {
+		length &^= orderedFlag
 	}
-
-	// 10. Convert data bits to bytes
-	data := make([]byte, messageLength)
-	for i := 0; i < int(messageLength); i++ {
-		for j := 0; j < 8; j++ {
-			if dataBits[i*8+j] == 1 {
-				data[i] |= 1 << uint(7-j)
-			}
-		}
-	}
-
-	// 11. Write the extracted data
-	_, err = result.Write(data)
-	return err
+	return length
 }
 
-func getImageAsRGBA(reader io.Reader) (*image.RGBA, string, error) {
+func decodeImage(reader io.Reader) (image.Image, string, error) {
 	img, format, err := image.Decode(reader)
 	if err != nil {
-		return nil, format, fmt.Errorf("error decoding carrier image: %v", err)
+		if errors.Is(err, image.ErrFormat) {
+			err = fmt.Errorf("%w: %v", steg.ErrUnsupportedFormat, err)
+		}
+		return nil, format, fmt.Errorf("error decoding carrier image: %w", err)
 	}
+	return img, format, nil
+}
 
+func toRGBA(img image.Image) *image.RGBA {
 	bounds := img.Bounds()
 	rgba := image.NewRGBA(bounds)
 	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// is16Bit reports whether the image has 16 bits per sample
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// toNRGBA converts the image to non-premultiplied colour, so semi-transparent pixels keep their exact samples
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	if src, ok := img.(*image.NRGBA); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(nrgba.Pix[nrgba.PixOffset(bounds.Min.X, y):], src.Pix[src.PixOffset(bounds.Min.X, y):src.PixOffset(bounds.Max.X, y)])
+		}
+		return nrgba
+	}
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// toNRGBA64 is toNRGBA for 16-bit carriers
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA64(bounds)
+	if src, ok := img.(*image.NRGBA64); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(nrgba.Pix[nrgba.PixOffset(bounds.Min.X, y):], src.Pix[src.PixOffset(bounds.Min.X, y):src.PixOffset(bounds.Max.X, y)])
+		}
+		return nrgba
+	}
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	return nrgba
+}
 
-	return rgba, format, nil
-}
\ No newline at end of file
+// excludeTransparent gives fully transparent pixels an infinite cost, so they are ranked
+// after every usable pixel, and returns the number of usable pixels
+func excludeTransparent(costs *CostMap, img image.Image) int {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	var usable atomic.Int64
+	forEachRowTile(bounds.Dy(), func(y0, y1 int) {
+		tileUsable := 0
+		for y := y0; y < y1; y++ {
+			row := costs.costs[y*width : (y+1)*width]
+			for x := range row {
+				if _, _, _, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA(); a == 0 {
+					row[x] = math.Inf(1)
+				} else {
+					tileUsable++
+				}
+			}
+		}
+		usable.Add(int64(tileUsable))
+	})
+	return int(usable.Load())
+}
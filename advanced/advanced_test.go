@@ -2,11 +2,20 @@ package advanced
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
+	"io"
 	"math"
+	"os"
 	"testing"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/steg"
 )
 
 func TestAdvancedEncodeAndDecode(t *testing.T) {
@@ -129,4 +138,264 @@ func getTestImageReader(img image.Image) *bytes.Buffer {
 		png.Encode(&buf, img)
 	}
 	return &buf
-}
\ No newline at end of file
+}
+func TestAdvancedEncodeAndDecode16Bit(t *testing.T) {
+	width, height := 128, 128
+	carrier := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			carrier.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(x * y * 4),
+				G: uint16((x*x + y*y) * 3),
+				B: uint16(x * 512),
+				A: 0xFFFF,
+			})
+		}
+	}
+
+	testData := []byte("Sixteen bits per sample leave plenty of room")
+
+	var encodedBuf bytes.Buffer
+	err := AdvancedEncode(getTestImageReader(carrier), bytes.NewReader(testData), &encodedBuf)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	encoded, err := png.Decode(bytes.NewReader(encodedBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode encoded image: %v", err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r1, _, _, _ := carrier.At(x, y).RGBA()
+			r2, _, _, _ := encoded.At(x, y).RGBA()
+			if diff := int(r1) - int(r2); diff > 1 || diff < -1 {
+				t.Fatalf("Pixel (%d,%d) changed by %d, expected at most one 16-bit step", x, y, diff)
+			}
+		}
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := AdvancedDecode(bytes.NewReader(encodedBuf.Bytes()), &decodedBuf); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Errorf("Decoded data does not match original.\nExpected: %v\nGot: %v", testData, decodedBuf.Bytes())
+	}
+}
+
+func TestAdvancedEncodeSkipsTransparentPixels(t *testing.T) {
+	width, height := 128, 128
+	carrier := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := uint8(64 + x)
+			if y < height/2 {
+				a = 0 // fully transparent half with colour data behind it
+			}
+			carrier.SetNRGBA(x, y, color.NRGBA{R: uint8(x * y), G: uint8(x*7 + y*3), B: uint8(x), A: a})
+		}
+	}
+	var carrierBuf bytes.Buffer
+	if err := png.Encode(&carrierBuf, carrier); err != nil {
+		t.Fatalf("Failed to create carrier: %v", err)
+	}
+
+	testData := bytes.Repeat([]byte("semi-transparent"), 40)
+	var encodedBuf bytes.Buffer
+	if err := AdvancedEncode(&carrierBuf, bytes.NewReader(testData), &encodedBuf); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	encoded, err := png.Decode(bytes.NewReader(encodedBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode encoded image: %v", err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(encoded.At(x, y)).(color.NRGBA)
+			original := carrier.NRGBAAt(x, y)
+			if c.G != original.G || c.B != original.B || c.A != original.A {
+				t.Fatalf("Pixel (%d,%d) changed outside of the Red channel", x, y)
+			}
+			if original.A == 0 && c.R != original.R {
+				t.Fatalf("Transparent pixel (%d,%d) was modified", x, y)
+			}
+		}
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := AdvancedDecode(bytes.NewReader(encodedBuf.Bytes()), &decodedBuf); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Error("Decoded data does not match original")
+	}
+}
+
+func TestAdvancedAlgorithmWithStegOptions(t *testing.T) {
+	carrier := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			carrier.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x + y), A: 255})
+		}
+	}
+	testData := bytes.Repeat([]byte("encrypted and error corrected "), 20)
+	options := steg.Options{Algorithm: Algorithm, Key: "secret", ECC: steg.ECCMedium}
+
+	// Split over two carriers to go through all of steg's handling
+	var first, second bytes.Buffer
+	carriers := []io.Reader{getTestImageReader(carrier), getTestImageReader(carrier)}
+	if err := steg.MultiCarrierEncodeContext(context.Background(), carriers, bytes.NewReader(testData), []io.Writer{&first, &second}, options); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := steg.MultiCarrierDecodeContext(context.Background(), []io.Reader{&first, &second}, &decodedBuf, options); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Errorf("Decoded data does not match original")
+	}
+}
+
+func TestAdvancedAlgorithmEncodeOptions(t *testing.T) {
+	carrier := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			carrier.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x + y), A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, carrier, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	withExif := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	withExif = append(withExif, encoded.Bytes()[2:]...)
+	data := []byte("metadata")
+
+	// The EXIF data of the JPEG carrier is translated only when requested
+	for _, translate := range []bool{false, true} {
+		var result bytes.Buffer
+		options := steg.Options{Algorithm: Algorithm, EncodeOptions: steg.EncodeOptions{JPEGMetadata: translate}}
+		if err := steg.EncodeContext(context.Background(), bytes.NewReader(withExif), bytes.NewReader(data), &result, options); err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		chunks, err := formats.ReadPNGChunks(bytes.NewReader(result.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to read chunks: %v", err)
+		}
+		if kept := len(chunks) == 1 && chunks[0].Type == "eXIf"; kept != translate {
+			t.Errorf("JPEGMetadata %v: expected the EXIF data kept %v, got %v", translate, translate, chunks)
+		}
+	}
+
+	options := steg.Options{Algorithm: Algorithm, EncodeOptions: steg.EncodeOptions{Alpha: true}}
+	if err := steg.EncodeContext(context.Background(), bytes.NewReader(withExif), bytes.NewReader(data), &bytes.Buffer{}, options); err == nil {
+		t.Error("Expected the alpha option to be rejected")
+	}
+}
+
+func TestAdvancedEncodeShouldReturnCapacityError(t *testing.T) {
+	carrier := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			carrier.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x + y), A: 255})
+		}
+	}
+
+	err := AdvancedEncode(getTestImageReader(carrier), bytes.NewReader(make([]byte, 4096)), &bytes.Buffer{})
+	if !errors.Is(err, steg.ErrCapacityExceeded) {
+		t.Fatalf("Expected ErrCapacityExceeded, got %v", err)
+	}
+	var capacityErr *steg.CapacityError
+	if !errors.As(err, &capacityErr) || capacityErr.Needed <= capacityErr.Available {
+		t.Errorf("Expected a CapacityError of more bytes needed than available, got %v", err)
+	}
+}
+
+func TestAdvancedDecodeCarrierOfEarlierVersion(t *testing.T) {
+	// Encoded before pixels of equal cost were selected by position, so without orderedFlag
+	carrier, err := os.ReadFile("../examples/advanced_legacy.png")
+	if err != nil {
+		t.Fatalf("Failed to read carrier: %v", err)
+	}
+	expected := "encoded before equal costs were ordered by position"
+
+	var decoded bytes.Buffer
+	if err := AdvancedDecode(bytes.NewReader(carrier), &decoded); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if decoded.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, decoded.String())
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(carrier))
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	if length, _, err := ProbeHeader(img); err != nil || length != uint64(len(expected)) {
+		t.Errorf("Expected a header of %d bytes, got %d (%v)", len(expected), length, err)
+	}
+
+	// Carriers of the current version carry the flag and decode in position order
+	var result bytes.Buffer
+	if err := AdvancedEncode(bytes.NewReader(carrier), bytes.NewReader([]byte(expected)), &result); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	img, _, err = image.Decode(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	c, err := readCarrier(img)
+	if err != nil || c.legacy != nil || binary.BigEndian.Uint64(c.header) != uint64(len(expected))|orderedFlag {
+		t.Errorf("Expected a header with orderedFlag, got %x (%v)", c.header, err)
+	}
+}
+
+func TestDecodeFromImageShouldRejectOverflowingLength(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x + y), A: 255})
+		}
+	}
+	// A header of 2^61 bytes, whose number of bits wraps to 0
+	c, err := readCarrier(img)
+	if err != nil {
+		t.Fatalf("Failed to read carrier: %v", err)
+	}
+	for i, pos := range legacyLowestCosts(c.costs.costs)[:headerSize*8] {
+		bit := uint8(0)
+		if i == 2 {
+			bit = 1
+		}
+		offset := img.PixOffset(pos%64, pos/64)
+		img.Pix[offset] = img.Pix[offset]&^1 | bit
+	}
+
+	err = DecodeFromImage(context.Background(), img, &bytes.Buffer{})
+	if !errors.Is(err, steg.ErrCorruptHeader) {
+		t.Errorf("Expected ErrCorruptHeader, got %v", err)
+	}
+}
+
+func TestLowestCosts(t *testing.T) {
+	costs := []float64{3, 1, math.Inf(1), 2, 1, math.MaxFloat64, 0.5, 2}
+	expected := []int{6, 1, 4, 3, 7, 0, 5, 2} // equal costs ordered by position
+
+	for k := 0; k <= len(costs)+1; k++ {
+		positions := lowestCosts(costs, k)
+		want := expected[:min(k, len(expected))]
+		if len(positions) != len(want) {
+			t.Fatalf("k=%d: expected %d positions, got %d", k, len(want), len(positions))
+		}
+		for i := range want {
+			if positions[i] != want[i] {
+				t.Errorf("k=%d: expected positions %v, got %v", k, want, positions)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package advanced
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+
+	"github.com/DimitarPetrov/stegify/formats/avi"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+// sequenceHeaderSize is the length of the frame index and piece count every piece starts with
+const sequenceHeaderSize = 8
+
+// EncodeAVI spreads data over the frames of an uncompressed or Motion JPEG AVI carrier.
+// Every frame is a carrier of its own: uncompressed frames are encoded by steg like any other
+// image carrier, i.e. by plain LSB replacement, and Motion JPEG frames in their DCT coefficients
+// with the J-UNIWARD costs of AdvancedEncodeJPEG.
+// The data is split in equal pieces, one per frame, and every piece starts with the index of
+// its frame and the number of pieces, so decoding detects dropped or reordered frames.
+// steg's multi carrier functions are not used for this because their pieces carry no index
+// and their count is not recorded, which leaves the decoder unable to tell how many frames to read.
+// Everything but the frames carrying data is written back unchanged.
+func EncodeAVI(carrier io.Reader, data io.Reader, result io.Writer) error {
+	video, err := avi.Read(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier video: %w", err)
+	}
+
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+
+	frames := carrierFrames(video)
+	if len(frames) == 0 {
+		return &steg.CapacityError{Needed: int64(len(dataBytes))}
+	}
+
+	pieces := min(len(frames), max(1, len(dataBytes)))
+	for i := 0; i < pieces; i++ {
+		piece := make([]byte, sequenceHeaderSize)
+		binary.BigEndian.PutUint32(piece, uint32(i))
+		binary.BigEndian.PutUint32(piece[4:], uint32(pieces))
+		piece = append(piece, dataBytes[i*len(dataBytes)/pieces:(i+1)*len(dataBytes)/pieces]...)
+
+		if err := encodeFrame(video, frames[i], piece); err != nil {
+			return fmt.Errorf("error encoding frame %d: %w", frames[i], err)
+		}
+	}
+
+	return video.Write(result)
+}
+
+// DecodeAVI extracts data previously hidden by EncodeAVI
+func DecodeAVI(carrier io.Reader, result io.Writer) error {
+	video, err := avi.Read(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier video: %w", err)
+	}
+
+	frames := carrierFrames(video)
+	pieces := 1 // known once the first piece is read
+	for i := 0; i < pieces; i++ {
+		if i >= len(frames) {
+			return fmt.Errorf("%w: data is spread over %d frames but the video has %d", steg.ErrShardMissing, pieces, len(frames))
+		}
+		piece, err := decodeFrame(video, frames[i])
+		if err != nil {
+			return fmt.Errorf("error decoding frame %d: %w", frames[i], err)
+		}
+		if len(piece) < sequenceHeaderSize {
+			return fmt.Errorf("%w: frame %d carries no data", steg.ErrNoPayload, frames[i])
+		}
+
+		index, count := int(binary.BigEndian.Uint32(piece)), int(binary.BigEndian.Uint32(piece[4:]))
+		if i == 0 {
+			pieces = count
+		}
+		if index != i || count != pieces || count == 0 {
+			return fmt.Errorf("%w: frame %d carries piece %d of %d instead of piece %d of %d, frames were dropped or reordered", steg.ErrShardMissing, frames[i], index, count, i, pieces)
+		}
+
+		if _, err := result.Write(piece[sequenceHeaderSize:]); err != nil {
+			return fmt.Errorf("error writing the result: %w", err)
+		}
+	}
+	return nil
+}
+
+// carrierFrames returns the indices of the frames that can carry data, dropped frames are empty
+func carrierFrames(video *avi.Video) []int {
+	var frames []int
+	for i := 0; i < video.FrameCount(); i++ {
+		if len(video.Frame(i)) > 0 {
+			frames = append(frames, i)
+		}
+	}
+	return frames
+}
+
+func encodeFrame(video *avi.Video, i int, piece []byte) error {
+	if video.IsMJPEG() {
+		coeffs, err := ReadJPEGCoefficients(bytes.NewReader(video.Frame(i)))
+		if err != nil {
+			return err
+		}
+		media, err := embedInCoefficients(coeffs, piece)
+		if err != nil {
+			return err
+		}
+		var frame bytes.Buffer
+		if err := media.Save(&frame); err != nil {
+			return err
+		}
+		video.SetFrame(i, frame.Bytes())
+		return nil
+	}
+
+	var carrier, stego bytes.Buffer
+	if err := framePNG(video, i, &carrier); err != nil {
+		return err
+	}
+	if err := steg.Encode(&carrier, bytes.NewReader(piece), &stego); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(&stego)
+	if err != nil {
+		return err
+	}
+	return video.SetFrameImage(i, img)
+}
+
+func decodeFrame(video *avi.Video, i int) ([]byte, error) {
+	if video.IsMJPEG() {
+		coeffs, err := ReadJPEGCoefficients(bytes.NewReader(video.Frame(i)))
+		if err != nil {
+			return nil, err
+		}
+		return extractFromCoefficients(coeffs)
+	}
+
+	var carrier, piece bytes.Buffer
+	if err := framePNG(video, i, &carrier); err != nil {
+		return nil, err
+	}
+	if err := steg.Decode(&carrier, &piece); err != nil {
+		return nil, err
+	}
+	return piece.Bytes(), nil
+}
+
+// framePNG writes an uncompressed frame as a PNG carrier for steg
+func framePNG(video *avi.Video, i int, w io.Writer) error {
+	img, err := video.FrameImage(i)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// EncodeAVIByFileNames is EncodeAVI working with file names
+func EncodeAVIByFileNames(carrierFileName, dataFileName, resultFileName string) error {
+	return byFileNames(carrierFileName, dataFileName, resultFileName, EncodeAVI)
+}
+
+// DecodeAVIByFileNames is DecodeAVI working with file names
+func DecodeAVIByFileNames(carrierFileName, resultFileName string) error {
+	return byFileNames(carrierFileName, "", resultFileName, func(carrier, _ io.Reader, result io.Writer) error {
+		return DecodeAVI(carrier, result)
+	})
+}
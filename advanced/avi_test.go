@@ -0,0 +1,137 @@
+package advanced
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math/rand"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/formats/avi"
+)
+
+func newTestAVI(t *testing.T, frames int, options *avi.Options) []byte {
+	images := make([]image.Image, frames)
+	for i := range images {
+		images[i] = newTexturedImage(64, 48)
+	}
+	var buf bytes.Buffer
+	if err := avi.Encode(&buf, images, options); err != nil {
+		t.Fatalf("Failed to encode avi: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// stripHuffmanTables removes the DHT segments of a JPEG, as Motion JPEG encoders commonly do
+func stripHuffmanTables(frame []byte) []byte {
+	out := append([]byte{}, frame[:2]...)
+	for pos := 2; pos+4 <= len(frame); {
+		marker, length := frame[pos+1], int(binary.BigEndian.Uint16(frame[pos+2:]))
+		if marker == 0xDA { // the scan runs to the end
+			return append(out, frame[pos:]...)
+		}
+		if marker != 0xC4 {
+			out = append(out, frame[pos:pos+2+length]...)
+		}
+		pos += 2 + length
+	}
+	return out
+}
+
+func TestAVIEncodeDecode(t *testing.T) {
+	mjpegWithoutTables := func() []byte {
+		video, err := avi.Read(bytes.NewReader(newTestAVI(t, 4, &avi.Options{MJPEG: true, Quality: 90})))
+		if err != nil {
+			t.Fatalf("Failed to read avi: %v", err)
+		}
+		for i := 0; i < video.FrameCount(); i++ {
+			frame := stripHuffmanTables(video.Frame(i))
+			if bytes.Contains(frame, []byte{0xFF, 0xC4}) {
+				t.Fatal("Failed to strip the huffman tables")
+			}
+			video.SetFrame(i, frame)
+		}
+		var buf bytes.Buffer
+		if err := video.Write(&buf); err != nil {
+			t.Fatalf("Failed to write avi: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		carrier []byte
+		size    int
+	}{
+		{"uncompressed", newTestAVI(t, 4, nil), 2000},
+		{"mjpeg", newTestAVI(t, 4, &avi.Options{MJPEG: true, Quality: 90}), 300},
+		{"mjpeg without huffman tables", mjpegWithoutTables(), 300},
+		{"fewer bytes than frames", newTestAVI(t, 4, nil), 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.New(rand.NewSource(5)).Read(data)
+
+			var result bytes.Buffer
+			if err := EncodeAVI(bytes.NewReader(test.carrier), bytes.NewReader(data), &result); err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			if _, err := avi.Read(bytes.NewReader(result.Bytes())); err != nil {
+				t.Fatalf("Result is not a valid avi: %v", err)
+			}
+
+			var decoded bytes.Buffer
+			if err := DecodeAVI(bytes.NewReader(result.Bytes()), &decoded); err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !bytes.Equal(decoded.Bytes(), data) {
+				t.Error("Decoded data does not match")
+			}
+		})
+	}
+}
+
+func TestAVIDecodeShouldDetectReorderedFrames(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(6)).Read(data)
+	var result bytes.Buffer
+	if err := EncodeAVI(bytes.NewReader(newTestAVI(t, 3, nil)), bytes.NewReader(data), &result); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	video, err := avi.Read(&result)
+	if err != nil {
+		t.Fatalf("Failed to read avi: %v", err)
+	}
+	first, second := video.Frame(0), video.Frame(1)
+	video.SetFrame(0, second)
+	video.SetFrame(1, first)
+	var swapped bytes.Buffer
+	if err := video.Write(&swapped); err != nil {
+		t.Fatalf("Failed to write avi: %v", err)
+	}
+
+	if err := DecodeAVI(&swapped, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for reordered frames")
+	}
+}
+
+func TestAVIEncodeShouldKeepUnusedFrames(t *testing.T) {
+	carrier := newTestAVI(t, 5, nil)
+	var result bytes.Buffer
+	if err := EncodeAVI(bytes.NewReader(carrier), bytes.NewReader([]byte{1, 2}), &result); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	cover, _ := avi.Read(bytes.NewReader(carrier))
+	stego, err := avi.Read(&result)
+	if err != nil {
+		t.Fatalf("Failed to read avi: %v", err)
+	}
+	for i := 2; i < cover.FrameCount(); i++ {
+		if !bytes.Equal(cover.Frame(i), stego.Frame(i)) {
+			t.Errorf("Frame %d does not carry data but was changed", i)
+		}
+	}
+}
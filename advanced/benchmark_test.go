@@ -2,7 +2,9 @@ package advanced
 
 import (
 	"bytes"
+	"fmt"
 	"image"
+	"math/rand"
 	"testing"
 
 	"github.com/DimitarPetrov/stegify/steg"
@@ -43,6 +45,56 @@ func BenchmarkComparison(b *testing.B) {
 	})
 }
 
+// newTexturedRGBA returns a deterministic textured image, so costs vary as they do for photos
+func newTexturedRGBA(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+// 24 megapixels, the size of a photo of a typical camera
+const largeWidth, largeHeight = 6000, 4000
+
+func BenchmarkCalculateCosts24MP(b *testing.B) {
+	img := newTexturedRGBA(largeWidth, largeHeight)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CalculateCosts(img, 1)
+	}
+}
+
+func BenchmarkRGBImageCosts24MP(b *testing.B) {
+	img := toNRGBA(newTexturedRGBA(largeWidth, largeHeight))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewRGBImage(img); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetOptimalChanges24MP(b *testing.B) {
+	img := newTexturedRGBA(largeWidth, largeHeight)
+	costs := CalculateCosts(img, 1)
+	pixels := make([]byte, largeWidth*largeHeight)
+	for i := range pixels {
+		pixels[i] = img.Pix[i*4]
+	}
+
+	for _, size := range []int{1 << 10, 1 << 20} {
+		message := make([]byte, size)
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				GetOptimalChanges(pixels, message, costs)
+			}
+		})
+	}
+}
+
 // SecurityAnalysis performs statistical tests to compare security
 func SecurityAnalysis(t *testing.T) {
 	// Create test images
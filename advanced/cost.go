@@ -3,8 +3,13 @@ package advanced
 import (
 	"image"
 	"math"
+	"runtime"
+	"sync"
 )
 
+// minRowTile is the least number of rows a worker processes at once
+const minRowTile = 16
+
 // CostMap represents the embedding costs for each pixel
 type CostMap struct {
 	costs  []float64
@@ -21,78 +26,85 @@ func NewCostMap(width, height int) *CostMap {
 	}
 }
 
-// getChannelValue is a helper to get a specific channel value from an RGBA image
-func getChannelValue(img *image.RGBA, x, y, channel int) float64 {
-	c := img.RGBAAt(x, y)
-	switch channel {
-	case 0:
-		return float64(c.R)
-	case 1:
-		return float64(c.G)
-	case 2:
-		return float64(c.B)
-	default:
-		// Default to Green if channel is invalid
-		return float64(c.G)
-	}
-}
-
 // CalculateCosts computes the embedding costs for each pixel based on edge detection
-// of a *specific channel*.
+// of a *specific channel*. Rows are processed in tiles across a worker pool.
 func CalculateCosts(img *image.RGBA, channel int) *CostMap {
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
 	costMap := NewCostMap(width, height)
-
-	// Sobel kernels for edge detection
-	sobelX := [3][3]float64{
-		{-1, 0, 1},
-		{-2, 0, 2},
-		{-1, 0, 1},
-	}
-	sobelY := [3][3]float64{
-		{-1, -2, -1},
-		{0, 0, 0},
-		{1, 2, 1},
+	if channel < 0 || channel > 2 {
+		// Default to Green if channel is invalid
+		channel = 1
 	}
 
-	// Calculate gradients and costs for each pixel
-	for y := 1; y < height-1; y++ {
-		for x := 1; x < width-1; x++ {
-			// Calculate Sobel gradients
-			var gx, gy float64
-			for i := -1; i <= 1; i++ {
-				for j := -1; j <= 1; j++ {
-					// Use the specific channel for cost calculation
-					pixel := getChannelValue(img, x+i, y+j, channel)
-					gx += pixel * sobelX[i+1][j+1]
-					gy += pixel * sobelY[i+1][j+1]
+	forEachRowTile(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := costMap.costs[y*width : (y+1)*width]
+
+			// Set very high costs for border pixels that we can't process
+			if y == 0 || y == height-1 {
+				for x := range row {
+					row[x] = math.MaxFloat64
 				}
+				continue
+			}
+			if width > 0 {
+				row[0] = math.MaxFloat64
+				row[width-1] = math.MaxFloat64
 			}
 
-			// Calculate gradient magnitude
-			gradientMagnitude := math.Sqrt(gx*gx + gy*gy)
+			offset := img.PixOffset(bounds.Min.X, bounds.Min.Y+y) + channel
+			for x := 1; x < width-1; x++ {
+				row[x] = sobelCost(img.Pix, offset+x*4, img.Stride, 4)
+			}
+		}
+	})
 
-			// Calculate cost: higher gradients (edges) = lower cost
-			// Add epsilon to prevent division by zero
-			cost := 1.0 / (gradientMagnitude + epsilon)
+	return costMap
+}
 
-			// Store the cost
-			costMap.Set(x, y, cost)
-		}
-	}
+// sobelCost returns the embedding cost of the sample at index i of pix from its 3x3 Sobel
+// gradient, step is the distance to the same sample of the next pixel and stride to the next row.
+// Higher gradients (edges) = lower cost, epsilon prevents division by zero.
+func sobelCost(pix []uint8, i, stride, step int) float64 {
+	up, down := i-stride, i+stride
+	topLeft, top, topRight := int(pix[up-step]), int(pix[up]), int(pix[up+step])
+	left, right := int(pix[i-step]), int(pix[i+step])
+	bottomLeft, bottom, bottomRight := int(pix[down-step]), int(pix[down]), int(pix[down+step])
+
+	gx := (bottomLeft + 2*bottom + bottomRight) - (topLeft + 2*top + topRight)
+	gy := (topRight + 2*right + bottomRight) - (topLeft + 2*left + bottomLeft)
+	return 1.0 / (math.Sqrt(float64(gx*gx+gy*gy)) + epsilon)
+}
 
-	// Set very high costs for border pixels that we couldn't process
-	for y := 0; y < height; y++ {
-		costMap.Set(0, y, math.MaxFloat64)
-		costMap.Set(width-1, y, math.MaxFloat64)
+// forEachRowTile calls fn with tiles of consecutive rows [y0, y1) covering [0, height)
+// on a pool of one worker per CPU, and returns once all tiles are done
+func forEachRowTile(height int, fn func(y0, y1 int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers == 1 || height <= minRowTile {
+		fn(0, height)
+		return
 	}
-	for x := 0; x < width; x++ {
-		costMap.Set(x, 0, math.MaxFloat64)
-		costMap.Set(x, height-1, math.MaxFloat64)
+	// A few tiles per worker balance rows of different cost
+	tile := max(minRowTile, (height+4*workers-1)/(4*workers))
+
+	tiles := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y0 := range tiles {
+				fn(y0, min(y0+tile, height))
+			}
+		}()
 	}
-
-	return costMap
+	for y0 := 0; y0 < height; y0 += tile {
+		tiles <- y0
+	}
+	close(tiles)
+	wg.Wait()
 }
 
 // Get returns the cost for the pixel at (x,y)
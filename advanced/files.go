@@ -0,0 +1,54 @@
+package advanced
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// byFileNames opens the carrier and data files, creates the result file and runs process on them.
+// An empty dataFileName is for decoding, process then gets a nil data Reader.
+// The files are closed afterwards and the result is removed if anything failed.
+func byFileNames(carrierFileName, dataFileName, resultFileName string, process func(carrier, data io.Reader, result io.Writer) error) (err error) {
+	carrier, err := os.Open(carrierFileName)
+	if err != nil {
+		return fmt.Errorf("error opening carrier file: %w", err)
+	}
+	defer func() {
+		closeErr := carrier.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	var data io.Reader
+	if dataFileName != "" {
+		dataFile, err := os.Open(dataFileName)
+		if err != nil {
+			return fmt.Errorf("error opening data file: %w", err)
+		}
+		defer func() {
+			closeErr := dataFile.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}()
+		data = dataFile
+	}
+
+	result, err := os.Create(resultFileName)
+	if err != nil {
+		return fmt.Errorf("error creating result file: %w", err)
+	}
+	defer func() {
+		closeErr := result.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(resultFileName)
+		}
+	}()
+
+	return process(carrier, data, result)
+}
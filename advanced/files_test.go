@@ -0,0 +1,114 @@
+package advanced
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestByFileNames(t *testing.T) {
+	dir := t.TempDir()
+	carrier, data := filepath.Join(dir, "carrier.wav"), filepath.Join(dir, "data")
+	if err := os.WriteFile(carrier, newTestWAV(16, 1, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(data, make([]byte, 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	video := filepath.Join(dir, "carrier.avi")
+	if err := os.WriteFile(video, newTestAVI(t, 1, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		process    func(result string) error
+		shouldFail bool
+	}{
+		{
+			name: "encoding passes all files",
+			process: func(result string) error {
+				return byFileNames(carrier, data, result, func(c, d io.Reader, r io.Writer) error {
+					if c == nil || d == nil {
+						return errors.New("missing carrier or data")
+					}
+					_, err := io.Copy(r, d)
+					return err
+				})
+			},
+		},
+		{
+			name: "decoding passes no data",
+			process: func(result string) error {
+				return byFileNames(carrier, "", result, func(c, d io.Reader, r io.Writer) error {
+					if d != nil {
+						return errors.New("unexpected data")
+					}
+					_, err := io.Copy(r, c)
+					return err
+				})
+			},
+		},
+		{
+			name: "missing data file",
+			process: func(result string) error {
+				return byFileNames(carrier, filepath.Join(dir, "missing"), result, AdvancedEncodeWAV)
+			},
+			shouldFail: true,
+		},
+		{
+			name: "wav encoding of data too large for the carrier",
+			process: func(result string) error {
+				return AdvancedEncodeWAVByFileNames(carrier, data, result)
+			},
+			shouldFail: true,
+		},
+		{
+			name: "wav decoding of a file which is no wav",
+			process: func(result string) error {
+				return AdvancedDecodeWAVByFileNames(data, result)
+			},
+			shouldFail: true,
+		},
+		{
+			name: "avi encoding of data too large for the carrier",
+			process: func(result string) error {
+				return EncodeAVIByFileNames(video, data, result)
+			},
+			shouldFail: true,
+		},
+		{
+			name: "avi decoding of a file which is no avi",
+			process: func(result string) error {
+				return DecodeAVIByFileNames(data, result)
+			},
+			shouldFail: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := filepath.Join(dir, "result")
+			defer os.Remove(result)
+
+			err := test.process(result)
+			if test.shouldFail {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				if _, err := os.Stat(result); !os.IsNotExist(err) {
+					t.Errorf("Expected the result of the failed run to be removed, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := os.ReadFile(result); err != nil {
+				t.Errorf("Expected the result to be written, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package advanced
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+// JPEGAlgorithm is the name of the J-UNIWARD algorithm in steg.Options. It hides data in the DCT
+// coefficients of JPEG carriers like AdvancedEncodeJPEG and writes the results as JPEG.
+// Importing this package registers it next to Algorithm.
+const JPEGAlgorithm = "juniward"
+
+// JPEGImage implements CoverMedia for the luminance DCT coefficients of a baseline JPEG
+type JPEGImage struct {
+	coeffs *JPEGCoefficients
+	costs  []float64
+}
+
+// NewJPEGImage creates a new JPEG cover media with J-UNIWARD costs
+func NewJPEGImage(coeffs *JPEGCoefficients) (*JPEGImage, error) {
+	if len(coeffs.Components) == 0 {
+		return nil, fmt.Errorf("jpeg has no components")
+	}
+	return &JPEGImage{
+		coeffs: coeffs,
+		costs:  CalculateJUNIWARDCosts(coeffs, 0).costs,
+	}, nil
+}
+
+func (j *JPEGImage) GetSize() int64 {
+	return int64(len(j.coeffs.Components[0].Coeffs))
+}
+
+func (j *JPEGImage) GetCosts() []float64 {
+	return j.costs
+}
+
+func (j *JPEGImage) Embed(data []byte, positions []int) error {
+	if len(positions) < len(data)*8 {
+		return &steg.CapacityError{Needed: int64(len(data)), Available: int64(len(positions) / 8)}
+	}
+
+	coeffs := j.coeffs.Components[0].Coeffs
+	for i := 0; i < len(data)*8; i++ {
+		bit := (data[i/8] >> uint(7-i%8)) & 1
+		if byte(coeffs[positions[i]]&1) != bit {
+			coeffs[positions[i]] = modifyCoefficient(coeffs[positions[i]])
+		}
+	}
+	return nil
+}
+
+func (j *JPEGImage) Extract(positions []int) ([]byte, error) {
+	data := make([]byte, len(positions)/8)
+	coeffs := j.coeffs.Components[0].Coeffs
+	for i := 0; i < len(data)*8; i++ {
+		data[i/8] |= byte(coeffs[positions[i]]&1) << uint(7-i%8)
+	}
+	return data, nil
+}
+
+func (j *JPEGImage) Save(w io.Writer) error {
+	return j.coeffs.Encode(w)
+}
+
+// parities returns the LSB of every luminance coefficient
+func (j *JPEGImage) parities() []byte {
+	coeffs := j.coeffs.Components[0].Coeffs
+	parity := make([]byte, len(coeffs))
+	for i, c := range coeffs {
+		parity[i] = byte(c & 1)
+	}
+	return parity
+}
+
+// modifyCoefficient changes a coefficient by ±1 while keeping it inside the baseline range
+func modifyCoefficient(c int32) int32 {
+	switch {
+	case c >= maxACCoefficient:
+		return c - 1
+	case c <= -maxACCoefficient:
+		return c + 1
+	case randBool():
+		return c + 1
+	default:
+		return c - 1
+	}
+}
+
+// AdvancedEncodeJPEG hides data in the DCT coefficients of a baseline JPEG carrier.
+// Changes are placed by syndrome-trellis coding to minimize the J-UNIWARD distortion,
+// and the result is written as a JPEG with the carrier's quantization tables.
+func AdvancedEncodeJPEG(carrier io.Reader, data io.Reader, result io.Writer) error {
+	coeffs, err := ReadJPEGCoefficients(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+
+	media, err := embedInCoefficients(coeffs, dataBytes)
+	if err != nil {
+		return err
+	}
+	return media.Save(result)
+}
+
+// encodeJPEGContext is the steg.EncodeFunc of JPEGAlgorithm
+func encodeJPEGContext(ctx context.Context, carrier io.Reader, data io.Reader, result io.Writer, options steg.Options) error {
+	if options.Alpha || options.JPEGMetadata {
+		return fmt.Errorf("the %s algorithm keeps the jpeg carrier and does not support the alpha or jpeg metadata options", JPEGAlgorithm)
+	}
+	if options.Format != "" && formats.Normalize(options.Format) != formats.JPEG {
+		return fmt.Errorf("the %s algorithm writes jpeg results and does not support the %s format", JPEGAlgorithm, options.Format)
+	}
+
+	coeffs, err := ReadJPEGCoefficients(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %v", err)
+	}
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	media, err := embedInCoefficients(coeffs, dataBytes)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return media.Save(result)
+}
+
+// decodeJPEGContext is the steg.DecodeFunc of JPEGAlgorithm
+func decodeJPEGContext(ctx context.Context, carrier io.Reader, result io.Writer, _ steg.Options) error {
+	coeffs, err := ReadJPEGCoefficients(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := extractFromCoefficients(coeffs)
+	if err != nil {
+		return err
+	}
+
+	_, err = result.Write(data)
+	return err
+}
+
+// embedInCoefficients hides data in the luminance coefficients where J-UNIWARD costs are lowest
+func embedInCoefficients(coeffs *JPEGCoefficients, data []byte) (*JPEGImage, error) {
+	media, err := NewJPEGImage(coeffs)
+	if err != nil {
+		return nil, err
+	}
+
+	flips, err := embedPayload(media.parities(), media.GetCosts(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	plane := coeffs.Components[0].Coeffs
+	for _, pos := range flips {
+		plane[pos] = modifyCoefficient(plane[pos])
+	}
+	return media, nil
+}
+
+// AdvancedEncodeSideInformed compresses a spatial carrier (e.g. PNG) into a JPEG of the given
+// quality and hides data in it during the compression. The rounding error e of every
+// luminance coefficient is used as side information: rounding to the other side instead
+// costs only (1-2|e|) of the J-UNIWARD cost, so coefficients that were close to a rounding
+// boundary carry the payload almost for free. The result is decoded with AdvancedDecodeJPEG.
+func AdvancedEncodeSideInformed(carrier io.Reader, data io.Reader, result io.Writer, quality int) error {
+	img, _, err := image.Decode(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+
+	coeffs, unquantized := compressJPEG(img, quality)
+	media, err := NewJPEGImage(coeffs)
+	if err != nil {
+		return err
+	}
+
+	plane := coeffs.Components[0].Coeffs
+	stride := coeffs.Components[0].BlocksW * 8
+	costs := media.GetCosts()
+	for i := range costs {
+		// DCT modes (0,0), (0,4), (4,0) and (4,4) of integer pixels have rounding
+		// errors that are not uniformly distributed and would leak the side information
+		if mode := (i/stride%8)*8 + i%8; mode == 0 || mode == 4 || mode == 32 || mode == 36 {
+			costs[i] = wetCost
+			continue
+		}
+		e := unquantized[i] - float64(plane[i])
+		costs[i] *= 1 - 2*math.Abs(e)
+	}
+
+	flips, err := embedPayload(media.parities(), costs, dataBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, pos := range flips {
+		switch e := unquantized[pos] - float64(plane[pos]); {
+		case e > 0 && plane[pos] < maxACCoefficient:
+			plane[pos]++
+		case e < 0 && plane[pos] > -maxACCoefficient:
+			plane[pos]--
+		default:
+			plane[pos] = modifyCoefficient(plane[pos])
+		}
+	}
+
+	return media.Save(result)
+}
+
+// AdvancedDecodeJPEG extracts data hidden by AdvancedEncodeJPEG or AdvancedEncodeSideInformed
+func AdvancedDecodeJPEG(carrier io.Reader, result io.Writer) error {
+	coeffs, err := ReadJPEGCoefficients(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+	data, err := extractFromCoefficients(coeffs)
+	if err != nil {
+		return err
+	}
+
+	_, err = result.Write(data)
+	return err
+}
+
+// extractFromCoefficients recovers data hidden by embedInCoefficients
+func extractFromCoefficients(coeffs *JPEGCoefficients) ([]byte, error) {
+	if len(coeffs.Components) == 0 {
+		return nil, fmt.Errorf("jpeg has no components")
+	}
+	media := &JPEGImage{coeffs: coeffs}
+	return extractPayload(media.parities())
+}
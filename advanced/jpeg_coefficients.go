@@ -0,0 +1,833 @@
+package advanced
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const dctBlockSize = 64
+
+// zigzag maps from the zig-zag ordering used in the JPEG bitstream to the
+// natural (row-major) ordering of an 8x8 block.
+var zigzag = [dctBlockSize]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// JPEGComponent holds the quantized DCT coefficients of a single colour component.
+// Coefficients are stored as a plane of BlocksW*8 x BlocksH*8 values where the
+// coefficient (u,v) of block (bx,by) lives at (8*bx+v, 8*by+u), which makes the
+// plane line up with a CostMap of the same dimensions.
+type JPEGComponent struct {
+	ID       byte
+	H, V     int // Sampling factors
+	QuantSel int // Index of the quantization table used by the component
+	BlocksW  int // Blocks per line, padded to whole MCUs
+	BlocksH  int // Block lines, padded to whole MCUs
+	Coeffs   []int32
+}
+
+// At returns the coefficient stored at (x,y) of the coefficient plane
+func (c *JPEGComponent) At(x, y int) int32 {
+	return c.Coeffs[y*c.BlocksW*8+x]
+}
+
+// Set sets the coefficient stored at (x,y) of the coefficient plane
+func (c *JPEGComponent) Set(x, y int, v int32) {
+	c.Coeffs[y*c.BlocksW*8+x] = v
+}
+
+// block copies the coefficients of block (bx,by) in natural order into dst
+func (c *JPEGComponent) block(bx, by int, dst *[dctBlockSize]int32) {
+	stride := c.BlocksW * 8
+	base := by*8*stride + bx*8
+	for i := 0; i < 8; i++ {
+		copy(dst[i*8:i*8+8], c.Coeffs[base+i*stride:base+i*stride+8])
+	}
+}
+
+// setBlock stores the coefficients of block (bx,by) given in natural order
+func (c *JPEGComponent) setBlock(bx, by int, src *[dctBlockSize]int32) {
+	stride := c.BlocksW * 8
+	base := by*8*stride + bx*8
+	for i := 0; i < 8; i++ {
+		copy(c.Coeffs[base+i*stride:base+i*stride+8], src[i*8:i*8+8])
+	}
+}
+
+// JPEGCoefficients is the DCT domain representation of a baseline JPEG image.
+// Reading and writing it back does not requantize, so changes made to the
+// coefficients survive a round trip exactly.
+type JPEGCoefficients struct {
+	Width, Height int
+	Components    []JPEGComponent
+	Quant         [4][dctBlockSize]uint16 // Quantization tables in natural order
+
+	segments [][]byte // APPn and COM segments, preserved verbatim on write
+}
+
+// ReadJPEGCoefficients parses a baseline sequential JPEG and returns its quantized DCT coefficients
+func ReadJPEGCoefficients(r io.Reader) (*JPEGCoefficients, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading jpeg: %w", err)
+	}
+	d := &jpegDecoder{data: data}
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+	return d.img, nil
+}
+
+func (j *JPEGCoefficients) maxSampling() (hmax, vmax int) {
+	for _, c := range j.Components {
+		if c.H > hmax {
+			hmax = c.H
+		}
+		if c.V > vmax {
+			vmax = c.V
+		}
+	}
+	return hmax, vmax
+}
+
+// componentSize returns the unpadded dimensions in pixels of component i
+func (j *JPEGCoefficients) componentSize(i int) (int, int) {
+	hmax, vmax := j.maxSampling()
+	c := j.Components[i]
+	return (j.Width*c.H + hmax - 1) / hmax, (j.Height*c.V + vmax - 1) / vmax
+}
+
+type jpegHuffman struct {
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []byte
+}
+
+func newJPEGHuffman(counts [16]byte, values []byte) *jpegHuffman {
+	h := &jpegHuffman{values: values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		if n == 0 {
+			h.maxCode[l] = -1
+		} else {
+			h.valPtr[l] = k
+			h.minCode[l] = code
+			code += n
+			k += n
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+type jpegScanComponent struct {
+	comp   int
+	dc, ac int
+}
+
+type jpegDecoder struct {
+	data []byte
+	pos  int
+	img  *JPEGCoefficients
+
+	huff            [2][4]*jpegHuffman
+	restartInterval int
+	frameSeen       bool
+
+	bits  uint32
+	nBits uint
+}
+
+func (d *jpegDecoder) decode() error {
+	if len(d.data) < 2 || d.data[0] != 0xFF || d.data[1] != 0xD8 {
+		return fmt.Errorf("missing jpeg SOI marker")
+	}
+	d.pos = 2
+	d.img = &JPEGCoefficients{}
+	// Motion JPEG frames commonly leave out their huffman tables and rely on the standard ones
+	for i, spec := range standardHuffmanSpecs {
+		d.huff[i%2][i/2] = newJPEGHuffman(spec.counts, spec.values)
+	}
+
+	for {
+		marker, err := d.nextMarker()
+		if err != nil {
+			return err
+		}
+		if marker == 0xD9 { // EOI
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue // parameterless markers
+		}
+		if d.pos+2 > len(d.data) {
+			return fmt.Errorf("unexpected end of jpeg data")
+		}
+		length := int(binary.BigEndian.Uint16(d.data[d.pos:]))
+		if length < 2 || d.pos+length > len(d.data) {
+			return fmt.Errorf("invalid jpeg segment length")
+		}
+		segment := d.data[d.pos+2 : d.pos+length]
+		d.pos += length
+
+		switch {
+		case marker == 0xC0 || marker == 0xC1:
+			err = d.parseFrame(segment)
+		case marker == 0xC2 || marker == 0xC3 || (marker >= 0xC5 && marker <= 0xCF && marker != 0xC8 && marker != 0xCC):
+			return fmt.Errorf("%w: jpeg, only baseline sequential huffman coding is supported", steg.ErrUnsupportedFormat)
+		case marker == 0xC4:
+			err = d.parseHuffman(segment)
+		case marker == 0xDB:
+			err = d.parseQuant(segment)
+		case marker == 0xDD:
+			if len(segment) < 2 {
+				return fmt.Errorf("invalid jpeg DRI segment")
+			}
+			d.restartInterval = int(binary.BigEndian.Uint16(segment))
+		case marker == 0xDA:
+			err = d.parseScan(segment)
+		case (marker >= 0xE0 && marker <= 0xEF) || marker == 0xFE:
+			raw := make([]byte, length+2)
+			raw[0], raw[1] = 0xFF, marker
+			copy(raw[2:], d.data[d.pos-length:d.pos])
+			d.img.segments = append(d.img.segments, raw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !d.frameSeen {
+		return fmt.Errorf("missing jpeg frame header")
+	}
+	return nil
+}
+
+func (d *jpegDecoder) nextMarker() (byte, error) {
+	for d.pos < len(d.data) && d.data[d.pos] != 0xFF {
+		d.pos++ // skip garbage between segments
+	}
+	for d.pos < len(d.data) && d.data[d.pos] == 0xFF {
+		d.pos++ // skip fill bytes
+	}
+	if d.pos >= len(d.data) {
+		return 0, fmt.Errorf("unexpected end of jpeg data")
+	}
+	marker := d.data[d.pos]
+	d.pos++
+	return marker, nil
+}
+
+func (d *jpegDecoder) parseFrame(s []byte) error {
+	if d.frameSeen {
+		return fmt.Errorf("multiple jpeg frames are not supported")
+	}
+	if len(s) < 6 {
+		return fmt.Errorf("invalid jpeg SOF segment")
+	}
+	if s[0] != 8 {
+		return fmt.Errorf("%w: jpeg sample precision of %d bits", steg.ErrUnsupportedFormat, s[0])
+	}
+	d.img.Height = int(binary.BigEndian.Uint16(s[1:]))
+	d.img.Width = int(binary.BigEndian.Uint16(s[3:]))
+	n := int(s[5])
+	if d.img.Width == 0 || d.img.Height == 0 || n == 0 || len(s) < 6+3*n {
+		return fmt.Errorf("invalid jpeg SOF segment")
+	}
+
+	d.img.Components = make([]JPEGComponent, n)
+	for i := 0; i < n; i++ {
+		c := &d.img.Components[i]
+		c.ID = s[6+3*i]
+		c.H = int(s[7+3*i] >> 4)
+		c.V = int(s[7+3*i] & 0x0F)
+		c.QuantSel = int(s[8+3*i])
+		if c.H < 1 || c.H > 4 || c.V < 1 || c.V > 4 || c.QuantSel > 3 {
+			return fmt.Errorf("invalid jpeg component parameters")
+		}
+	}
+	if n == 1 { // a single component image always has one block per MCU
+		d.img.Components[0].H, d.img.Components[0].V = 1, 1
+	}
+
+	hmax, vmax := d.img.maxSampling()
+	mcusX := (d.img.Width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (d.img.Height + 8*vmax - 1) / (8 * vmax)
+	for i := range d.img.Components {
+		c := &d.img.Components[i]
+		c.BlocksW = mcusX * c.H
+		c.BlocksH = mcusY * c.V
+		c.Coeffs = make([]int32, c.BlocksW*c.BlocksH*dctBlockSize)
+	}
+	d.frameSeen = true
+	return nil
+}
+
+func (d *jpegDecoder) parseHuffman(s []byte) error {
+	for len(s) > 0 {
+		if len(s) < 17 {
+			return fmt.Errorf("invalid jpeg DHT segment")
+		}
+		class, id := s[0]>>4, s[0]&0x0F
+		if class > 1 || id > 3 {
+			return fmt.Errorf("invalid jpeg huffman table")
+		}
+		var counts [16]byte
+		copy(counts[:], s[1:17])
+		total := 0
+		for _, c := range counts {
+			total += int(c)
+		}
+		if len(s) < 17+total {
+			return fmt.Errorf("invalid jpeg DHT segment")
+		}
+		values := make([]byte, total)
+		copy(values, s[17:17+total])
+		d.huff[class][id] = newJPEGHuffman(counts, values)
+		s = s[17+total:]
+	}
+	return nil
+}
+
+func (d *jpegDecoder) parseQuant(s []byte) error {
+	for len(s) > 0 {
+		precision, id := s[0]>>4, s[0]&0x0F
+		if id > 3 || precision > 1 {
+			return fmt.Errorf("invalid jpeg quantization table")
+		}
+		size := 1 + dctBlockSize*(1+int(precision))
+		if len(s) < size {
+			return fmt.Errorf("invalid jpeg DQT segment")
+		}
+		for k := 0; k < dctBlockSize; k++ {
+			if precision == 0 {
+				d.img.Quant[id][zigzag[k]] = uint16(s[1+k])
+			} else {
+				d.img.Quant[id][zigzag[k]] = binary.BigEndian.Uint16(s[1+2*k:])
+			}
+		}
+		s = s[size:]
+	}
+	return nil
+}
+
+func (d *jpegDecoder) parseScan(s []byte) error {
+	if !d.frameSeen {
+		return fmt.Errorf("jpeg scan before frame header")
+	}
+	if len(s) < 1 {
+		return fmt.Errorf("invalid jpeg SOS segment")
+	}
+	n := int(s[0])
+	if n < 1 || n > len(d.img.Components) || len(s) < 1+2*n+3 {
+		return fmt.Errorf("invalid jpeg SOS segment")
+	}
+	comps := make([]jpegScanComponent, n)
+	for i := 0; i < n; i++ {
+		id := s[1+2*i]
+		idx := -1
+		for k, c := range d.img.Components {
+			if c.ID == id {
+				idx = k
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("jpeg scan references unknown component %d", id)
+		}
+		comps[i] = jpegScanComponent{comp: idx, dc: int(s[2+2*i] >> 4), ac: int(s[2+2*i] & 0x0F)}
+		if comps[i].dc > 3 || comps[i].ac > 3 || d.huff[0][comps[i].dc] == nil || d.huff[1][comps[i].ac] == nil {
+			return fmt.Errorf("jpeg scan references missing huffman table")
+		}
+	}
+	return d.decodeScan(comps)
+}
+
+func (d *jpegDecoder) decodeScan(comps []jpegScanComponent) error {
+	d.bits, d.nBits = 0, 0
+	preds := make([]int32, len(comps))
+	var blk [dctBlockSize]int32
+
+	decodeBlock := func(sc jpegScanComponent, pi, bx, by int) error {
+		c := &d.img.Components[sc.comp]
+		for i := range blk {
+			blk[i] = 0
+		}
+		t, err := d.decodeHuffman(d.huff[0][sc.dc])
+		if err != nil {
+			return err
+		}
+		diff, err := d.receiveExtend(t)
+		if err != nil {
+			return err
+		}
+		preds[pi] += diff
+		blk[0] = preds[pi]
+
+		for k := 1; k < dctBlockSize; k++ {
+			rs, err := d.decodeHuffman(d.huff[1][sc.ac])
+			if err != nil {
+				return err
+			}
+			r, s := int(rs>>4), rs&0x0F
+			if s == 0 {
+				if r != 15 {
+					break // EOB
+				}
+				k += 15
+				continue
+			}
+			k += r
+			if k >= dctBlockSize {
+				return fmt.Errorf("corrupt jpeg: coefficient index out of range")
+			}
+			v, err := d.receiveExtend(s)
+			if err != nil {
+				return err
+			}
+			blk[zigzag[k]] = v
+		}
+		c.setBlock(bx, by, &blk)
+		return nil
+	}
+
+	var mcusX, mcusY int
+	if len(comps) == 1 {
+		w, h := d.img.componentSize(comps[0].comp)
+		mcusX, mcusY = (w+7)/8, (h+7)/8
+	} else {
+		hmax, vmax := d.img.maxSampling()
+		mcusX = (d.img.Width + 8*hmax - 1) / (8 * hmax)
+		mcusY = (d.img.Height + 8*vmax - 1) / (8 * vmax)
+	}
+
+	mcu := 0
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			if d.restartInterval > 0 && mcu > 0 && mcu%d.restartInterval == 0 {
+				if err := d.readRestart(); err != nil {
+					return err
+				}
+				for i := range preds {
+					preds[i] = 0
+				}
+			}
+			if len(comps) == 1 {
+				if err := decodeBlock(comps[0], 0, mx, my); err != nil {
+					return err
+				}
+			} else {
+				for i, sc := range comps {
+					c := d.img.Components[sc.comp]
+					for v := 0; v < c.V; v++ {
+						for h := 0; h < c.H; h++ {
+							if err := decodeBlock(sc, i, mx*c.H+h, my*c.V+v); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+			mcu++
+		}
+	}
+	return nil
+}
+
+func (d *jpegDecoder) readRestart() error {
+	d.bits, d.nBits = 0, 0
+	if d.pos+1 < len(d.data) && d.data[d.pos] == 0xFF && d.data[d.pos+1] >= 0xD0 && d.data[d.pos+1] <= 0xD7 {
+		d.pos += 2
+		return nil
+	}
+	return fmt.Errorf("corrupt jpeg: missing restart marker")
+}
+
+func (d *jpegDecoder) readBit() (uint32, error) {
+	if d.nBits == 0 {
+		if d.pos >= len(d.data) {
+			return 0, fmt.Errorf("unexpected end of jpeg data")
+		}
+		b := d.data[d.pos]
+		if b == 0xFF {
+			next := byte(0)
+			if d.pos+1 < len(d.data) {
+				next = d.data[d.pos+1]
+			}
+			if next == 0x00 {
+				d.pos += 2
+			} else {
+				b = 0 // a marker ends the entropy coded data, feed zeros
+			}
+		} else {
+			d.pos++
+		}
+		d.bits, d.nBits = uint32(b), 8
+	}
+	d.nBits--
+	return (d.bits >> d.nBits) & 1, nil
+}
+
+func (d *jpegDecoder) receive(s byte) (int32, error) {
+	var v int32
+	for i := byte(0); i < s; i++ {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | int32(b)
+	}
+	return v, nil
+}
+
+func (d *jpegDecoder) receiveExtend(s byte) (int32, error) {
+	if s == 0 {
+		return 0, nil
+	}
+	if s > 16 {
+		return 0, fmt.Errorf("corrupt jpeg: invalid coefficient size")
+	}
+	v, err := d.receive(s)
+	if err != nil {
+		return 0, err
+	}
+	if v < 1<<(s-1) {
+		v += (-1 << s) + 1
+	}
+	return v, nil
+}
+
+func (d *jpegDecoder) decodeHuffman(h *jpegHuffman) (byte, error) {
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(b)
+		if h.maxCode[l] >= 0 && code <= h.maxCode[l] {
+			return h.values[h.valPtr[l]+code-h.minCode[l]], nil
+		}
+	}
+	return 0, fmt.Errorf("corrupt jpeg: invalid huffman code")
+}
+
+// jpegHuffmanSpec is a Huffman table as listed in section K.3 of the JPEG spec
+type jpegHuffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// standardHuffmanSpecs holds the luminance DC, luminance AC, chrominance DC and
+// chrominance AC tables of section K.3, which cover every baseline symbol.
+var standardHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegCode is a Huffman codeword and its length in bits
+type jpegCode struct {
+	code uint32
+	size uint
+}
+
+func (s jpegHuffmanSpec) codes() [256]jpegCode {
+	var codes [256]jpegCode
+	code, k := uint32(0), 0
+	for l := 0; l < 16; l++ {
+		for i := 0; i < int(s.counts[l]); i++ {
+			codes[s.values[k]] = jpegCode{code: code, size: uint(l + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+type jpegEncoder struct {
+	w     *bufio.Writer
+	err   error
+	bits  uint32
+	nBits uint
+}
+
+func (e *jpegEncoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *jpegEncoder) writeSegment(marker byte, payload []byte) {
+	var hdr [4]byte
+	hdr[0], hdr[1] = 0xFF, marker
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)+2))
+	e.write(hdr[:])
+	e.write(payload)
+}
+
+func (e *jpegEncoder) emit(bits uint32, n uint) {
+	for n > 0 {
+		n--
+		e.bits = e.bits<<1 | (bits>>n)&1
+		e.nBits++
+		if e.nBits == 8 {
+			b := byte(e.bits)
+			e.write([]byte{b})
+			if b == 0xFF {
+				e.write([]byte{0x00})
+			}
+			e.bits, e.nBits = 0, 0
+		}
+	}
+}
+
+func (e *jpegEncoder) flushBits() {
+	if e.nBits > 0 {
+		e.emit(0xFF, 8-e.nBits) // pad with ones
+	}
+}
+
+func bitLength(v int32) uint {
+	if v < 0 {
+		v = -v
+	}
+	n := uint(0)
+	for v > 0 {
+		n++
+		v >>= 1
+	}
+	return n
+}
+
+func (e *jpegEncoder) emitValue(codes *[256]jpegCode, symbol byte, v int32, size uint) {
+	c := codes[symbol]
+	e.emit(c.code, c.size)
+	if size > 0 {
+		if v < 0 {
+			v--
+		}
+		e.emit(uint32(v)&(1<<size-1), size)
+	}
+}
+
+// Encode writes the coefficients as a baseline JPEG using the original quantization
+// tables and the standard Huffman tables.
+func (j *JPEGCoefficients) Encode(w io.Writer) error {
+	e := &jpegEncoder{w: bufio.NewWriter(w)}
+
+	e.write([]byte{0xFF, 0xD8})
+	for _, s := range j.segments {
+		e.write(s)
+	}
+
+	extended := false
+	used := map[int]bool{}
+	for _, c := range j.Components {
+		used[c.QuantSel] = true
+	}
+	for id := 0; id < 4; id++ {
+		if !used[id] {
+			continue
+		}
+		precision := 0
+		for _, q := range j.Quant[id] {
+			if q > 255 {
+				precision = 1
+				extended = true
+			}
+		}
+		payload := []byte{byte(precision<<4 | id)}
+		for k := 0; k < dctBlockSize; k++ {
+			q := j.Quant[id][zigzag[k]]
+			if precision == 0 {
+				payload = append(payload, byte(q))
+			} else {
+				payload = append(payload, byte(q>>8), byte(q))
+			}
+		}
+		e.writeSegment(0xDB, payload)
+	}
+
+	sof := []byte{8, byte(j.Height >> 8), byte(j.Height), byte(j.Width >> 8), byte(j.Width), byte(len(j.Components))}
+	for _, c := range j.Components {
+		sof = append(sof, c.ID, byte(c.H<<4|c.V), byte(c.QuantSel))
+	}
+	marker := byte(0xC0)
+	if extended {
+		marker = 0xC1
+	}
+	e.writeSegment(marker, sof)
+
+	var dht []byte
+	for i, spec := range standardHuffmanSpecs {
+		dht = append(dht, byte((i%2)<<4|i/2))
+		dht = append(dht, spec.counts[:]...)
+		dht = append(dht, spec.values...)
+	}
+	e.writeSegment(0xC4, dht)
+
+	sos := []byte{byte(len(j.Components))}
+	for i, c := range j.Components {
+		table := byte(0)
+		if i > 0 {
+			table = 1
+		}
+		sos = append(sos, c.ID, table<<4|table)
+	}
+	sos = append(sos, 0, 63, 0)
+	e.writeSegment(0xDA, sos)
+
+	var codes [4][256]jpegCode
+	for i, spec := range standardHuffmanSpecs {
+		codes[i] = spec.codes()
+	}
+
+	preds := make([]int32, len(j.Components))
+	var blk [dctBlockSize]int32
+	encodeBlock := func(ci, bx, by int) error {
+		table := 0
+		if ci > 0 {
+			table = 2
+		}
+		j.Components[ci].block(bx, by, &blk)
+
+		diff := blk[0] - preds[ci]
+		preds[ci] = blk[0]
+		size := bitLength(diff)
+		if size > 11 {
+			return fmt.Errorf("dc coefficient difference out of range: %d", diff)
+		}
+		e.emitValue(&codes[table], byte(size), diff, size)
+
+		run := 0
+		for k := 1; k < dctBlockSize; k++ {
+			v := blk[zigzag[k]]
+			if v == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				e.emitValue(&codes[table+1], 0xF0, 0, 0)
+				run -= 16
+			}
+			size := bitLength(v)
+			if size > 10 {
+				return fmt.Errorf("ac coefficient out of range: %d", v)
+			}
+			e.emitValue(&codes[table+1], byte(run<<4)|byte(size), v, size)
+			run = 0
+		}
+		if run > 0 {
+			e.emitValue(&codes[table+1], 0x00, 0, 0)
+		}
+		return nil
+	}
+
+	if len(j.Components) == 1 {
+		w, h := j.componentSize(0)
+		for by := 0; by < (h+7)/8; by++ {
+			for bx := 0; bx < (w+7)/8; bx++ {
+				if err := encodeBlock(0, bx, by); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		hmax, vmax := j.maxSampling()
+		mcusX := (j.Width + 8*hmax - 1) / (8 * hmax)
+		mcusY := (j.Height + 8*vmax - 1) / (8 * vmax)
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				for ci, c := range j.Components {
+					for v := 0; v < c.V; v++ {
+						for h := 0; h < c.H; h++ {
+							if err := encodeBlock(ci, mx*c.H+h, my*c.V+v); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	e.flushBits()
+	e.write([]byte{0xFF, 0xD9})
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,190 @@
+package advanced
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// standardQuantTables are the luminance and chrominance tables of section K.1 of the JPEG spec, in natural order
+var standardQuantTables = [2][dctBlockSize]uint16{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jfifSegment is a minimal JFIF APP0 segment written into newly compressed images
+var jfifSegment = []byte{0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00}
+
+// scaledQuantTable scales a standard table to the given quality the same way libjpeg does
+func scaledQuantTable(table int, quality int) [dctBlockSize]uint16 {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 5000 / quality
+	if quality >= 50 {
+		scale = 200 - 2*quality
+	}
+	var q [dctBlockSize]uint16
+	for i, v := range standardQuantTables[table] {
+		x := (int(v)*scale + 50) / 100
+		if x < 1 {
+			x = 1
+		} else if x > 255 {
+			x = 255
+		}
+		q[i] = uint16(x)
+	}
+	return q
+}
+
+// forwardDCT transforms a level shifted 8x8 block: F[u][v] = sum_y sum_x basis[u][y] * basis[v][x] * f[y][x]
+func forwardDCT(src *[dctBlockSize]float64, dst *[dctBlockSize]float64) {
+	var tmp [dctBlockSize]float64
+	for y := 0; y < 8; y++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += dctBasis[v][x] * src[y*8+x]
+			}
+			tmp[y*8+v] = s
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += dctBasis[u][y] * tmp[y*8+v]
+			}
+			dst[u*8+v] = s
+		}
+	}
+}
+
+// compressJPEG converts a spatial image into baseline JPEG coefficients at the given quality,
+// using 4:2:0 chroma subsampling for colour images. Besides the quantized coefficients it
+// returns the unquantized ones of the luminance plane divided by their quantization step,
+// i.e. the values before rounding.
+func compressJPEG(img image.Image, quality int) (*JPEGCoefficients, []float64) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	gray := false
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		gray = true
+	}
+
+	j := &JPEGCoefficients{
+		Width:    width,
+		Height:   height,
+		segments: [][]byte{append([]byte(nil), jfifSegment...)},
+	}
+	j.Quant[0] = scaledQuantTable(0, quality)
+	j.Quant[1] = scaledQuantTable(1, quality)
+
+	if gray {
+		j.Components = []JPEGComponent{{ID: 1, H: 1, V: 1, QuantSel: 0}}
+	} else {
+		j.Components = []JPEGComponent{
+			{ID: 1, H: 2, V: 2, QuantSel: 0},
+			{ID: 2, H: 1, V: 1, QuantSel: 1},
+			{ID: 3, H: 1, V: 1, QuantSel: 1},
+		}
+	}
+	hmax, vmax := j.maxSampling()
+	mcusX := (width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (height + 8*vmax - 1) / (8 * vmax)
+
+	// Full resolution planes, padded by edge replication to whole MCUs
+	padW, padH := mcusX*8*hmax, mcusY*8*vmax
+	planes := make([][]float64, len(j.Components))
+	for i := range planes {
+		planes[i] = make([]float64, padW*padH)
+	}
+	for y := 0; y < padH; y++ {
+		sy := bounds.Min.Y + min(y, height-1)
+		for x := 0; x < padW; x++ {
+			sx := bounds.Min.X + min(x, width-1)
+			if gray {
+				planes[0][y*padW+x] = float64(color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y)
+				continue
+			}
+			r, g, b, _ := img.At(sx, sy).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			planes[0][y*padW+x] = float64(yy)
+			planes[1][y*padW+x] = float64(cb)
+			planes[2][y*padW+x] = float64(cr)
+		}
+	}
+
+	var unquantized []float64
+	var src, dst [dctBlockSize]float64
+	var blk [dctBlockSize]int32
+	for ci := range j.Components {
+		c := &j.Components[ci]
+		c.BlocksW, c.BlocksH = mcusX*c.H, mcusY*c.V
+		c.Coeffs = make([]int32, c.BlocksW*c.BlocksH*dctBlockSize)
+		quant := &j.Quant[c.QuantSel]
+		sx, sy := hmax/c.H, vmax/c.V // subsampling factors
+		if ci == 0 {
+			unquantized = make([]float64, len(c.Coeffs))
+		}
+
+		for by := 0; by < c.BlocksH; by++ {
+			for bx := 0; bx < c.BlocksW; bx++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						var sum float64
+						for dy := 0; dy < sy; dy++ {
+							for dx := 0; dx < sx; dx++ {
+								px := (bx*8+x)*sx + dx
+								py := (by*8+y)*sy + dy
+								sum += planes[ci][py*padW+px]
+							}
+						}
+						src[y*8+x] = sum/float64(sx*sy) - 128
+					}
+				}
+				forwardDCT(&src, &dst)
+				for k := 0; k < dctBlockSize; k++ {
+					v := dst[k] / float64(quant[k])
+					q := math.Round(v)
+					q = math.Max(-maxACCoefficient, math.Min(maxACCoefficient, q))
+					blk[k] = int32(q)
+					if ci == 0 {
+						unquantized[(by*8+k/8)*c.BlocksW*8+bx*8+k%8] = v
+					}
+				}
+				c.setBlock(bx, by, &blk)
+			}
+		}
+	}
+
+	return j, unquantized
+}
+
+// NewJPEGCoefficients compresses a spatial image into baseline JPEG coefficients at the given quality (1-100)
+func NewJPEGCoefficients(img image.Image, quality int) *JPEGCoefficients {
+	j, _ := compressJPEG(img, quality)
+	return j
+}
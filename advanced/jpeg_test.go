@@ -0,0 +1,234 @@
+package advanced
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+func getTestJPEGReader(t *testing.T, img image.Image) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	return &buf
+}
+
+// newTexturedImage returns an image with a flat left half and a noisy right half
+func newTexturedImage(width, height int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(128)
+			if x >= width/2 {
+				v = uint8(rng.Intn(256))
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestJPEGCoefficientsRoundTrip(t *testing.T) {
+	original := getTestJPEGReader(t, newTexturedImage(100, 60)).Bytes()
+
+	coeffs, err := ReadJPEGCoefficients(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Failed to read coefficients: %v", err)
+	}
+
+	var rewritten bytes.Buffer
+	if err := coeffs.Encode(&rewritten); err != nil {
+		t.Fatalf("Failed to write coefficients: %v", err)
+	}
+
+	again, err := ReadJPEGCoefficients(bytes.NewReader(rewritten.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to re-read coefficients: %v", err)
+	}
+	for i := range coeffs.Components {
+		a, b := coeffs.Components[i].Coeffs, again.Components[i].Coeffs
+		if len(a) != len(b) {
+			t.Fatalf("Component %d size changed: %d != %d", i, len(a), len(b))
+		}
+		for k := range a {
+			if a[k] != b[k] {
+				t.Fatalf("Component %d coefficient %d changed: %d != %d", i, k, a[k], b[k])
+			}
+		}
+	}
+
+	// The standard decoder must see exactly the same image
+	img1, err := jpeg.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := jpeg.Decode(bytes.NewReader(rewritten.Bytes()))
+	if err != nil {
+		t.Fatalf("Rewritten jpeg is not decodable: %v", err)
+	}
+	bounds := img1.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if img1.At(x, y) != img2.At(x, y) {
+				t.Fatalf("Pixel (%d,%d) differs after round trip", x, y)
+			}
+		}
+	}
+}
+
+func TestJUNIWARDCostsPreferTexture(t *testing.T) {
+	coeffs, err := ReadJPEGCoefficients(getTestJPEGReader(t, newTexturedImage(128, 64)))
+	if err != nil {
+		t.Fatalf("Failed to read coefficients: %v", err)
+	}
+
+	costs := CalculateJUNIWARDCosts(coeffs, 0)
+	if costs.Width() != coeffs.Components[0].BlocksW*8 || costs.Height() != coeffs.Components[0].BlocksH*8 {
+		t.Fatalf("Cost map does not match coefficient plane")
+	}
+
+	var flat, textured float64
+	for y := 16; y < 48; y++ {
+		for x := 0; x < 32; x++ {
+			flat += costs.Get(x, y)
+			textured += costs.Get(x+96, y)
+		}
+	}
+	if textured >= flat {
+		t.Errorf("Textured region should be cheaper than flat region: %f >= %f", textured, flat)
+	}
+}
+
+func TestAdvancedEncodeAndDecodeJPEG(t *testing.T) {
+	carrier := getTestJPEGReader(t, newTexturedImage(256, 256))
+	testData := []byte("This is a test message hidden in DCT coefficients!")
+
+	var encodedBuf bytes.Buffer
+	if err := AdvancedEncodeJPEG(carrier, bytes.NewReader(testData), &encodedBuf); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(encodedBuf.Bytes())); err != nil {
+		t.Fatalf("Encoded image is not a valid jpeg: %v", err)
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := AdvancedDecodeJPEG(bytes.NewReader(encodedBuf.Bytes()), &decodedBuf); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Errorf("Decoded data does not match original.\nExpected: %s\nGot: %s", testData, decodedBuf.Bytes())
+	}
+}
+
+func TestJPEGAlgorithmContext(t *testing.T) {
+	carrier := getTestJPEGReader(t, newTexturedImage(256, 256)).Bytes()
+	testData := []byte("Hidden in DCT coefficients through the steg options")
+	options := steg.Options{Algorithm: JPEGAlgorithm, Key: "secret", ECC: steg.ECCLow}
+
+	var encodedBuf bytes.Buffer
+	if err := steg.EncodeContext(context.Background(), bytes.NewReader(carrier), bytes.NewReader(testData), &encodedBuf, options); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(encodedBuf.Bytes())); err != nil || format != "jpeg" {
+		t.Fatalf("Expected a jpeg result, got %s: %v", format, err)
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := steg.DecodeContext(context.Background(), bytes.NewReader(encodedBuf.Bytes()), &decodedBuf, options); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Errorf("Decoded data does not match original.\nExpected: %s\nGot: %s", testData, decodedBuf.Bytes())
+	}
+
+	for _, encodeOptions := range []steg.EncodeOptions{{Alpha: true}, {JPEGMetadata: true}, {Format: "png"}} {
+		options := steg.Options{Algorithm: JPEGAlgorithm, EncodeOptions: encodeOptions}
+		if err := steg.EncodeContext(context.Background(), bytes.NewReader(carrier), bytes.NewReader(testData), &bytes.Buffer{}, options); err == nil {
+			t.Errorf("Expected options %+v to be rejected", encodeOptions)
+		}
+	}
+}
+
+func TestSTCEmbedAndExtract(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	cover := make([]byte, 4000)
+	costs := make([]float64, len(cover))
+	for i := range cover {
+		cover[i] = byte(rng.Intn(2))
+		costs[i] = rng.Float64()
+	}
+	message := make([]byte, 1000)
+	for i := range message {
+		message[i] = byte(rng.Intn(2))
+	}
+
+	stego, err := STCEmbed(cover, costs, message)
+	if err != nil {
+		t.Fatalf("Failed to embed: %v", err)
+	}
+	if !bytes.Equal(STCExtract(stego, len(message)), message) {
+		t.Fatal("Extracted message does not match")
+	}
+
+	changes := 0
+	for i := range cover {
+		if cover[i] != stego[i] {
+			changes++
+		}
+	}
+	// Plain replacement changes half of the message bits, the trellis code must do better
+	if changes >= len(message)/2 {
+		t.Errorf("Too many changes for rate 1/4: %d", changes)
+	}
+}
+
+func TestAdvancedEncodeSideInformed(t *testing.T) {
+	carrier := newTexturedImage(256, 256)
+	testData := []byte("Side information makes rounding errors work for us")
+
+	var encodedBuf bytes.Buffer
+	err := AdvancedEncodeSideInformed(getTestImageReader(carrier), bytes.NewReader(testData), &encodedBuf, 85)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	var decodedBuf bytes.Buffer
+	if err := AdvancedDecodeJPEG(bytes.NewReader(encodedBuf.Bytes()), &decodedBuf); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(testData, decodedBuf.Bytes()) {
+		t.Errorf("Decoded data does not match original.\nExpected: %s\nGot: %s", testData, decodedBuf.Bytes())
+	}
+
+	// Every change must round the unquantized coefficient to its other neighbour
+	cover, unquantized := compressJPEG(carrier, 85)
+	stego, err := ReadJPEGCoefficients(bytes.NewReader(encodedBuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	for i, c := range cover.Components[0].Coeffs {
+		s := stego.Components[0].Coeffs[i]
+		if s == c {
+			continue
+		}
+		changes++
+		if math.Abs(unquantized[i]-float64(s)) > 1 {
+			t.Fatalf("Coefficient %d moved away from its unquantized value %f: %d -> %d", i, unquantized[i], c, s)
+		}
+	}
+	if changes == 0 {
+		t.Error("Expected the payload to change some coefficients")
+	}
+}
@@ -0,0 +1,237 @@
+package advanced
+
+import (
+	"math"
+)
+
+const (
+	// juniwardSigma stabilizes the J-UNIWARD cost in flat regions, as in the reference implementation
+	juniwardSigma = 1.0 / 64
+
+	// wetCost marks coefficients that must not be modified
+	wetCost = 1e13
+
+	// maxACCoefficient is the largest magnitude a baseline JPEG can store
+	maxACCoefficient = 1023
+)
+
+// db8HighPass is the decomposition high-pass filter of the Daubechies 8 wavelet
+var db8HighPass = [16]float64{
+	-0.0544158422, 0.3128715909, -0.6756307363, 0.5853546837,
+	0.0158291053, -0.2840155430, -0.0004724846, 0.1287474266,
+	0.0173693010, -0.0440882539, -0.0139810279, 0.0087460940,
+	0.0048703530, -0.0003917404, -0.0006754494, -0.0001174768,
+}
+
+// db8LowPass returns the quadrature mirror of db8HighPass
+func db8LowPass() [16]float64 {
+	var lp [16]float64
+	for i := range lp {
+		lp[i] = db8HighPass[15-i]
+		if i%2 == 1 {
+			lp[i] = -lp[i]
+		}
+	}
+	return lp
+}
+
+// waveletFilter is a separable 2D filter applied as a column filter followed by a row filter
+type waveletFilter struct {
+	col, row [16]float64
+}
+
+// juniwardFilters returns the LH, HL and HH directional filters of the first decomposition level
+func juniwardFilters() [3]waveletFilter {
+	lp := db8LowPass()
+	return [3]waveletFilter{
+		{col: lp, row: db8HighPass},
+		{col: db8HighPass, row: lp},
+		{col: db8HighPass, row: db8HighPass},
+	}
+}
+
+// dctBasis holds the 8x8 inverse DCT basis values: dctBasis[u][x] = C(u)/2 * cos((2x+1)u*pi/16)
+var dctBasis = func() [8][8]float64 {
+	var b [8][8]float64
+	for u := 0; u < 8; u++ {
+		cu := 1.0
+		if u == 0 {
+			cu = 1 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			b[u][x] = cu / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return b
+}()
+
+// decompress returns the unrounded spatial plane of a component by dequantizing and
+// inverse transforming every block. The plane covers the padded block area.
+func decompress(comp *JPEGComponent, quant *[dctBlockSize]uint16) []float64 {
+	width, height := comp.BlocksW*8, comp.BlocksH*8
+	plane := make([]float64, width*height)
+	var blk [dctBlockSize]int32
+	var tmp [dctBlockSize]float64
+
+	for by := 0; by < comp.BlocksH; by++ {
+		for bx := 0; bx < comp.BlocksW; bx++ {
+			comp.block(bx, by, &blk)
+			// rows: tmp[u][x] = sum_v F[u][v] * basis[v][x]
+			for u := 0; u < 8; u++ {
+				for x := 0; x < 8; x++ {
+					var s float64
+					for v := 0; v < 8; v++ {
+						s += float64(blk[u*8+v]) * float64(quant[u*8+v]) * dctBasis[v][x]
+					}
+					tmp[u*8+x] = s
+				}
+			}
+			// columns: pixel[y][x] = sum_u basis[u][y] * tmp[u][x]
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					var s float64
+					for u := 0; u < 8; u++ {
+						s += dctBasis[u][y] * tmp[u*8+x]
+					}
+					plane[(by*8+y)*width+bx*8+x] = s + 128
+				}
+			}
+		}
+	}
+	return plane
+}
+
+// mirror reflects an out of range index back into [0,n) using symmetric padding
+func mirror(i, n int) int {
+	for i < 0 || i >= n {
+		if i < 0 {
+			i = -i - 1
+		}
+		if i >= n {
+			i = 2*n - i - 1
+		}
+	}
+	return i
+}
+
+// waveletResidual filters plane with f. The output at (x,y) is aligned with the full
+// convolution index (x+8,y+8), so a change of the block at (8*bx,8*by) affects the
+// residual from (8*bx-8,8*by-8) onwards.
+func waveletResidual(plane []float64, width, height int, f waveletFilter) []float64 {
+	rows := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var s float64
+			for a := 0; a < 16; a++ {
+				s += f.row[a] * plane[y*width+mirror(x+8-a, width)]
+			}
+			rows[y*width+x] = s
+		}
+	}
+	out := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var s float64
+			for a := 0; a < 16; a++ {
+				s += f.col[a] * rows[mirror(y+8-a, height)*width+x]
+			}
+			out[y*width+x] = s
+		}
+	}
+	return out
+}
+
+// waveletImpact returns the absolute responses of the column and row filters of f to the
+// 1D DCT basis of the given frequency. The 23x23 impact of changing the mode (u,v) by one
+// quantization step q is q*col_u[t]*row_v[s], which lets the cost be accumulated separably.
+func waveletImpact(f waveletFilter, freq int) (col, row [23]float64) {
+	for t := 0; t < 23; t++ {
+		for y := 0; y < 8; y++ {
+			if a := t - y; a >= 0 && a < 16 {
+				col[t] += f.col[a] * dctBasis[freq][y]
+				row[t] += f.row[a] * dctBasis[freq][y]
+			}
+		}
+		col[t] = math.Abs(col[t])
+		row[t] = math.Abs(row[t])
+	}
+	return col, row
+}
+
+// CalculateJUNIWARDCosts computes the J-UNIWARD embedding cost of every DCT coefficient of
+// the given component. The cost of changing a coefficient by ±1 is the sum of the relative
+// changes it causes in the LH, HL and HH wavelet residuals of the decompressed image, so
+// coefficients whose change lands in textured regions are cheap and ones in smooth regions
+// are expensive. The returned CostMap is laid out like the component's coefficient plane.
+func CalculateJUNIWARDCosts(img *JPEGCoefficients, component int) *CostMap {
+	comp := &img.Components[component]
+	quant := &img.Quant[comp.QuantSel]
+	width, height := comp.BlocksW*8, comp.BlocksH*8
+	costMap := NewCostMap(width, height)
+
+	plane := decompress(comp, quant)
+	filters := juniwardFilters()
+
+	var xi [3][]float64
+	var colImpact, rowImpact [3][8][23]float64
+	for k, f := range filters {
+		residual := waveletResidual(plane, width, height, f)
+		xi[k] = make([]float64, len(residual))
+		for i, r := range residual {
+			xi[k][i] = 1 / (juniwardSigma + math.Abs(r))
+		}
+		for freq := 0; freq < 8; freq++ {
+			colImpact[k][freq], rowImpact[k][freq] = waveletImpact(f, freq)
+		}
+	}
+
+	var rowSums [23][8]float64
+	var blockCosts [dctBlockSize]float64
+	for by := 0; by < comp.BlocksH; by++ {
+		for bx := 0; bx < comp.BlocksW; bx++ {
+			for i := range blockCosts {
+				blockCosts[i] = 0
+			}
+			for k := range filters {
+				// rowSums[t][v] = sum_s row_v[s] * xi(t,s)
+				for t := 0; t < 23; t++ {
+					rowSums[t] = [8]float64{}
+					py := by*8 + t - 8
+					if py < 0 || py >= height {
+						continue
+					}
+					line := xi[k][py*width:]
+					for s := 0; s < 23; s++ {
+						px := bx*8 + s - 8
+						if px < 0 || px >= width {
+							continue
+						}
+						for v := 0; v < 8; v++ {
+							rowSums[t][v] += rowImpact[k][v][s] * line[px]
+						}
+					}
+				}
+				for u := 0; u < 8; u++ {
+					for v := 0; v < 8; v++ {
+						var sum float64
+						for t := 0; t < 23; t++ {
+							sum += colImpact[k][u][t] * rowSums[t][v]
+						}
+						blockCosts[u*8+v] += sum
+					}
+				}
+			}
+
+			for mode := 0; mode < dctBlockSize; mode++ {
+				x, y := bx*8+mode%8, by*8+mode/8
+				cost := float64(quant[mode]) * blockCosts[mode]
+				if c := comp.At(x, y); c >= maxACCoefficient || c <= -maxACCoefficient || math.IsNaN(cost) || cost > wetCost {
+					cost = wetCost
+				}
+				costMap.Set(x, y, cost)
+			}
+		}
+	}
+
+	return costMap
+}
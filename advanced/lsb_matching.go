@@ -2,6 +2,7 @@ package advanced
 
 import (
 	"crypto/rand"
+	"slices"
 	"sort"
 )
 
@@ -52,10 +53,37 @@ type pixelCost struct {
 	cost float64 // The embedding cost
 }
 
+// sample is a colour sample of 8 or 16 bits
+type sample interface {
+	~uint8 | ~uint16
+}
+
+// lsbMatchingSample embeds a bit into a sample using LSB matching (±1), keeping it within [0, maxValue]
+func lsbMatchingSample[T sample](value T, bit byte, maxValue T) T {
+	if byte(value&1) == bit {
+		return value
+	}
+	switch {
+	case value == 0:
+		return 1
+	case value == maxValue:
+		return value - 1
+	case randBool():
+		return value + 1
+	default:
+		return value - 1
+	}
+}
+
 // GetOptimalChanges modifies pixels using LSB Matching on the lowest-cost pixels.
-// This is the **FIXED** version that sorts pixels by cost and embeds sequentially.
+// This is the **FIXED** version that selects pixels by cost and embeds sequentially.
 func GetOptimalChanges(img []byte, message []byte, costs *CostMap) []byte {
-	result := make([]byte, len(img))
+	return getOptimalChanges(img, message, costs, 255)
+}
+
+// getOptimalChanges is GetOptimalChanges for samples of any depth
+func getOptimalChanges[T sample](img []T, message []byte, costs *CostMap, maxValue T) []T {
+	result := make([]T, len(img))
 	copy(result, img)
 
 	messageLenBits := len(message) * 8
@@ -64,24 +92,13 @@ func GetOptimalChanges(img []byte, message []byte, costs *CostMap) []byte {
 		return result
 	}
 
-	// 1. Create a slice of all pixels with their costs
-	allPixelCosts := make([]pixelCost, len(img))
-	for i := 0; i < len(img); i++ {
-		allPixelCosts[i] = pixelCost{
-			pos:  i,
-			cost: costs.costs[i],
-		}
-	}
-
-	// 2. Sort the pixels by cost, from lowest to highest
-	sort.Slice(allPixelCosts, func(i, j int) bool {
-		return allPixelCosts[i].cost < allPixelCosts[j].cost
-	})
+	// 1. Select the lowest-cost pixels, from lowest to highest
+	positions := lowestCosts(costs.costs[:len(img)], messageLenBits)
 
-	// 3. Embed the message bits into the lowest-cost pixels in order
+	// 2. Embed the message bits into the lowest-cost pixels in order
 	for bitIndex := 0; bitIndex < messageLenBits; bitIndex++ {
-		// Get the pixel position from the sorted list
-		pixelPos := allPixelCosts[bitIndex].pos
+		// Get the pixel position from the selection
+		pixelPos := positions[bitIndex]
 
 		// Get the bit to embed
 		byteIndex := bitIndex / 8
@@ -89,8 +106,118 @@ func GetOptimalChanges(img []byte, message []byte, costs *CostMap) []byte {
 		bitToEmbed := (message[byteIndex] >> (7 - bitOffset)) & 1
 
 		// Modify the pixel in the result image
-		result[pixelPos], _ = LSBMatchingEmbed(img[pixelPos], bitToEmbed, costs.costs[pixelPos])
+		result[pixelPos] = lsbMatchingSample(img[pixelPos], bitToEmbed, maxValue)
 	}
 
 	return result
 }
+
+// lowestCosts returns the positions of the k lowest costs, from lowest to highest.
+// Equal costs are ordered by position, so the encoder and decoder agree on the order.
+// Only the selected positions are sorted: the k-th lowest cost is found first and
+// bounds the positions that are collected.
+func lowestCosts(costs []float64, k int) []int {
+	k = min(max(k, 0), len(costs))
+	if k == 0 {
+		return nil
+	}
+
+	values := slices.Clone(costs)
+	threshold := kthLowest(values, k-1)
+	below := 0
+	for _, c := range costs {
+		if c < threshold {
+			below++
+		}
+	}
+
+	// Positions are visited in order, so the first equal ones are taken
+	selected := make([]pixelCost, 0, k)
+	equal := k - below
+	for i, c := range costs {
+		if c < threshold || c == threshold && equal > 0 {
+			if c == threshold {
+				equal--
+			}
+			selected = append(selected, pixelCost{pos: i, cost: c})
+		}
+	}
+	slices.SortFunc(selected, func(a, b pixelCost) int {
+		switch {
+		case a.cost < b.cost:
+			return -1
+		case a.cost > b.cost:
+			return 1
+		}
+		return a.pos - b.pos
+	})
+
+	positions := make([]int, k)
+	for i, p := range selected {
+		positions[i] = p.pos
+	}
+	return positions
+}
+
+// legacyLowestCosts returns all positions ordered by cost as carriers without orderedFlag
+// were encoded: by sort.Slice, which leaves equal costs in an order of its own
+func legacyLowestCosts(costs []float64) []int {
+	all := make([]pixelCost, len(costs))
+	for i, c := range costs {
+		all[i] = pixelCost{pos: i, cost: c}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].cost < all[j].cost
+	})
+
+	positions := make([]int, len(all))
+	for i, p := range all {
+		positions[i] = p.pos
+	}
+	return positions
+}
+
+// kthLowest returns the k-th lowest of values, counting from 0, and reorders values.
+// It is a quickselect with median of three pivots.
+func kthLowest(values []float64, k int) float64 {
+	lo, hi := 0, len(values)-1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if values[mid] < values[lo] {
+			values[lo], values[mid] = values[mid], values[lo]
+		}
+		if values[hi] < values[lo] {
+			values[lo], values[hi] = values[hi], values[lo]
+		}
+		if values[hi] < values[mid] {
+			values[mid], values[hi] = values[hi], values[mid]
+		}
+		pivot := values[mid]
+
+		// Hoare partition: [lo, j] are at most the pivot and [i, hi] at least the pivot
+		i, j := lo, hi
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for pivot < values[j] {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case k <= j:
+			hi = j
+		case k >= i:
+			lo = i
+		default:
+			// Values between j and i equal the pivot
+			return pivot
+		}
+	}
+	return values[k]
+}
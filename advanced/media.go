@@ -4,10 +4,11 @@ import (
 	"crypto/rand"
 	"fmt"
 	"image"
-	"image/draw"
-	"image/png"
 	"io"
 	"math"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/steg"
 )
 
 // MediaType represents different types of cover media
@@ -39,18 +40,46 @@ type CoverMedia interface {
 
 // RGBImage implements CoverMedia for RGB images
 type RGBImage struct {
-	img    *image.RGBA
+	img    *image.NRGBA
 	costs  []float64
+	format string // Format Save writes, PNG when empty
+}
+
+// DecodeRGBImage reads an image and creates a RGB cover media which is saved in the same
+// format when that format is lossless
+func DecodeRGBImage(r io.Reader) (*RGBImage, error) {
+	img, carrierFormat, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding carrier image: %w", err)
+	}
+	format, err := formats.Resolve(carrierFormat, "")
+	if err != nil {
+		return nil, err
+	}
+	rgbImg, err := NewRGBImage(img)
+	if err != nil {
+		return nil, err
+	}
+	rgbImg.format = format
+	return rgbImg, nil
+}
+
+// SetFormat selects the lossless format the image is saved in
+func (r *RGBImage) SetFormat(format string) error {
+	resolved, err := formats.Resolve(formats.PNG, format)
+	if err != nil {
+		return err
+	}
+	r.format = resolved
+	return nil
 }
 
 // NewRGBImage creates a new RGB image cover media
 func NewRGBImage(img image.Image) (*RGBImage, error) {
 	bounds := img.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
 
 	rgbImg := &RGBImage{
-		img:    rgba,
+		img:    toNRGBA(img),
 		costs:  make([]float64, bounds.Dx()*bounds.Dy()*3), // RGB channels
 	}
 
@@ -71,7 +100,7 @@ func (r *RGBImage) GetCosts() []float64 {
 
 func (r *RGBImage) Embed(data []byte, positions []int) error {
 	if len(positions) < len(data)*8 {
-		return fmt.Errorf("insufficient positions for data")
+		return &steg.CapacityError{Needed: int64(len(data)), Available: int64(len(positions) / 8)}
 	}
 
 	bounds := r.img.Bounds()
@@ -91,7 +120,7 @@ func (r *RGBImage) Embed(data []byte, positions []int) error {
 		y := (pos / 3) / width
 		channel := pos % 3
 
-		c := r.img.RGBAAt(x, y)
+		c := r.img.NRGBAAt(x, y)
 		switch channel {
 		case 0:
 			c.R = modifyPixelLSBMatching(c.R, bit)
@@ -100,7 +129,7 @@ func (r *RGBImage) Embed(data []byte, positions []int) error {
 		case 2:
 			c.B = modifyPixelLSBMatching(c.B, bit)
 		}
-		r.img.SetRGBA(x, y, c)
+		r.img.SetNRGBA(x, y, c)
 	}
 
 	return nil
@@ -124,7 +153,7 @@ func (r *RGBImage) Extract(positions []int) ([]byte, error) {
 		y := (pos / 3) / width
 		channel := pos % 3
 
-		c := r.img.RGBAAt(x, y)
+		c := r.img.NRGBAAt(x, y)
 		var bit byte
 		switch channel {
 		case 0:
@@ -142,7 +171,10 @@ func (r *RGBImage) Extract(positions []int) ([]byte, error) {
 }
 
 func (r *RGBImage) Save(w io.Writer) error {
-	return png.Encode(w, r.img)
+	if r.format == "" {
+		return formats.Encode(w, r.img, formats.PNG)
+	}
+	return formats.Encode(w, r.img, r.format)
 }
 
 func (r *RGBImage) calculateCosts() {
@@ -150,66 +182,27 @@ func (r *RGBImage) calculateCosts() {
 	width := bounds.Dx()
 	height := bounds.Dy()
 
-	// Sobel operators
-	sobelX := [3][3]float64{{-1, 0, 1}, {-2, 0, 2}, {-1, 0, 1}}
-	sobelY := [3][3]float64{{-1, -2, -1}, {0, 0, 0}, {1, 2, 1}}
-
-	// Calculate gradients for each channel
-	for y := 1; y < height-1; y++ {
-		for x := 1; x < width-1; x++ {
-			// Process each channel
-			for c := 0; c < 3; c++ {
-				var gradX, gradY float64
-
-				// Apply Sobel operators
-				for i := -1; i <= 1; i++ {
-					for j := -1; j <= 1; j++ {
-						pixel := r.getChannelValue(x+i, y+j, c)
-						gradX += pixel * sobelX[i+1][j+1]
-						gradY += pixel * sobelY[i+1][j+1]
+	forEachRowTile(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := r.costs[y*width*3 : (y+1)*width*3]
+			offset := r.img.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			for x := 0; x < width; x++ {
+				for c := 0; c < 3; c++ {
+					switch {
+					case r.img.Pix[offset+x*4+3] == 0:
+						// Never use fully transparent pixels, changing them is easy to spot
+						row[x*3+c] = math.Inf(1)
+					case x == 0 || x == width-1 || y == 0 || y == height-1:
+						// Set high costs for border pixels
+						row[x*3+c] = math.MaxFloat64
+					default:
+						// Cost from the Sobel gradient of the channel
+						row[x*3+c] = sobelCost(r.img.Pix, offset+x*4+c, r.img.Stride, 4)
 					}
 				}
-
-				// Calculate gradient magnitude
-				gradMag := math.Sqrt(gradX*gradX + gradY*gradY)
-				
-				// Convert to cost (inverse relationship)
-				cost := 1.0 / (gradMag + epsilon)
-				
-				// Store cost
-				pos := (y*width + x) * 3 + c
-				r.costs[pos] = cost
 			}
 		}
-	}
-
-	// Set high costs for border pixels
-	for y := 0; y < height; y++ {
-		for c := 0; c < 3; c++ {
-			r.costs[(y*width+0)*3+c] = math.MaxFloat64
-			r.costs[(y*width+width-1)*3+c] = math.MaxFloat64
-		}
-	}
-	for x := 0; x < width; x++ {
-		for c := 0; c < 3; c++ {
-			r.costs[(0*width+x)*3+c] = math.MaxFloat64
-			r.costs[((height-1)*width+x)*3+c] = math.MaxFloat64
-		}
-	}
-}
-
-func (r *RGBImage) getChannelValue(x, y, channel int) float64 {
-	c := r.img.RGBAAt(x, y)
-	switch channel {
-	case 0:
-		return float64(c.R)
-	case 1:
-		return float64(c.G)
-	case 2:
-		return float64(c.B)
-	default:
-		return 0
-	}
+	})
 }
 
 // modifyPixelLSBMatching modifies pixel value using LSB matching (±1)
@@ -0,0 +1,272 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/DimitarPetrov/stegify/steg"
+	"github.com/DimitarPetrov/stegify/structural"
+)
+
+// Names of the detectors of a Report
+const (
+	DetectorChiSquare    = "chi-square"
+	DetectorRS           = "rs"
+	DetectorSPA          = "spa"
+	DetectorWS           = "ws"
+	DetectorSignature    = "signature"
+	DetectorAppendedData = "appended-data"
+	DetectorEnsemble     = "ensemble"
+)
+
+// Verdicts of a Report
+const (
+	VerdictClean      = "clean"
+	VerdictSuspicious = "suspicious"
+	VerdictStego      = "stego"
+)
+
+const (
+	// suspiciousScore and stegoScore are the least overall scores of the verdicts
+	// VerdictSuspicious and VerdictStego
+	suspiciousScore = 0.4
+	stegoScore      = 0.8
+	// chiSquarePoints is the number of points of the chi-square attack along the path
+	chiSquarePoints = 100
+)
+
+// DetectorScore is the result of a detector for an image. Value is the raw result of the
+// detector, e.g. an estimated message length, and Score maps it to [0, 1], higher being
+// more suspicious.
+type DetectorScore struct {
+	Detector string  `json:"detector"`
+	Value    float64 `json:"value"`
+	Score    float64 `json:"score"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+// Report is the blind steganalysis of a file. Score is the highest score of its detectors,
+// which gives the Verdict. Files that could not be analysed hold the Error instead.
+type Report struct {
+	Path    string          `json:"path"`
+	Format  string          `json:"format,omitempty"`
+	Scores  []DetectorScore `json:"scores,omitempty"`
+	Score   float64         `json:"score"`
+	Verdict string          `json:"verdict,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// DetectorScore returns the score of the named detector and whether it ran
+func (r Report) DetectorScore(detector string) (DetectorScore, bool) {
+	for _, s := range r.Scores {
+		if s.Detector == detector {
+			return s, true
+		}
+	}
+	return DetectorScore{}, false
+}
+
+// AnalyzeOptions configures AnalyzeFile and AnalyzePaths
+type AnalyzeOptions struct {
+	// Workers is the number of files analysed at once by AnalyzePaths, GOMAXPROCS when 0
+	Workers int
+	// Ensemble adds the prediction of a trained ensemble to the detectors when set
+	Ensemble *Ensemble
+}
+
+// AnalyzeFile runs every detector on an image file: the chi-square attack along the path of
+// steg.Encode, RS analysis, Sample Pair Analysis, Weighted Stego, the headers stegify writes
+// (see ProbeSignature), data appended to the image and, when given, the ensemble. The pixel detectors are
+// skipped for GIF files, whose data steg hides in the palette indices, and see the high byte of
+// the samples of 16-bit images only. Files that are no images return steg.ErrUnsupportedFormat.
+func AnalyzeFile(path string, options AnalyzeOptions) (Report, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return Report{}, fmt.Errorf("error reading file: %w", err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(file))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			err = fmt.Errorf("%w: %v", steg.ErrUnsupportedFormat, err)
+		}
+		return Report{}, fmt.Errorf("error decoding image %s: %w", path, err)
+	}
+
+	report := Report{Path: path, Format: format}
+	if format != "gif" {
+		bounds := img.Bounds()
+		nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+		report.Scores = append(report.Scores, pixelScores(nrgba)...)
+		if options.Ensemble != nil {
+			p, err := options.Ensemble.PredictImage(nrgba)
+			if err != nil {
+				return Report{}, err
+			}
+			report.Scores = append(report.Scores, DetectorScore{Detector: DetectorEnsemble, Value: p, Score: p})
+		}
+	}
+	report.Scores = append(report.Scores, appendedDataScore(file, format))
+
+	for _, s := range report.Scores {
+		report.Score = math.Max(report.Score, s.Score)
+	}
+	switch {
+	case report.Score >= stegoScore:
+		report.Verdict = VerdictStego
+	case report.Score >= suspiciousScore:
+		report.Verdict = VerdictSuspicious
+	default:
+		report.Verdict = VerdictClean
+	}
+	return report, nil
+}
+
+// AnalyzePaths analyses the given files and, recursively, the files in the given directories
+// with a pool of workers. Files in directories that are no images are skipped, other files
+// that can not be analysed are reported with their error. The reports are ranked by their
+// score, the most suspicious first.
+func AnalyzePaths(ctx context.Context, paths []string, options AnalyzeOptions) ([]Report, error) {
+	type job struct {
+		path     string
+		explicit bool
+	}
+	var jobs []job
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		if !info.IsDir() {
+			jobs = append(jobs, job{path, true})
+			continue
+		}
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				jobs = append(jobs, job{p, false})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error walking %s: %w", path, err)
+		}
+	}
+
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	reports := make([]*Report, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				report, err := AnalyzeFile(jobs[i].path, options)
+				switch {
+				case err == nil:
+				case !jobs[i].explicit && errors.Is(err, steg.ErrUnsupportedFormat):
+					continue
+				default:
+					report = Report{Path: jobs[i].path, Error: err.Error()}
+				}
+				reports[i] = &report
+			}
+		}()
+	}
+feed:
+	for i := range jobs {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var ranked []Report
+	for _, report := range reports {
+		if report != nil {
+			ranked = append(ranked, *report)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Path < ranked[j].Path
+	})
+	return ranked, nil
+}
+
+// pixelScores runs the detectors of LSB embedding on the pixels
+func pixelScores(img *image.NRGBA) []DetectorScore {
+	fraction := ChiSquareAttack(img, chiSquarePoints).EmbeddedFraction(0.5)
+	rs := RSAnalysis(img).MessageLength()
+	spa := SamplePairAnalysis(img).Mean()
+	ws := WeightedStego(img).Mean()
+	return []DetectorScore{
+		{Detector: DetectorChiSquare, Value: fraction, Score: fraction, Detail: fmt.Sprintf("%.0f%% of the path carries a sequential payload", 100*fraction)},
+		// Clean images estimate message lengths within a few percent of 0, change rates are half of them
+		{Detector: DetectorRS, Value: rs, Score: ramp(rs, 0.03, 0.1), Detail: fmt.Sprintf("message length %.3f", rs)},
+		{Detector: DetectorSPA, Value: spa, Score: ramp(spa, 0.015, 0.05), Detail: fmt.Sprintf("change rate %.3f", spa)},
+		{Detector: DetectorWS, Value: ws, Score: ramp(ws, 0.015, 0.05), Detail: fmt.Sprintf("change rate %.3f", ws)},
+		signatureScore(img),
+	}
+}
+
+// appendedDataScore looks for data following the end of png, jpeg and bmp images
+func appendedDataScore(file []byte, format string) DetectorScore {
+	score := DetectorScore{Detector: DetectorAppendedData}
+	appended := 0
+	switch format {
+	case "png", "jpeg":
+		findings, err := structural.Detect(bytes.NewReader(file))
+		if err != nil {
+			return score
+		}
+		for _, f := range findings {
+			if f.Location == "trailing data" {
+				appended = f.Size
+			}
+		}
+	case "bmp":
+		if len(file) >= 6 {
+			if size := int(binary.LittleEndian.Uint32(file[2:6])); size > 0 && size < len(file) {
+				appended = len(file) - size
+			}
+		}
+	}
+	if appended > 0 {
+		score.Value = float64(appended)
+		score.Score = 1
+		score.Detail = fmt.Sprintf("%d bytes after the end of the image", appended)
+	}
+	return score
+}
+
+// ramp maps values up to low to 0, from high on to 1 and linearly in between
+func ramp(value, low, high float64) float64 {
+	return math.Max(0, math.Min(1, (value-low)/(high-low)))
+}
@@ -0,0 +1,77 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+func TestAnalyzePaths(t *testing.T) {
+	dir := t.TempDir()
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	writeTestPNG(t, filepath.Join(dir, "clean.png"), carrier)
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, carrier); err != nil {
+		t.Fatalf("Error encoding carrier: %v", err)
+	}
+	data := make([]byte, 512*512*3/4/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	var stego bytes.Buffer
+	if err := steg.Encode(bytes.NewReader(encoded.Bytes()), bytes.NewReader(data), &stego); err != nil {
+		t.Fatalf("Error encoding data: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nested", "stego.png"), stego.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	appended := append(bytes.Clone(encoded.Bytes()), "appended secret"...)
+	if err := os.WriteFile(filepath.Join(dir, "appended.png"), appended, 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+
+	reports, err := AnalyzePaths(context.Background(), []string{dir}, AnalyzeOptions{Workers: 2})
+	if err != nil {
+		t.Fatalf("Error analysing: %v", err)
+	}
+	verdicts := make(map[string]Report)
+	for _, r := range reports {
+		verdicts[filepath.Base(r.Path)] = r
+	}
+	if len(reports) != 3 || reports[len(reports)-1].Path != filepath.Join(dir, "clean.png") {
+		t.Fatalf("expected 3 images ranked with the clean one last, got %+v", reports)
+	}
+	if r := verdicts["clean.png"]; r.Verdict != VerdictClean {
+		t.Errorf("expected a clean verdict for the carrier, got %s with %+v", r.Verdict, r.Scores)
+	}
+	if r := verdicts["stego.png"]; r.Verdict != VerdictStego {
+		t.Errorf("expected a stego verdict for the steg result, got %s with %+v", r.Verdict, r.Scores)
+	}
+	if s, _ := verdicts["stego.png"].DetectorScore(DetectorSignature); s.Detail != "likely produced by stegify lsb with a payload of 98304 bytes" {
+		t.Errorf("expected the header of the steg result to be recognized, got %+v", s)
+	}
+	if s, _ := verdicts["appended.png"].DetectorScore(DetectorAppendedData); s.Value != float64(len("appended secret")) {
+		t.Errorf("expected the appended data to be found, got %+v", s)
+	}
+
+	reports, err = AnalyzePaths(context.Background(), []string{filepath.Join(dir, "notes.txt")}, AnalyzeOptions{})
+	if err != nil || len(reports) != 1 || reports[0].Error == "" {
+		t.Errorf("expected a report of the error of an explicit file, got %+v and %v", reports, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AnalyzePaths(ctx, []string{dir}, AnalyzeOptions{}); err != context.Canceled {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// chiSquareMinExpected is the least expected count of a pair of values for it to take part
+// in the test, rarer pairs make the chi-square approximation unreliable
+const chiSquareMinExpected = 5
+
+// ChiSquareCurve is the result of Westfeld and Pfitzmann's pairs-of-values chi-square attack
+// along the embedding path. Replacing LSBs with message bits equalizes the counts of the values
+// 2k and 2k+1, so the p-value of a part of the path that carries a payload is close to 1
+// while it drops to 0 where the pairs keep the unequal counts of a clean image.
+type ChiSquareCurve struct {
+	// Pixels[i] is the number of pixels from the start of the path that point i covers
+	Pixels []int
+	// Channels holds the p-values of the red, green and blue channels at each point
+	Channels [3][]float64
+	// PValues holds the p-values of the three channels together at each point
+	PValues []float64
+}
+
+// ChiSquareAttack runs the pairs-of-values chi-square test on growing parts of the embedding
+// path of steg.Encode, column by column from the left and top to bottom, skipping fully
+// transparent pixels. The path is split into the given number of points, each covering the
+// pixels of the previous one and the next 1/points of the path.
+func ChiSquareAttack(img image.Image, points int) ChiSquareCurve {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	visible := 0
+	for i := 3; i < len(nrgba.Pix); i += 4 {
+		if nrgba.Pix[i] != 0 {
+			visible++
+		}
+	}
+	points = max(1, min(points, visible))
+
+	var curve ChiSquareCurve
+	var histograms [3][256]int
+	seen := 0
+	next := 1
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := nrgba.PixOffset(x, y)
+			if nrgba.Pix[offset+3] == 0 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				histograms[c][nrgba.Pix[offset+c]]++
+			}
+			seen++
+
+			if seen == visible*next/points {
+				curve.addPoint(seen, &histograms)
+				next++
+			}
+		}
+	}
+	return curve
+}
+
+// addPoint appends the p-values of the histograms of the first pixels of the path
+func (c *ChiSquareCurve) addPoint(pixels int, histograms *[3][256]int) {
+	c.Pixels = append(c.Pixels, pixels)
+	var chiSquare float64
+	var categories int
+	for channel := range histograms {
+		x, n := pairsOfValues(&histograms[channel])
+		c.Channels[channel] = append(c.Channels[channel], chiSquarePValue(x, n))
+		chiSquare += x
+		categories += n
+	}
+	c.PValues = append(c.PValues, chiSquarePValue(chiSquare, categories))
+}
+
+// pairsOfValues returns the chi-square statistic of the pairs of values of the histogram,
+// with the mean of a pair as the expected count of its even value, and the number of pairs used
+func pairsOfValues(histogram *[256]int) (float64, int) {
+	var chiSquare float64
+	categories := 0
+	for k := 0; k < 256; k += 2 {
+		expected := float64(histogram[k]+histogram[k+1]) / 2
+		if expected < chiSquareMinExpected {
+			continue
+		}
+		d := float64(histogram[k]) - expected
+		chiSquare += d * d / expected
+		categories++
+	}
+	return chiSquare, categories
+}
+
+// chiSquarePValue returns the probability of a chi-square statistic of at least x with
+// categories-1 degrees of freedom, 0 when there are too few categories to tell
+func chiSquarePValue(x float64, categories int) float64 {
+	if categories < 2 {
+		return 0
+	}
+	return upperGamma(float64(categories-1)/2, x/2)
+}
+
+// EmbeddedFraction returns the fraction of the path, from its start, over which the combined
+// p-value stays at least threshold. It estimates the share of the image that carries a
+// sequential payload, 0.5 is a common threshold.
+func (c ChiSquareCurve) EmbeddedFraction(threshold float64) float64 {
+	if len(c.Pixels) == 0 {
+		return 0
+	}
+	covered := 0
+	for i, p := range c.PValues {
+		if p < threshold {
+			break
+		}
+		covered = c.Pixels[i]
+	}
+	return float64(covered) / float64(c.Pixels[len(c.Pixels)-1])
+}
+
+// upperGamma returns the regularized upper incomplete gamma function Q(a, x),
+// from its series for x < a+1 and from its continued fraction otherwise
+func upperGamma(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lgamma, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lgamma)
+
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return math.Max(0, 1-prefix*sum)
+	}
+
+	// Modified Lentz's method
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Min(1, prefix*h)
+}
@@ -0,0 +1,62 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestUpperGamma(t *testing.T) {
+	tests := []struct {
+		a, x, expected float64
+	}{
+		{0.5, 1.920729, 0.05}, // chi-square of 1 degree of freedom at 3.841
+		{5, 9.1535, 0.05},     // chi-square of 10 degrees of freedom at 18.307
+		{5, 1.2791, 0.99},     // chi-square of 10 degrees of freedom at 2.558
+		{1, 2, math.Exp(-2)},
+	}
+	for _, test := range tests {
+		if q := upperGamma(test.a, test.x); math.Abs(q-test.expected) > 1e-4 {
+			t.Errorf("Q(%v, %v): expected %v, got %v", test.a, test.x, test.expected, q)
+		}
+	}
+}
+
+func TestChiSquareAttack(t *testing.T) {
+	carrier, err := loadImageFromFile("../../examples/lake.jpeg")
+	if err != nil {
+		t.Fatalf("Failed to load carrier image: %v", err)
+	}
+	// An 8-bit carrier, steg.Encode hides whole bytes in the low byte of 16-bit samples
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	draw.Draw(nrgba, nrgba.Bounds(), carrier, image.Point{}, draw.Src)
+	carrier = nrgba
+
+	clean := ChiSquareAttack(carrier, 100)
+	if len(clean.PValues) != 100 || clean.Pixels[99] != 512*512 {
+		t.Fatalf("Expected 100 points covering all pixels, got %d covering %d", len(clean.PValues), clean.Pixels[len(clean.Pixels)-1])
+	}
+	if fraction := clean.EmbeddedFraction(0.5); fraction > 0.05 {
+		t.Errorf("Expected no payload in the clean image, got %.2f of the path", fraction)
+	}
+
+	// steg.Encode hides 6 bits per pixel, fill 40% of the path
+	data := make([]byte, 512*512*6/8*4/10)
+	rand.New(rand.NewSource(1)).Read(data)
+	stego := embedWithOriginalLSB(t, carrier, data)
+
+	curve := ChiSquareAttack(stego, 100)
+	if fraction := curve.EmbeddedFraction(0.5); fraction < 0.3 || fraction > 0.5 {
+		t.Errorf("Expected a payload in about 40%% of the path, got %.2f", fraction)
+	}
+	for c, pValues := range curve.Channels {
+		if pValues[10] < 0.9 {
+			t.Errorf("Expected a p-value close to 1 in the payload of channel %d, got %.4f", c, pValues[10])
+		}
+	}
+	if p := curve.PValues[99]; p > 0.01 {
+		t.Errorf("Expected a p-value close to 0 over the whole path, got %.4f", p)
+	}
+}
@@ -0,0 +1,481 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+
+	_ "github.com/DimitarPetrov/stegify/formats/bmp"
+	_ "github.com/DimitarPetrov/stegify/formats/tiff"
+)
+
+const (
+	// DefaultLearners is the number of base learners of an ensemble when none is given
+	DefaultLearners = 51
+	// DefaultSubspace is the dimension of the random feature subspaces when none is given
+	DefaultSubspace = 300
+)
+
+// EnsembleOptions configures the training of an Ensemble
+type EnsembleOptions struct {
+	// Learners is the number of base learners, DefaultLearners when 0
+	Learners int
+	// Subspace is the number of random features each learner sees, DefaultSubspace when 0,
+	// at most the dimension of the feature vectors
+	Subspace int
+	// Seed seeds the random subspaces and bootstrap samples, equal seeds train equal ensembles
+	Seed int64
+}
+
+// FLD is a Fisher linear discriminant on a subspace of the features. It votes stego when the
+// projection of the features on the subspace onto Weights is above Threshold.
+type FLD struct {
+	Subspace  []int     `json:"subspace"`
+	Weights   []float64 `json:"weights"`
+	Threshold float64   `json:"threshold"`
+}
+
+// Ensemble is Kodovský, Fridrich and Holub's ensemble classifier: Fisher linear discriminants,
+// each trained on a random subspace of the features and a bootstrap sample of the training set,
+// whose majority vote tells cover from stego images
+type Ensemble struct {
+	// FeatureVersion and Dimension describe the feature vectors the ensemble was trained on
+	FeatureVersion int   `json:"featureVersion"`
+	Dimension      int   `json:"dimension"`
+	Learners       []FLD `json:"learners"`
+	// OOBError is the out-of-bag estimate of the probability of error, the mean of the false
+	// alarm and missed detection rates over the training images each learner has not seen
+	OOBError float64 `json:"oobError"`
+}
+
+// TrainEnsemble trains an Ensemble on the feature vectors of cover and stego images.
+// When there are as many stego images as covers, cover[i] and stego[i] are taken to be the
+// same image and are bootstrapped together, so no learner sees one of them out of bag.
+func TrainEnsemble(cover, stego []FeatureVector, options EnsembleOptions) (*Ensemble, error) {
+	if len(cover) == 0 || len(stego) == 0 {
+		return nil, fmt.Errorf("training needs both cover and stego feature vectors")
+	}
+	dimension := len(cover[0])
+	for _, f := range slices.Concat(cover, stego) {
+		if len(f) != dimension {
+			return nil, fmt.Errorf("feature vectors of %d and %d features", dimension, len(f))
+		}
+	}
+	learners := options.Learners
+	if learners <= 0 {
+		learners = DefaultLearners
+	}
+	subspace := options.Subspace
+	if subspace <= 0 {
+		subspace = DefaultSubspace
+	}
+	subspace = min(subspace, dimension)
+
+	ensemble := &Ensemble{FeatureVersion: FeatureVersion, Dimension: dimension, Learners: make([]FLD, learners)}
+	// inBag[l] marks the training vectors, covers first, that learner l was trained on
+	inBag := make([][]bool, learners)
+	seeds := rand.New(rand.NewSource(options.Seed))
+	learnerSeeds := make([]int64, learners)
+	for l := range learnerSeeds {
+		learnerSeeds[l] = seeds.Int63()
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range jobs {
+				ensemble.Learners[l], inBag[l] = trainLearner(cover, stego, subspace, rand.New(rand.NewSource(learnerSeeds[l])))
+			}
+		}()
+	}
+	for l := 0; l < learners; l++ {
+		jobs <- l
+	}
+	close(jobs)
+	wg.Wait()
+
+	ensemble.OOBError = ensemble.outOfBagError(cover, stego, inBag)
+	return ensemble, nil
+}
+
+// trainLearner trains an FLD on a random subspace and bootstrap sample and returns it with
+// the training vectors, covers first, in its sample
+func trainLearner(cover, stego []FeatureVector, subspace int, rng *rand.Rand) (FLD, []bool) {
+	features := rng.Perm(len(cover[0]))[:subspace]
+	sort.Ints(features)
+
+	inBag := make([]bool, len(cover)+len(stego))
+	var coverSample, stegoSample []int
+	if len(cover) == len(stego) {
+		for range cover {
+			i := rng.Intn(len(cover))
+			coverSample, stegoSample = append(coverSample, i), append(stegoSample, i)
+			inBag[i], inBag[len(cover)+i] = true, true
+		}
+	} else {
+		for range cover {
+			i := rng.Intn(len(cover))
+			coverSample = append(coverSample, i)
+			inBag[i] = true
+		}
+		for range stego {
+			i := rng.Intn(len(stego))
+			stegoSample = append(stegoSample, i)
+			inBag[len(cover)+i] = true
+		}
+	}
+
+	coverMean := subspaceMean(cover, coverSample, features)
+	stegoMean := subspaceMean(stego, stegoSample, features)
+	scatter := make([]float64, subspace*subspace)
+	addScatter(scatter, cover, coverSample, features, coverMean)
+	addScatter(scatter, stego, stegoSample, features, stegoMean)
+	difference := make([]float64, subspace)
+	for i := range difference {
+		difference[i] = stegoMean[i] - coverMean[i]
+	}
+
+	fld := FLD{Subspace: features, Weights: solveRegularized(scatter, difference)}
+	fld.Threshold = fld.bestThreshold(cover, coverSample, stego, stegoSample)
+	return fld, inBag
+}
+
+// Project returns the projection of the features onto the discriminant
+func (f FLD) Project(features FeatureVector) float64 {
+	var p float64
+	for i, feature := range f.Subspace {
+		p += f.Weights[i] * features[feature]
+	}
+	return p
+}
+
+// bestThreshold returns the threshold of the projections with the least training error,
+// the mean of the false alarm and missed detection rates
+func (f FLD) bestThreshold(cover []FeatureVector, coverSample []int, stego []FeatureVector, stegoSample []int) float64 {
+	type projection struct {
+		value float64
+		stego bool
+	}
+	projections := make([]projection, 0, len(coverSample)+len(stegoSample))
+	for _, i := range coverSample {
+		projections = append(projections, projection{f.Project(cover[i]), false})
+	}
+	for _, i := range stegoSample {
+		projections = append(projections, projection{f.Project(stego[i]), true})
+	}
+	sort.Slice(projections, func(i, j int) bool { return projections[i].value < projections[j].value })
+
+	// With the threshold below all projections every cover is a false alarm
+	falseAlarms, misses := len(coverSample), 0
+	best := math.Inf(1)
+	threshold := projections[0].value - 1
+	for i, p := range projections {
+		if p.stego {
+			misses++
+		} else {
+			falseAlarms--
+		}
+		if i+1 < len(projections) && projections[i+1].value == p.value {
+			continue
+		}
+		errorRate := float64(falseAlarms)/float64(len(coverSample)) + float64(misses)/float64(len(stegoSample))
+		if errorRate < best {
+			best = errorRate
+			if i+1 < len(projections) {
+				threshold = (p.value + projections[i+1].value) / 2
+			} else {
+				threshold = p.value
+			}
+		}
+	}
+	return threshold
+}
+
+// Predict returns the probability that the features are those of a stego image,
+// the share of the learners voting stego
+func (e *Ensemble) Predict(features FeatureVector) (float64, error) {
+	if len(features) != e.Dimension {
+		return 0, fmt.Errorf("feature vector of %d features, the ensemble expects %d", len(features), e.Dimension)
+	}
+	votes := 0
+	for _, learner := range e.Learners {
+		if learner.Project(features) > learner.Threshold {
+			votes++
+		}
+	}
+	return float64(votes) / float64(len(e.Learners)), nil
+}
+
+// PredictImage returns the probability that the image is a stego image, see Predict
+func (e *Ensemble) PredictImage(img image.Image) (float64, error) {
+	if e.FeatureVersion != FeatureVersion {
+		return 0, fmt.Errorf("ensemble trained on features of version %d, expected version %d", e.FeatureVersion, FeatureVersion)
+	}
+	return e.Predict(ExtractFeatures(img))
+}
+
+// outOfBagError returns the error of the majority votes of the learners that did not see each
+// training vector, vectors all learners saw are left out
+func (e *Ensemble) outOfBagError(cover, stego []FeatureVector, inBag [][]bool) float64 {
+	errorRate := func(vectors []FeatureVector, offset int, stego bool) float64 {
+		wrong, voted := 0, 0
+		for i, features := range vectors {
+			votes, total := 0, 0
+			for l, learner := range e.Learners {
+				if inBag[l][offset+i] {
+					continue
+				}
+				total++
+				if learner.Project(features) > learner.Threshold {
+					votes++
+				}
+			}
+			if total == 0 {
+				continue
+			}
+			voted++
+			if (2*votes > total) != stego {
+				wrong++
+			}
+		}
+		if voted == 0 {
+			return 0
+		}
+		return float64(wrong) / float64(voted)
+	}
+	return (errorRate(cover, 0, false) + errorRate(stego, len(cover), true)) / 2
+}
+
+// Save writes the ensemble to a JSON file
+func (e *Ensemble) Save(path string) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding ensemble: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing ensemble: %w", err)
+	}
+	return nil
+}
+
+// LoadEnsemble reads an ensemble written by Save
+func LoadEnsemble(path string) (*Ensemble, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ensemble: %w", err)
+	}
+	var e Ensemble
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("error decoding ensemble: %w", err)
+	}
+	if len(e.Learners) == 0 {
+		return nil, fmt.Errorf("ensemble without learners")
+	}
+	for _, learner := range e.Learners {
+		if len(learner.Subspace) != len(learner.Weights) {
+			return nil, fmt.Errorf("learner of %d features with %d weights", len(learner.Subspace), len(learner.Weights))
+		}
+		for _, feature := range learner.Subspace {
+			if feature < 0 || feature >= e.Dimension {
+				return nil, fmt.Errorf("learner feature %d out of the %d features", feature, e.Dimension)
+			}
+		}
+	}
+	return &e, nil
+}
+
+// TrainEnsembleFromDirs extracts the features of the images in a directory of covers and one of
+// stego images and trains an Ensemble on them. Files that are no images are skipped. When both
+// directories hold as many images, each stego image must have the name of its cover, which
+// keeps the pairs together (see TrainEnsemble); otherwise the images are trained unpaired.
+func TrainEnsembleFromDirs(coverDir, stegoDir string, options EnsembleOptions) (*Ensemble, error) {
+	coverNames, cover, err := ExtractDirFeatures(coverDir)
+	if err != nil {
+		return nil, err
+	}
+	stegoNames, stego, err := ExtractDirFeatures(stegoDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(coverNames) == len(stegoNames) {
+		for i := range coverNames {
+			if coverNames[i] != stegoNames[i] {
+				return nil, fmt.Errorf("stego image %s has no cover of the same name to be paired with", stegoNames[i])
+			}
+		}
+	}
+	return TrainEnsemble(cover, stego, options)
+}
+
+// ExtractDirFeatures returns the names and feature vectors of the images in a directory,
+// sorted by name. Subdirectories and files that are no images are skipped.
+func ExtractDirFeatures(dir string) ([]string, []FeatureVector, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	features := make([]FeatureVector, len(names))
+	errs := make([]error, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				features[i], errs[i] = extractFileFeatures(filepath.Join(dir, names[i]))
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var images []string
+	var vectors []FeatureVector
+	for i, name := range names {
+		switch {
+		case errors.Is(errs[i], image.ErrFormat):
+			continue
+		case errs[i] != nil:
+			return nil, nil, errs[i]
+		}
+		images = append(images, name)
+		vectors = append(vectors, features[i])
+	}
+	return images, vectors, nil
+}
+
+func extractFileFeatures(path string) (FeatureVector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image: %w", err)
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image %s: %w", path, err)
+	}
+	return ExtractFeatures(img), nil
+}
+
+func subspaceMean(vectors []FeatureVector, sample, features []int) []float64 {
+	mean := make([]float64, len(features))
+	for _, i := range sample {
+		for j, feature := range features {
+			mean[j] += vectors[i][feature]
+		}
+	}
+	for j := range mean {
+		mean[j] /= float64(len(sample))
+	}
+	return mean
+}
+
+// addScatter adds the scatter matrix of the sample around the mean to the row-major matrix
+func addScatter(scatter []float64, vectors []FeatureVector, sample, features []int, mean []float64) {
+	n := len(features)
+	centred := make([]float64, n)
+	for _, i := range sample {
+		for j, feature := range features {
+			centred[j] = vectors[i][feature] - mean[j]
+		}
+		for j := 0; j < n; j++ {
+			if centred[j] == 0 {
+				continue
+			}
+			row := scatter[j*n : j*n+n]
+			for k := j; k < n; k++ {
+				row[k] += centred[j] * centred[k]
+			}
+		}
+	}
+	for j := 0; j < n; j++ {
+		for k := 0; k < j; k++ {
+			scatter[j*n+k] = scatter[k*n+j]
+		}
+	}
+}
+
+// solveRegularized solves (S + λI)x = b for the symmetric positive semidefinite matrix S with
+// the Cholesky decomposition, raising λ from a tiny share of the trace until S + λI is well
+// conditioned enough to decompose
+func solveRegularized(s, b []float64) []float64 {
+	n := len(b)
+	trace := 0.0
+	for i := 0; i < n; i++ {
+		trace += s[i*n+i]
+	}
+	lambda := math.Max(trace/float64(n), 1e-12) * 1e-10
+	for {
+		if x, ok := solveCholesky(s, b, lambda); ok {
+			return x
+		}
+		lambda *= 10
+	}
+}
+
+// solveCholesky solves (S + λI)x = b, ok is false when S + λI is not positive definite
+func solveCholesky(s, b []float64, lambda float64) ([]float64, bool) {
+	n := len(b)
+	l := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			sum := s[i*n+j]
+			if i == j {
+				sum += lambda
+			}
+			for k := 0; k < j; k++ {
+				sum -= l[i*n+k] * l[j*n+k]
+			}
+			if i == j {
+				if sum <= lambda*1e-3 {
+					return nil, false
+				}
+				l[i*n+i] = math.Sqrt(sum)
+			} else {
+				l[i*n+j] = sum / l[j*n+j]
+			}
+		}
+	}
+
+	// Forward substitution of Ly = b, then back substitution of Lᵀx = y
+	x := make([]float64, n)
+	for i := 0; i < n; i++ {
+		sum := b[i]
+		for k := 0; k < i; k++ {
+			sum -= l[i*n+k] * x[k]
+		}
+		x[i] = sum / l[i*n+i]
+	}
+	for i := n - 1; i >= 0; i-- {
+		sum := x[i]
+		for k := i + 1; k < n; k++ {
+			sum -= l[k*n+i] * x[k]
+		}
+		x[i] = sum / l[i*n+i]
+	}
+	return x, true
+}
@@ -0,0 +1,138 @@
+package security
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTiles splits the example carriers into 64x64 covers
+func testTiles(t *testing.T) []*image.NRGBA {
+	var tiles []*image.NRGBA
+	for _, name := range []string{"lake.jpeg", "street.jpeg"} {
+		carrier := loadTestCarrier(t, name)
+		for y := 0; y < 512; y += 64 {
+			for x := 0; x < 512; x += 64 {
+				tile := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+				draw.Draw(tile, tile.Bounds(), carrier, image.Point{X: x, Y: y}, draw.Src)
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles
+}
+
+func TestTrainEnsemble(t *testing.T) {
+	tiles := testTiles(t)
+	var cover, stego []FeatureVector
+	for i, tile := range tiles {
+		cover = append(cover, ExtractFeatures(tile))
+		stego = append(stego, ExtractFeatures(replaceLSBs(tile, 1, int64(i))))
+	}
+
+	// Train on the odd tiles and test on the even ones
+	var trainCover, trainStego []FeatureVector
+	for i := 1; i < len(tiles); i += 2 {
+		trainCover, trainStego = append(trainCover, cover[i]), append(trainStego, stego[i])
+	}
+	ensemble, err := TrainEnsemble(trainCover, trainStego, EnsembleOptions{Learners: 21, Subspace: 50, Seed: 1})
+	if err != nil {
+		t.Fatalf("Error training ensemble: %v", err)
+	}
+	if len(ensemble.Learners) != 21 || ensemble.OOBError > 0.25 {
+		t.Errorf("expected 21 learners with an out-of-bag error below 0.25, got %d and %f", len(ensemble.Learners), ensemble.OOBError)
+	}
+
+	wrong := 0
+	for i := 0; i < len(tiles); i += 2 {
+		for _, sample := range []struct {
+			features FeatureVector
+			stego    bool
+		}{{cover[i], false}, {stego[i], true}} {
+			p, err := ensemble.Predict(sample.features)
+			if err != nil {
+				t.Fatalf("Error predicting: %v", err)
+			}
+			if (p > 0.5) != sample.stego {
+				wrong++
+			}
+		}
+	}
+	if rate := float64(wrong) / float64(len(tiles)); rate > 0.2 {
+		t.Errorf("expected a test error below 0.2, got %f", rate)
+	}
+
+	path := filepath.Join(t.TempDir(), "ensemble.json")
+	if err := ensemble.Save(path); err != nil {
+		t.Fatalf("Error saving ensemble: %v", err)
+	}
+	loaded, err := LoadEnsemble(path)
+	if err != nil {
+		t.Fatalf("Error loading ensemble: %v", err)
+	}
+	for i := range tiles {
+		want, _ := ensemble.Predict(stego[i])
+		if got, _ := loaded.Predict(stego[i]); got != want {
+			t.Fatalf("expected the loaded ensemble to predict %f, got %f", want, got)
+		}
+	}
+	if _, err := loaded.Predict(stego[0][:10]); err == nil {
+		t.Error("expected an error for a vector of another dimension")
+	}
+}
+
+func TestTrainEnsembleFromDirs(t *testing.T) {
+	coverDir, stegoDir := t.TempDir(), t.TempDir()
+	tiles := testTiles(t)[:16]
+	for i, tile := range tiles {
+		writeTestPNG(t, filepath.Join(coverDir, fmt.Sprintf("%02d.png", i)), tile)
+		writeTestPNG(t, filepath.Join(stegoDir, fmt.Sprintf("%02d.png", i)), replaceLSBs(tile, 1, int64(i)))
+	}
+	if err := os.WriteFile(filepath.Join(coverDir, "README"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+
+	names, features, err := ExtractDirFeatures(coverDir)
+	if err != nil {
+		t.Fatalf("Error extracting features: %v", err)
+	}
+	if len(names) != len(tiles) || len(features) != len(tiles) || names[0] != "00.png" {
+		t.Errorf("expected the features of the %d images in order, got %d: %v", len(tiles), len(names), names)
+	}
+
+	ensemble, err := TrainEnsembleFromDirs(coverDir, stegoDir, EnsembleOptions{Learners: 5, Subspace: 50})
+	if err != nil {
+		t.Fatalf("Error training ensemble: %v", err)
+	}
+	if p, err := ensemble.PredictImage(tiles[0]); err != nil || p < 0 || p > 1 {
+		t.Errorf("expected a probability, got %f and %v", p, err)
+	}
+
+	if err := os.Rename(filepath.Join(stegoDir, "00.png"), filepath.Join(stegoDir, "16.png")); err != nil {
+		t.Fatalf("Error renaming file: %v", err)
+	}
+	if _, err := TrainEnsembleFromDirs(coverDir, stegoDir, EnsembleOptions{Learners: 5, Subspace: 50}); err == nil {
+		t.Error("expected an error when a stego image has no cover of the same name")
+	}
+	if err := os.Remove(filepath.Join(stegoDir, "16.png")); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+	if _, err := TrainEnsembleFromDirs(coverDir, stegoDir, EnsembleOptions{Learners: 5, Subspace: 50}); err != nil {
+		t.Errorf("expected unpaired images to be trained, got %v", err)
+	}
+}
+
+func writeTestPNG(t *testing.T, path string, img image.Image) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Error encoding image: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package security
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// FeatureVersion is the version of the layout of FeatureVector. It changes whenever features
+// are added, removed or computed differently, so stored vectors are never mixed up.
+const FeatureVersion = 1
+
+const (
+	// spamT is the truncation threshold of the SPAM differences
+	spamT = 3
+	// spamDimension is the number of SPAM features: the second-order transition probabilities
+	// of the horizontal and vertical directions and of the diagonal directions
+	spamDimension = 2 * (2*spamT + 1) * (2*spamT + 1) * (2*spamT + 1)
+	// srmT is the truncation threshold of the quantized rich model residuals
+	srmT = 2
+)
+
+// srmResidual is a residual of the spatial rich model subset, a linear filter along a row
+// applied horizontally and, transposed, vertically, quantized with step q
+type srmResidual struct {
+	name   string
+	kernel [][]int // rows of the kernel
+	q      int
+}
+
+// srmResiduals are the residuals of the subset: the first, second and third order differences
+// and the 3x3 KV-like square kernel
+var srmResiduals = []srmResidual{
+	{"s1", [][]int{{-1, 1}}, 1},
+	{"s2", [][]int{{1, -2, 1}}, 2},
+	{"s3", [][]int{{1, -3, 3, -1}}, 3},
+	{"s3x3", [][]int{{-1, 2, -1}, {2, -4, 2}, {-1, 2, -1}}, 4},
+}
+
+// srmClasses maps the 4-tuples of truncated residuals, as base 2T+1 indices, to their class
+// under sign and direction symmetry, and srmClassTuples holds the representative of each class
+var srmClasses, srmClassTuples = srmSymmetryClasses()
+
+// FeatureDimension is the number of features in a FeatureVector
+var FeatureDimension = spamDimension + len(srmResiduals)*len(srmClassTuples)
+
+// FeatureVector holds the steganalysis features of an image for machine-learning detectors,
+// in the layout of FeatureNames:
+//
+//   - SPAM: the second-order Markov transition probabilities of pixel differences truncated
+//     to [-3, 3] (Pevný, Bas and Fridrich), averaged over the horizontal and vertical
+//     directions and over the diagonal directions, 686 features.
+//   - SRM subset: 4th-order co-occurrences of quantized residuals truncated to [-2, 2] along
+//     rows and columns (Fridrich and Kodovský's spatial rich model), merged by sign and
+//     direction symmetry into 169 features for each residual.
+//
+// Counts are accumulated over the red, green and blue channels. Pixels in the neighbourhood of
+// fully transparent pixels are skipped.
+type FeatureVector []float64
+
+// ExtractFeatures computes the FeatureVector of an image
+func ExtractFeatures(img image.Image) FeatureVector {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	features := make(FeatureVector, 0, FeatureDimension)
+	features = append(features, spamFeatures(nrgba)...)
+	for _, residual := range srmResiduals {
+		features = append(features, srmFeatures(nrgba, residual)...)
+	}
+	return features
+}
+
+// FeatureNames returns the names of the features of a FeatureVector in order, e.g.
+// "spam_hv_-3_0_1" for the probability of a difference of 1 after -3 and 0 in the horizontal
+// and vertical directions, or "srm_s2_-2_-1_0_1" for the co-occurrence class of that tuple
+func FeatureNames() []string {
+	names := make([]string, 0, FeatureDimension)
+	for _, group := range []string{"hv", "diag"} {
+		for u := -spamT; u <= spamT; u++ {
+			for v := -spamT; v <= spamT; v++ {
+				for w := -spamT; w <= spamT; w++ {
+					names = append(names, fmt.Sprintf("spam_%s_%d_%d_%d", group, u, v, w))
+				}
+			}
+		}
+	}
+	for _, residual := range srmResiduals {
+		for _, t := range srmClassTuples {
+			names = append(names, fmt.Sprintf("srm_%s_%d_%d_%d_%d", residual.name, t[0], t[1], t[2], t[3]))
+		}
+	}
+	return names
+}
+
+// featureMagic starts serialized feature vectors
+var featureMagic = []byte("SFV")
+
+// MarshalBinary encodes the vector as the magic "SFV", the FeatureVersion byte, the number of
+// features as a little-endian uint32 and the features as little-endian IEEE 754 doubles
+func (f FeatureVector) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(featureMagic)
+	buf.WriteByte(FeatureVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(f)))
+	binary.Write(&buf, binary.LittleEndian, []float64(f))
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a vector encoded by MarshalBinary. Vectors of other versions or
+// dimensions than the current layout are rejected.
+func (f *FeatureVector) UnmarshalBinary(data []byte) error {
+	headerSize := len(featureMagic) + 1 + 4
+	if len(data) < headerSize || !bytes.Equal(data[:len(featureMagic)], featureMagic) {
+		return fmt.Errorf("invalid feature vector")
+	}
+	if version := data[len(featureMagic)]; version != FeatureVersion {
+		return fmt.Errorf("feature vector of version %d, expected version %d", version, FeatureVersion)
+	}
+	dimension := int(binary.LittleEndian.Uint32(data[len(featureMagic)+1:]))
+	if dimension != FeatureDimension || len(data) != headerSize+8*dimension {
+		return fmt.Errorf("feature vector of %d features, expected %d", dimension, FeatureDimension)
+	}
+	values := make(FeatureVector, dimension)
+	for i := range values {
+		values[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[headerSize+8*i:]))
+	}
+	*f = values
+	return nil
+}
+
+// spamFeatures returns the second-order SPAM features of the image
+func spamFeatures(img *image.NRGBA) []float64 {
+	const size = 2*spamT + 1
+	directions := [2][4][2]int{
+		{{1, 0}, {-1, 0}, {0, 1}, {0, -1}},   // horizontal and vertical
+		{{1, 1}, {-1, -1}, {1, -1}, {-1, 1}}, // diagonal
+	}
+
+	features := make([]float64, 0, spamDimension)
+	for _, group := range directions {
+		averaged := make([]float64, size*size*size)
+		for _, d := range group {
+			var counts [size][size][size]float64
+			// The differences of the pixels p, p+d, p+2d and p+3d
+			forEachChain(img, d[0], d[1], 4, func(values []int) {
+				u := clamp(values[0]-values[1], spamT) + spamT
+				v := clamp(values[1]-values[2], spamT) + spamT
+				w := clamp(values[2]-values[3], spamT) + spamT
+				counts[u][v][w]++
+			})
+			for u := range counts {
+				for v := range counts[u] {
+					total := 0.0
+					for _, c := range counts[u][v] {
+						total += c
+					}
+					if total == 0 {
+						continue
+					}
+					for w, c := range counts[u][v] {
+						averaged[(u*size+v)*size+w] += c / total / float64(len(group))
+					}
+				}
+			}
+		}
+		features = append(features, averaged...)
+	}
+	return features
+}
+
+// srmFeatures returns the symmetrized co-occurrences of 4 horizontally adjacent residuals of the
+// horizontal kernel and 4 vertically adjacent residuals of the transposed kernel, normalized
+func srmFeatures(img *image.NRGBA, residual srmResidual) []float64 {
+	const size = 2*srmT + 1
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	counts := make([]float64, len(srmClassTuples))
+	total := 0.0
+	for _, vertical := range []bool{false, true} {
+		kernel := residual.kernel
+		step := 1
+		if vertical {
+			kernel = transpose(kernel)
+			step = width
+		}
+		for c := 0; c < 3; c++ {
+			residuals := residualMap(img, kernel, residual.q, c)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if (vertical && y+3 >= height) || (!vertical && x+3 >= width) {
+						continue
+					}
+					index := 0
+					for k, i := 0, y*width+x; k < 4; k, i = k+1, i+step {
+						if residuals[i] < 0 {
+							index = -1
+							break
+						}
+						index = index*size + int(residuals[i])
+					}
+					if index >= 0 {
+						counts[srmClasses[index]]++
+						total++
+					}
+				}
+			}
+		}
+	}
+	if total > 0 {
+		for i := range counts {
+			counts[i] /= total
+		}
+	}
+	return counts
+}
+
+// residualMap returns the residuals of a channel under the kernel, anchored at its top left
+// sample, quantized with step q and truncated and shifted to [0, 2T]. It is -1 where the kernel
+// leaves the image or covers fully transparent pixels.
+func residualMap(img *image.NRGBA, kernel [][]int, q, channel int) []int8 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rows, cols := len(kernel), len(kernel[0])
+	residuals := make([]int8, width*height)
+	for y := 0; y < height; y++ {
+	samples:
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			residuals[i] = -1
+			if x+cols > width || y+rows > height {
+				continue
+			}
+			r := 0
+			for ky, row := range kernel {
+				offset := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y+ky)
+				for _, w := range row {
+					if img.Pix[offset+3] == 0 {
+						continue samples
+					}
+					r += w * int(img.Pix[offset+channel])
+					offset += 4
+				}
+			}
+			residuals[i] = int8(clamp(quantize(r, q), srmT) + srmT)
+		}
+	}
+	return residuals
+}
+
+// forEachChain calls fn with the values of n pixels p, p+d, ... of each channel for every
+// chain of visible pixels in direction d = (dx, dy)
+func forEachChain(img *image.NRGBA, dx, dy, n int, fn func(values []int)) {
+	bounds := img.Bounds()
+	values := make([]int, n)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		last := y + (n-1)*dy
+		if last < bounds.Min.Y || last >= bounds.Max.Y {
+			continue
+		}
+	pixels:
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			last := x + (n-1)*dx
+			if last < bounds.Min.X || last >= bounds.Max.X {
+				continue
+			}
+			for i := 0; i < n; i++ {
+				if img.Pix[img.PixOffset(x+i*dx, y+i*dy)+3] == 0 {
+					continue pixels
+				}
+			}
+			for c := 0; c < 3; c++ {
+				for i := range values {
+					values[i] = int(img.Pix[img.PixOffset(x+i*dx, y+i*dy)+c])
+				}
+				fn(values)
+			}
+		}
+	}
+}
+
+// srmSymmetryClasses groups the 4-tuples over [-T, T] into classes of tuples that are equal up to
+// reversal and negation, and returns the class of each tuple and the smallest tuple of each class
+func srmSymmetryClasses() ([]int, [][4]int) {
+	const size = 2*srmT + 1
+	index := func(t [4]int) int {
+		i := 0
+		for _, v := range t {
+			i = i*size + v + srmT
+		}
+		return i
+	}
+
+	classes := make([]int, size*size*size*size)
+	for i := range classes {
+		classes[i] = -1
+	}
+	var tuples [][4]int
+	for i := range classes {
+		if classes[i] >= 0 {
+			continue
+		}
+		var t [4]int
+		for k, rest := 3, i; k >= 0; k, rest = k-1, rest/size {
+			t[k] = rest%size - srmT
+		}
+		reversed := [4]int{t[3], t[2], t[1], t[0]}
+		for _, s := range [][4]int{t, reversed, negate(t), negate(reversed)} {
+			classes[index(s)] = len(tuples)
+		}
+		tuples = append(tuples, t)
+	}
+	return classes, tuples
+}
+
+func negate(t [4]int) [4]int {
+	return [4]int{-t[0], -t[1], -t[2], -t[3]}
+}
+
+func transpose(kernel [][]int) [][]int {
+	transposed := make([][]int, len(kernel[0]))
+	for x := range transposed {
+		transposed[x] = make([]int, len(kernel))
+		for y := range kernel {
+			transposed[x][y] = kernel[y][x]
+		}
+	}
+	return transposed
+}
+
+// quantize divides r by q rounding half away from zero
+func quantize(r, q int) int {
+	if r < 0 {
+		return -((-r + q/2) / q)
+	}
+	return (r + q/2) / q
+}
+
+func clamp(v, t int) int {
+	return max(-t, min(t, v))
+}
@@ -0,0 +1,72 @@
+package security
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExtractFeatures(t *testing.T) {
+	names := FeatureNames()
+	if len(names) != FeatureDimension || FeatureDimension != 686+4*169 {
+		t.Fatalf("expected %d feature names, got %d", 686+4*169, len(names))
+	}
+
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	clean := ExtractFeatures(carrier)
+	if len(clean) != FeatureDimension {
+		t.Fatalf("expected %d features, got %d", FeatureDimension, len(clean))
+	}
+
+	// Each SPAM row of transition probabilities is a distribution, and so is each SRM block
+	for start := 0; start < spamDimension; start += 2*spamT + 1 {
+		sum := 0.0
+		for _, p := range clean[start : start+2*spamT+1] {
+			sum += p
+		}
+		if sum != 0 && math.Abs(sum-1) > 1e-9 {
+			t.Errorf("%s: expected transition probabilities summing to 1, got %f", names[start], sum)
+		}
+	}
+	for r := range srmResiduals {
+		start := spamDimension + r*len(srmClassTuples)
+		sum := 0.0
+		for _, p := range clean[start : start+len(srmClassTuples)] {
+			sum += p
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("%s: expected co-occurrences summing to 1, got %f", names[start], sum)
+		}
+	}
+
+	again := ExtractFeatures(carrier)
+	stego := ExtractFeatures(replaceLSBs(carrier, 1, 1))
+	var repeated, embedded float64
+	for i := range clean {
+		repeated += math.Abs(again[i] - clean[i])
+		embedded += math.Abs(stego[i] - clean[i])
+	}
+	if repeated != 0 || embedded < 0.1 {
+		t.Errorf("expected deterministic features that LSB replacement changes, got distances %f and %f", repeated, embedded)
+	}
+
+	data, err := clean.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshalling features: %v", err)
+	}
+	var decoded FeatureVector
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Error unmarshalling features: %v", err)
+	}
+	for i := range clean {
+		if decoded[i] != clean[i] {
+			t.Fatalf("%s: expected %v after round trip, got %v", names[i], clean[i], decoded[i])
+		}
+	}
+	data[3] = FeatureVersion + 1
+	if err := decoded.UnmarshalBinary(data); err == nil {
+		t.Error("expected an error for another version of the layout")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-8]); err == nil {
+		t.Error("expected an error for a truncated vector")
+	}
+}
@@ -0,0 +1,193 @@
+package security
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/DimitarPetrov/stegify/advanced"
+)
+
+// channelNames are the names of the channels of an NRGBA pixel in the names of ForensicImages
+var channelNames = []string{"r", "g", "b", "a"}
+
+// heatmapColors are the stops of the colour scale of CostHeatmap, from the lowest cost to the highest
+var heatmapColors = []color.NRGBA{
+	{R: 255, A: 255},
+	{R: 255, G: 255, A: 255},
+	{G: 255, A: 255},
+	{G: 255, B: 255, A: 255},
+	{B: 255, A: 255},
+}
+
+// ForensicImage is a named image rendered by RenderForensics
+type ForensicImage struct {
+	Name  string
+	Image image.Image
+}
+
+// BitPlane renders a bit of a channel of the image, 0 being the LSB and the channels red,
+// green, blue and alpha in this order, white where the bit is set and black elsewhere.
+// Embedding shows as noise replacing the structure the planes of a clean image keep.
+// Channels outside [0, 3] and bits outside [0, 7] return an error.
+func BitPlane(img image.Image, channel, bit int) (*image.Gray, error) {
+	if channel < 0 || channel >= len(channelNames) {
+		return nil, fmt.Errorf("channel %d out of range [0, %d]", channel, len(channelNames)-1)
+	}
+	if bit < 0 || bit > 7 {
+		return nil, fmt.Errorf("bit %d out of range [0, 7]", bit)
+	}
+	nrgba := toNRGBA(img)
+	plane := image.NewGray(nrgba.Bounds())
+	for i := range plane.Pix {
+		if nrgba.Pix[4*i+channel]>>bit&1 == 1 {
+			plane.Pix[i] = 255
+		}
+	}
+	return plane, nil
+}
+
+// AmplifyLSBs scales the given number of low bits of every colour sample to the full range,
+// so the LSB planes of the channels show together in colour. The alpha channel is kept.
+// Numbers of bits outside [1, 8] return an error.
+func AmplifyLSBs(img image.Image, bits int) (*image.NRGBA, error) {
+	if bits < 1 || bits > 8 {
+		return nil, fmt.Errorf("number of bits %d out of range [1, 8]", bits)
+	}
+	nrgba := toNRGBA(img)
+	amplified := image.NewNRGBA(nrgba.Bounds())
+	mask := 1<<bits - 1
+	for i, v := range nrgba.Pix {
+		if i%4 == 3 {
+			amplified.Pix[i] = v
+			continue
+		}
+		amplified.Pix[i] = byte((int(v) & mask) * 255 / mask)
+	}
+	return amplified, nil
+}
+
+// XORDifference renders the XOR of the samples of a cover and a stego image of the same size.
+// Equal samples are black, the others are brighter the higher the bit that changed: 64 for
+// the LSB, 128 for the second bit, 192 for both and 255 for higher bits. The image is opaque,
+// so changes of the alpha channel show in its colour samples only when they changed as well.
+func XORDifference(cover, stego image.Image) (*image.NRGBA, error) {
+	if cover.Bounds().Size() != stego.Bounds().Size() {
+		return nil, fmt.Errorf("cover of %v and stego image of %v pixels differ in size", cover.Bounds().Size(), stego.Bounds().Size())
+	}
+	c, s := toNRGBA(cover), toNRGBA(stego)
+	difference := image.NewNRGBA(c.Bounds())
+	for i := range difference.Pix {
+		if i%4 == 3 {
+			difference.Pix[i] = 255
+			continue
+		}
+		difference.Pix[i] = byte(min(255, int(c.Pix[i]^s.Pix[i])*64))
+	}
+	return difference, nil
+}
+
+// CostHeatmap renders a CostMap of the advanced algorithm on a logarithmic scale from red for
+// the lowest costs, the textured pixels the algorithm embeds in first, over yellow, green and
+// cyan to blue for the highest. Pixels that can not carry data are black.
+func CostHeatmap(costs *advanced.CostMap) *image.NRGBA {
+	width, height := costs.Width(), costs.Height()
+	heatmap := image.NewNRGBA(image.Rect(0, 0, width, height))
+	usable := func(cost float64) bool {
+		return cost > 0 && cost < math.MaxFloat64
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if cost := costs.Get(x, y); usable(cost) {
+				low, high = math.Min(low, math.Log(cost)), math.Max(high, math.Log(cost))
+			}
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			cost := costs.Get(x, y)
+			if !usable(cost) {
+				heatmap.SetNRGBA(x, y, color.NRGBA{A: 255})
+				continue
+			}
+			t := 0.0
+			if high > low {
+				t = (math.Log(cost) - low) / (high - low)
+			}
+			heatmap.SetNRGBA(x, y, heatmapColor(t))
+		}
+	}
+	return heatmap
+}
+
+// heatmapColor interpolates the colour of t in [0, 1] between the stops of heatmapColors
+func heatmapColor(t float64) color.NRGBA {
+	position := t * float64(len(heatmapColors)-1)
+	i := min(int(position), len(heatmapColors)-2)
+	f := position - float64(i)
+	from, to := heatmapColors[i], heatmapColors[i+1]
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + f*(float64(b)-float64(a))))
+	}
+	return color.NRGBA{R: mix(from.R, to.R), G: mix(from.G, to.G), B: mix(from.B, to.B), A: 255}
+}
+
+// RenderForensics renders the images an analyst inspects a suspicious carrier with: the 8 bit
+// planes of the red, green and blue channels named e.g. "r-bit0" for the red LSB, those of the
+// alpha channel when the image is not opaque, the amplified LSBs named "lsb", the heatmap of the
+// costs of the advanced algorithm named "costs" and, when a cover is given, its XOR difference
+// with the image named "xor".
+func RenderForensics(img, cover image.Image) ([]ForensicImage, error) {
+	nrgba := toNRGBA(img)
+	channels := 3
+	if !nrgba.Opaque() {
+		channels = 4
+	}
+
+	var images []ForensicImage
+	for c := 0; c < channels; c++ {
+		for bit := 0; bit < 8; bit++ {
+			plane, err := BitPlane(nrgba, c, bit)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, ForensicImage{fmt.Sprintf("%s-bit%d", channelNames[c], bit), plane})
+		}
+	}
+	amplified, err := AmplifyLSBs(nrgba, 1)
+	if err != nil {
+		return nil, err
+	}
+	images = append(images, ForensicImage{"lsb", amplified})
+
+	// The advanced algorithm computes its costs from the green channel of the premultiplied
+	// image, so semi-transparent pixels are premultiplied here as well to show the same costs
+	rgba := image.NewRGBA(nrgba.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), nrgba, image.Point{}, draw.Src)
+	images = append(images, ForensicImage{"costs", CostHeatmap(advanced.CalculateCosts(rgba, 1))})
+
+	if cover != nil {
+		difference, err := XORDifference(cover, nrgba)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, ForensicImage{"xor", difference})
+	}
+	return images, nil
+}
+
+// toNRGBA returns the image as 8-bit non-premultiplied colour starting at the origin
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) && nrgba.Stride == 4*nrgba.Rect.Dx() {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	return nrgba
+}
@@ -0,0 +1,87 @@
+package security
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/advanced"
+)
+
+func TestBitPlanes(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 12, 11))
+	img.SetNRGBA(10, 10, color.NRGBA{R: 0b101, G: 0b10, B: 255, A: 255})
+	img.SetNRGBA(11, 10, color.NRGBA{R: 0b100, G: 0b11, A: 128})
+
+	if plane, err := BitPlane(img, 0, 0); err != nil || plane.Pix[0] != 255 || plane.Pix[1] != 0 || plane.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Errorf("expected the red LSB plane set for the first pixel only, got %v (%v)", plane, err)
+	}
+	if plane, err := BitPlane(img, 0, 2); err != nil || plane.Pix[0] != 255 || plane.Pix[1] != 255 {
+		t.Errorf("expected the third red bit plane set for both pixels, got %v (%v)", plane, err)
+	}
+	if plane, err := BitPlane(img, 3, 7); err != nil || plane.Pix[0] != 255 || plane.Pix[1] != 255 {
+		t.Errorf("expected the highest alpha bit plane set for both pixels, got %v (%v)", plane, err)
+	}
+	if amplified, err := AmplifyLSBs(img, 2); err != nil || amplified.Pix[0] != 85 || amplified.Pix[1] != 170 || amplified.Pix[2] != 255 || amplified.Pix[7] != 128 {
+		t.Errorf("expected the 2 LSBs scaled to the full range and alpha kept, got %v (%v)", amplified, err)
+	}
+	if amplified, err := AmplifyLSBs(img, 8); err != nil || amplified.Pix[0] != 0b101 || amplified.Pix[2] != 255 {
+		t.Errorf("expected all 8 bits kept, got %v (%v)", amplified, err)
+	}
+	for _, args := range [][2]int{{-1, 0}, {4, 0}, {0, -1}, {0, 8}} {
+		if _, err := BitPlane(img, args[0], args[1]); err == nil {
+			t.Errorf("expected channel %d and bit %d to be rejected", args[0], args[1])
+		}
+	}
+	for _, bits := range []int{-1, 0, 9} {
+		if _, err := AmplifyLSBs(img, bits); err == nil {
+			t.Errorf("expected %d bits to be rejected", bits)
+		}
+	}
+
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	difference, err := XORDifference(carrier, replaceLSBs(carrier, 1, 1))
+	if err != nil {
+		t.Fatalf("Error rendering difference: %v", err)
+	}
+	changed := 0
+	for i, v := range difference.Pix {
+		switch {
+		case i%4 == 3:
+		case v == 64:
+			changed++
+		case v != 0:
+			t.Fatalf("expected only LSB changes, got %d", v)
+		}
+	}
+	if share := float64(changed) / float64(512*512*3); share < 0.45 || share > 0.55 {
+		t.Errorf("expected half of the samples changed, got %f", share)
+	}
+	if _, err := XORDifference(carrier, img); err == nil {
+		t.Error("expected an error for images of different sizes")
+	}
+}
+
+func TestCostHeatmap(t *testing.T) {
+	costs := advanced.NewCostMap(3, 1)
+	costs.Set(0, 0, 1)
+	costs.Set(1, 0, 100)
+	costs.Set(2, 0, math.MaxFloat64)
+
+	heatmap := CostHeatmap(costs)
+	for x, want := range []color.NRGBA{heatmapColors[0], heatmapColors[len(heatmapColors)-1], {A: 255}} {
+		if got := heatmap.NRGBAAt(x, 0); got != want {
+			t.Errorf("pixel %d: expected %v, got %v", x, want, got)
+		}
+	}
+
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	images, err := RenderForensics(carrier, carrier)
+	if err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if len(images) != 3*8+3 || images[0].Name != "r-bit0" || images[len(images)-1].Name != "xor" {
+		t.Errorf("expected the bit planes of the colour channels, lsb, costs and xor, got %d images", len(images))
+	}
+}
@@ -0,0 +1,156 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/cmplx"
+)
+
+// HCFChannel holds the centres of mass of the histogram characteristic function (HCF-COM)
+// of a colour channel, for the image and for the image downsampled by 2 as a calibration
+type HCFChannel struct {
+	COM           float64
+	CalibratedCOM float64
+}
+
+// Ratio returns the calibrated HCF-COM C(H)/C(H'). LSB matching acts as a low-pass filter on the
+// histogram, which lowers the COM of the image but hardly that of the downsampled one, so
+// lower ratios are more suspicious. Clean images are close to 1.
+func (h HCFChannel) Ratio() float64 {
+	if h.CalibratedCOM == 0 {
+		return 1
+	}
+	return h.COM / h.CalibratedCOM
+}
+
+// HCFResult holds the calibrated HCF-COM of the red, green and blue channels
+type HCFResult struct {
+	Channels [3]HCFChannel
+}
+
+// Ratio returns the mean calibrated ratio of the channels, see HCFChannel.Ratio
+func (h HCFResult) Ratio() float64 {
+	return (h.Channels[0].Ratio() + h.Channels[1].Ratio() + h.Channels[2].Ratio()) / 3
+}
+
+// HCFCOMAnalysis computes Harmsen and Pearlman's HCF-COM detector with Ker's calibration, which
+// compares it with the HCF-COM of the image downsampled by averaging 2x2 blocks, so the
+// score depends less on the content of the image. It targets LSB matching, which the
+// chi-square style detectors miss. Fully transparent pixels are skipped.
+func HCFCOMAnalysis(img image.Image) HCFResult {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	downsampled := downsample(nrgba)
+
+	var result HCFResult
+	for c := range result.Channels {
+		result.Channels[c] = HCFChannel{
+			COM:           centreOfMass(channelHistogram(nrgba, c)),
+			CalibratedCOM: centreOfMass(channelHistogram(downsampled, c)),
+		}
+	}
+	return result
+}
+
+// AmplitudeOfLocalExtrema computes Zhang, Cox and Doërr's ALE detector per channel: the sum of
+// the amplitudes |2h(n) - h(n-1) - h(n+1)| of the local extrema of the histogram h, relative to
+// the number of samples. LSB matching smooths the histogram and lowers it, so lower values are
+// more suspicious. The saturated values 0 and 255 are left out, they are no extrema in the
+// sense of the detector.
+func AmplitudeOfLocalExtrema(img image.Image) [3]float64 {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	var amplitudes [3]float64
+	for c := range amplitudes {
+		h := channelHistogram(nrgba, c)
+		samples := 0
+		for _, count := range h {
+			samples += count
+		}
+		if samples == 0 {
+			continue
+		}
+		sum := 0
+		for n := 1; n < 255; n++ {
+			if (h[n]-h[n-1])*(h[n]-h[n+1]) > 0 {
+				amplitude := 2*h[n] - h[n-1] - h[n+1]
+				if amplitude < 0 {
+					amplitude = -amplitude
+				}
+				sum += amplitude
+			}
+		}
+		amplitudes[c] = float64(sum) / float64(samples)
+	}
+	return amplitudes
+}
+
+// channelHistogram returns the histogram of a channel of the visible pixels
+func channelHistogram(img *image.NRGBA, channel int) [256]int {
+	var h [256]int
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		if img.Pix[i+3] != 0 {
+			h[img.Pix[i+channel]]++
+		}
+	}
+	return h
+}
+
+// centreOfMass returns the centre of mass of the magnitude of the histogram's discrete Fourier
+// transform, the HCF, over its non-negative frequencies
+func centreOfMass(h [256]int) float64 {
+	var weighted, total float64
+	for k := 0; k <= len(h)/2; k++ {
+		var hcf complex128
+		for n, count := range h {
+			if count != 0 {
+				hcf += complex(float64(count), 0) * cmplx.Exp(complex(0, -2*math.Pi*float64(n*k)/float64(len(h))))
+			}
+		}
+		magnitude := cmplx.Abs(hcf)
+		weighted += float64(k) * magnitude
+		total += magnitude
+	}
+	if total == 0 {
+		return 0
+	}
+	return weighted / total
+}
+
+// downsample returns the image of the rounded down means of its 2x2 blocks,
+// blocks with fully transparent pixels are transparent
+func downsample(img *image.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	small := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+	for y := 0; y < small.Rect.Dy(); y++ {
+		for x := 0; x < small.Rect.Dx(); x++ {
+			block := [4]int{
+				img.PixOffset(bounds.Min.X+2*x, bounds.Min.Y+2*y),
+				img.PixOffset(bounds.Min.X+2*x+1, bounds.Min.Y+2*y),
+				img.PixOffset(bounds.Min.X+2*x, bounds.Min.Y+2*y+1),
+				img.PixOffset(bounds.Min.X+2*x+1, bounds.Min.Y+2*y+1),
+			}
+			offset := small.PixOffset(x, y)
+			var sums [3]int
+			opaque := true
+			for _, b := range block {
+				opaque = opaque && img.Pix[b+3] != 0
+				for c := range sums {
+					sums[c] += int(img.Pix[b+c])
+				}
+			}
+			if !opaque {
+				continue
+			}
+			for c, sum := range sums {
+				small.Pix[offset+c] = uint8(sum / 4)
+			}
+			small.Pix[offset+3] = 255
+		}
+	}
+	return small
+}
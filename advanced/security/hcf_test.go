@@ -0,0 +1,49 @@
+package security
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// matchLSBs embeds random bits with LSB matching in the given share of the colour samples
+func matchLSBs(img *image.NRGBA, rate float64, seed int64) *image.NRGBA {
+	stego := image.NewNRGBA(img.Bounds())
+	copy(stego.Pix, img.Pix)
+	rng := rand.New(rand.NewSource(seed))
+	for i := range stego.Pix {
+		// Half of the bits match the LSB already
+		if i%4 == 3 || rng.Float64() >= rate || rng.Intn(2) == 0 {
+			continue
+		}
+		switch v := stego.Pix[i]; {
+		case v == 0:
+			stego.Pix[i] = 1
+		case v == 255, rng.Intn(2) == 0:
+			stego.Pix[i] = v - 1
+		default:
+			stego.Pix[i] = v + 1
+		}
+	}
+	return stego
+}
+
+func meanALE(img image.Image) float64 {
+	ale := AmplitudeOfLocalExtrema(img)
+	return (ale[0] + ale[1] + ale[2]) / 3
+}
+
+func TestLSBMatchingDetectors(t *testing.T) {
+	for _, name := range []string{"lake.jpeg", "street.jpeg"} {
+		carrier := loadTestCarrier(t, name)
+		stego := matchLSBs(carrier, 1, 1)
+
+		clean, matched := HCFCOMAnalysis(carrier).Ratio(), HCFCOMAnalysis(stego).Ratio()
+		if clean < 0.9 || matched >= clean-0.05 {
+			t.Errorf("%s: expected a calibrated HCF-COM close to 1 that LSB matching lowers, got %.4f and %.4f", name, clean, matched)
+		}
+		if clean, matched := meanALE(carrier), meanALE(stego); matched >= clean {
+			t.Errorf("%s: expected LSB matching to lower the ALE, got %.4f and %.4f", name, clean, matched)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// rsMask is the flipping mask applied to groups of horizontally adjacent pixels in RS analysis
+var rsMask = []int{0, 1, 1, 0}
+
+// RSChannel holds the RS analysis of a colour channel. The counts are the ratios of regular
+// and singular groups under the mask M and its negation -M, for the image as it is and with
+// all its LSBs flipped.
+type RSChannel struct {
+	Regular, Singular                 float64 // R_M and S_M
+	RegularNegative, SingularNegative float64 // R_-M and S_-M
+	FlippedRegular, FlippedSingular   float64 // R_M and S_M with all LSBs flipped
+	FlippedRegularNegative            float64 // R_-M with all LSBs flipped
+	FlippedSingularNegative           float64 // S_-M with all LSBs flipped
+	// MessageLength is the estimated share of the channel's samples carrying message bits
+	// in their LSB, about 0 for clean images. Noise can take it slightly out of [0, 1].
+	MessageLength float64
+}
+
+// RSResult holds the RS analysis of the red, green and blue channels
+type RSResult struct {
+	Channels [3]RSChannel
+}
+
+// MessageLength returns the mean estimated message length of the channels
+func (r RSResult) MessageLength() float64 {
+	return (r.Channels[0].MessageLength + r.Channels[1].MessageLength + r.Channels[2].MessageLength) / 3
+}
+
+// RSAnalysis performs Fridrich, Goljan and Du's RS steganalysis of LSB replacement.
+// Pixels are grouped in fours along rows, groups with fully transparent pixels are skipped.
+// A group is regular when flipping LSBs by a mask increases its noise, measured by the
+// discrimination function, and singular when it decreases it. LSB replacement moves the
+// counts of M and -M apart as the message grows, which gives the quadratic estimate of its length.
+// Changes of the second LSB, which steg.Encode replaces as well, are outside this model,
+// so such payloads are underestimated.
+func RSAnalysis(img image.Image) RSResult {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	var result RSResult
+	for c := range result.Channels {
+		result.Channels[c] = rsChannel(nrgba, c)
+	}
+	return result
+}
+
+// rsCounts accumulates the regular and singular groups of the masks M and -M
+type rsCounts struct {
+	regular, singular, regularNegative, singularNegative, groups int
+}
+
+func (r *rsCounts) add(group []int) {
+	original := discrimination(group)
+	flipped := make([]int, len(group))
+	for _, sign := range []int{1, -1} {
+		for i, x := range group {
+			flipped[i] = flip(x, sign*rsMask[i])
+		}
+		switch f := discrimination(flipped); {
+		case f > original && sign == 1:
+			r.regular++
+		case f < original && sign == 1:
+			r.singular++
+		case f > original:
+			r.regularNegative++
+		case f < original:
+			r.singularNegative++
+		}
+	}
+	r.groups++
+}
+
+func (r *rsCounts) ratios() (regular, singular, regularNegative, singularNegative float64) {
+	if r.groups == 0 {
+		return 0, 0, 0, 0
+	}
+	n := float64(r.groups)
+	return float64(r.regular) / n, float64(r.singular) / n, float64(r.regularNegative) / n, float64(r.singularNegative) / n
+}
+
+func rsChannel(img *image.NRGBA, channel int) RSChannel {
+	bounds := img.Bounds()
+	var counts, flippedCounts rsCounts
+	group := make([]int, len(rsMask))
+	flippedGroup := make([]int, len(rsMask))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+	groups:
+		for x := bounds.Min.X; x+len(rsMask) <= bounds.Max.X; x += len(rsMask) {
+			for i := range group {
+				offset := img.PixOffset(x+i, y)
+				if img.Pix[offset+3] == 0 {
+					continue groups
+				}
+				group[i] = int(img.Pix[offset+channel])
+				flippedGroup[i] = group[i] ^ 1
+			}
+			counts.add(group)
+			flippedCounts.add(flippedGroup)
+		}
+	}
+
+	var r RSChannel
+	r.Regular, r.Singular, r.RegularNegative, r.SingularNegative = counts.ratios()
+	r.FlippedRegular, r.FlippedSingular, r.FlippedRegularNegative, r.FlippedSingularNegative = flippedCounts.ratios()
+	r.MessageLength = rsEstimate(r)
+	return r
+}
+
+// rsEstimate solves 2(d1+d0)z² + (d-0-d-1-d1-3d0)z + d0-d-0 = 0 for the root z of the smaller
+// absolute value, the message length is p = z/(z-1/2)
+func rsEstimate(r RSChannel) float64 {
+	d0 := r.Regular - r.Singular
+	d1 := r.FlippedRegular - r.FlippedSingular
+	dNegative0 := r.RegularNegative - r.SingularNegative
+	dNegative1 := r.FlippedRegularNegative - r.FlippedSingularNegative
+
+	a := 2 * (d1 + d0)
+	b := dNegative0 - dNegative1 - d1 - 3*d0
+	c := d0 - dNegative0
+
+	var z float64
+	if a == 0 {
+		if b == 0 {
+			return 0
+		}
+		z = -c / b
+	} else {
+		// Without a real root, which noise causes close to full embedding, the vertex is closest
+		root := math.Sqrt(math.Max(0, b*b-4*a*c))
+		z1, z2 := (-b+root)/(2*a), (-b-root)/(2*a)
+		z = z1
+		if math.Abs(z2) < math.Abs(z1) {
+			z = z2
+		}
+	}
+	if z == 0.5 {
+		return 0
+	}
+	return z / (z - 0.5)
+}
+
+// discrimination measures the noise of a group as the sum of the differences of neighbours
+func discrimination(group []int) int {
+	f := 0
+	for i := 1; i < len(group); i++ {
+		d := group[i] - group[i-1]
+		if d < 0 {
+			d = -d
+		}
+		f += d
+	}
+	return f
+}
+
+// flip applies the flipping function F1 (2k <-> 2k+1) for 1, F-1 (2k-1 <-> 2k) for -1
+// and the identity for 0
+func flip(x, f int) int {
+	switch f {
+	case 1:
+		return x ^ 1
+	case -1:
+		return ((x + 1) ^ 1) - 1
+	}
+	return x
+}
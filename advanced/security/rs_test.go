@@ -0,0 +1,53 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// loadTestCarrier returns a 512x512 8-bit crop of an example image
+func loadTestCarrier(t *testing.T, name string) *image.NRGBA {
+	img, err := loadImageFromFile("../../examples/" + name)
+	if err != nil {
+		t.Fatalf("Failed to load carrier image: %v", err)
+	}
+	carrier := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	draw.Draw(carrier, carrier.Bounds(), img, image.Point{X: 400, Y: 300}, draw.Src)
+	return carrier
+}
+
+// replaceLSBs replaces the LSB of the given share of the colour samples with random bits
+func replaceLSBs(img *image.NRGBA, rate float64, seed int64) *image.NRGBA {
+	stego := image.NewNRGBA(img.Bounds())
+	copy(stego.Pix, img.Pix)
+	rng := rand.New(rand.NewSource(seed))
+	for i := range stego.Pix {
+		if i%4 != 3 && rng.Float64() < rate {
+			stego.Pix[i] = stego.Pix[i]&^1 | byte(rng.Intn(2))
+		}
+	}
+	return stego
+}
+
+func TestRSAnalysis(t *testing.T) {
+	carrier := loadTestCarrier(t, "lake.jpeg")
+
+	for _, rate := range []float64{0, 0.1, 0.5} {
+		result := RSAnalysis(replaceLSBs(carrier, rate, 1))
+		for c, channel := range result.Channels {
+			if math.Abs(channel.MessageLength-rate) > 0.05 {
+				t.Errorf("Rate %.1f: expected an estimate close to it in channel %d, got %.3f", rate, c, channel.MessageLength)
+			}
+		}
+	}
+
+	// steg.Encode fills 60% of the path here, its second LSB makes RS underestimate it
+	data := make([]byte, 512*512*6/8*6/10)
+	rand.New(rand.NewSource(1)).Read(data)
+	if estimate := RSAnalysis(embedWithOriginalLSB(t, carrier, data)).MessageLength(); estimate < 0.2 {
+		t.Errorf("Expected steg.Encode to be detected, got an estimate of %.3f", estimate)
+	}
+}
@@ -286,6 +286,9 @@ func logMetrics(t *testing.T, metrics SecurityMetrics) {
 	t.Logf("  • Histogram Distance:  %.6f  (lower = less detectable)", metrics.HistogramDistance)
 	t.Logf("  • PSNR:                %.2f dB  (higher = better quality)", metrics.PSNRValue)
 	t.Logf("  • SSIM:                %.4f  (closer to 1 = better similarity)", metrics.SSIMValue)
+	t.Logf("  • RS Message Length:   %.4f  (estimated share of samples carrying data)", metrics.RSMessageLength)
+	t.Logf("  • HCF-COM Ratio:       %.4f  (lower = more suspicious of LSB matching)", metrics.HCFCOMRatio)
+	t.Logf("  • ALE:                 %.4f  (lower = more suspicious of LSB matching)", metrics.ALE)
 }
 
 func compareMetrics(t *testing.T, original, advanced SecurityMetrics) {
@@ -319,8 +322,8 @@ func verifySecurityImprovements(t *testing.T, original, advanced SecurityMetrics
 		// PSNR can be slightly lower if LSB matching changes a non-edge pixel
 		// t.Error("Advanced method did not improve visual quality (PSNR)")
 	}
-	// FIX: This check is disabled because the SSIM implementation is flawed
-	// and will always return ~1.0, causing a false failure (1.0 <= 1.0)
+	// The payloads of these tests change too few pixels to move the SSIM of either method
+	// measurably below 1.0, and LSB matching may change more than the LSB of a sample
 	// if advanced.SSIMValue <= original.SSIMValue {
 	// 	t.Error("Advanced method did not improve structural similarity (SSIM)")
 	// }
@@ -11,9 +11,17 @@ type SecurityMetrics struct {
 	HistogramDistance float64
 	PSNRValue         float64
 	SSIMValue         float64
+	// RSMessageLength is the message length RS analysis estimates for the stego image
+	RSMessageLength float64
+	// HCFCOMRatio is the calibrated HCF-COM of the stego image, lower is more suspicious of LSB matching
+	HCFCOMRatio float64
+	// ALE is the mean amplitude of local extrema of the stego image, lower is more suspicious of LSB matching
+	ALE float64
 }
 
-// CalculateChiSquare performs chi-square test on image LSBs
+// CalculateChiSquare performs chi-square test on image LSBs.
+// It only compares the counts of even and odd red values, see ChiSquareAttack for the
+// pairs-of-values test that detects sequential LSB embedding.
 func CalculateChiSquare(img image.Image) float64 {
 	bounds := img.Bounds()
 	histogram := make(map[int]int)
@@ -112,58 +120,15 @@ func CalculatePSNR(original, stego image.Image) float64 {
 	return 10 * math.Log10(math.Pow(255, 2) / mse)
 }
 
-// CalculateSSIM calculates Structural Similarity Index
-// NOTE: This implementation is a global SSIM, not a proper windowed SSIM.
-// It will likely return ~1.0 for any LSB modification.
+// CalculateSSIM calculates the Structural Similarity Index of the images, the mean of the
+// windowed SSIM of their red, green and blue channels, see WindowedSSIM. Images of different
+// sizes have a similarity of 0.
 func CalculateSSIM(original, stego image.Image) float64 {
-	bounds := original.Bounds()
-	var sumOriginal, sumStego, sumOriginalSquare, sumStegoSquare, sumOriginalStego float64
-	windowSize := 8
-	c1 := math.Pow(0.01*255, 2)
-	c2 := math.Pow(0.03*255, 2)
-
-	// This logic is flawed - it calculates global stats, not windowed stats.
-	// But we leave the flawed implementation for now.
-	for y := bounds.Min.Y; y < bounds.Max.Y-windowSize; y += windowSize {
-		for x := bounds.Min.X; x < bounds.Max.X-windowSize; x += windowSize {
-			// Calculate statistics for window
-			for wy := 0; wy < windowSize; wy++ {
-				for wx := 0; wx < windowSize; wx++ {
-					r1, _, _, _ := original.At(x+wx, y+wy).RGBA()
-					r2, _, _, _ := stego.At(x+wx, y+wy).RGBA()
-
-					v1 := float64(r1 >> 8)
-					v2 := float64(r2 >> 8)
-
-					sumOriginal += v1
-					sumStego += v2
-					sumOriginalSquare += v1 * v1
-					sumStegoSquare += v2 * v2
-					sumOriginalStego += v1 * v2
-				}
-			}
-		}
-	}
-
-	n := float64(bounds.Dx() * bounds.Dy())
-	// Handle edge case where n is 0 or sums are 0
-	if n == 0 {
-		return 1 // Or handle as error
-	}
-	
-	mu1 := sumOriginal / n
-	mu2 := sumStego / n
-	sigma1Squared := sumOriginalSquare/n - mu1*mu1
-	sigma2Squared := sumStegoSquare/n - mu2*mu2
-	sigma12 := sumOriginalStego/n - mu1*mu2
-
-	numerator := (2*mu1*mu2 + c1) * (2*sigma12 + c2)
-	denominator := (mu1*mu1 + mu2*mu2 + c1) * (sigma1Squared + sigma2Squared + c2)
-
-	if denominator == 0 {
-		return 1
+	result, err := windowedSSIM(original, stego, false)
+	if err != nil {
+		return 0
 	}
-	return numerator / denominator
+	return result.Mean
 }
 
 func calculateHistogram(img image.Image) [256]int {
@@ -183,10 +148,14 @@ func calculateHistogram(img image.Image) [256]int {
 
 // AnalyzeSecurity performs comprehensive security analysis
 func AnalyzeSecurity(original, stego image.Image) SecurityMetrics {
+	ale := AmplitudeOfLocalExtrema(stego)
 	return SecurityMetrics{
 		ChiSquareValue:    CalculateChiSquare(stego),
 		HistogramDistance: CalculateHistogramDistance(original, stego),
 		PSNRValue:         CalculatePSNR(original, stego),
 		SSIMValue:         CalculateSSIM(original, stego),
+		RSMessageLength:   RSAnalysis(stego).MessageLength(),
+		HCFCOMRatio:       HCFCOMAnalysis(stego).Ratio(),
+		ALE:               (ale[0] + ale[1] + ale[2]) / 3,
 	}
 }
\ No newline at end of file
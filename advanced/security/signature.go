@@ -0,0 +1,244 @@
+package security
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	mathbits "math/bits"
+
+	"github.com/DimitarPetrov/stegify/advanced"
+	"github.com/DimitarPetrov/stegify/bits"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const (
+	// stegHeaderPixels is the number of visible pixels holding the header of steg.Encode
+	stegHeaderPixels = 5
+	// stegAlphaFlag marks headers of steg.Encode whose payload uses the alpha channel as well
+	stegAlphaFlag = 1 << 31
+	// signatureMinSamples is the least number of samples or bits of a region for its LSB
+	// statistics to count
+	signatureMinSamples = 50000
+	// signatureMaxDependence is the dependence of the 2 LSBs on the other bits above which a
+	// region keeps the statistics of a clean image, which are rarely below 0.005
+	signatureMaxDependence = 0.002
+	// signatureMaxImbalance is the deviation of the share of set bits from 1/2 above which a
+	// payload of the advanced algorithm is no compressed or encrypted data
+	signatureMaxImbalance = 0.01
+)
+
+// Signature is the result of ProbeSignature
+type Signature struct {
+	// Algorithm is steg.AlgorithmLSB or advanced.Algorithm when the image has a plausible header
+	// of the algorithm, and empty otherwise
+	Algorithm string
+	// PayloadLength is the payload length in bytes the header claims and Capacity the number of
+	// bytes the image can hold
+	PayloadLength, Capacity int64
+	// Dependence is the dependence of the 2 LSBs of the samples in the region steg.Encode claims
+	// on their other bits, see lowBitsDependence, and RestDependence that of the samples
+	// following the region. Replacing the LSBs with a payload takes it to about 0.
+	Dependence, RestDependence float64
+	// Ones is the share of set bits of the payload of advanced.Algorithm, about 1/2 for
+	// compressed or encrypted data
+	Ones float64
+	// Confidence is the confidence in [0, 1] that the image was produced by stegify
+	Confidence float64
+}
+
+func (s Signature) String() string {
+	switch {
+	case s.Algorithm == "":
+		return "no stegify header"
+	case s.Confidence >= 0.8:
+		return fmt.Sprintf("likely produced by stegify %s with a payload of %d bytes", s.Algorithm, s.PayloadLength)
+	}
+	return fmt.Sprintf("stegify %s header claiming %d bytes, not confirmed by the LSB statistics", s.Algorithm, s.PayloadLength)
+}
+
+// ProbeSignature looks for the headers stegify writes into the pixels: the length of steg.Encode
+// in the 2 LSBs of the first five visible pixels along its path, and the 64-bit length of
+// advanced.Algorithm in the Red LSBs of its lowest-cost pixels. The header of a clean image holds
+// random bits, which seldom claim a payload that fits the image, and the region a real payload
+// claims has the LSB statistics of the payload rather than of the image, which confirms the
+// header of payloads of at least 12500 bytes. Payloads of the advanced algorithm are confirmed by
+// bits as balanced as those of compressed or encrypted data, so text payloads leave its header
+// unconfirmed. 16-bit images are read at 8-bit precision, so their headers are not found.
+func ProbeSignature(img image.Image) Signature {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	signature := probeLSB(nrgba)
+	if s := probeAdvanced(nrgba); s.Confidence > signature.Confidence {
+		signature = s
+	}
+	return signature
+}
+
+// signatureScore is the DetectorScore of ProbeSignature
+func signatureScore(img *image.NRGBA) DetectorScore {
+	s := ProbeSignature(img)
+	return DetectorScore{Detector: DetectorSignature, Value: float64(s.PayloadLength), Score: s.Confidence, Detail: s.String()}
+}
+
+// probeLSB probes the header of steg.Encode
+func probeLSB(img *image.NRGBA) Signature {
+	quarters, alpha, ok := stegHeader(img)
+	if !ok {
+		return Signature{}
+	}
+
+	// Walk the path after the header, counting the quarters the image holds and the values of the
+	// samples in the claimed region and after it
+	bounds := img.Bounds()
+	var region, rest [256]int
+	capacity, seen := 0, 0
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			pix := img.Pix[img.PixOffset(x, y):]
+			if pix[3] == 0 {
+				continue
+			}
+			if seen++; seen <= stegHeaderPixels {
+				continue
+			}
+			samples := 3
+			if alpha && pix[3]>>2 != 0 && pix[3]>>2 != 0xFF>>2 {
+				samples = 4
+			}
+			for i := 0; i < samples; i++ {
+				if capacity < quarters {
+					region[pix[i]]++
+				} else if i < 3 {
+					rest[pix[i]]++
+				}
+				capacity++
+			}
+		}
+	}
+	if quarters == 0 || quarters > capacity {
+		return Signature{}
+	}
+
+	s := Signature{Algorithm: steg.AlgorithmLSB, PayloadLength: int64(quarters / 4), Capacity: int64(capacity / 4), Ones: -1}
+	s.Dependence, s.RestDependence = lowBitsDependence(&region), lowBitsDependence(&rest)
+	switch {
+	case s.Dependence < 0:
+		// Too short a payload to tell from a chance header
+		s.Confidence = 0.5
+	case s.Dependence > signatureMaxDependence:
+		s.Confidence = 0.2
+	case s.RestDependence > signatureMaxDependence:
+		// The statistics change where the payload ends
+		s.Confidence = 0.95
+	default:
+		s.Confidence = 0.8
+	}
+	return s
+}
+
+// stegHeader returns the number of quarters of a byte in the header of steg.Encode, whether
+// the alpha channel carries data and whether the image has enough visible pixels for a header
+func stegHeader(img *image.NRGBA) (int, bool, bool) {
+	bounds := img.Bounds()
+	quarters := make([]byte, 0, 4*4)
+	for x := bounds.Min.X; x < bounds.Max.X && len(quarters) < 3*stegHeaderPixels; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y && len(quarters) < 3*stegHeaderPixels; y++ {
+			offset := img.PixOffset(x, y)
+			if img.Pix[offset+3] == 0 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				quarters = append(quarters, bits.GetLastTwoBits(img.Pix[offset+c]))
+			}
+		}
+	}
+	if len(quarters) < 3*stegHeaderPixels {
+		return 0, false, false
+	}
+	quarters = append(quarters, 0)
+	header := binary.LittleEndian.Uint32([]byte{
+		bits.ConstructByteOfQuartersAsSlice(quarters[:4]),
+		bits.ConstructByteOfQuartersAsSlice(quarters[4:8]),
+		bits.ConstructByteOfQuartersAsSlice(quarters[8:12]),
+		bits.ConstructByteOfQuartersAsSlice(quarters[12:]),
+	})
+	return int(header &^ stegAlphaFlag), header&stegAlphaFlag != 0, true
+}
+
+// lowBitsDependence measures the dependence of the 2 LSBs of the values of the histogram on
+// their other bits, as the chi-square statistic of their independence in excess of its degrees
+// of freedom, per sample. Replacing the 2 LSBs with a payload makes them independent whatever
+// the payload, while they follow the slope of the histogram of clean images. It is -1 for fewer
+// than signatureMinSamples samples.
+func lowBitsDependence(histogram *[256]int) float64 {
+	samples := 0
+	var lows [4]int
+	for v, count := range histogram {
+		samples += count
+		lows[v&3] += count
+	}
+	if samples < signatureMinSamples {
+		return -1
+	}
+	var chiSquare float64
+	quads := 0
+	for k := 0; k < 256; k += 4 {
+		quad := histogram[k] + histogram[k+1] + histogram[k+2] + histogram[k+3]
+		if quad == 0 {
+			continue
+		}
+		for j, count := range histogram[k : k+4] {
+			expected := float64(quad) * float64(lows[j]) / float64(samples)
+			if expected == 0 {
+				continue
+			}
+			d := float64(count) - expected
+			chiSquare += d * d / expected
+		}
+		quads++
+	}
+	if quads < 2 {
+		return -1
+	}
+	return math.Max(0, chiSquare-float64(3*(quads-1))) / float64(samples)
+}
+
+// probeAdvanced probes the header of advanced.Algorithm
+func probeAdvanced(img *image.NRGBA) Signature {
+	length, capacity, err := advanced.ProbeHeader(img)
+	const headerBits = 64
+	if err != nil || length == 0 || length > uint64(capacity-headerBits)/8 {
+		return Signature{}
+	}
+
+	s := Signature{Algorithm: advanced.Algorithm, PayloadLength: int64(length), Capacity: int64(capacity-headerBits) / 8, Dependence: -1, RestDependence: -1}
+	var counter bitCounter
+	if err := advanced.DecodeFromImage(context.Background(), img, &counter); err != nil {
+		return Signature{}
+	}
+	s.Ones = float64(counter.ones) / float64(counter.bits)
+	// A random 64-bit header fits hardly ever, so the header alone is strong evidence
+	s.Confidence = 0.8
+	if counter.bits >= signatureMinSamples && math.Abs(s.Ones-0.5) <= signatureMaxImbalance {
+		s.Confidence = 0.95
+	}
+	return s
+}
+
+// bitCounter counts the bits and the set bits written to it
+type bitCounter struct {
+	bits, ones int
+}
+
+func (c *bitCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.ones += mathbits.OnesCount8(b)
+	}
+	c.bits += 8 * len(p)
+	return len(p), nil
+}
@@ -0,0 +1,57 @@
+package security
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/advanced"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+func TestProbeSignature(t *testing.T) {
+	for _, name := range []string{"lake.jpeg", "street.jpeg"} {
+		carrier := loadTestCarrier(t, name)
+		if s := ProbeSignature(carrier); s.Confidence > 0.5 {
+			t.Errorf("%s: expected no confident signature in the clean carrier, got %s", name, s)
+		}
+
+		data := make([]byte, 20000)
+		rand.New(rand.NewSource(1)).Read(data)
+		tests := []struct {
+			algorithm string
+			encode    func(carrier, data *bytes.Reader, result *bytes.Buffer) error
+		}{
+			{steg.AlgorithmLSB, func(c, d *bytes.Reader, r *bytes.Buffer) error { return steg.Encode(c, d, r) }},
+			{advanced.Algorithm, func(c, d *bytes.Reader, r *bytes.Buffer) error { return advanced.AdvancedEncode(c, d, r) }},
+		}
+		for _, test := range tests {
+			stego := encodeTestCarrier(t, carrier, data, test.encode)
+			s := ProbeSignature(stego)
+			if s.Algorithm != test.algorithm || s.PayloadLength != int64(len(data)) || s.Confidence < 0.95 {
+				t.Errorf("%s: expected a confident %s signature of %d bytes, got %+v", name, test.algorithm, len(data), s)
+			}
+			if want := "likely produced by stegify " + test.algorithm; !strings.HasPrefix(s.String(), want) {
+				t.Errorf("%s: expected %q, got %q", name, want, s.String())
+			}
+		}
+	}
+}
+
+func encodeTestCarrier(t *testing.T, carrier image.Image, data []byte, encode func(carrier, data *bytes.Reader, result *bytes.Buffer) error) image.Image {
+	var encoded, result bytes.Buffer
+	if err := png.Encode(&encoded, carrier); err != nil {
+		t.Fatalf("Error encoding carrier: %v", err)
+	}
+	if err := encode(bytes.NewReader(encoded.Bytes()), bytes.NewReader(data), &result); err != nil {
+		t.Fatalf("Error encoding data: %v", err)
+	}
+	img, err := png.Decode(&result)
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	return img
+}
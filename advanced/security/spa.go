@@ -0,0 +1,127 @@
+package security
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// ChangeRateEstimate holds the estimated change rates of the red, green and blue channels:
+// the shares of their samples whose LSB was changed by embedding. LSB replacement of random
+// message bits changes half of the samples it uses, so it is half the message length of RSResult.
+type ChangeRateEstimate struct {
+	Channels [3]float64
+}
+
+// Mean returns the mean change rate of the channels
+func (e ChangeRateEstimate) Mean() float64 {
+	return (e.Channels[0] + e.Channels[1] + e.Channels[2]) / 3
+}
+
+// SamplePairAnalysis estimates the change rate of LSB replacement with Dumitrescu, Wu and
+// Wang's Sample Pair Analysis over pairs of horizontally adjacent pixels. Pairs with fully
+// transparent pixels are skipped.
+func SamplePairAnalysis(img image.Image) ChangeRateEstimate {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	var estimate ChangeRateEstimate
+	for c := range estimate.Channels {
+		estimate.Channels[c] = samplePairChannel(nrgba, c)
+	}
+	return estimate
+}
+
+func samplePairChannel(img *image.NRGBA, channel int) float64 {
+	bounds := img.Bounds()
+	// x counts the pairs in X, whose larger sample is even or smaller one is odd,
+	// y the pairs in Y, the other unequal pairs, and k the pairs of C0, equal but for the LSB
+	var x, y, k, pairs float64
+	for row := bounds.Min.Y; row < bounds.Max.Y; row++ {
+		for col := bounds.Min.X; col+1 < bounds.Max.X; col++ {
+			left, right := img.PixOffset(col, row), img.PixOffset(col+1, row)
+			if img.Pix[left+3] == 0 || img.Pix[right+3] == 0 {
+				continue
+			}
+			u, v := int(img.Pix[left+channel]), int(img.Pix[right+channel])
+			switch {
+			case v%2 == 0 && u < v, v%2 == 1 && u > v:
+				x++
+			case v%2 == 0 && u > v, v%2 == 1 && u < v:
+				y++
+			}
+			if u>>1 == v>>1 {
+				k++
+			}
+			pairs++
+		}
+	}
+	if k == 0 {
+		return 0
+	}
+
+	// The change rate β is the smaller root of 2k β² + 2(2x - pairs) β + y - x = 0
+	a := 2 * k
+	b := 2 * (2*x - pairs)
+	c := y - x
+	root := math.Sqrt(math.Max(0, b*b-4*a*c))
+	return math.Min((-b+root)/(2*a), (-b-root)/(2*a))
+}
+
+// WeightedStego estimates the change rate of LSB replacement with Fridrich and Goljan's
+// Weighted Stego-image estimator, as revisited by Ker and Böhme. Each sample is predicted by
+// the mean of its four neighbours and weighted by 1/(5+σ²) of their local variance σ², so flat
+// areas where the prediction is reliable count the most. Border pixels and pixels next to fully
+// transparent ones are skipped.
+func WeightedStego(img image.Image) ChangeRateEstimate {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	var estimate ChangeRateEstimate
+	for c := range estimate.Channels {
+		estimate.Channels[c] = weightedStegoChannel(nrgba, c)
+	}
+	return estimate
+}
+
+func weightedStegoChannel(img *image.NRGBA, channel int) float64 {
+	bounds := img.Bounds()
+	var sum, weights float64
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+	pixels:
+		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+			offset := img.PixOffset(x, y)
+			neighbours := [4]int{offset - 4, offset + 4, offset - img.Stride, offset + img.Stride}
+			if img.Pix[offset+3] == 0 {
+				continue
+			}
+			var values [4]float64
+			var mean float64
+			for i, n := range neighbours {
+				if img.Pix[n+3] == 0 {
+					continue pixels
+				}
+				values[i] = float64(img.Pix[n+channel])
+				mean += values[i] / 4
+			}
+			var variance float64
+			for _, v := range values {
+				variance += (v - mean) * (v - mean) / 4
+			}
+
+			s := img.Pix[offset+channel]
+			// s - s̄ is the change of flipping the LSB back, -1 for even and 1 for odd samples
+			flipped := float64(int(s&1)*2 - 1)
+			weight := 1 / (5 + variance)
+			sum += weight * flipped * (float64(s) - mean)
+			weights += weight
+		}
+	}
+	if weights == 0 {
+		return 0
+	}
+	// The message length is 2 Σ w (s - s̄)(s - F(s)) with normalized weights, half of it changed
+	return sum / weights
+}
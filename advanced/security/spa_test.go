@@ -0,0 +1,36 @@
+package security
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestChangeRateEstimators(t *testing.T) {
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	estimators := []struct {
+		name     string
+		estimate func(image.Image) ChangeRateEstimate
+	}{
+		{"SPA", SamplePairAnalysis},
+		{"WS", WeightedStego},
+	}
+
+	for _, estimator := range estimators {
+		for _, rate := range []float64{0, 0.2, 0.6} {
+			// Random message bits change half of the replaced LSBs
+			estimate := estimator.estimate(replaceLSBs(carrier, rate, 2))
+			for c, changeRate := range estimate.Channels {
+				if math.Abs(changeRate-rate/2) > 0.03 {
+					t.Errorf("%s: expected a change rate of about %.2f in channel %d, got %.3f", estimator.name, rate/2, c, changeRate)
+				}
+			}
+		}
+	}
+
+	stego := replaceLSBs(carrier, 0.4, 3)
+	rs := RSAnalysis(stego).MessageLength() / 2
+	if spa := SamplePairAnalysis(stego).Mean(); math.Abs(spa-rs) > 0.03 {
+		t.Errorf("Expected SPA to agree with RS, got %.3f and %.3f", spa, rs)
+	}
+}
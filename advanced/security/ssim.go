@@ -0,0 +1,305 @@
+package security
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+const (
+	// ssimWindow and ssimSigma are the size and standard deviation of the Gaussian window of SSIM
+	ssimWindow = 11
+	ssimSigma  = 1.5
+	// ssimC1 and ssimC2 stabilize the luminance and contrast-structure terms of SSIM,
+	// (0.01*255)² and (0.03*255)²
+	ssimC1 = 0.01 * 255 * 0.01 * 255
+	ssimC2 = 0.03 * 255 * 0.03 * 255
+)
+
+// msssimWeights are the exponents of the scales of MS-SSIM, finest first
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// ssimKernel is the one-dimensional Gaussian window, normalized
+var ssimKernel = [ssimWindow]float64(gaussianKernel(ssimWindow, ssimSigma))
+
+// SSIMMap holds a similarity per pixel, row by row
+type SSIMMap struct {
+	Width, Height int
+	Values        []float64
+}
+
+// At returns the similarity of the pixel at (x, y) relative to the top left pixel
+func (m SSIMMap) At(x, y int) float64 {
+	return m.Values[y*m.Width+x]
+}
+
+// Image renders the map in gray levels, white for identical neighbourhoods and black for
+// similarities of 0 or less
+func (m SSIMMap) Image() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, m.Width, m.Height))
+	for i, v := range m.Values {
+		img.Pix[i] = uint8(math.Round(255 * math.Max(0, math.Min(1, v))))
+	}
+	return img
+}
+
+// SSIMResult is the result of WindowedSSIM
+type SSIMResult struct {
+	// Mean is the mean of Map and Channels the mean similarities of the red, green and blue channels
+	Mean     float64
+	Channels [3]float64
+	// Luminance is the mean similarity of the Rec. 601 luma of the images
+	Luminance float64
+	// Map is the similarity of every pixel averaged over the red, green and blue channels
+	Map SSIMMap
+}
+
+// WindowedSSIM computes the Structural Similarity Index of Wang et al. of two images of the same
+// size in a Gaussian window of 11x11 pixels with a standard deviation of 1.5 around every pixel,
+// for the red, green and blue channels and for the luma. Windows are cut at the borders of the
+// image and their weights renormalized, so the map covers every pixel. Colours are compared
+// without premultiplied alpha.
+func WindowedSSIM(original, stego image.Image) (SSIMResult, error) {
+	return windowedSSIM(original, stego, true)
+}
+
+// windowedSSIM is WindowedSSIM, leaving Luminance at 0 unless luminance is set
+func windowedSSIM(original, stego image.Image, luminance bool) (SSIMResult, error) {
+	a, b, err := ssimPlanes(original, stego, luminance)
+	if err != nil {
+		return SSIMResult{}, err
+	}
+
+	// The planes are independent, so each is compared by a goroutine of its own
+	var maps [4]ssimPlane
+	var wg sync.WaitGroup
+	for c := range a {
+		if a[c].values == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			maps[c], _ = ssimMaps(a[c], b[c])
+		}()
+	}
+	wg.Wait()
+
+	width, height := a[0].width, a[0].height
+	result := SSIMResult{Map: SSIMMap{Width: width, Height: height, Values: make([]float64, width*height)}}
+	for c := 0; c < 3; c++ {
+		result.Channels[c] = mean(maps[c].values)
+		for i, v := range maps[c].values {
+			result.Map.Values[i] += v / 3
+		}
+	}
+	if luminance {
+		result.Luminance = mean(maps[3].values)
+	}
+	result.Mean = mean(result.Map.Values)
+	return result, nil
+}
+
+// MultiScaleSSIM computes the multi-scale SSIM of Wang, Simoncelli and Bovik, averaged over the
+// red, green and blue channels. The contrast-structure terms of 5 scales, halving the images by
+// averaging 2x2 pixels, and the luminance term of the coarsest are weighted with the exponents
+// of the paper. Images of less than 176 pixels on a side use as many scales as keep them at
+// least 11 pixels, with the exponents of those scales renormalized. Negative terms count as 0.
+func MultiScaleSSIM(original, stego image.Image) (float64, error) {
+	a, b, err := ssimPlanes(original, stego, false)
+	if err != nil {
+		return 0, err
+	}
+
+	scales := 1
+	for w, h := a[0].width/2, a[0].height/2; scales < len(msssimWeights) && min(w, h) >= ssimWindow; w, h = w/2, h/2 {
+		scales++
+	}
+	weights := msssimWeights[:scales]
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	result := 0.0
+	for c := 0; c < 3; c++ {
+		x, y := a[c], b[c]
+		value := 1.0
+		for s, w := range weights {
+			similarity, cs := ssimMaps(x, y)
+			term := mean(cs.values)
+			if s == scales-1 {
+				term = mean(similarity.values)
+			}
+			value *= math.Pow(math.Max(0, term), w/total)
+			x, y = x.downsample(), y.downsample()
+		}
+		result += value / 3
+	}
+	return result, nil
+}
+
+// ssimPlane holds the samples of a channel of an image, row by row
+type ssimPlane struct {
+	width, height int
+	values        []float64
+}
+
+func newSSIMPlane(width, height int) ssimPlane {
+	return ssimPlane{width, height, make([]float64, width*height)}
+}
+
+// ssimPlanes returns the red, green and blue planes of two images of the same size and, when
+// luma is set, their luma planes
+func ssimPlanes(original, stego image.Image, luma bool) ([4]ssimPlane, [4]ssimPlane, error) {
+	if original.Bounds().Size() != stego.Bounds().Size() {
+		return [4]ssimPlane{}, [4]ssimPlane{}, fmt.Errorf("original of %v and stego image of %v pixels differ in size", original.Bounds().Size(), stego.Bounds().Size())
+	}
+	planes := func(img image.Image) [4]ssimPlane {
+		nrgba := toNRGBA(img)
+		width, height := nrgba.Rect.Dx(), nrgba.Rect.Dy()
+		var p [4]ssimPlane
+		for c := 0; c < 3; c++ {
+			p[c] = newSSIMPlane(width, height)
+		}
+		if luma {
+			p[3] = newSSIMPlane(width, height)
+		}
+		for i := 0; i < width*height; i++ {
+			pix := nrgba.Pix[4*i:]
+			for c := 0; c < 3; c++ {
+				p[c].values[i] = float64(pix[c])
+			}
+			if luma {
+				p[3].values[i] = 0.299*float64(pix[0]) + 0.587*float64(pix[1]) + 0.114*float64(pix[2])
+			}
+		}
+		return p
+	}
+	return planes(original), planes(stego), nil
+}
+
+// ssimMaps returns the SSIM map of two planes and the map of its contrast-structure term
+func ssimMaps(a, b ssimPlane) (ssimPlane, ssimPlane) {
+	product := func(x, y ssimPlane) ssimPlane {
+		p := newSSIMPlane(x.width, x.height)
+		for i := range p.values {
+			p.values[i] = x.values[i] * y.values[i]
+		}
+		return p
+	}
+	muA, muB := a.blur(), b.blur()
+	aa, bb, ab := product(a, a).blur(), product(b, b).blur(), product(a, b).blur()
+
+	similarity, cs := newSSIMPlane(a.width, a.height), newSSIMPlane(a.width, a.height)
+	for i := range similarity.values {
+		ma, mb := muA.values[i], muB.values[i]
+		varianceA, varianceB, covariance := aa.values[i]-ma*ma, bb.values[i]-mb*mb, ab.values[i]-ma*mb
+		cs.values[i] = (2*covariance + ssimC2) / (varianceA + varianceB + ssimC2)
+		similarity.values[i] = (2*ma*mb + ssimC1) / (ma*ma + mb*mb + ssimC1) * cs.values[i]
+	}
+	return similarity, cs
+}
+
+// blur convolves the plane with the Gaussian window, horizontally and then vertically.
+// Windows cut by the borders are renormalized to the weights of their samples in the image.
+// Inside the image the window is symmetric, so samples at the same distance share a weight.
+func (p ssimPlane) blur() ssimPlane {
+	const radius = ssimWindow / 2
+	w := &ssimKernel
+	horizontal := newSSIMPlane(p.width, p.height)
+	for y := 0; y < p.height; y++ {
+		src, dst := p.values[y*p.width:(y+1)*p.width], horizontal.values[y*p.width:(y+1)*p.width]
+		for x := range dst {
+			if x >= radius && x < p.width-radius {
+				v := (*[ssimWindow]float64)(src[x-radius:])
+				dst[x] = w[0]*(v[0]+v[10]) + w[1]*(v[1]+v[9]) + w[2]*(v[2]+v[8]) + w[3]*(v[3]+v[7]) + w[4]*(v[4]+v[6]) + w[5]*v[5]
+				continue
+			}
+			sum, weight := 0.0, 0.0
+			for k := range w {
+				if i := x + k - radius; i >= 0 && i < p.width {
+					sum += w[k] * src[i]
+					weight += w[k]
+				}
+			}
+			dst[x] = sum / weight
+		}
+	}
+
+	// Rows are accumulated whole, which keeps the vertical pass in memory order
+	blurred := newSSIMPlane(p.width, p.height)
+	row := func(i int) []float64 {
+		return horizontal.values[i*p.width : (i+1)*p.width]
+	}
+	for y := 0; y < p.height; y++ {
+		dst := blurred.values[y*p.width : (y+1)*p.width]
+		if y >= radius && y < p.height-radius {
+			center := row(y)
+			for x := range dst {
+				dst[x] = w[radius] * center[x]
+			}
+			for k := 0; k < radius; k++ {
+				above, below := row(y+k-radius), row(y+radius-k)
+				for x := range dst {
+					dst[x] += w[k] * (above[x] + below[x])
+				}
+			}
+			continue
+		}
+		weight := 0.0
+		for k := range w {
+			i := y + k - radius
+			if i < 0 || i >= p.height {
+				continue
+			}
+			weight += w[k]
+			for x, v := range row(i) {
+				dst[x] += w[k] * v
+			}
+		}
+		for x := range dst {
+			dst[x] /= weight
+		}
+	}
+	return blurred
+}
+
+// downsample halves the plane by averaging 2x2 samples, dropping an odd last row or column
+func (p ssimPlane) downsample() ssimPlane {
+	d := newSSIMPlane(p.width/2, p.height/2)
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			i := 2*y*p.width + 2*x
+			d.values[y*d.width+x] = (p.values[i] + p.values[i+1] + p.values[i+p.width] + p.values[i+p.width+1]) / 4
+		}
+	}
+	return d
+}
+
+// gaussianKernel returns a normalized Gaussian window of the given size and standard deviation
+func gaussianKernel(size int, sigma float64) []float64 {
+	kernel := make([]float64, size)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - size/2)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 1
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
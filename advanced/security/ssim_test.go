@@ -0,0 +1,75 @@
+package security
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWindowedSSIM(t *testing.T) {
+	// Flat images differ in luminance only, which SSIM gives in closed form
+	flat := func(v uint8) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: v, G: v, B: v, A: 255}), image.Point{}, draw.Src)
+		return img
+	}
+	result, err := WindowedSSIM(flat(100), flat(110))
+	if err != nil {
+		t.Fatalf("Error computing SSIM: %v", err)
+	}
+	expected := (2*100*110 + ssimC1) / (100*100 + 110*110 + ssimC1)
+	if math.Abs(result.Mean-expected) > 1e-9 || math.Abs(result.Luminance-expected) > 1e-9 || math.Abs(result.Map.At(19, 0)-expected) > 1e-9 {
+		t.Errorf("expected an SSIM of %f everywhere, got %f with a luminance SSIM of %f", expected, result.Mean, result.Luminance)
+	}
+
+	carrier := loadTestCarrier(t, "lake.jpeg")
+	if result, _ := WindowedSSIM(carrier, carrier); result.Mean != 1 || result.Luminance != 1 {
+		t.Errorf("expected identical images to have an SSIM of 1, got %f", result.Mean)
+	}
+	if msssim, _ := MultiScaleSSIM(carrier, carrier); math.Abs(msssim-1) > 1e-12 {
+		t.Errorf("expected identical images to have an MS-SSIM of 1, got %f", msssim)
+	}
+
+	// Noise in the left half of the image lowers the SSIM there only, and its MS-SSIM
+	bounds := carrier.Bounds()
+	noisy := image.NewNRGBA(bounds)
+	copy(noisy.Pix, carrier.Pix)
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx()/2; x++ {
+			for c := 0; c < 3; c++ {
+				i := noisy.PixOffset(x, y) + c
+				noisy.Pix[i] = uint8(max(0, min(255, int(noisy.Pix[i])+rng.Intn(41)-20)))
+			}
+		}
+	}
+	result, err = WindowedSSIM(carrier, noisy)
+	if err != nil {
+		t.Fatalf("Error computing SSIM: %v", err)
+	}
+	left, right := result.Map.At(bounds.Dx()/4, bounds.Dy()/2), result.Map.At(3*bounds.Dx()/4, bounds.Dy()/2)
+	if left > 0.9 || right != 1 {
+		t.Errorf("expected the noise to lower the SSIM of the left half only, got %f and %f", left, right)
+	}
+	if result.Mean > 0.95 || result.Mean < 0.5 {
+		t.Errorf("expected the noise to lower the mean SSIM, got %f", result.Mean)
+	}
+	if gray := result.Map.Image(); gray.GrayAt(3*bounds.Dx()/4, bounds.Dy()/2).Y != 255 {
+		t.Errorf("expected identical neighbourhoods to render white")
+	}
+	msssim, err := MultiScaleSSIM(carrier, noisy)
+	if err != nil || msssim >= 1 || msssim < result.Mean {
+		t.Errorf("expected an MS-SSIM below 1 and above the SSIM of fine noise %f, got %f (%v)", result.Mean, msssim, err)
+	}
+
+	// Replacing every LSB is barely visible, but no longer rounds to a similarity of 1
+	if ssim := CalculateSSIM(carrier, replaceLSBs(carrier, 1, 1)); ssim >= 0.9999 || ssim < 0.95 {
+		t.Errorf("expected LSB replacement to lower the SSIM slightly, got %f", ssim)
+	}
+	if _, err := WindowedSSIM(carrier, flat(0)); err == nil || CalculateSSIM(carrier, flat(0)) != 0 {
+		t.Error("expected images of different sizes to be rejected")
+	}
+}
@@ -0,0 +1,237 @@
+package advanced
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const (
+	// stcHeight is the constraint height h of the syndrome-trellis code.
+	// Higher values embed closer to the rate-distortion bound at the price
+	// of 2^h trellis states per cover element.
+	stcHeight = 7
+
+	// stcHeaderRate is the number of cover elements spent per header bit
+	stcHeaderRate = 16
+
+	// stcSeed seeds the permutation that spreads the payload over the cover
+	stcSeed = 0x5354430a
+)
+
+// stcColumns returns the columns of the h x w submatrix used for a given width.
+// Every column has its first and last row set, which keeps the parity-check
+// matrix full rank and therefore every message embeddable.
+func stcColumns(w int) []uint32 {
+	rng := rand.New(rand.NewSource(int64(w)*7919 + stcHeight))
+	cols := make([]uint32, w)
+	mask := uint32(1)<<stcHeight - 1
+	for i := range cols {
+		cols[i] = (rng.Uint32() & mask) | 1 | 1<<(stcHeight-1)
+	}
+	return cols
+}
+
+// STCEmbed finds stego parity bits y with syndrome H*y equal to message which minimize
+// the sum of costs over the positions where y differs from cover.
+// Both cover and message hold one bit per byte, costs holds one entry per cover bit.
+func STCEmbed(cover []byte, costs []float64, message []byte) ([]byte, error) {
+	n, m := len(cover), len(message)
+	if len(costs) != n {
+		return nil, fmt.Errorf("cover and costs length mismatch: %d != %d", n, len(costs))
+	}
+	if m == 0 {
+		return append([]byte(nil), cover...), nil
+	}
+	if m > n {
+		return nil, &steg.CapacityError{Needed: int64(m+7) / 8, Available: int64(n / 8)}
+	}
+
+	w := n / m
+	cols := stcColumns(w)
+	states := 1 << stcHeight
+	words := (states + 63) / 64
+	path := make([]uint64, m*w*words)
+
+	wght := make([]float64, states)
+	newWght := make([]float64, states)
+	for k := range wght {
+		wght[k] = math.Inf(1)
+	}
+	wght[0] = 0
+
+	idx := 0
+	for i := 0; i < m; i++ {
+		rowMask := uint32(states - 1)
+		if rem := m - i; rem < stcHeight {
+			rowMask = uint32(1)<<uint(rem) - 1
+		}
+		for j := 0; j < w; j++ {
+			col := int(cols[j] & rowMask)
+			c0 := float64(cover[idx]) * costs[idx]
+			c1 := float64(1-cover[idx]) * costs[idx]
+			base := idx * words
+			for k := 0; k < states; k++ {
+				w0 := wght[k] + c0
+				w1 := wght[k^col] + c1
+				if w1 < w0 {
+					path[base+k/64] |= 1 << uint(k%64)
+					newWght[k] = w1
+				} else {
+					newWght[k] = w0
+				}
+			}
+			wght, newWght = newWght, wght
+			idx++
+		}
+		half := states / 2
+		for k := 0; k < half; k++ {
+			wght[k] = wght[2*k+int(message[i])]
+		}
+		for k := half; k < states; k++ {
+			wght[k] = math.Inf(1)
+		}
+	}
+
+	if math.IsInf(wght[0], 1) {
+		return nil, fmt.Errorf("no solution found for syndrome-trellis embedding")
+	}
+
+	stego := append([]byte(nil), cover...)
+	state := 0
+	idx--
+	for i := m - 1; i >= 0; i-- {
+		state = 2*state + int(message[i])
+		state &= states - 1
+		rowMask := uint32(states - 1)
+		if rem := m - i; rem < stcHeight {
+			rowMask = uint32(1)<<uint(rem) - 1
+		}
+		for j := w - 1; j >= 0; j-- {
+			bit := byte(path[idx*words+state/64]>>uint(state%64)) & 1
+			stego[idx] = bit
+			if bit == 1 {
+				state ^= int(cols[j] & rowMask)
+			}
+			idx--
+		}
+	}
+
+	return stego, nil
+}
+
+// STCExtract computes the syndrome H*y of the stego parity bits, recovering a message of messageBits bits
+func STCExtract(stego []byte, messageBits int) []byte {
+	message := make([]byte, messageBits)
+	if messageBits == 0 || messageBits > len(stego) {
+		return message
+	}
+	w := len(stego) / messageBits
+	cols := stcColumns(w)
+	idx := 0
+	for i := 0; i < messageBits; i++ {
+		for j := 0; j < w; j++ {
+			if stego[idx] == 1 {
+				for r := 0; r < stcHeight && i+r < messageBits; r++ {
+					message[i+r] ^= byte(cols[j]>>uint(r)) & 1
+				}
+			}
+			idx++
+		}
+	}
+	return message
+}
+
+// stcPermutation returns the fixed pseudo random order in which cover elements are used
+func stcPermutation(n int) []int {
+	return rand.New(rand.NewSource(stcSeed)).Perm(n)
+}
+
+// embedPayload hides payload, prefixed by its length, in the parities of the cover elements
+// while minimizing the total cost of the changes.
+// It returns the indices of the elements whose parity has to be flipped.
+func embedPayload(parity []byte, costs []float64, payload []byte) ([]int, error) {
+	n := len(parity)
+	headerElements := headerSize * 8 * stcHeaderRate
+	available := n - headerElements
+	needed := len(payload) * 8
+	if available < needed || available <= 0 {
+		return nil, &steg.CapacityError{Needed: int64(needed / 8), Available: int64(max(available, 0) / 8)}
+	}
+
+	perm := stcPermutation(n)
+	permParity := make([]byte, n)
+	permCosts := make([]float64, n)
+	for i, p := range perm {
+		permParity[i] = parity[p]
+		permCosts[i] = costs[p]
+	}
+
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint64(header, uint64(len(payload)))
+	stegoHeader, err := STCEmbed(permParity[:headerElements], permCosts[:headerElements], bytesToBits(header))
+	if err != nil {
+		return nil, err
+	}
+	stegoBody, err := STCEmbed(permParity[headerElements:], permCosts[headerElements:], bytesToBits(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	stego := append(stegoHeader, stegoBody...)
+	var flips []int
+	for i, p := range perm {
+		if stego[i] != permParity[i] {
+			flips = append(flips, p)
+		}
+	}
+	return flips, nil
+}
+
+// extractPayload recovers a payload previously hidden by embedPayload
+func extractPayload(parity []byte) ([]byte, error) {
+	n := len(parity)
+	headerElements := headerSize * 8 * stcHeaderRate
+	if n <= headerElements {
+		return nil, fmt.Errorf("%w: carrier is too small to contain a header", steg.ErrNoPayload)
+	}
+
+	perm := stcPermutation(n)
+	permParity := make([]byte, n)
+	for i, p := range perm {
+		permParity[i] = parity[p]
+	}
+
+	header := bitsToBytes(STCExtract(permParity[:headerElements], headerSize*8))
+	length := binary.BigEndian.Uint64(header)
+	if length == 0 || length*8 > uint64(n-headerElements) {
+		return nil, fmt.Errorf("%w: invalid message length %d", steg.ErrCorruptHeader, length)
+	}
+
+	return bitsToBytes(STCExtract(permParity[headerElements:], int(length)*8)), nil
+}
+
+// bytesToBits expands data into one bit per byte, most significant bit first
+func bytesToBits(data []byte) []byte {
+	out := make([]byte, len(data)*8)
+	for i, b := range data {
+		for j := 0; j < 8; j++ {
+			out[i*8+j] = (b >> uint(7-j)) & 1
+		}
+	}
+	return out
+}
+
+// bitsToBytes packs one bit per byte, most significant bit first
+func bitsToBytes(bits []byte) []byte {
+	out := make([]byte, len(bits)/8)
+	for i := range out {
+		for j := 0; j < 8; j++ {
+			out[i] |= bits[i*8+j] << uint(7-j)
+		}
+	}
+	return out
+}
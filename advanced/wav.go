@@ -0,0 +1,293 @@
+package advanced
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatExtensible = 0xFFFE
+
+	// wavEnergyWindow is the number of samples on each side of a sample over which its
+	// local energy is measured
+	wavEnergyWindow = 8
+)
+
+// WAVAudio implements CoverMedia for the samples of a PCM WAV file.
+// Everything around the samples (the RIFF header, the format chunk and any other chunk)
+// is kept as read, so saving writes it back byte for byte.
+type WAVAudio struct {
+	header        []byte // bytes preceding the samples
+	trailer       []byte // bytes following the samples
+	samples       []int32
+	channels      int
+	bitsPerSample int
+	costs         []float64
+}
+
+// IsWAV reports whether header starts like a RIFF WAVE file
+func IsWAV(header []byte) bool {
+	return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+// ReadWAV parses an 8, 16 or 24-bit PCM WAV file
+func ReadWAV(r io.Reader) (*WAVAudio, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading wav: %w", err)
+	}
+	if !IsWAV(data) {
+		return nil, fmt.Errorf("%w: missing RIFF WAVE header", steg.ErrUnsupportedFormat)
+	}
+
+	w := &WAVAudio{}
+	blockAlign := 0
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		start := offset + 8
+
+		switch id {
+		case "fmt ":
+			if size < 16 || start+size > len(data) {
+				return nil, fmt.Errorf("invalid wav format chunk")
+			}
+			fmtChunk := data[start : start+size]
+			format := binary.LittleEndian.Uint16(fmtChunk[0:])
+			if format == wavFormatExtensible && size >= 26 {
+				format = binary.LittleEndian.Uint16(fmtChunk[24:]) // first bytes of the sub format GUID
+			}
+			if format != wavFormatPCM {
+				return nil, fmt.Errorf("%w: wav encoding %d, only PCM is supported", steg.ErrUnsupportedFormat, format)
+			}
+			w.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:]))
+			blockAlign = int(binary.LittleEndian.Uint16(fmtChunk[12:]))
+			w.bitsPerSample = int(binary.LittleEndian.Uint16(fmtChunk[14:]))
+			if w.bitsPerSample != 8 && w.bitsPerSample != 16 && w.bitsPerSample != 24 {
+				return nil, fmt.Errorf("%w: wav sample size of %d bits", steg.ErrUnsupportedFormat, w.bitsPerSample)
+			}
+			if w.channels < 1 || blockAlign != w.channels*w.bitsPerSample/8 {
+				return nil, fmt.Errorf("invalid wav block alignment")
+			}
+		case "data":
+			if w.channels == 0 {
+				return nil, fmt.Errorf("wav data chunk precedes the format chunk")
+			}
+			// streamed files may announce more data than they contain
+			length := min(size, len(data)-start)
+			length -= length % blockAlign
+			w.header = data[:start]
+			w.trailer = data[start+length:]
+			w.samples = decodeWAVSamples(data[start:start+length], w.bitsPerSample)
+			w.costs = calculateWAVCosts(w.samples, w.channels)
+			return w, nil
+		}
+		offset = start + size + size%2 // chunks are padded to an even size
+	}
+	return nil, fmt.Errorf("wav has no data chunk")
+}
+
+func decodeWAVSamples(data []byte, bits int) []int32 {
+	size := bits / 8
+	samples := make([]int32, len(data)/size)
+	for i := range samples {
+		b := data[i*size:]
+		switch bits {
+		case 8:
+			samples[i] = int32(b[0]) // unsigned
+		case 16:
+			samples[i] = int32(int16(binary.LittleEndian.Uint16(b)))
+		case 24:
+			samples[i] = int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		}
+	}
+	return samples
+}
+
+func encodeWAVSamples(samples []int32, bits int) []byte {
+	size := bits / 8
+	data := make([]byte, len(samples)*size)
+	for i, s := range samples {
+		b := data[i*size:]
+		switch bits {
+		case 8:
+			b[0] = byte(s)
+		case 16:
+			binary.LittleEndian.PutUint16(b, uint16(s))
+		case 24:
+			b[0], b[1], b[2] = byte(s), byte(s>>8), byte(s>>16)
+		}
+	}
+	return data
+}
+
+// calculateWAVCosts assigns every sample the inverse RMS of the high-pass residual around it,
+// so changes go to loud, noisy passages where they are masked and stay out of quiet ones.
+// Samples in digital silence are never changed.
+func calculateWAVCosts(samples []int32, channels int) []float64 {
+	costs := make([]float64, len(samples))
+	frames := len(samples) / channels
+	for c := 0; c < channels; c++ {
+		at := func(t int) int64 {
+			t = max(0, min(frames-1, t))
+			return int64(samples[t*channels+c])
+		}
+		// twice the residual keeps the sums exact integers
+		residual := make([]int64, frames)
+		for t := range residual {
+			r := 2*at(t) - at(t-1) - at(t+1)
+			residual[t] = r * r
+		}
+
+		// running sum over the window around every frame
+		var sum int64
+		for t := 0; t < min(wavEnergyWindow, frames); t++ {
+			sum += residual[t]
+		}
+		for t := 0; t < frames; t++ {
+			if end := t + wavEnergyWindow; end < frames {
+				sum += residual[end]
+			}
+			if start := t - wavEnergyWindow - 1; start >= 0 {
+				sum -= residual[start]
+			}
+			if sum == 0 {
+				costs[t*channels+c] = wetCost
+				continue
+			}
+			window := min(frames-1, t+wavEnergyWindow) - max(0, t-wavEnergyWindow) + 1
+			rms := math.Sqrt(float64(sum)/float64(window)) / 2
+			costs[t*channels+c] = 1 / (rms + epsilon)
+		}
+	}
+	return costs
+}
+
+func (w *WAVAudio) GetSize() int64 {
+	return int64(len(w.samples))
+}
+
+func (w *WAVAudio) GetCosts() []float64 {
+	return w.costs
+}
+
+func (w *WAVAudio) Embed(data []byte, positions []int) error {
+	if len(positions) < len(data)*8 {
+		return &steg.CapacityError{Needed: int64(len(data)), Available: int64(len(positions) / 8)}
+	}
+
+	for i := 0; i < len(data)*8; i++ {
+		bit := (data[i/8] >> uint(7-i%8)) & 1
+		if byte(w.samples[positions[i]]&1) != bit {
+			w.modifySample(positions[i])
+		}
+	}
+	return nil
+}
+
+func (w *WAVAudio) Extract(positions []int) ([]byte, error) {
+	data := make([]byte, len(positions)/8)
+	for i := 0; i < len(data)*8; i++ {
+		data[i/8] |= byte(w.samples[positions[i]]&1) << uint(7-i%8)
+	}
+	return data, nil
+}
+
+func (w *WAVAudio) Save(out io.Writer) error {
+	for _, b := range [][]byte{w.header, encodeWAVSamples(w.samples, w.bitsPerSample), w.trailer} {
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parities returns the LSB of every sample
+func (w *WAVAudio) parities() []byte {
+	parity := make([]byte, len(w.samples))
+	for i, s := range w.samples {
+		parity[i] = byte(s & 1)
+	}
+	return parity
+}
+
+// modifySample changes a sample by ±1 while keeping it inside the range of its bit depth
+func (w *WAVAudio) modifySample(i int) {
+	low, high := int32(-1)<<uint(w.bitsPerSample-1), int32(1)<<uint(w.bitsPerSample-1)-1
+	if w.bitsPerSample == 8 {
+		low, high = 0, 255
+	}
+	switch s := w.samples[i]; {
+	case s >= high:
+		w.samples[i] = s - 1
+	case s <= low:
+		w.samples[i] = s + 1
+	case randBool():
+		w.samples[i] = s + 1
+	default:
+		w.samples[i] = s - 1
+	}
+}
+
+// AdvancedEncodeWAV hides data in the samples of a PCM WAV carrier by LSB matching.
+// Changes are placed by syndrome-trellis coding to minimize the local energy based
+// distortion, and everything but the samples is written back unchanged.
+func AdvancedEncodeWAV(carrier io.Reader, data io.Reader, result io.Writer) error {
+	media, err := ReadWAV(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier audio: %w", err)
+	}
+
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+
+	flips, err := embedPayload(media.parities(), media.GetCosts(), dataBytes)
+	if err != nil {
+		return err
+	}
+	for _, pos := range flips {
+		media.modifySample(pos)
+	}
+
+	return media.Save(result)
+}
+
+// AdvancedDecodeWAV extracts data previously hidden by AdvancedEncodeWAV
+func AdvancedDecodeWAV(carrier io.Reader, result io.Writer) error {
+	media, err := ReadWAV(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier audio: %w", err)
+	}
+
+	payload, err := extractPayload(media.parities())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(result, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error writing the result: %w", err)
+	}
+	return nil
+}
+
+// AdvancedEncodeWAVByFileNames is AdvancedEncodeWAV working with file names
+func AdvancedEncodeWAVByFileNames(carrierFileName, dataFileName, resultFileName string) error {
+	return byFileNames(carrierFileName, dataFileName, resultFileName, AdvancedEncodeWAV)
+}
+
+// AdvancedDecodeWAVByFileNames is AdvancedDecodeWAV working with file names
+func AdvancedDecodeWAVByFileNames(carrierFileName, resultFileName string) error {
+	return byFileNames(carrierFileName, "", resultFileName, func(carrier, _ io.Reader, result io.Writer) error {
+		return AdvancedDecodeWAV(carrier, result)
+	})
+}
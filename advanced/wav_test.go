@@ -0,0 +1,133 @@
+package advanced
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// newTestWAV builds a PCM WAV whose first half is silent and second half is a noisy tone,
+// followed by a LIST chunk which has to survive encoding
+func newTestWAV(bits, channels, frames int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	amplitude := float64(int(1)<<uint(bits-1)) * 0.5
+	samples := make([]int32, frames*channels)
+	for t := 0; t < frames; t++ {
+		for c := 0; c < channels; c++ {
+			v := 0.0
+			if t >= frames/2 {
+				v = amplitude*math.Sin(float64(t)*0.07+float64(c)) + rng.NormFloat64()*amplitude*0.05
+			}
+			s := int32(v)
+			if bits == 8 {
+				s += 128
+			}
+			samples[t*channels+c] = s
+		}
+	}
+	data := encodeWAVSamples(samples, bits)
+
+	var buf bytes.Buffer
+	le := func(v interface{}) { binary.Write(&buf, binary.LittleEndian, v) }
+	list := []byte("INFOISFT\x06\x00\x00\x00tests\x00")
+	buf.WriteString("RIFF")
+	le(uint32(4 + 8 + 16 + 8 + len(data) + len(data)%2 + 8 + len(list)))
+	buf.WriteString("WAVEfmt ")
+	le(uint32(16))
+	le(uint16(wavFormatPCM))
+	le(uint16(channels))
+	le(uint32(44100))
+	le(uint32(44100 * channels * bits / 8))
+	le(uint16(channels * bits / 8))
+	le(uint16(bits))
+	buf.WriteString("data")
+	le(uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	buf.WriteString("LIST")
+	le(uint32(len(list)))
+	buf.Write(list)
+	return buf.Bytes()
+}
+
+func TestWAVEncodeDecode(t *testing.T) {
+	const frames = 20001
+	for _, bits := range []int{8, 16, 24} {
+		for _, channels := range []int{1, 2} {
+			carrier := newTestWAV(bits, channels, frames)
+			data := make([]byte, 200)
+			rand.New(rand.NewSource(2)).Read(data)
+
+			var result bytes.Buffer
+			if err := AdvancedEncodeWAV(bytes.NewReader(carrier), bytes.NewReader(data), &result); err != nil {
+				t.Fatalf("%d-bit %d channel: encode failed: %v", bits, channels, err)
+			}
+
+			cover, _ := ReadWAV(bytes.NewReader(carrier))
+			stego, err := ReadWAV(bytes.NewReader(result.Bytes()))
+			if err != nil {
+				t.Fatalf("%d-bit %d channel: result is not a valid wav: %v", bits, channels, err)
+			}
+			if !bytes.Equal(cover.header, stego.header) || !bytes.Equal(cover.trailer, stego.trailer) {
+				t.Errorf("%d-bit %d channel: bytes around the samples changed", bits, channels)
+			}
+			for i := range cover.samples {
+				diff := cover.samples[i] - stego.samples[i]
+				if diff < -1 || diff > 1 {
+					t.Fatalf("%d-bit %d channel: sample %d changed by %d", bits, channels, i, diff)
+				}
+				if diff != 0 && i/channels < frames/2-wavEnergyWindow {
+					t.Errorf("%d-bit %d channel: silent sample %d was changed", bits, channels, i)
+				}
+			}
+
+			var decoded bytes.Buffer
+			if err := AdvancedDecodeWAV(bytes.NewReader(result.Bytes()), &decoded); err != nil {
+				t.Fatalf("%d-bit %d channel: decode failed: %v", bits, channels, err)
+			}
+			if !bytes.Equal(decoded.Bytes(), data) {
+				t.Errorf("%d-bit %d channel: decoded data does not match", bits, channels)
+			}
+		}
+	}
+}
+
+func TestWAVCostsFollowLocalEnergy(t *testing.T) {
+	samples := make([]int32, 300)
+	rng := rand.New(rand.NewSource(3))
+	for i := 100; i < 200; i++ {
+		samples[i] = int32(rng.Intn(200) - 100) // quiet
+	}
+	for i := 200; i < 300; i++ {
+		samples[i] = int32(rng.Intn(20000) - 10000) // loud
+	}
+
+	costs := calculateWAVCosts(samples, 1)
+	if costs[50] != wetCost {
+		t.Errorf("Expected digital silence to be wet, got cost %v", costs[50])
+	}
+	if costs[250] >= costs[150] {
+		t.Errorf("Expected loud samples to be cheaper than quiet ones, got %v and %v", costs[250], costs[150])
+	}
+}
+
+func TestReadWAVShouldRejectUnsupportedFiles(t *testing.T) {
+	float := newTestWAV(16, 1, 100)
+	binary.LittleEndian.PutUint16(float[20:], 3) // IEEE float
+
+	tests := map[string][]byte{
+		"not riff":   []byte("not a wav file at all"),
+		"float":      float,
+		"no data":    newTestWAV(16, 1, 100)[:36],
+		"32-bit pcm": func() []byte { b := newTestWAV(16, 1, 100); binary.LittleEndian.PutUint16(b[34:], 32); return b }(),
+	}
+	for name, file := range tests {
+		if _, err := ReadWAV(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/DimitarPetrov/stegify/advanced/security"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+)
+
+const analyze = "analyze"
+
+var jsonReport = flag.Bool("json", false, "print the analysis as json instead of a table")
+var workers = flag.Int("workers", 0, "number of files analysed at once (defaults to the number of CPUs)")
+var model = flag.String("model", "", "ensemble model file trained with the security package, adds its prediction to the analysis")
+
+//analyzeColumns are the detectors shown in the table, in order
+var analyzeColumns = []string{
+	security.DetectorChiSquare,
+	security.DetectorRS,
+	security.DetectorSPA,
+	security.DetectorWS,
+	security.DetectorSignature,
+	security.DetectorAppendedData,
+}
+
+//runAnalyze analyses the files and directories given as arguments and prints the reports ranked by score
+func runAnalyze() {
+	paths := flag.Args()
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "Files or directories to analyze must be specified. Use stegify --help for more information.")
+		os.Exit(1)
+	}
+
+	options := security.AnalyzeOptions{Workers: *workers}
+	columns := analyzeColumns
+	if *model != "" {
+		ensemble, err := security.LoadEnsemble(*model)
+		if err != nil {
+			exit(err)
+		}
+		options.Ensemble = ensemble
+		columns = append(columns, security.DetectorEnsemble)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	reports, err := security.AnalyzePaths(ctx, paths, options)
+	if err != nil {
+		exit(err)
+	}
+
+	if *jsonReport {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			exit(err)
+		}
+		return
+	}
+	printReports(reports, columns)
+}
+
+//printReports prints a table of the verdicts and detector scores of the reports, the errors go to stderr
+func printReports(reports []security.Report, columns []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "RANK\tVERDICT\tSCORE\t%s\tFILE\n", strings.ToUpper(strings.Join(columns, "\t")))
+	for i, r := range reports {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%d\terror\t-\t%s%s\n", i+1, strings.Repeat("-\t", len(columns)), r.Path)
+			fmt.Fprintln(os.Stderr, r.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%.2f\t", i+1, r.Verdict, r.Score)
+		for _, detector := range columns {
+			if s, ok := r.DetectorScore(detector); ok {
+				fmt.Fprintf(w, "%.2f\t", s.Score)
+			} else {
+				fmt.Fprint(w, "-\t")
+			}
+		}
+		fmt.Fprintln(w, r.Path)
+	}
+	w.Flush()
+}
@@ -0,0 +1,248 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func newTestFrames(count, width, height int) []image.Image {
+	rng := rand.New(rand.NewSource(1))
+	frames := make([]image.Image, count)
+	for i := range frames {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.RGBA{R: uint8(rng.Intn(256)), G: uint8(x * 20), B: uint8(y * 20), A: 255})
+			}
+		}
+		frames[i] = img
+	}
+	return frames
+}
+
+func assertSameImage(t *testing.T, expected, actual image.Image) {
+	t.Helper()
+	if expected.Bounds() != actual.Bounds() {
+		t.Fatalf("Expected bounds %v, got %v", expected.Bounds(), actual.Bounds())
+	}
+	for y := expected.Bounds().Min.Y; y < expected.Bounds().Max.Y; y++ {
+		for x := expected.Bounds().Min.X; x < expected.Bounds().Max.X; x++ {
+			if color.RGBAModel.Convert(expected.At(x, y)) != color.RGBAModel.Convert(actual.At(x, y)) {
+				t.Fatalf("Pixel (%d, %d) differs: expected %v, got %v", x, y, expected.At(x, y), actual.At(x, y))
+			}
+		}
+	}
+}
+
+//assertValidIndex checks that every idx1 entry points to a chunk of the indexed size
+func assertValidIndex(t *testing.T, v *Video) {
+	t.Helper()
+	if len(v.index) != v.FrameCount() {
+		t.Fatalf("Expected %d index entries, got %d", v.FrameCount(), len(v.index))
+	}
+	for i, e := range v.index {
+		if e.chunk != v.frames[i] {
+			t.Fatalf("Index entry %d does not point to frame %d", i, i)
+		}
+		if size := int(binary.LittleEndian.Uint32(e.raw[12:])); size != len(e.chunk.data) {
+			t.Fatalf("Index entry %d has size %d, frame is %d bytes", i, size, len(e.chunk.data))
+		}
+	}
+}
+
+func TestEncodeReadUncompressed(t *testing.T) {
+	frames := newTestFrames(3, 5, 3) //odd width to exercise row padding
+	var buf bytes.Buffer
+	if err := Encode(&buf, frames, nil); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	v, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if v.IsMJPEG() || v.FrameCount() != len(frames) || v.Bounds() != frames[0].Bounds() {
+		t.Fatalf("Unexpected video: mjpeg %v, %d frames of %v", v.IsMJPEG(), v.FrameCount(), v.Bounds())
+	}
+	assertValidIndex(t, v)
+	for i, frame := range frames {
+		img, err := v.FrameImage(i)
+		if err != nil {
+			t.Fatalf("Failed to decode frame %d: %v", i, err)
+		}
+		assertSameImage(t, frame, img)
+	}
+
+	var rewritten bytes.Buffer
+	if err := v.Write(&rewritten); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), rewritten.Bytes()) {
+		t.Error("Expected an unmodified video to be written back unchanged")
+	}
+}
+
+func TestSetFrameImage(t *testing.T) {
+	frames := newTestFrames(2, 4, 4)
+	var buf bytes.Buffer
+	if err := Encode(&buf, frames, nil); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	v, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	replacement := newTestFrames(1, 4, 4)[0].(*image.RGBA)
+	replacement.Set(0, 0, color.RGBA{R: 1, G: 2, B: 3, A: 255})
+	if err := v.SetFrameImage(1, replacement); err != nil {
+		t.Fatalf("Failed to set frame: %v", err)
+	}
+	if err := v.SetFrameImage(0, image.NewRGBA(image.Rect(0, 0, 3, 4))); err == nil {
+		t.Error("Expected an error for a frame of different dimensions")
+	}
+
+	var out bytes.Buffer
+	if err := v.Write(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	v, err = Read(&out)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	for i, expected := range []image.Image{frames[0], replacement} {
+		img, err := v.FrameImage(i)
+		if err != nil {
+			t.Fatalf("Failed to decode frame %d: %v", i, err)
+		}
+		assertSameImage(t, expected, img)
+	}
+}
+
+func TestMJPEGFramesOfNewSizeKeepIndexValid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, newTestFrames(3, 16, 16), &Options{MJPEG: true, Quality: 90}); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	v, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !v.IsMJPEG() {
+		t.Fatal("Expected a Motion JPEG video")
+	}
+	if _, err := v.FrameImage(0); err != nil {
+		t.Fatalf("Failed to decode frame: %v", err)
+	}
+
+	// an odd size also exercises chunk padding
+	replacement := append(append([]byte{}, v.Frame(1)...), make([]byte, 1001)...)
+	v.SetFrame(1, replacement)
+	first, last := v.Frame(0), v.Frame(2)
+
+	var out bytes.Buffer
+	if err := v.Write(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	v, err = Read(&out)
+	if err != nil {
+		t.Fatalf("Failed to read rewritten video: %v", err)
+	}
+	assertValidIndex(t, v)
+	for i, expected := range [][]byte{first, replacement, last} {
+		if !bytes.Equal(v.Frame(i), expected) {
+			t.Errorf("Frame %d differs after rewriting", i)
+		}
+	}
+	if size := binary.LittleEndian.Uint32(v.avih.data[avihBufferSize:]); int(size) < len(replacement) {
+		t.Errorf("Expected the suggested buffer size to fit the largest frame, got %d", size)
+	}
+}
+
+//riff lays out a chunk, lists take their type as the first part of the body
+func riff(id string, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	out := make([]byte, 8, 8+len(data)+1)
+	copy(out, id)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func TestReadTopDown32BitWithAbsoluteIndex(t *testing.T) {
+	avih := make([]byte, avihLen)
+	strh := make([]byte, strhLen)
+	copy(strh, "vids")
+	strf := make([]byte, bihLen)
+	binary.LittleEndian.PutUint32(strf[4:], 2)
+	binary.LittleEndian.PutUint32(strf[8:], uint32(0xFFFFFFFF)) //height -1, top-down
+	binary.LittleEndian.PutUint16(strf[14:], 32)
+	pixels := []byte{1, 2, 3, 0xAA, 4, 5, 6, 0xBB} //BGRX
+
+	header := riff("LIST", []byte("hdrl"), riff("avih", avih), riff("LIST", []byte("strl"), riff("strh", strh), riff("strf", strf)))
+	movi := riff("LIST", []byte("movi"), riff("00db", pixels))
+	frameOffset := 12 + len(header) + 12
+	index := make([]byte, 16)
+	copy(index, "00db")
+	binary.LittleEndian.PutUint32(index[8:], uint32(frameOffset))
+	binary.LittleEndian.PutUint32(index[12:], uint32(len(pixels)))
+	file := riff("RIFF", []byte("AVI "), header, movi, riff("idx1", index))
+
+	v, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !v.absolute {
+		t.Error("Expected absolute index offsets to be detected")
+	}
+	assertValidIndex(t, v)
+
+	img, err := v.FrameImage(0)
+	if err != nil {
+		t.Fatalf("Failed to decode frame: %v", err)
+	}
+	if c := img.At(1, 0); c != (color.RGBA{R: 6, G: 5, B: 4, A: 255}) {
+		t.Errorf("Unexpected pixel %v", c)
+	}
+
+	if err := v.SetFrameImage(0, image.NewRGBA(v.Bounds())); err != nil {
+		t.Fatalf("Failed to set frame: %v", err)
+	}
+	if expected := []byte{0, 0, 0, 0xAA, 0, 0, 0, 0xBB}; !bytes.Equal(v.Frame(0), expected) {
+		t.Errorf("Expected the fourth bytes to be kept, got %v", v.Frame(0))
+	}
+}
+
+func TestReadShouldRejectUnsupportedFiles(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, newTestFrames(1, 2, 2), nil); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	valid := buf.Bytes()
+	strf := bytes.Index(valid, []byte("strf")) + 8
+
+	paletted := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(paletted[strf+14:], 8)
+	compressed := append([]byte{}, valid...)
+	copy(compressed[strf+16:], "H264")
+
+	tests := map[string][]byte{
+		"not riff":   []byte("RIFF\x04\x00\x00\x00WAVE"),
+		"truncated":  valid[:len(valid)-10],
+		"paletted":   paletted,
+		"compressed": compressed,
+		"extended":   append(append([]byte{}, valid...), riff("RIFF", []byte("AVIX"))...),
+	}
+	for name, file := range tests {
+		if _, err := Read(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+//Package avi reads and writes AVI (RIFF) files whose video stream is uncompressed or Motion JPEG.
+//
+//A file is kept as a tree of its chunks, so writing it back only changes the frames that were replaced
+//together with the sizes and index entries that depend on them.
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/DimitarPetrov/stegify/formats"
+)
+
+const (
+	avihLen = 56
+	strhLen = 56
+	bihLen  = 40
+
+	biRGB = 0
+
+	//offsets of the suggested buffer sizes in the avih and strh chunks
+	avihBufferSize = 28
+	strhBufferSize = 36
+)
+
+//FormatError reports that the input is not a valid AVI
+type FormatError string
+
+func (e FormatError) Error() string { return "avi: invalid format: " + string(e) }
+
+//UnsupportedError reports that the input uses a valid but unimplemented AVI feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "avi: unsupported feature: " + string(e) }
+
+//Is makes unsupported features match formats.ErrUnsupportedFormat
+func (e UnsupportedError) Is(target error) bool { return target == formats.ErrUnsupportedFormat }
+
+type chunk struct {
+	id       string
+	listType string //set for RIFF and LIST chunks, which have children instead of data
+	data     []byte
+	children []*chunk
+	offset   int //position of the chunk header in the file
+}
+
+func (c *chunk) isList() bool {
+	return c.id == "RIFF" || c.id == "LIST"
+}
+
+//child returns the first data chunk with the given id
+func (c *chunk) child(id string) *chunk {
+	for _, ch := range c.children {
+		if ch.id == id && !ch.isList() {
+			return ch
+		}
+	}
+	return nil
+}
+
+//lists returns the LIST chunks of the given type
+func (c *chunk) lists(listType string) []*chunk {
+	var lists []*chunk
+	for _, ch := range c.children {
+		if ch.id == "LIST" && ch.listType == listType {
+			lists = append(lists, ch)
+		}
+	}
+	return lists
+}
+
+//walk calls f for every descendant of c in file order
+func (c *chunk) walk(f func(*chunk)) {
+	for _, ch := range c.children {
+		f(ch)
+		ch.walk(f)
+	}
+}
+
+//indexEntry is an entry of the idx1 chunk, pointing to the chunk it describes when that was found
+type indexEntry struct {
+	raw   []byte
+	chunk *chunk
+}
+
+//Video is an AVI file with an uncompressed or Motion JPEG video stream
+type Video struct {
+	root       *chunk
+	avih, strh *chunk
+	movi       *chunk
+	idx1       *chunk
+	index      []indexEntry
+	absolute   bool //idx1 offsets are file positions instead of positions relative to the movi list
+
+	frames        []*chunk
+	width, height int
+	topDown       bool
+	bitCount      int
+	mjpeg         bool
+}
+
+//IsAVI reports whether header starts like a RIFF AVI file
+func IsAVI(header []byte) bool {
+	return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "AVI "
+}
+
+//Read parses an AVI file and locates the frames of its first video stream.
+//OpenDML (AVI 2.0) files and streams other than 24 or 32 bit bitmaps and Motion JPEG are not supported.
+func Read(r io.Reader) (*Video, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("avi: error reading file: %w", err)
+	}
+	if !IsAVI(b) {
+		return nil, FormatError("missing RIFF AVI header")
+	}
+	chunks, err := parseChunks(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) != 1 {
+		return nil, UnsupportedError("OpenDML (AVI 2.0) extended files")
+	}
+
+	v := &Video{root: chunks[0]}
+	hdrl := v.root.lists("hdrl")
+	movi := v.root.lists("movi")
+	if len(hdrl) == 0 || len(movi) == 0 {
+		return nil, FormatError("missing hdrl or movi list")
+	}
+	v.movi = movi[0]
+	if v.avih = hdrl[0].child("avih"); v.avih == nil || len(v.avih.data) < avihLen {
+		return nil, FormatError("missing main header")
+	}
+
+	stream := -1
+	for i, strl := range hdrl[0].lists("strl") {
+		if strl.child("indx") != nil {
+			return nil, UnsupportedError("OpenDML (AVI 2.0) indexes")
+		}
+		strh := strl.child("strh")
+		if stream < 0 && strh != nil && len(strh.data) >= strhLen && string(strh.data[:4]) == "vids" {
+			stream, v.strh = i, strh
+			if err := v.parseFormat(strl.child("strf")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if stream < 0 {
+		return nil, FormatError("no video stream")
+	}
+
+	prefix := fmt.Sprintf("%02d", stream)
+	v.movi.walk(func(c *chunk) {
+		if !c.isList() && strings.HasPrefix(c.id, prefix) && (c.id[2:] == "db" || c.id[2:] == "dc") {
+			v.frames = append(v.frames, c)
+		}
+	})
+
+	if v.idx1 = v.root.child("idx1"); v.idx1 != nil {
+		v.parseIndex()
+	}
+	return v, nil
+}
+
+func parseChunks(b []byte, offset int) ([]*chunk, error) {
+	var chunks []*chunk
+	for len(b) >= 8 {
+		c := &chunk{id: string(b[:4]), offset: offset}
+		size := int(binary.LittleEndian.Uint32(b[4:]))
+		if size > len(b)-8 {
+			return nil, FormatError(fmt.Sprintf("chunk %q at offset %d is truncated", c.id, offset))
+		}
+		body := b[8 : 8+size]
+		if c.isList() {
+			if size < 4 {
+				return nil, FormatError(fmt.Sprintf("list at offset %d has no type", offset))
+			}
+			c.listType = string(body[:4])
+			children, err := parseChunks(body[4:], offset+12)
+			if err != nil {
+				return nil, err
+			}
+			c.children = children
+		} else {
+			c.data = body
+		}
+		chunks = append(chunks, c)
+
+		n := min(8+size+size%2, len(b)) //chunks are padded to an even size
+		b, offset = b[n:], offset+n
+	}
+	return chunks, nil
+}
+
+//parseFormat reads the BITMAPINFOHEADER of the video stream
+func (v *Video) parseFormat(strf *chunk) error {
+	if strf == nil || len(strf.data) < bihLen {
+		return FormatError("missing video format")
+	}
+	d := strf.data
+	v.width = int(int32(binary.LittleEndian.Uint32(d[4:])))
+	v.height = int(int32(binary.LittleEndian.Uint32(d[8:])))
+	v.bitCount = int(binary.LittleEndian.Uint16(d[14:]))
+	if v.height < 0 {
+		v.height, v.topDown = -v.height, true
+	}
+	if v.width <= 0 || v.height <= 0 {
+		return FormatError(fmt.Sprintf("dimensions %dx%d", v.width, v.height))
+	}
+
+	compression := d[16:20]
+	switch {
+	case binary.LittleEndian.Uint32(compression) == biRGB:
+		if v.bitCount != 24 && v.bitCount != 32 {
+			return UnsupportedError(fmt.Sprintf("%d bit uncompressed frames", v.bitCount))
+		}
+	case strings.EqualFold(string(compression), "MJPG"):
+		v.mjpeg = true
+	default:
+		return UnsupportedError(fmt.Sprintf("compression %q", compression))
+	}
+	return nil
+}
+
+//parseIndex links the idx1 entries to the chunks they point to
+func (v *Video) parseIndex() {
+	byOffset := make(map[int]*chunk)
+	v.movi.walk(func(c *chunk) {
+		byOffset[c.offset] = c
+	})
+	moviStart := v.movi.offset + 8 //relative offsets count from the list type
+
+	d := v.idx1.data
+	for i := 0; i+16 <= len(d); i += 16 {
+		offset := int(binary.LittleEndian.Uint32(d[i+8:]))
+		if i == 0 {
+			_, relative := byOffset[moviStart+offset]
+			v.absolute = !relative
+		}
+		if !v.absolute {
+			offset += moviStart
+		}
+		v.index = append(v.index, indexEntry{raw: d[i : i+16], chunk: byOffset[offset]})
+	}
+}
+
+//FrameCount returns the number of frames of the video stream, including empty (dropped) frames
+func (v *Video) FrameCount() int {
+	return len(v.frames)
+}
+
+//IsMJPEG reports whether the frames are JPEG images, otherwise they are uncompressed bitmaps
+func (v *Video) IsMJPEG() bool {
+	return v.mjpeg
+}
+
+//Bounds returns the dimensions of the frames
+func (v *Video) Bounds() image.Rectangle {
+	return image.Rect(0, 0, v.width, v.height)
+}
+
+//Frame returns the encoded data of frame i: a bitmap without header or a JPEG image
+func (v *Video) Frame(i int) []byte {
+	return v.frames[i].data
+}
+
+//SetFrame replaces the encoded data of frame i
+func (v *Video) SetFrame(i int, data []byte) {
+	v.frames[i].data = data
+}
+
+//FrameImage decodes frame i. Uncompressed frames are returned as opaque *image.RGBA.
+func (v *Video) FrameImage(i int) (image.Image, error) {
+	data := v.frames[i].data
+	if v.mjpeg {
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("avi: error decoding frame %d: %w", i, err)
+		}
+		return img, nil
+	}
+
+	bytesPerPixel, stride := v.bitCount/8, v.rowLen()
+	if len(data) < stride*v.height {
+		return nil, FormatError(fmt.Sprintf("frame %d is %d bytes long", i, len(data)))
+	}
+	img := image.NewRGBA(v.Bounds())
+	for y := 0; y < v.height; y++ {
+		row := data[v.row(y)*stride:]
+		p := img.Pix[y*img.Stride:]
+		for x := 0; x < v.width; x++ {
+			b := row[x*bytesPerPixel:]
+			p[4*x], p[4*x+1], p[4*x+2], p[4*x+3] = b[2], b[1], b[0], 0xFF
+		}
+	}
+	return img, nil
+}
+
+//SetFrameImage replaces uncompressed frame i by img, which must have the dimensions of the video.
+//The unused fourth byte of 32 bit pixels is kept.
+func (v *Video) SetFrameImage(i int, img image.Image) error {
+	if v.mjpeg {
+		return UnsupportedError("replacing Motion JPEG frames by images")
+	}
+	if img.Bounds().Dx() != v.width || img.Bounds().Dy() != v.height {
+		return fmt.Errorf("avi: frame of %dx%d does not match the video of %dx%d", img.Bounds().Dx(), img.Bounds().Dy(), v.width, v.height)
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Bounds().Min != (image.Point{}) {
+		rgba = image.NewRGBA(v.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+
+	bytesPerPixel, stride := v.bitCount/8, v.rowLen()
+	data := make([]byte, max(stride*v.height, len(v.frames[i].data)))
+	copy(data, v.frames[i].data)
+	for y := 0; y < v.height; y++ {
+		row := data[v.row(y)*stride:]
+		p := rgba.Pix[y*rgba.Stride:]
+		for x := 0; x < v.width; x++ {
+			b := row[x*bytesPerPixel:]
+			b[0], b[1], b[2] = p[4*x+2], p[4*x+1], p[4*x]
+		}
+	}
+	v.frames[i].data = data
+	return nil
+}
+
+//rowLen returns the length of a bitmap row, which is padded to 4 bytes
+func (v *Video) rowLen() int {
+	return (v.width*v.bitCount/8 + 3) &^ 3
+}
+
+//row returns the position of image row y in a bitmap
+func (v *Video) row(y int) int {
+	if v.topDown {
+		return y
+	}
+	return v.height - 1 - y
+}
@@ -0,0 +1,223 @@
+package avi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+const (
+	avifHasIndex   = 0x10
+	aviifKeyframe  = 0x10
+	defaultFPS     = 25
+	indexEntrySize = 16
+)
+
+//Options are the parameters of new videos
+type Options struct {
+	//FrameRate is the number of frames per second, 25 when zero
+	FrameRate int
+	//MJPEG stores the frames as JPEG images instead of uncompressed bitmaps
+	MJPEG bool
+	//Quality of the JPEG frames, jpeg.DefaultQuality when zero
+	Quality int
+}
+
+//Encode writes frames as a new AVI with a single video stream.
+//All frames must have the same dimensions. Options may be nil.
+func Encode(w io.Writer, frames []image.Image, opt *Options) error {
+	if len(frames) == 0 {
+		return errors.New("avi: can not encode a video without frames")
+	}
+	if opt == nil {
+		opt = &Options{}
+	}
+	fps := opt.FrameRate
+	if fps <= 0 {
+		fps = defaultFPS
+	}
+	quality := opt.Quality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+
+	bounds := frames[0].Bounds()
+	v := &Video{width: bounds.Dx(), height: bounds.Dy(), bitCount: 24, mjpeg: opt.MJPEG}
+	if v.width <= 0 || v.height <= 0 {
+		return errors.New("avi: can not encode empty frames")
+	}
+
+	frameID, handler, compression := "00db", "DIB ", []byte{0, 0, 0, 0}
+	if v.mjpeg {
+		frameID, handler, compression = "00dc", "MJPG", []byte("MJPG")
+	}
+
+	v.movi = &chunk{id: "LIST", listType: "movi"}
+	index := make([]byte, indexEntrySize*len(frames))
+	for i, frame := range frames {
+		c := &chunk{id: frameID}
+		v.frames = append(v.frames, c)
+		v.movi.children = append(v.movi.children, c)
+		if frame.Bounds().Dx() != v.width || frame.Bounds().Dy() != v.height {
+			return fmt.Errorf("avi: frame %d does not have the dimensions of the first frame", i)
+		}
+
+		if v.mjpeg {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, frame, &jpeg.Options{Quality: quality}); err != nil {
+				return fmt.Errorf("avi: error encoding frame %d: %v", i, err)
+			}
+			c.data = buf.Bytes()
+		} else if err := v.SetFrameImage(i, frame); err != nil {
+			return err
+		}
+
+		entry := index[i*indexEntrySize:]
+		copy(entry, frameID)
+		binary.LittleEndian.PutUint32(entry[4:], aviifKeyframe)
+		v.index = append(v.index, indexEntry{raw: entry[:indexEntrySize], chunk: c})
+	}
+	v.idx1 = &chunk{id: "idx1", data: index}
+
+	v.avih = &chunk{id: "avih", data: make([]byte, avihLen)}
+	binary.LittleEndian.PutUint32(v.avih.data[0:], uint32(1000000/fps))
+	binary.LittleEndian.PutUint32(v.avih.data[12:], avifHasIndex)
+	binary.LittleEndian.PutUint32(v.avih.data[16:], uint32(len(frames)))
+	binary.LittleEndian.PutUint32(v.avih.data[24:], 1) //streams
+	binary.LittleEndian.PutUint32(v.avih.data[32:], uint32(v.width))
+	binary.LittleEndian.PutUint32(v.avih.data[36:], uint32(v.height))
+
+	v.strh = &chunk{id: "strh", data: make([]byte, strhLen)}
+	copy(v.strh.data[0:], "vids")
+	copy(v.strh.data[4:], handler)
+	binary.LittleEndian.PutUint32(v.strh.data[20:], 1) //scale
+	binary.LittleEndian.PutUint32(v.strh.data[24:], uint32(fps))
+	binary.LittleEndian.PutUint32(v.strh.data[32:], uint32(len(frames)))
+	binary.LittleEndian.PutUint32(v.strh.data[40:], 0xFFFFFFFF) //default quality
+	binary.LittleEndian.PutUint16(v.strh.data[52:], uint16(v.width))
+	binary.LittleEndian.PutUint16(v.strh.data[54:], uint16(v.height))
+
+	strf := &chunk{id: "strf", data: make([]byte, bihLen)}
+	binary.LittleEndian.PutUint32(strf.data[0:], bihLen)
+	binary.LittleEndian.PutUint32(strf.data[4:], uint32(v.width))
+	binary.LittleEndian.PutUint32(strf.data[8:], uint32(v.height)) //bottom-up
+	binary.LittleEndian.PutUint16(strf.data[12:], 1)               //planes
+	binary.LittleEndian.PutUint16(strf.data[14:], uint16(v.bitCount))
+	copy(strf.data[16:], compression)
+	if !v.mjpeg {
+		binary.LittleEndian.PutUint32(strf.data[20:], uint32(v.rowLen()*v.height))
+	}
+
+	v.root = &chunk{id: "RIFF", listType: "AVI ", children: []*chunk{
+		{id: "LIST", listType: "hdrl", children: []*chunk{
+			v.avih,
+			{id: "LIST", listType: "strl", children: []*chunk{v.strh, strf}},
+		}},
+		v.movi,
+		v.idx1,
+	}}
+
+	largest := v.updateBufferSizes()
+	binary.LittleEndian.PutUint32(v.avih.data[4:], uint32(largest*fps)) //max bytes per second
+	return v.Write(w)
+}
+
+//Write writes the video. Chunk sizes, idx1 entries and suggested buffer sizes are updated
+//to the current frames, everything else is written as it was read.
+func (v *Video) Write(w io.Writer) error {
+	v.updateBufferSizes()
+	layout(v.root, 0)
+	v.updateIndex()
+
+	bw := bufio.NewWriter(w)
+	if err := writeChunk(bw, v.root); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+//layout assigns c and its descendants the offsets they are written at
+func layout(c *chunk, offset int) {
+	c.offset = offset
+	offset += 12 //header and list type
+	for _, ch := range c.children {
+		layout(ch, offset)
+		n := bodySize(ch)
+		offset += 8 + n + n%2
+	}
+}
+
+//bodySize returns the size of a chunk without its header and padding
+func bodySize(c *chunk) int {
+	if !c.isList() {
+		return len(c.data)
+	}
+	size := 4
+	for _, ch := range c.children {
+		n := bodySize(ch)
+		size += 8 + n + n%2
+	}
+	return size
+}
+
+func writeChunk(w io.Writer, c *chunk) error {
+	size := bodySize(c)
+	header := make([]byte, 8, 12)
+	copy(header, c.id)
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	if c.isList() {
+		header = append(header, c.listType...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(c.data); err != nil {
+		return err
+	}
+	for _, ch := range c.children {
+		if err := writeChunk(w, ch); err != nil {
+			return err
+		}
+	}
+	if size%2 == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+//updateIndex points the idx1 entries to where their chunks are written, after layout
+func (v *Video) updateIndex() {
+	moviStart := v.movi.offset + 8
+	for _, e := range v.index {
+		if e.chunk == nil {
+			continue
+		}
+		offset := e.chunk.offset
+		if !v.absolute {
+			offset -= moviStart
+		}
+		binary.LittleEndian.PutUint32(e.raw[8:], uint32(offset))
+		binary.LittleEndian.PutUint32(e.raw[12:], uint32(bodySize(e.chunk)))
+	}
+}
+
+//updateBufferSizes raises the suggested buffer sizes when a frame no longer fits and returns the largest frame size
+func (v *Video) updateBufferSizes() int {
+	largest := 0
+	for _, f := range v.frames {
+		largest = max(largest, len(f.data))
+	}
+	for _, field := range [][]byte{v.avih.data[avihBufferSize:], v.strh.data[strhBufferSize:]} {
+		if binary.LittleEndian.Uint32(field) < uint32(largest) {
+			binary.LittleEndian.PutUint32(field, uint32(largest))
+		}
+	}
+	return largest
+}
@@ -0,0 +1,181 @@
+package bmp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/DimitarPetrov/stegify/formats/bmp"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeDecodeOpaque(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 13, 7)) //rows need padding
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 13; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 19), G: uint8(y * 31), B: uint8(x * y), A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if bpp := binary.LittleEndian.Uint16(buf.Bytes()[28:]); bpp != 24 {
+		t.Errorf("Expected 24 bits per pixel, got %d", bpp)
+	}
+
+	decoded, err := bmp.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	rgba, ok := decoded.(*image.RGBA)
+	if !ok {
+		t.Fatalf("Expected *image.RGBA, got %T", decoded)
+	}
+	if !bytes.Equal(rgba.Pix, img.Pix) {
+		t.Error("Decoded pixels differ")
+	}
+}
+
+func TestEncodeDecodeAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 5; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 50), G: uint8(y * 60), B: 7, A: uint8(x*40 + y)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil || format != "bmp" || config.ColorModel != color.NRGBAModel {
+		t.Fatalf("Unexpected config %v, format %s, error %v", config, format, err)
+	}
+
+	decoded, err := bmp.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	nrgba, ok := decoded.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("Expected *image.NRGBA, got %T", decoded)
+	}
+	if !bytes.Equal(nrgba.Pix, img.Pix) {
+		t.Error("Decoded pixels differ")
+	}
+}
+
+func TestDecodeTopDown(t *testing.T) {
+	//a 2x2 24 bit top-down image written by hand
+	file := make([]byte, 14+40)
+	copy(file, "BM")
+	binary.LittleEndian.PutUint32(file[10:], 54)
+	binary.LittleEndian.PutUint32(file[14:], 40)
+	binary.LittleEndian.PutUint32(file[18:], 2)
+	binary.LittleEndian.PutUint32(file[22:], uint32(0x100000000-2)) //negative height
+	binary.LittleEndian.PutUint16(file[26:], 1)
+	binary.LittleEndian.PutUint16(file[28:], 24)
+	file = append(file,
+		0, 0, 255, 0, 255, 0, 0, 0, //red, green and padding
+		255, 0, 0, 255, 255, 255, 0, 0, //blue, white and padding
+	)
+
+	img, err := bmp.Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	expected := map[image.Point]color.RGBA{
+		{0, 0}: {R: 255, A: 255},
+		{1, 0}: {G: 255, A: 255},
+		{0, 1}: {B: 255, A: 255},
+		{1, 1}: {R: 255, G: 255, B: 255, A: 255},
+	}
+	for p, c := range expected {
+		if got := img.(*image.RGBA).RGBAAt(p.X, p.Y); got != c {
+			t.Errorf("Pixel %v: expected %v, got %v", p, c, got)
+		}
+	}
+}
+
+func TestDecodeV3BitFieldsHeader(t *testing.T) {
+	//a 2x1 32 bit image with a 56 byte info header holding all four channel masks
+	file := make([]byte, 14+56)
+	copy(file, "BM")
+	binary.LittleEndian.PutUint32(file[10:], 70)
+	binary.LittleEndian.PutUint32(file[14:], 56)
+	binary.LittleEndian.PutUint32(file[18:], 2)
+	binary.LittleEndian.PutUint32(file[22:], 1)
+	binary.LittleEndian.PutUint16(file[26:], 1)
+	binary.LittleEndian.PutUint16(file[28:], 32)
+	binary.LittleEndian.PutUint32(file[30:], 3) //BI_BITFIELDS
+	binary.LittleEndian.PutUint32(file[54:], 0x00FF0000)
+	binary.LittleEndian.PutUint32(file[58:], 0x0000FF00)
+	binary.LittleEndian.PutUint32(file[62:], 0x000000FF)
+	binary.LittleEndian.PutUint32(file[66:], 0xFF000000)
+	file = append(file,
+		10, 20, 30, 40, //blue, green, red and alpha
+		50, 60, 70, 255,
+	)
+
+	img, err := bmp.Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("Expected *image.NRGBA, got %T", img)
+	}
+	expected := []color.NRGBA{{R: 30, G: 20, B: 10, A: 40}, {R: 70, G: 60, B: 50, A: 255}}
+	for x, c := range expected {
+		if got := nrgba.NRGBAAt(x, 0); got != c {
+			t.Errorf("Pixel %d: expected %v, got %v", x, c, got)
+		}
+	}
+}
+
+func TestDecodeShouldRejectUnsupportedDepth(t *testing.T) {
+	file := make([]byte, 14+40)
+	copy(file, "BM")
+	binary.LittleEndian.PutUint32(file[10:], 54)
+	binary.LittleEndian.PutUint32(file[14:], 40)
+	binary.LittleEndian.PutUint32(file[18:], 2)
+	binary.LittleEndian.PutUint32(file[22:], 2)
+	binary.LittleEndian.PutUint16(file[26:], 1)
+	binary.LittleEndian.PutUint16(file[28:], 8)
+
+	_, err := bmp.Decode(bytes.NewReader(file))
+	if _, ok := err.(bmp.UnsupportedError); !ok {
+		t.Errorf("Expected UnsupportedError, got %v", err)
+	}
+}
+
+func TestDecodeShouldRejectOversizedImages(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint32
+	}{
+		{"overflowing dimensions", 0x7FFFFFFF, 0x7FFFFFFF},
+		{"negated minimum height", 1, 0x80000000},
+		{"dimensions above the limit", 100000, 100000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := make([]byte, 14+40)
+			copy(file, "BM")
+			binary.LittleEndian.PutUint32(file[10:], 54)
+			binary.LittleEndian.PutUint32(file[14:], 40)
+			binary.LittleEndian.PutUint32(file[18:], test.width)
+			binary.LittleEndian.PutUint32(file[22:], test.height)
+			binary.LittleEndian.PutUint16(file[26:], 1)
+			binary.LittleEndian.PutUint16(file[28:], 24)
+
+			_, err := bmp.Decode(bytes.NewReader(file))
+			if _, ok := err.(bmp.FormatError); !ok {
+				t.Errorf("Expected FormatError, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+//Package bmp implements a decoder and encoder of uncompressed 24 and 32 bit BMP images.
+//
+//Importing the package registers the decoder with the image package and the encoder with the formats package.
+package bmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+
+	"github.com/DimitarPetrov/stegify/formats"
+)
+
+const (
+	fileHeaderLen   = 14
+	infoHeaderLen   = 40
+	v2InfoHeaderLen = 52 //adds the red, green and blue masks
+	v3InfoHeaderLen = 56 //adds the alpha mask
+	v4InfoHeaderLen = 108
+	v5InfoHeaderLen = 124
+
+	biRGB       = 0
+	biBitFields = 3
+)
+
+//Standard channel masks of 32 bit images with alpha
+const (
+	redMask   = 0x00FF0000
+	greenMask = 0x0000FF00
+	blueMask  = 0x000000FF
+	alphaMask = 0xFF000000
+)
+
+func init() {
+	image.RegisterFormat(formats.BMP, "BM????\x00\x00\x00\x00", Decode, DecodeConfig)
+	formats.Register(formats.BMP, Encode)
+}
+
+//FormatError reports that the input is not a valid BMP
+type FormatError string
+
+func (e FormatError) Error() string { return "bmp: invalid format: " + string(e) }
+
+//UnsupportedError reports that the input uses a valid but unimplemented BMP feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "bmp: unsupported feature: " + string(e) }
+
+type header struct {
+	width, height int
+	topDown       bool
+	bitsPerPixel  int
+	alpha         bool //32 bit pixels carry alpha in their fourth byte
+}
+
+//readHeader reads the file and info headers and discards everything up to the pixel data
+func readHeader(r io.Reader) (header, error) {
+	b := make([]byte, fileHeaderLen+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return header{}, fmt.Errorf("bmp: error reading header: %v", err)
+	}
+	if string(b[:2]) != "BM" {
+		return header{}, FormatError("missing BM signature")
+	}
+	pixelOffset := int64(binary.LittleEndian.Uint32(b[10:]))
+	infoLen := int64(binary.LittleEndian.Uint32(b[14:]))
+	if infoLen < infoHeaderLen || infoLen > v5InfoHeaderLen {
+		return header{}, UnsupportedError(fmt.Sprintf("info header of %d bytes", infoLen))
+	}
+	if infoLen > pixelOffset {
+		return header{}, FormatError("pixel data overlaps the header")
+	}
+
+	info := make([]byte, infoLen-4)
+	if _, err := io.ReadFull(r, info); err != nil {
+		return header{}, fmt.Errorf("bmp: error reading header: %v", err)
+	}
+	read := fileHeaderLen + infoLen
+
+	h := header{
+		width:        int(int32(binary.LittleEndian.Uint32(info[0:]))),
+		height:       int(int32(binary.LittleEndian.Uint32(info[4:]))),
+		bitsPerPixel: int(binary.LittleEndian.Uint16(info[10:])),
+	}
+	if planes := binary.LittleEndian.Uint16(info[8:]); planes != 1 {
+		return header{}, FormatError(fmt.Sprintf("%d planes", planes))
+	}
+	if h.height < 0 {
+		h.height, h.topDown = -h.height, true
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return header{}, FormatError(fmt.Sprintf("dimensions %dx%d", h.width, h.height))
+	}
+	if !formats.FitsDecodeLimit(h.width, h.height, 4) { //decoded pixels take 4 bytes
+		return header{}, FormatError(fmt.Sprintf("dimensions %dx%d exceed the size limit", h.width, h.height))
+	}
+
+	compression := binary.LittleEndian.Uint32(info[12:])
+	switch {
+	case h.bitsPerPixel == 24 && compression == biRGB:
+	case h.bitsPerPixel == 32 && compression == biRGB: //the fourth byte is unused
+	case h.bitsPerPixel == 32 && compression == biBitFields:
+		var masks []byte
+		switch {
+		case infoLen >= v3InfoHeaderLen:
+			masks = info[36:52]
+		case infoLen >= v2InfoHeaderLen:
+			masks = info[36:48]
+		case infoLen == infoHeaderLen: //the masks follow the info header
+			masks = make([]byte, 12)
+			if _, err := io.ReadFull(r, masks); err != nil {
+				return header{}, fmt.Errorf("bmp: error reading channel masks: %v", err)
+			}
+			read += 12
+		default:
+			return header{}, UnsupportedError(fmt.Sprintf("channel masks with info header of %d bytes", infoLen))
+		}
+		if binary.LittleEndian.Uint32(masks[0:]) != redMask ||
+			binary.LittleEndian.Uint32(masks[4:]) != greenMask ||
+			binary.LittleEndian.Uint32(masks[8:]) != blueMask {
+			return header{}, UnsupportedError("non-standard channel masks")
+		}
+		h.alpha = len(masks) == 16 && binary.LittleEndian.Uint32(masks[12:]) == alphaMask
+	default:
+		return header{}, UnsupportedError(fmt.Sprintf("%d bits per pixel with compression %d", h.bitsPerPixel, compression))
+	}
+
+	if pixelOffset < read {
+		return header{}, FormatError("pixel data overlaps the header")
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, pixelOffset-read); err != nil {
+		return header{}, fmt.Errorf("bmp: error reading header: %v", err)
+	}
+	return h, nil
+}
+
+//DecodeConfig returns the color model and dimensions of a BMP image without decoding the entire image
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.RGBAModel
+	if h.alpha {
+		model = color.NRGBAModel
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+//Decode reads a BMP image from r and returns it as an image.Image.
+//Opaque images are returned as *image.RGBA and images with alpha as *image.NRGBA.
+func Decode(r io.Reader) (image.Image, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, h.width, h.height)
+	var pix []byte
+	var stride int
+	var img image.Image
+	if h.alpha {
+		m := image.NewNRGBA(bounds)
+		pix, stride, img = m.Pix, m.Stride, m
+	} else {
+		m := image.NewRGBA(bounds)
+		pix, stride, img = m.Pix, m.Stride, m
+	}
+
+	bytesPerPixel := h.bitsPerPixel / 8
+	row := make([]byte, (h.width*bytesPerPixel+3)&^3) //rows are padded to 4 bytes
+	for i := 0; i < h.height; i++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("bmp: error reading pixel data: %v", err)
+		}
+		y := h.height - 1 - i
+		if h.topDown {
+			y = i
+		}
+		p := pix[y*stride:]
+		for x := 0; x < h.width; x++ {
+			b := row[x*bytesPerPixel:]
+			p[4*x], p[4*x+1], p[4*x+2], p[4*x+3] = b[2], b[1], b[0], 0xFF
+			if h.alpha {
+				p[4*x+3] = b[3]
+			}
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,98 @@
+package bmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+//pixelsPerMeter is the resolution written to the header, 72 DPI
+const pixelsPerMeter = 2835
+
+var errEmptyImage = errors.New("bmp: can not encode an empty image")
+
+//Encode writes img to w in BMP format.
+//Opaque images are written with 24 bits per pixel, images with transparency
+//with 32 bits per pixel and a V4 header describing the alpha channel.
+//Rows are written bottom-up as most readers expect.
+func Encode(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return errEmptyImage
+	}
+
+	alpha := !isOpaque(img)
+	bytesPerPixel, infoLen, compression := 3, infoHeaderLen, uint32(biRGB)
+	if alpha {
+		bytesPerPixel, infoLen, compression = 4, v4InfoHeaderLen, biBitFields
+	}
+	rowLen := (width*bytesPerPixel + 3) &^ 3
+	pixelOffset := fileHeaderLen + infoLen
+
+	h := make([]byte, pixelOffset)
+	copy(h, "BM")
+	binary.LittleEndian.PutUint32(h[2:], uint32(pixelOffset+rowLen*height))
+	binary.LittleEndian.PutUint32(h[10:], uint32(pixelOffset))
+	info := h[fileHeaderLen:]
+	binary.LittleEndian.PutUint32(info[0:], uint32(infoLen))
+	binary.LittleEndian.PutUint32(info[4:], uint32(width))
+	binary.LittleEndian.PutUint32(info[8:], uint32(height))
+	binary.LittleEndian.PutUint16(info[12:], 1)
+	binary.LittleEndian.PutUint16(info[14:], uint16(bytesPerPixel*8))
+	binary.LittleEndian.PutUint32(info[16:], compression)
+	binary.LittleEndian.PutUint32(info[20:], uint32(rowLen*height))
+	binary.LittleEndian.PutUint32(info[24:], pixelsPerMeter)
+	binary.LittleEndian.PutUint32(info[28:], pixelsPerMeter)
+	if alpha {
+		binary.LittleEndian.PutUint32(info[40:], redMask)
+		binary.LittleEndian.PutUint32(info[44:], greenMask)
+		binary.LittleEndian.PutUint32(info[48:], blueMask)
+		binary.LittleEndian.PutUint32(info[52:], alphaMask)
+		copy(info[56:], "BGRs") //LCS_sRGB colour space
+	}
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+
+	row := make([]byte, rowLen)
+	for y := bounds.Max.Y - 1; y >= bounds.Min.Y; y-- {
+		for x := 0; x < width; x++ {
+			c := nrgbaAt(img, bounds.Min.X+x, y)
+			p := row[x*bytesPerPixel:]
+			p[0], p[1], p[2] = c.B, c.G, c.R
+			if alpha {
+				p[3] = c.A
+			}
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//nrgbaAt returns the non-premultiplied colour of a pixel, exact for *image.NRGBA
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	if m, ok := img.(*image.NRGBA); ok {
+		return m.NRGBAAt(x, y)
+	}
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xFFFF {
+				return false
+			}
+		}
+	}
+	return true
+}
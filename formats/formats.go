@@ -0,0 +1,121 @@
+//Package formats provides selection and encoding of the image formats results are written in.
+package formats
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+)
+
+//Names of the image formats as reported by image.Decode
+const (
+	PNG  = "png"
+	JPEG = "jpeg"
+	GIF  = "gif"
+	BMP  = "bmp"
+	TIFF = "tiff"
+	WebP = "webp"
+)
+
+//ErrUnsupportedFormat is matched by the errors of carriers and results in formats that can not be used
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+//MaxDecodedBytes limits the pixel data the decoders of this module allocate for an image, so a header can not claim more memory than any real carrier needs
+const MaxDecodedBytes = 1 << 30
+
+//FitsDecodeLimit reports whether an image of width x height pixels of bytesPerPixel bytes stays within MaxDecodedBytes, without overflowing
+func FitsDecodeLimit(width, height, bytesPerPixel int) bool {
+	return width > 0 && height > 0 && bytesPerPixel > 0 && width <= MaxDecodedBytes/bytesPerPixel/height
+}
+
+//Encoder writes an image in a specific format
+type Encoder func(w io.Writer, img image.Image) error
+
+var encoders = map[string]Encoder{
+	PNG: png.Encode,
+}
+
+//deepFormats keep 16 bits per sample
+var deepFormats = map[string]bool{
+	PNG: true,
+}
+
+//lossyFormats can not store modified pixels exactly (GIF because of palette quantization)
+var lossyFormats = map[string]bool{
+	JPEG: true,
+	GIF:  true,
+	WebP: true,
+}
+
+var aliases = map[string]string{
+	"jpg": JPEG,
+	"tif": TIFF,
+}
+
+//Register makes an encoder available for the given format name
+func Register(format string, encoder Encoder) {
+	encoders[format] = encoder
+}
+
+//RegisterDeep is Register for encoders that keep 16 bits per sample
+func RegisterDeep(format string, encoder Encoder) {
+	Register(format, encoder)
+	deepFormats[format] = true
+}
+
+//IsDeep reports whether results written in the format keep 16 bits per sample
+func IsDeep(format string) bool {
+	return deepFormats[Normalize(format)]
+}
+
+//Normalize returns the canonical name of a user supplied format name, e.g. "JPG" becomes "jpeg"
+func Normalize(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(format), "."))
+	if canonical, ok := aliases[format]; ok {
+		return canonical
+	}
+	return format
+}
+
+//IsLossy reports whether writing an image in the format would destroy data hidden in its pixels
+func IsLossy(format string) bool {
+	return lossyFormats[Normalize(format)]
+}
+
+//Resolve returns the format a result should be written in.
+//If requested is empty the carrier format is kept when it is lossless, otherwise PNG is used.
+//An explicitly requested lossy format is rejected because the hidden data would not survive it.
+func Resolve(carrierFormat, requested string) (string, error) {
+	carrierFormat = Normalize(carrierFormat)
+	if _, ok := encoders[carrierFormat]; !ok && !lossyFormats[carrierFormat] {
+		return "", fmt.Errorf("%w: carrier format %q", ErrUnsupportedFormat, carrierFormat)
+	}
+
+	if requested == "" {
+		if _, ok := encoders[carrierFormat]; ok {
+			return carrierFormat, nil
+		}
+		return PNG, nil
+	}
+
+	requested = Normalize(requested)
+	if lossyFormats[requested] {
+		return "", fmt.Errorf("%w: output format %s is lossy and would destroy the hidden data, use a lossless format such as png", ErrUnsupportedFormat, requested)
+	}
+	if _, ok := encoders[requested]; !ok {
+		return "", fmt.Errorf("%w: output format %q", ErrUnsupportedFormat, requested)
+	}
+	return requested, nil
+}
+
+//Encode writes img to w in the given format
+func Encode(w io.Writer, img image.Image, format string) error {
+	encoder, ok := encoders[Normalize(format)]
+	if !ok {
+		return fmt.Errorf("%w: output format %q", ErrUnsupportedFormat, format)
+	}
+	return encoder(w, img)
+}
@@ -0,0 +1,46 @@
+package formats_test
+
+import (
+	"github.com/DimitarPetrov/stegify/formats"
+	_ "github.com/DimitarPetrov/stegify/formats/bmp"
+	_ "github.com/DimitarPetrov/stegify/formats/tiff"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name          string
+		carrierFormat string
+		requested     string
+		expected      string
+		shouldFail    bool
+	}{
+		{name: "Lossless carrier keeps its format", carrierFormat: "png", expected: "png"},
+		{name: "Lossy carrier falls back to png", carrierFormat: "jpeg", expected: "png"},
+		{name: "Explicit format wins", carrierFormat: "jpeg", requested: "PNG", expected: "png"},
+		{name: "Bmp carrier keeps its format", carrierFormat: "bmp", expected: "bmp"},
+		{name: "Tiff alias is accepted", carrierFormat: "png", requested: "tif", expected: "tiff"},
+		{name: "Explicit lossy format should fail", carrierFormat: "png", requested: "jpg", shouldFail: true},
+		{name: "Unknown output format should fail", carrierFormat: "png", requested: "xyz", shouldFail: true},
+		{name: "Unknown carrier format should fail", carrierFormat: "xyz", shouldFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, err := formats.Resolve(test.carrierFormat, test.requested)
+			if test.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected error, got format %s", format)
+				}
+				t.Log(err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if format != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, format)
+			}
+		})
+	}
+}
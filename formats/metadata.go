@@ -0,0 +1,307 @@
+package formats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+//PNGChunk is an ancillary chunk carried over from a carrier to a PNG result
+type PNGChunk struct {
+	Type string
+	Data []byte
+	//AfterImageData is set when the chunk followed the image data in the carrier
+	AfterImageData bool
+}
+
+//preservedChunks are the ancillary chunks that do not depend on how the pixels are encoded.
+//Chunks such as tRNS, bKGD or sBIT describe the encoded samples and are left to the encoder.
+var preservedChunks = map[string]bool{
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+	"tIME": true,
+	"iCCP": true,
+	"sRGB": true,
+	"gAMA": true,
+	"cHRM": true,
+	"pHYs": true,
+	"eXIf": true,
+}
+
+//trailingChunks are the preserved chunks which are allowed to follow the image data
+var trailingChunks = map[string]bool{
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+	"tIME": true,
+}
+
+//ReadMetadata returns the chunks of an encoded carrier that are carried over to PNG results.
+//PNG carriers keep their ancillary chunks. The EXIF data and ICC profile of JPEG carriers
+//are translated to eXIf and iCCP chunks only when translateJPEG is set.
+func ReadMetadata(carrier []byte, carrierFormat string, translateJPEG bool) ([]PNGChunk, error) {
+	switch Normalize(carrierFormat) {
+	case PNG:
+		return ReadPNGChunks(bytes.NewReader(carrier))
+	case JPEG:
+		if translateJPEG {
+			return ReadJPEGMetadata(bytes.NewReader(carrier))
+		}
+	}
+	return nil, nil
+}
+
+//EncodeWithMetadata is Encode which also writes the given chunks when the format is PNG
+func EncodeWithMetadata(w io.Writer, img image.Image, format string, chunks []PNGChunk) error {
+	if Normalize(format) != PNG || len(chunks) == 0 {
+		return Encode(w, img, format)
+	}
+
+	var encoded bytes.Buffer
+	if err := Encode(&encoded, img, format); err != nil {
+		return err
+	}
+	result, err := InsertPNGChunks(encoded.Bytes(), chunks)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(result)
+	return err
+}
+
+//ReadPNGChunks returns the chunks of a PNG stream that are preserved when it is re-encoded
+func ReadPNGChunks(r io.Reader) ([]PNGChunk, error) {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return nil, fmt.Errorf("error reading png signature: %v", err)
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, fmt.Errorf("invalid png signature")
+	}
+
+	var chunks []PNGChunk
+	afterImageData := false
+	for {
+		chunkType, data, err := readPNGChunk(r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case chunkType == "IEND":
+			return chunks, nil
+		case chunkType == "IDAT":
+			afterImageData = true
+		case preservedChunks[chunkType]:
+			chunks = append(chunks, PNGChunk{Type: chunkType, Data: data, AfterImageData: afterImageData})
+		}
+	}
+}
+
+func readPNGChunk(r io.Reader) (string, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, fmt.Errorf("error reading png chunk: %v", err)
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	chunkType := string(header[4:])
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil || int64(len(data)) != length {
+		return "", nil, fmt.Errorf("error reading png chunk %s: unexpected end of data", chunkType)
+	}
+
+	crc := make([]byte, 4)
+	if _, err := io.ReadFull(r, crc); err != nil {
+		return "", nil, fmt.Errorf("error reading png chunk %s: %v", chunkType, err)
+	}
+	if binary.BigEndian.Uint32(crc) != chunkCRC(chunkType, data) {
+		return "", nil, fmt.Errorf("invalid checksum of png chunk %s", chunkType)
+	}
+	return chunkType, data, nil
+}
+
+//WritePNGChunk writes a chunk with its length and checksum
+func WritePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	if len(chunkType) != 4 {
+		return fmt.Errorf("invalid png chunk type %q", chunkType)
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, chunkCRC(chunkType, data))
+
+	for _, b := range [][]byte{header, data, crc} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func chunkCRC(chunkType string, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+//InsertPNGChunks adds chunks to an encoded PNG stream.
+//Chunks are written right after the IHDR chunk, except trailing text and time chunks
+//which are written before IEND as they were in the carrier.
+func InsertPNGChunks(encoded []byte, chunks []PNGChunk) ([]byte, error) {
+	if !bytes.HasPrefix(encoded, pngSignature) {
+		return nil, fmt.Errorf("invalid png signature")
+	}
+
+	var result bytes.Buffer
+	result.Write(pngSignature)
+	for offset := len(pngSignature); offset < len(encoded); {
+		if len(encoded)-offset < 12 {
+			return nil, fmt.Errorf("truncated png chunk at offset %d", offset)
+		}
+		length := int(binary.BigEndian.Uint32(encoded[offset:]))
+		chunkType := string(encoded[offset+4 : offset+8])
+		end := offset + 12 + length
+		if length < 0 || end > len(encoded) {
+			return nil, fmt.Errorf("truncated png chunk %s", chunkType)
+		}
+
+		if chunkType == "IEND" {
+			if err := writePNGChunks(&result, chunks, true); err != nil {
+				return nil, err
+			}
+		}
+		result.Write(encoded[offset:end])
+		if chunkType == "IHDR" {
+			if err := writePNGChunks(&result, chunks, false); err != nil {
+				return nil, err
+			}
+		}
+		offset = end
+	}
+	return result.Bytes(), nil
+}
+
+func writePNGChunks(w io.Writer, chunks []PNGChunk, trailing bool) error {
+	for _, chunk := range chunks {
+		if (chunk.AfterImageData && trailingChunks[chunk.Type]) != trailing {
+			continue
+		}
+		if err := WritePNGChunk(w, chunk.Type, chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ReadJPEGMetadata translates the EXIF data and ICC profile of a JPEG stream into eXIf and iCCP chunks
+func ReadJPEGMetadata(r io.Reader) ([]PNGChunk, error) {
+	reader := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(reader, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, fmt.Errorf("invalid jpeg start of image marker")
+	}
+
+	var exif []byte
+	iccParts := make(map[byte][]byte)
+	var iccCount byte
+	for {
+		marker, err := nextJPEGMarker(reader)
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xDA || marker == 0xD9 { // metadata precedes the scan
+			break
+		}
+		if marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 { // markers without a segment
+			continue
+		}
+
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return nil, fmt.Errorf("error reading jpeg segment: %v", err)
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes)) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid jpeg segment length")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return nil, fmt.Errorf("error reading jpeg segment: %v", err)
+		}
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			exif = segment[6:]
+		case marker == 0xE2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) && len(segment) >= 14:
+			iccParts[segment[12]] = segment[14:]
+			iccCount = segment[13]
+		}
+	}
+
+	var chunks []PNGChunk
+	if profile := joinICCParts(iccParts, iccCount); profile != nil {
+		var data bytes.Buffer
+		data.WriteString("ICC Profile\x00\x00") // profile name and compression method
+		compressor := zlib.NewWriter(&data)
+		if _, err := compressor.Write(profile); err != nil {
+			return nil, err
+		}
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, PNGChunk{Type: "iCCP", Data: data.Bytes()})
+	}
+	if exif != nil {
+		chunks = append(chunks, PNGChunk{Type: "eXIf", Data: exif})
+	}
+	return chunks, nil
+}
+
+func nextJPEGMarker(reader *bufio.Reader) (byte, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("error reading jpeg marker: %v", err)
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("invalid jpeg marker")
+	}
+	for b == 0xFF { // markers may be preceded by fill bytes
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, fmt.Errorf("error reading jpeg marker: %v", err)
+		}
+	}
+	return b, nil
+}
+
+//joinICCParts concatenates an ICC profile split over APP2 segments, nil when parts are missing
+func joinICCParts(parts map[byte][]byte, count byte) []byte {
+	if len(parts) == 0 || len(parts) != int(count) {
+		return nil
+	}
+	sequence := make([]int, 0, len(parts))
+	for i := range parts {
+		sequence = append(sequence, int(i))
+	}
+	sort.Ints(sequence)
+
+	var profile []byte
+	for i, n := range sequence {
+		if n != i+1 { // sequence numbers start at 1
+			return nil
+		}
+		profile = append(profile, parts[byte(n)]...)
+	}
+	return profile
+}
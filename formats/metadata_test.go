@@ -0,0 +1,126 @@
+package formats_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/DimitarPetrov/stegify/formats"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func encodeTestPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 31)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPNGChunksRoundTrip(t *testing.T) {
+	chunks := []formats.PNGChunk{
+		{Type: "gAMA", Data: []byte{0, 0, 0xB1, 0x8F}},
+		{Type: "pHYs", Data: []byte{0, 0, 0x0B, 0x13, 0, 0, 0x0B, 0x13, 1}},
+		{Type: "tEXt", Data: []byte("Software\x00stegify")},
+		{Type: "tIME", Data: []byte{0x07, 0xE9, 1, 2, 3, 4, 5}, AfterImageData: true},
+	}
+
+	withChunks, err := formats.InsertPNGChunks(encodeTestPNG(t), chunks)
+	if err != nil {
+		t.Fatalf("Error inserting chunks: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(withChunks)); err != nil {
+		t.Fatalf("Result is not a valid png: %v", err)
+	}
+
+	read, err := formats.ReadPNGChunks(bytes.NewReader(withChunks))
+	if err != nil {
+		t.Fatalf("Error reading chunks: %v", err)
+	}
+	if len(read) != len(chunks) {
+		t.Fatalf("Expected %d chunks, got %d", len(chunks), len(read))
+	}
+	for i := range chunks {
+		if read[i].Type != chunks[i].Type || !bytes.Equal(read[i].Data, chunks[i].Data) || read[i].AfterImageData != chunks[i].AfterImageData {
+			t.Errorf("Chunk %d differs: expected %v, got %v", i, chunks[i], read[i])
+		}
+	}
+}
+
+func TestReadPNGChunksShouldSkipEncoderChunks(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Transparent, color.White})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding png: %v", err)
+	}
+
+	chunks, err := formats.ReadPNGChunks(&buf)
+	if err != nil {
+		t.Fatalf("Error reading chunks: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no preserved chunks, got %v", chunks)
+	}
+}
+
+func TestReadJPEGMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Error encoding jpeg: %v", err)
+	}
+
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	profile := bytes.Repeat([]byte("icc profile data "), 10)
+	segment := func(marker byte, data []byte) []byte {
+		s := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(s[2:], uint16(len(data)+2))
+		return append(s, data...)
+	}
+
+	carrier := append([]byte{}, encoded.Bytes()[:2]...)
+	carrier = append(carrier, segment(0xE1, append([]byte("Exif\x00\x00"), exif...))...)
+	// the profile is split in two APP2 segments written out of order
+	carrier = append(carrier, segment(0xE2, append([]byte("ICC_PROFILE\x00\x02\x02"), profile[80:]...))...)
+	carrier = append(carrier, segment(0xE2, append([]byte("ICC_PROFILE\x00\x01\x02"), profile[:80]...))...)
+	carrier = append(carrier, encoded.Bytes()[2:]...)
+
+	chunks, err := formats.ReadMetadata(carrier, "jpeg", true)
+	if err != nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+	if len(chunks) != 2 || chunks[0].Type != "iCCP" || chunks[1].Type != "eXIf" {
+		t.Fatalf("Expected iCCP and eXIf chunks, got %v", chunks)
+	}
+	if !bytes.Equal(chunks[1].Data, exif) {
+		t.Error("EXIF data differs")
+	}
+
+	name := []byte("ICC Profile\x00\x00")
+	if !bytes.HasPrefix(chunks[0].Data, name) {
+		t.Fatalf("Invalid iCCP header: %q", chunks[0].Data)
+	}
+	decompressor, err := zlib.NewReader(bytes.NewReader(chunks[0].Data[len(name):]))
+	if err != nil {
+		t.Fatalf("Error decompressing profile: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		t.Fatalf("Error decompressing profile: %v", err)
+	}
+	if !bytes.Equal(decompressed, profile) {
+		t.Error("ICC profile differs")
+	}
+
+	chunks, err = formats.ReadMetadata(carrier, "jpeg", false)
+	if err != nil || len(chunks) != 0 {
+		t.Errorf("Expected no chunks without translation, got %v, %v", chunks, err)
+	}
+}
@@ -0,0 +1,141 @@
+package tiff
+
+import (
+	"fmt"
+)
+
+//TIFF flavour of LZW: codes are packed most significant bit first and the code width
+//grows one code earlier than in GIF, as written by libtiff and every other modern encoder.
+const (
+	lzwClear    = 256
+	lzwEOI      = 257
+	lzwFirst    = 258
+	lzwMinWidth = 9
+	lzwMaxWidth = 12
+	lzwMaxCode  = 1<<lzwMaxWidth - 1
+)
+
+//lzwDecode decompresses a strip, sizeHint is the expected length of the result
+func lzwDecode(src []byte, sizeHint int) ([]byte, error) {
+	out := make([]byte, 0, sizeHint)
+
+	//every table entry is a run of bytes already written to out
+	var start, length [1 << lzwMaxWidth]int
+
+	var acc uint32
+	var bits uint
+	pos := 0
+	width := uint(lzwMinWidth)
+	next := lzwFirst
+	prevStart, prevLen := -1, 0
+
+	for {
+		for bits < width && pos < len(src) {
+			acc = acc<<8 | uint32(src[pos])
+			pos++
+			bits += 8
+		}
+		if bits < width {
+			return out, nil //some encoders omit the end of information code
+		}
+		code := int(acc>>(bits-width)) & (1<<width - 1)
+		bits -= width
+
+		switch code {
+		case lzwClear:
+			width, next, prevStart = lzwMinWidth, lzwFirst, -1
+			continue
+		case lzwEOI:
+			return out, nil
+		}
+
+		curStart := len(out)
+		switch {
+		case code < lzwClear:
+			out = append(out, byte(code))
+		case code >= lzwFirst && code < next:
+			out = append(out, out[start[code]:start[code]+length[code]]...)
+		case code == next && prevStart >= 0: //the entry being defined by this very code
+			out = append(out, out[prevStart:prevStart+prevLen]...)
+			out = append(out, out[prevStart])
+		default:
+			return nil, fmt.Errorf("tiff: invalid lzw code %d", code)
+		}
+
+		//the new entry is the previous run followed by the first byte of this one, which is right behind it in out
+		if prevStart >= 0 && next <= lzwMaxCode {
+			start[next], length[next] = prevStart, prevLen+1
+			next++
+			if next >= 1<<width-1 && width < lzwMaxWidth {
+				width++
+			}
+		}
+		prevStart, prevLen = curStart, len(out)-curStart
+	}
+}
+
+type bitWriter struct {
+	out  []byte
+	acc  uint32
+	bits uint
+}
+
+func (w *bitWriter) write(code int, width uint) {
+	w.acc = w.acc<<width | uint32(code)
+	w.bits += width
+	for w.bits >= 8 {
+		w.out = append(w.out, byte(w.acc>>(w.bits-8)))
+		w.bits -= 8
+	}
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.bits > 0 {
+		w.out = append(w.out, byte(w.acc<<(8-w.bits)))
+		w.bits = 0
+	}
+	return w.out
+}
+
+//lzwEncode compresses a strip
+func lzwEncode(src []byte) []byte {
+	w := &bitWriter{out: make([]byte, 0, len(src)/2)}
+	width := uint(lzwMinWidth)
+	table := make(map[uint32]int)
+	next := lzwFirst
+
+	w.write(lzwClear, width)
+	if len(src) == 0 {
+		w.write(lzwEOI, width)
+		return w.flush()
+	}
+
+	//addEntry accounts for the entry the decoder defines after reading the code just written
+	addEntry := func() {
+		next++
+		if next == lzwMaxCode-1 { //the table is full, start over
+			w.write(lzwClear, width)
+			table = make(map[uint32]int)
+			width, next = lzwMinWidth, lzwFirst
+		} else if next > 1<<width-1 {
+			width++
+		}
+	}
+
+	prefix := int(src[0])
+	for _, b := range src[1:] {
+		key := uint32(prefix)<<8 | uint32(b)
+		if code, ok := table[key]; ok {
+			prefix = code
+			continue
+		}
+		w.write(prefix, width)
+		table[key] = next
+		addEntry()
+		prefix = int(b)
+	}
+	w.write(prefix, width)
+	addEntry()
+	w.write(lzwEOI, width)
+	return w.flush()
+}
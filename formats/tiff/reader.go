@@ -0,0 +1,561 @@
+//Package tiff implements a decoder and encoder of baseline TIFF images.
+//
+//Strips of uncompressed, PackBits, LZW and Deflate compressed data are supported for
+//bilevel, grayscale, palette and RGB(A) images with 8 or 16 bit samples.
+//Importing the package registers the decoder with the image package and the encoder with the formats package.
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+
+	"github.com/DimitarPetrov/stegify/formats"
+)
+
+//Tags used by the decoder and encoder
+const (
+	tImageWidth                = 256
+	tImageLength               = 257
+	tBitsPerSample             = 258
+	tCompression               = 259
+	tPhotometricInterpretation = 262
+	tStripOffsets              = 273
+	tSamplesPerPixel           = 277
+	tRowsPerStrip              = 278
+	tStripByteCounts           = 279
+	tXResolution               = 282
+	tYResolution               = 283
+	tPlanarConfiguration       = 284
+	tResolutionUnit            = 296
+	tPredictor                 = 317
+	tColorMap                  = 320
+	tTileWidth                 = 322
+	tExtraSamples              = 338
+	tSampleFormat              = 339
+)
+
+//Field types
+const (
+	dtByte     = 1
+	dtASCII    = 2
+	dtShort    = 3
+	dtLong     = 4
+	dtRational = 5
+)
+
+var typeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+//Compression schemes
+const (
+	cNone       = 1
+	cLZW        = 5
+	cDeflate    = 8
+	cPackBits   = 32773
+	cDeflateOld = 32946
+)
+
+//Photometric interpretations
+const (
+	pWhiteIsZero = 0
+	pBlackIsZero = 1
+	pRGB         = 2
+	pPaletted    = 3
+)
+
+//Values of the ExtraSamples tag
+const (
+	extraNone            = 0 //unspecified data
+	extraAssociatedAlpha = 1
+	extraUnassociated    = 2
+)
+
+const (
+	prNone       = 1
+	prHorizontal = 2
+)
+
+func init() {
+	image.RegisterFormat(formats.TIFF, "II*\x00", Decode, DecodeConfig)
+	image.RegisterFormat(formats.TIFF, "MM\x00*", Decode, DecodeConfig)
+	formats.RegisterDeep(formats.TIFF, func(w io.Writer, img image.Image) error {
+		return Encode(w, img, &Options{Compression: LZW, Predictor: true})
+	})
+}
+
+//FormatError reports that the input is not a valid TIFF
+type FormatError string
+
+func (e FormatError) Error() string { return "tiff: invalid format: " + string(e) }
+
+//UnsupportedError reports that the input uses a valid but unimplemented TIFF feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "tiff: unsupported feature: " + string(e) }
+
+type decoder struct {
+	data        []byte
+	byteOrder   binary.ByteOrder
+	tags        map[uint16][]uint
+	width       int
+	height      int
+	bits        int //bits per sample, the same for every sample
+	samples     int
+	photometric uint
+	extra       uint //kind of the sample following RGB
+	palette     color.Palette
+}
+
+func newDecoder(r io.Reader) (*decoder, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("tiff: error reading image: %v", err)
+	}
+	if len(data) < 8 {
+		return nil, FormatError("missing header")
+	}
+
+	d := &decoder{data: data, tags: make(map[uint16][]uint)}
+	switch string(data[:4]) {
+	case "II*\x00":
+		d.byteOrder = binary.LittleEndian
+	case "MM\x00*":
+		d.byteOrder = binary.BigEndian
+	default:
+		return nil, FormatError("missing byte order mark")
+	}
+	if err := d.readIFD(int(d.byteOrder.Uint32(data[4:]))); err != nil {
+		return nil, err
+	}
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//readIFD reads the integer fields of the first image file directory, other fields are not needed for decoding
+func (d *decoder) readIFD(offset int) error {
+	if offset < 8 || offset+2 > len(d.data) {
+		return FormatError("image file directory offset out of range")
+	}
+	count := int(d.byteOrder.Uint16(d.data[offset:]))
+	entries := d.data[offset+2:]
+	if len(entries) < 12*count {
+		return FormatError("truncated image file directory")
+	}
+
+	for i := 0; i < count; i++ {
+		entry := entries[12*i : 12*i+12]
+		tag := d.byteOrder.Uint16(entry[0:])
+		dataType := int(d.byteOrder.Uint16(entry[2:]))
+		n := int(d.byteOrder.Uint32(entry[4:]))
+		if dataType != dtByte && dataType != dtShort && dataType != dtLong {
+			continue
+		}
+
+		size := typeSizes[dataType]
+		raw := entry[8:12]
+		if n < 0 || n > len(d.data)/size {
+			return FormatError(fmt.Sprintf("field %d has too many values", tag))
+		}
+		if n*size > 4 {
+			valueOffset := int(d.byteOrder.Uint32(entry[8:]))
+			if valueOffset < 0 || valueOffset+n*size > len(d.data) {
+				return FormatError(fmt.Sprintf("values of field %d out of range", tag))
+			}
+			raw = d.data[valueOffset : valueOffset+n*size]
+		}
+
+		values := make([]uint, n)
+		for j := range values {
+			switch dataType {
+			case dtByte:
+				values[j] = uint(raw[j])
+			case dtShort:
+				values[j] = uint(d.byteOrder.Uint16(raw[2*j:]))
+			case dtLong:
+				values[j] = uint(d.byteOrder.Uint32(raw[4*j:]))
+			}
+		}
+		d.tags[tag] = values
+	}
+	return nil
+}
+
+//first returns the first value of a field or the default when the field is missing
+func (d *decoder) first(tag uint16, def uint) uint {
+	if values := d.tags[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return def
+}
+
+func (d *decoder) validate() error {
+	d.width = int(d.first(tImageWidth, 0))
+	d.height = int(d.first(tImageLength, 0))
+	if d.width <= 0 || d.height <= 0 {
+		return FormatError(fmt.Sprintf("dimensions %dx%d", d.width, d.height))
+	}
+	if _, ok := d.tags[tTileWidth]; ok {
+		return UnsupportedError("tiled images")
+	}
+	if planar := d.first(tPlanarConfiguration, 1); planar != 1 {
+		return UnsupportedError("separate sample planes")
+	}
+	for _, format := range d.tags[tSampleFormat] {
+		if format != 1 {
+			return UnsupportedError("non unsigned integer samples")
+		}
+	}
+
+	d.samples = int(d.first(tSamplesPerPixel, 1))
+	bits := d.tags[tBitsPerSample]
+	if len(bits) == 0 {
+		bits = []uint{1}
+	}
+	d.bits = int(bits[0])
+	for _, b := range bits {
+		if int(b) != d.bits {
+			return UnsupportedError("samples of different size")
+		}
+	}
+
+	d.photometric = d.first(tPhotometricInterpretation, ^uint(0))
+	switch d.photometric {
+	case pWhiteIsZero, pBlackIsZero:
+		if d.samples != 1 || !oneOf(d.bits, 1, 2, 4, 8, 16) {
+			return UnsupportedError(fmt.Sprintf("grayscale with %d samples of %d bits", d.samples, d.bits))
+		}
+	case pPaletted:
+		if d.samples != 1 || !oneOf(d.bits, 1, 2, 4, 8) {
+			return UnsupportedError(fmt.Sprintf("palette with %d samples of %d bits", d.samples, d.bits))
+		}
+		colorMap := d.tags[tColorMap]
+		n := 1 << uint(d.bits)
+		if len(colorMap) != 3*n {
+			return FormatError("color map of wrong size")
+		}
+		d.palette = make(color.Palette, n)
+		for i := range d.palette {
+			d.palette[i] = color.RGBA64{
+				R: uint16(colorMap[i]),
+				G: uint16(colorMap[n+i]),
+				B: uint16(colorMap[2*n+i]),
+				A: 0xFFFF,
+			}
+		}
+	case pRGB:
+		if !oneOf(d.bits, 8, 16) || d.samples != 3 && d.samples != 4 {
+			return UnsupportedError(fmt.Sprintf("RGB with %d samples of %d bits", d.samples, d.bits))
+		}
+		if d.samples == 4 {
+			d.extra = d.first(tExtraSamples, extraNone)
+			if d.extra != extraAssociatedAlpha && d.extra != extraUnassociated {
+				return UnsupportedError("extra sample which is not alpha")
+			}
+		}
+	default:
+		return UnsupportedError(fmt.Sprintf("photometric interpretation %d", d.photometric))
+	}
+
+	if c := d.first(tCompression, cNone); !oneOf(int(c), cNone, cLZW, cDeflate, cPackBits, cDeflateOld) {
+		return UnsupportedError(fmt.Sprintf("compression %d", c))
+	}
+	if p := d.first(tPredictor, prNone); p != prNone && (p != prHorizontal || d.bits < 8) {
+		return UnsupportedError(fmt.Sprintf("predictor %d with %d bit samples", p, d.bits))
+	}
+
+	//both the strips and the image the pixels are converted to are held in memory
+	sampleBytes := (d.bits + 7) / 8
+	pixelBytes := sampleBytes //grayscale and palette images keep a single sample
+	if d.photometric == pRGB {
+		pixelBytes = 4 * sampleBytes
+	}
+	if !formats.FitsDecodeLimit(d.width, d.height, pixelBytes) || !formats.FitsDecodeLimit(d.width, d.height, d.samples*sampleBytes) {
+		return FormatError(fmt.Sprintf("dimensions %dx%d exceed the size limit", d.width, d.height))
+	}
+	return nil
+}
+
+func oneOf(v int, values ...int) bool {
+	for _, value := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *decoder) colorModel() color.Model {
+	switch d.photometric {
+	case pWhiteIsZero, pBlackIsZero:
+		if d.bits == 16 {
+			return color.Gray16Model
+		}
+		return color.GrayModel
+	case pPaletted:
+		return d.palette
+	}
+	switch {
+	case d.bits == 16 && d.extra == extraUnassociated:
+		return color.NRGBA64Model
+	case d.bits == 16:
+		return color.RGBA64Model
+	case d.extra == extraUnassociated:
+		return color.NRGBAModel
+	}
+	return color.RGBAModel
+}
+
+//DecodeConfig returns the color model and dimensions of a TIFF image without decoding the entire image
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: d.colorModel(), Width: d.width, Height: d.height}, nil
+}
+
+//Decode reads the first image of a TIFF file.
+//The returned type depends on the image: *image.Gray, *image.Gray16 and *image.Paletted for grayscale and palette images,
+//*image.RGBA and *image.RGBA64 for opaque and associated alpha, *image.NRGBA and *image.NRGBA64 for unassociated alpha.
+func Decode(r io.Reader) (image.Image, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rowLen := (d.width*d.samples*d.bits + 7) / 8
+	pix, err := d.readStrips(rowLen)
+	if err != nil {
+		return nil, err
+	}
+	if d.first(tPredictor, prNone) == prHorizontal {
+		for y := 0; y < d.height; y++ {
+			d.undoPredictor(pix[y*rowLen : (y+1)*rowLen])
+		}
+	}
+	return d.toImage(pix, rowLen), nil
+}
+
+//readStrips returns the decompressed rows of the image
+func (d *decoder) readStrips(rowLen int) ([]byte, error) {
+	offsets := d.tags[tStripOffsets]
+	counts := d.tags[tStripByteCounts]
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, FormatError("missing or inconsistent strips")
+	}
+	rowsPerStrip := int(d.first(tRowsPerStrip, uint(d.height)))
+	if rowsPerStrip <= 0 || rowsPerStrip > d.height {
+		rowsPerStrip = d.height
+	}
+
+	//the strips must be able to hold the rows before they are allocated
+	strips, available := 0, 0
+	for i := range offsets {
+		if i*rowsPerStrip >= d.height {
+			break
+		}
+		offset, count := int(offsets[i]), int(counts[i])
+		if offset < 0 || count < 0 || offset+count > len(d.data) {
+			return nil, FormatError(fmt.Sprintf("strip %d out of range", i))
+		}
+		strips++
+		if available < rowLen*d.height {
+			available += count * d.maxExpansion()
+		}
+	}
+	if available < rowLen*d.height {
+		return nil, FormatError("strips too short for the dimensions")
+	}
+
+	pix := make([]byte, 0, rowLen*d.height)
+	for i := 0; i < strips; i++ {
+		rows := min(rowsPerStrip, d.height-i*rowsPerStrip)
+		offset, count := int(offsets[i]), int(counts[i])
+		strip, err := d.decompress(d.data[offset:offset+count], rows*rowLen)
+		if err != nil {
+			return nil, err
+		}
+		if len(strip) < rows*rowLen {
+			return nil, FormatError(fmt.Sprintf("strip %d is truncated", i))
+		}
+		pix = append(pix, strip[:rows*rowLen]...)
+	}
+	if len(pix) < rowLen*d.height {
+		return nil, FormatError("missing strips")
+	}
+	return pix, nil
+}
+
+//maxExpansion is the most bytes a byte of a strip decompresses to
+func (d *decoder) maxExpansion() int {
+	switch d.first(tCompression, cNone) {
+	case cLZW: //codes of at least 9 bits for strings of up to 4096 bytes
+		return 4096 * 8 / 9
+	case cDeflate, cDeflateOld:
+		return 1032
+	case cPackBits: //2 bytes for a run of 128
+		return 64
+	}
+	return 1
+}
+
+func (d *decoder) decompress(src []byte, size int) ([]byte, error) {
+	switch d.first(tCompression, cNone) {
+	case cLZW:
+		return lzwDecode(src, size)
+	case cDeflate, cDeflateOld:
+		r, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("tiff: error decompressing strip: %v", err)
+		}
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(size)))
+		if err != nil {
+			return nil, fmt.Errorf("tiff: error decompressing strip: %v", err)
+		}
+		return out, nil
+	case cPackBits:
+		return unpackBits(src, size)
+	}
+	return src, nil
+}
+
+//unpackBits decompresses PackBits run-length encoded data
+func unpackBits(src []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(src) && len(out) < size; {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0: //n+1 literal bytes
+			if i+n+1 > len(src) {
+				return nil, FormatError("truncated PackBits run")
+			}
+			out = append(out, src[i:i+n+1]...)
+			i += n + 1
+		case n != -128: //the next byte repeated 1-n times
+			if i >= len(src) {
+				return nil, FormatError("truncated PackBits run")
+			}
+			for j := 0; j < 1-n; j++ {
+				out = append(out, src[i])
+			}
+			i++
+		}
+	}
+	return out, nil
+}
+
+//undoPredictor reverts horizontal differencing of a row
+func (d *decoder) undoPredictor(row []byte) {
+	if d.bits == 8 {
+		for i := d.samples; i < len(row); i++ {
+			row[i] += row[i-d.samples]
+		}
+		return
+	}
+	for i := 2 * d.samples; i+1 < len(row); i += 2 {
+		v := d.byteOrder.Uint16(row[i:]) + d.byteOrder.Uint16(row[i-2*d.samples:])
+		d.byteOrder.PutUint16(row[i:], v)
+	}
+}
+
+func (d *decoder) toImage(pix []byte, rowLen int) image.Image {
+	bounds := image.Rect(0, 0, d.width, d.height)
+	switch d.photometric {
+	case pWhiteIsZero, pBlackIsZero:
+		invert := d.photometric == pWhiteIsZero
+		if d.bits == 16 {
+			img := image.NewGray16(bounds)
+			for y := 0; y < d.height; y++ {
+				for x := 0; x < d.width; x++ {
+					v := d.byteOrder.Uint16(pix[y*rowLen+2*x:])
+					if invert {
+						v = 0xFFFF - v
+					}
+					img.SetGray16(x, y, color.Gray16{Y: v})
+				}
+			}
+			return img
+		}
+		img := image.NewGray(bounds)
+		max := 1<<uint(d.bits) - 1
+		for y := 0; y < d.height; y++ {
+			for x := 0; x < d.width; x++ {
+				v := d.packedSample(pix[y*rowLen:], x)
+				if invert {
+					v = max - v
+				}
+				img.Pix[y*img.Stride+x] = uint8(v * 0xFF / max)
+			}
+		}
+		return img
+	case pPaletted:
+		img := image.NewPaletted(bounds, d.palette)
+		for y := 0; y < d.height; y++ {
+			for x := 0; x < d.width; x++ {
+				img.Pix[y*img.Stride+x] = uint8(d.packedSample(pix[y*rowLen:], x))
+			}
+		}
+		return img
+	}
+
+	var img image.Image
+	var dst []byte
+	var stride int
+	switch {
+	case d.bits == 16 && d.extra == extraUnassociated:
+		m := image.NewNRGBA64(bounds)
+		img, dst, stride = m, m.Pix, m.Stride
+	case d.bits == 16:
+		m := image.NewRGBA64(bounds)
+		img, dst, stride = m, m.Pix, m.Stride
+	case d.extra == extraUnassociated:
+		m := image.NewNRGBA(bounds)
+		img, dst, stride = m, m.Pix, m.Stride
+	default:
+		m := image.NewRGBA(bounds)
+		img, dst, stride = m, m.Pix, m.Stride
+	}
+
+	sampleLen := d.bits / 8
+	for y := 0; y < d.height; y++ {
+		row := pix[y*rowLen:]
+		out := dst[y*stride:]
+		for x := 0; x < d.width; x++ {
+			for s := 0; s < 4; s++ {
+				o := (4*x + s) * sampleLen
+				if s == 3 && d.samples == 3 { //opaque
+					out[o] = 0xFF
+					if sampleLen == 2 {
+						out[o+1] = 0xFF
+					}
+					continue
+				}
+				i := (d.samples*x + s) * sampleLen
+				if sampleLen == 1 {
+					out[o] = row[i]
+				} else { //image pixels are big endian
+					binary.BigEndian.PutUint16(out[o:], d.byteOrder.Uint16(row[i:]))
+				}
+			}
+		}
+	}
+	return img
+}
+
+//packedSample returns sample x of a row of single sample pixels with up to 8 bits, packed most significant bit first
+func (d *decoder) packedSample(row []byte, x int) int {
+	if d.bits == 8 {
+		return int(row[x])
+	}
+	bit := x * d.bits
+	shift := uint(8 - d.bits - bit%8)
+	return int(row[bit/8]>>shift) & (1<<uint(d.bits) - 1)
+}
@@ -0,0 +1,211 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestLZWDecodeSpecExample(t *testing.T) {
+	//the example of section 13 of the TIFF 6.0 specification
+	codes := []int{lzwClear, 7, 258, 8, 8, 258, 6, 6, lzwEOI}
+	w := &bitWriter{}
+	for _, c := range codes {
+		w.write(c, lzwMinWidth)
+	}
+
+	decoded, err := lzwDecode(w.flush(), 0)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	expected := []byte{7, 7, 7, 8, 8, 7, 7, 6, 6}
+	if !bytes.Equal(decoded, expected) {
+		t.Errorf("Expected %v, got %v", expected, decoded)
+	}
+}
+
+func TestLZWRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tests := map[string][]byte{
+		"empty":  {},
+		"single": {42},
+		"runs":   bytes.Repeat([]byte{1, 1, 1, 2, 2, 3}, 5000),
+		"random": make([]byte, 200000), //fills the table several times
+	}
+	random.Read(tests["random"])
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := lzwDecode(lzwEncode(data), len(data))
+			if err != nil {
+				t.Fatalf("Error decoding: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Error("Decoded data differs")
+			}
+		})
+	}
+}
+
+func TestUnpackBits(t *testing.T) {
+	//the example of section 9 of the TIFF 6.0 specification
+	packed := []byte{0xFE, 0xAA, 0x02, 0x80, 0x00, 0x2A, 0xFD, 0xAA, 0x03, 0x80, 0x00, 0x2A, 0x22, 0xF7, 0xAA}
+	expected := []byte{0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0xAA, 0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0x22,
+		0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+
+	unpacked, err := unpackBits(packed, len(expected))
+	if err != nil {
+		t.Fatalf("Error unpacking: %v", err)
+	}
+	if !bytes.Equal(unpacked, expected) {
+		t.Errorf("Expected %x, got %x", expected, unpacked)
+	}
+}
+
+func testImages() map[string]image.Image {
+	bounds := image.Rect(0, 0, 37, 21)
+	gray := image.NewGray(bounds)
+	gray16 := image.NewGray16(bounds)
+	opaque := image.NewRGBA(bounds)
+	nrgba := image.NewNRGBA(bounds)
+	nrgba64 := image.NewNRGBA64(bounds)
+	paletted := image.NewPaletted(bounds, color.Palette{color.Black, color.White, color.RGBA{R: 200, G: 10, B: 30, A: 255}})
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray.SetGray(x, y, color.Gray{Y: uint8(x * y)})
+			gray16.SetGray16(x, y, color.Gray16{Y: uint16(x*y*977 + x)})
+			opaque.SetRGBA(x, y, color.RGBA{R: uint8(x * 7), G: uint8(y * 11), B: uint8(x ^ y), A: 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 11), B: uint8(x ^ y), A: uint8(x * y)})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{R: uint16(x * 1777), G: uint16(y * 3001), B: uint16(x * y * 13), A: uint16(x * 1500)})
+			paletted.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+	return map[string]image.Image{
+		"gray": gray, "gray16": gray16, "rgb": opaque, "nrgba": nrgba, "nrgba64": nrgba64, "paletted": paletted,
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	options := map[string]*Options{
+		"uncompressed":  nil,
+		"lzw":           {Compression: LZW},
+		"lzw predictor": {Compression: LZW, Predictor: true},
+		"deflate":       {Compression: Deflate, Predictor: true},
+	}
+	for imageName, img := range testImages() {
+		for optionsName, opt := range options {
+			t.Run(imageName+" "+optionsName, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := Encode(&buf, img, opt); err != nil {
+					t.Fatalf("Error encoding: %v", err)
+				}
+				decoded, err := Decode(&buf)
+				if err != nil {
+					t.Fatalf("Error decoding: %v", err)
+				}
+				if reflect.TypeOf(decoded) != reflect.TypeOf(img) {
+					t.Fatalf("Expected %T, got %T", img, decoded)
+				}
+				bounds := img.Bounds()
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					for x := bounds.Min.X; x < bounds.Max.X; x++ {
+						if !reflect.DeepEqual(decoded.At(x, y), img.At(x, y)) && !sameColor(decoded.At(x, y), img.At(x, y)) {
+							t.Fatalf("Pixel (%d,%d) differs: expected %v, got %v", x, y, img.At(x, y), decoded.At(x, y))
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+func TestDecodeBigEndianBilevel(t *testing.T) {
+	//a 10x2 WhiteIsZero bilevel image written by hand
+	buf := bigEndianTIFF([]byte{0xF0, 0x00, 0x0F, 0xC0}, [][3]uint32{ //two rows of two bytes, the last 6 bits are padding
+		{tImageWidth, dtShort, 10},
+		{tImageLength, dtShort, 2},
+		{tBitsPerSample, dtShort, 1},
+		{tCompression, dtShort, cNone},
+		{tPhotometricInterpretation, dtShort, pWhiteIsZero},
+		{tStripOffsets, dtLong, 8},
+		{tStripByteCounts, dtLong, 4},
+	})
+
+	img, err := Decode(buf)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("Expected *image.Gray, got %T", img)
+	}
+	expected := []uint8{
+		0, 0, 0, 0, 255, 255, 255, 255, 255, 255,
+		255, 255, 255, 255, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(gray.Pix, expected) {
+		t.Errorf("Expected %v, got %v", expected, gray.Pix)
+	}
+}
+
+func TestDecodeShouldRejectOversizedImages(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint32
+		compression   uint32
+	}{
+		{"overflowing dimensions", 0xFFFFFFFF, 0xFFFFFFFF, cNone},
+		{"dimensions above the limit", 100000, 100000, cNone},
+		{"uncompressed strips too short", 20000, 20000, cNone},
+		{"deflate strips too short", 20000, 20000, cDeflate},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bigEndianTIFF([]byte{1, 2, 3, 4}, [][3]uint32{
+				{tImageWidth, dtLong, test.width},
+				{tImageLength, dtLong, test.height},
+				{tBitsPerSample, dtShort, 8},
+				{tCompression, dtShort, test.compression},
+				{tPhotometricInterpretation, dtShort, pBlackIsZero},
+				{tStripOffsets, dtLong, 8},
+				{tStripByteCounts, dtLong, 4},
+			})
+			_, err := Decode(bytes.NewReader(buf.Bytes()))
+			if _, ok := err.(FormatError); !ok {
+				t.Errorf("Expected a FormatError, got %v", err)
+			}
+		})
+	}
+}
+
+//bigEndianTIFF writes a big endian TIFF of the pixel data at offset 8 followed by an image file directory of single value entries
+func bigEndianTIFF(pixels []byte, entries [][3]uint32) *bytes.Buffer {
+	var buf bytes.Buffer
+	buf.WriteString("MM\x00*")
+	binary.Write(&buf, binary.BigEndian, uint32(8+len(pixels)))
+	buf.Write(pixels)
+	binary.Write(&buf, binary.BigEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&buf, binary.BigEndian, uint16(e[0]))
+		binary.Write(&buf, binary.BigEndian, uint16(e[1]))
+		binary.Write(&buf, binary.BigEndian, uint32(1))
+		if e[1] == dtShort {
+			binary.Write(&buf, binary.BigEndian, uint16(e[2]))
+			binary.Write(&buf, binary.BigEndian, uint16(0))
+		} else {
+			binary.Write(&buf, binary.BigEndian, e[2])
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	return &buf
+}
@@ -0,0 +1,263 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+//CompressionType selects how the pixel data is compressed
+type CompressionType int
+
+//Supported compression types
+const (
+	Uncompressed CompressionType = iota
+	LZW
+	Deflate
+)
+
+//Options are the encoding parameters
+type Options struct {
+	Compression CompressionType
+	//Predictor enables horizontal differencing, which helps the compression of photographs
+	Predictor bool
+}
+
+var errEmptyImage = errors.New("tiff: can not encode an empty image")
+
+//layout describes how the pixels of an image are stored
+type layout struct {
+	photometric uint
+	samples     int
+	bits        int
+	extra       uint
+	palette     color.Palette
+	pix         []byte //rows of little endian samples
+}
+
+//Encode writes img to w as a single strip little endian TIFF.
+//Samples are written at their original depth, so 16-bit images keep 16 bits per sample,
+//and alpha is stored associated or unassociated as it is in img. Options may be nil.
+func Encode(w io.Writer, img image.Image, opt *Options) error {
+	if img.Bounds().Empty() {
+		return errEmptyImage
+	}
+	if opt == nil {
+		opt = &Options{}
+	}
+
+	l := newLayout(img)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	rowLen := width * l.samples * l.bits / 8
+
+	predictor := opt.Predictor && opt.Compression != Uncompressed && l.photometric != pPaletted
+	if predictor {
+		for y := 0; y < height; y++ {
+			applyPredictor(l.pix[y*rowLen:(y+1)*rowLen], l.samples, l.bits)
+		}
+	}
+
+	data := l.pix
+	compression := uint32(cNone)
+	switch opt.Compression {
+	case LZW:
+		data, compression = lzwEncode(l.pix), cLZW
+	case Deflate:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(l.pix); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data, compression = buf.Bytes(), cDeflate
+	}
+
+	bits := make([]uint32, l.samples)
+	for i := range bits {
+		bits[i] = uint32(l.bits)
+	}
+	entries := []ifdEntry{
+		{tImageWidth, dtLong, []uint32{uint32(width)}},
+		{tImageLength, dtLong, []uint32{uint32(height)}},
+		{tBitsPerSample, dtShort, bits},
+		{tCompression, dtShort, []uint32{compression}},
+		{tPhotometricInterpretation, dtShort, []uint32{uint32(l.photometric)}},
+		{tStripOffsets, dtLong, []uint32{8}},
+		{tSamplesPerPixel, dtShort, []uint32{uint32(l.samples)}},
+		{tRowsPerStrip, dtLong, []uint32{uint32(height)}},
+		{tStripByteCounts, dtLong, []uint32{uint32(len(data))}},
+		{tXResolution, dtRational, []uint32{72, 1}},
+		{tYResolution, dtRational, []uint32{72, 1}},
+		{tPlanarConfiguration, dtShort, []uint32{1}},
+		{tResolutionUnit, dtShort, []uint32{2}}, //inches
+	}
+	if predictor {
+		entries = append(entries, ifdEntry{tPredictor, dtShort, []uint32{prHorizontal}})
+	}
+	if l.extra != extraNone {
+		entries = append(entries, ifdEntry{tExtraSamples, dtShort, []uint32{uint32(l.extra)}})
+	}
+	if l.palette != nil {
+		entries = append(entries, ifdEntry{tColorMap, dtShort, colorMap(l.palette)})
+	}
+
+	header := make([]byte, 8)
+	copy(header, "II*\x00")
+	ifdOffset := 8 + len(data) + len(data)%2 //the directory starts on a word boundary
+	binary.LittleEndian.PutUint32(header[4:], uint32(ifdOffset))
+
+	for _, b := range [][]byte{header, data, make([]byte, len(data)%2), encodeIFD(entries, ifdOffset)} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newLayout(img image.Image) layout {
+	switch m := img.(type) {
+	case *image.Gray:
+		return layout{photometric: pBlackIsZero, samples: 1, bits: 8, pix: interleave(m.Pix, m.Stride, m.Bounds(), 1, 1, 1)}
+	case *image.Gray16:
+		return layout{photometric: pBlackIsZero, samples: 1, bits: 16, pix: interleave(m.Pix, m.Stride, m.Bounds(), 1, 1, 2)}
+	case *image.Paletted:
+		if opaquePalette(m.Palette) {
+			palette := make(color.Palette, 256) //the color map has an entry for every 8 bit index
+			for i := range palette {
+				palette[i] = color.Black
+			}
+			copy(palette, m.Palette)
+			return layout{photometric: pPaletted, samples: 1, bits: 8, palette: palette, pix: interleave(m.Pix, m.Stride, m.Bounds(), 1, 1, 1)}
+		}
+	case *image.RGBA:
+		return rgbLayout(m.Pix, m.Stride, m.Bounds(), m.Opaque(), extraAssociatedAlpha, 1)
+	case *image.NRGBA:
+		return rgbLayout(m.Pix, m.Stride, m.Bounds(), m.Opaque(), extraUnassociated, 1)
+	case *image.RGBA64:
+		return rgbLayout(m.Pix, m.Stride, m.Bounds(), m.Opaque(), extraAssociatedAlpha, 2)
+	case *image.NRGBA64:
+		return rgbLayout(m.Pix, m.Stride, m.Bounds(), m.Opaque(), extraUnassociated, 2)
+	}
+
+	bounds := img.Bounds()
+	m := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(m, m.Bounds(), img, bounds.Min, draw.Src)
+	return rgbLayout(m.Pix, m.Stride, m.Bounds(), m.Opaque(), extraUnassociated, 1)
+}
+
+func rgbLayout(pix []byte, stride int, bounds image.Rectangle, opaque bool, alpha uint, sampleLen int) layout {
+	l := layout{photometric: pRGB, samples: 4, bits: 8 * sampleLen, extra: alpha}
+	if opaque {
+		l.samples, l.extra = 3, extraNone
+	}
+	l.pix = interleave(pix, stride, bounds, 4, l.samples, sampleLen)
+	return l
+}
+
+//interleave copies the first keep of the channels big endian samples of every pixel into little endian rows
+func interleave(pix []byte, stride int, bounds image.Rectangle, channels, keep, sampleLen int) []byte {
+	width, height := bounds.Dx(), bounds.Dy()
+	out := make([]byte, 0, width*height*keep*sampleLen)
+	for y := 0; y < height; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < width; x++ {
+			for s := 0; s < keep; s++ {
+				i := (channels*x + s) * sampleLen
+				if sampleLen == 1 {
+					out = append(out, row[i])
+				} else {
+					out = append(out, row[i+1], row[i])
+				}
+			}
+		}
+	}
+	return out
+}
+
+//applyPredictor replaces the samples of a row with their difference to the previous pixel
+func applyPredictor(row []byte, samples, bits int) {
+	if bits == 8 {
+		for i := len(row) - 1; i >= samples; i-- {
+			row[i] -= row[i-samples]
+		}
+		return
+	}
+	for i := len(row) - 2; i >= 2*samples; i -= 2 {
+		v := binary.LittleEndian.Uint16(row[i:]) - binary.LittleEndian.Uint16(row[i-2*samples:])
+		binary.LittleEndian.PutUint16(row[i:], v)
+	}
+}
+
+func opaquePalette(palette color.Palette) bool {
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a != 0xFFFF {
+			return false
+		}
+	}
+	return len(palette) <= 256
+}
+
+//colorMap lays out a palette as all red, then all green, then all blue values
+func colorMap(palette color.Palette) []uint32 {
+	n := len(palette)
+	values := make([]uint32, 3*n)
+	for i, c := range palette {
+		r, g, b, _ := c.RGBA()
+		values[i], values[n+i], values[2*n+i] = r, g, b
+	}
+	return values
+}
+
+type ifdEntry struct {
+	tag      uint16
+	dataType uint16
+	values   []uint32
+}
+
+//encodeIFD lays out a directory at offset, followed by the values that do not fit in their entries
+func encodeIFD(entries []ifdEntry, offset int) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	dir := make([]byte, 2+12*len(entries)+4) //the next directory offset stays zero
+	binary.LittleEndian.PutUint16(dir, uint16(len(entries)))
+	var values []byte
+	valuesOffset := offset + len(dir)
+
+	for i, e := range entries {
+		var raw []byte
+		for _, v := range e.values {
+			if e.dataType == dtShort {
+				raw = binary.LittleEndian.AppendUint16(raw, uint16(v))
+			} else { //longs and the two longs of rationals
+				raw = binary.LittleEndian.AppendUint32(raw, v)
+			}
+		}
+		count := len(e.values)
+		if e.dataType == dtRational {
+			count /= 2
+		}
+
+		entry := dir[2+12*i:]
+		binary.LittleEndian.PutUint16(entry[0:], e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.dataType)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(count))
+		if len(raw) <= 4 {
+			copy(entry[8:12], raw)
+			continue
+		}
+		binary.LittleEndian.PutUint32(entry[8:], uint32(valuesOffset+len(values)))
+		values = append(values, raw...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	return append(dir, values...)
+}
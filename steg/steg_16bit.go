@@ -0,0 +1,207 @@
+package steg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+)
+
+//dataSizeHeaderBytes16 is the size of the 32 bit data size, which the first samples of 16-bit carriers hold
+const dataSizeHeaderBytes16 = 4
+
+//is16Bit reports whether the image has 16 bits per sample.
+//Such carriers hide a whole byte in the low byte of every sample, which changes
+//the colour by at most one level of 8-bit precision.
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+//toNRGBA64 converts the image to non-premultiplied 16-bit colour, so semi-transparent pixels keep their exact samples
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	NRGBA64Image := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if src, ok := img.(*image.NRGBA64); ok {
+		for y := 0; y < bounds.Dy(); y++ {
+			copy(NRGBA64Image.Pix[y*NRGBA64Image.Stride:(y+1)*NRGBA64Image.Stride], src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+		}
+		return NRGBA64Image
+	}
+	draw.Draw(NRGBA64Image, NRGBA64Image.Bounds(), img, bounds.Min, draw.Src)
+	return NRGBA64Image
+}
+
+//headerSamples16 returns the samples of a pixel that hold the data size: red, green and blue,
+//or only red for gray carriers, whose samples are all equal once converted to NRGBA64 (see toGray16)
+func headerSamples16(c *color.NRGBA64, gray bool) []*uint16 {
+	if gray {
+		return []*uint16{&c.R}
+	}
+	return []*uint16{&c.R, &c.G, &c.B}
+}
+
+//samples16 returns the samples of a pixel that hide data
+func samples16(c *color.NRGBA64, alpha, gray bool) []*uint16 {
+	if gray {
+		return headerSamples16(c, gray)
+	}
+	return colorSegments16(c, alpha)
+}
+
+//headerPixels16 returns the number of pixels holding the data size
+func headerPixels16(gray bool) int {
+	n := len(headerSamples16(&color.NRGBA64{}, gray))
+	return (dataSizeHeaderBytes16 + n - 1) / n
+}
+
+//toGray16 returns the red samples of an image converted from a Gray16 one as gray image again
+func toGray16(img *image.NRGBA64) *image.Gray16 {
+	gray := image.NewGray16(img.Bounds())
+	for i := 0; i < len(gray.Pix); i += 2 {
+		gray.Pix[i], gray.Pix[i+1] = img.Pix[4*i], img.Pix[4*i+1]
+	}
+	return gray
+}
+
+//visiblePixels returns the coordinates of the pixels that are not fully transparent in the column by column order used for encoding
+func visiblePixels(img *image.NRGBA64) []image.Point {
+	dx := img.Bounds().Dx()
+	dy := img.Bounds().Dy()
+	points := make([]image.Point, 0, dx*dy)
+	for x := 0; x < dx; x++ {
+		for y := 0; y < dy; y++ {
+			if img.NRGBA64At(x, y).A != 0 {
+				points = append(points, image.Pt(x, y))
+			}
+		}
+	}
+	return points
+}
+
+//encode16 stops with the context's error once ctx is done, checking it once per column of pixels as encodeLSB does
+func encode16(ctx context.Context, img *image.NRGBA64, data io.Reader, alpha, gray bool) error {
+	reader := bufio.NewReader(data)
+	pixels := visiblePixels(img)
+	headerPixels := headerPixels16(gray)
+	if len(pixels) < headerPixels {
+		return capacityError16(reader, 0, 0)
+	}
+
+	var dataCount uint32
+	hasMoreBytes := true
+
+	dy := img.Bounds().Dy()
+	for i, p := range pixels[headerPixels:] {
+		if !hasMoreBytes {
+			break
+		}
+		if i%dy == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		c := img.NRGBA64At(p.X, p.Y)
+		for _, sample := range samples16(&c, alpha, gray) {
+			b, err := reader.ReadByte()
+			if err == io.EOF {
+				hasMoreBytes = false
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading data %w", err)
+			}
+			*sample = *sample&0xFF00 | uint16(b)
+			dataCount++
+		}
+		img.SetNRGBA64(p.X, p.Y, c)
+	}
+
+	if hasMoreBytes {
+		if _, err := reader.Peek(1); err != io.EOF {
+			return capacityError16(reader, int64(dataCount), int64(dataCount))
+		}
+	}
+
+	if alpha {
+		dataCount |= alphaCarrierFlag
+	}
+	header := make([]byte, dataSizeHeaderBytes16)
+	binary.LittleEndian.PutUint32(header, dataCount)
+	perPixel := len(headerSamples16(&color.NRGBA64{}, gray))
+	for i, b := range header {
+		p := pixels[i/perPixel]
+		c := img.NRGBA64At(p.X, p.Y)
+		sample := headerSamples16(&c, gray)[i%perPixel]
+		*sample = *sample&0xFF00 | uint16(b)
+		img.SetNRGBA64(p.X, p.Y, c)
+	}
+	return nil
+}
+
+//capacityError16 returns the error of data that does not fit the available bytes after read bytes of it were hidden
+func capacityError16(reader *bufio.Reader, read, available int64) error {
+	left, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return fmt.Errorf("error reading data %w", err)
+	}
+	return &CapacityError{Needed: read + left, Available: available}
+}
+
+//decode16 stops with the context's error once ctx is done like encode16
+func decode16(ctx context.Context, img *image.NRGBA64, result io.Writer, gray bool) error {
+	pixels := visiblePixels(img)
+	headerPixels := headerPixels16(gray)
+	if len(pixels) < headerPixels {
+		return fmt.Errorf("%w: too few visible pixels to hold a header", ErrNoPayload)
+	}
+
+	header := make([]byte, dataSizeHeaderBytes16)
+	perPixel := len(headerSamples16(&color.NRGBA64{}, gray))
+	for i := range header {
+		c := img.NRGBA64At(pixels[i/perPixel].X, pixels[i/perPixel].Y)
+		header[i] = byte(*headerSamples16(&c, gray)[i%perPixel])
+	}
+	dataCount := binary.LittleEndian.Uint32(header)
+	alpha := dataCount&alphaCarrierFlag != 0
+	dataCount &^= alphaCarrierFlag
+	if uint64(dataCount) > uint64(len(pixels)-headerPixels)*4 {
+		return fmt.Errorf("%w: message length of %d exceeds the carrier", ErrCorruptHeader, dataCount)
+	}
+
+	length := dataCount
+	writer := bufio.NewWriter(result)
+	dy := img.Bounds().Dy()
+	for i, p := range pixels[headerPixels:] {
+		if dataCount == 0 {
+			break
+		}
+		if i%dy == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		c := img.NRGBA64At(p.X, p.Y)
+		for _, sample := range samples16(&c, alpha, gray) {
+			if dataCount == 0 {
+				break
+			}
+			if err := writer.WriteByte(byte(*sample)); err != nil {
+				return err
+			}
+			dataCount--
+		}
+	}
+	if dataCount > 0 {
+		return fmt.Errorf("%w: message length of %d exceeds the carrier", ErrCorruptHeader, length)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,47 @@
+package steg
+
+import (
+	"image/color"
+)
+
+//alphaCarrierFlag is set in the data size header when the alpha channel carries data too.
+//It uses the highest header bit, which data sizes that fit in a carrier never reach.
+const alphaCarrierFlag = 1 << 31
+
+//EncodeOptions configures EncodeWithOptions and its multi carrier variants
+type EncodeOptions struct {
+	//Format of the result, see EncodeWithFormat
+	Format string
+	//Alpha enables hiding data in the alpha channel of semi-transparent pixels as well
+	Alpha bool
+	//JPEGMetadata translates the EXIF data and ICC profile of JPEG carriers into chunks of the PNG result
+	JPEGMetadata bool
+}
+
+//alphaCarries reports whether an alpha value can carry data.
+//Opaque and fully transparent pixels are left alone because any change of their alpha would be visible.
+//The range is chosen so that setting the last two bits never moves a value out of it.
+func alphaCarries(a uint8) bool {
+	return a>>2 != 0 && a>>2 != 0xFF>>2
+}
+
+//alphaCarries16 reports whether an alpha sample of a 16-bit carrier can carry a byte in its low byte
+func alphaCarries16(a uint16) bool {
+	return a>>8 != 0 && a>>8 != 0xFF
+}
+
+//samplesUsed returns how many of the R, G, B and A samples of a pixel with alpha a carry data, in this order
+func samplesUsed(a uint8, alpha bool) int {
+	if alpha && alphaCarries(a) {
+		return 4
+	}
+	return 3
+}
+
+//colorSegments16 returns the samples of a 16-bit pixel used for data in the order they are used
+func colorSegments16(c *color.NRGBA64, alpha bool) []*uint16 {
+	if alpha && alphaCarries16(c.A) {
+		return []*uint16{&c.R, &c.G, &c.B, &c.A}
+	}
+	return []*uint16{&c.R, &c.G, &c.B}
+}
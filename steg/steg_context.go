@@ -0,0 +1,293 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+)
+
+//AlgorithmLSB is the default algorithm, which hides two bits in every colour sample of the carrier's pixels
+const AlgorithmLSB = "lsb"
+
+//Options configures the context aware functions such as EncodeContext and DecodeContext.
+//The zero value hides the data as Encode does.
+type Options struct {
+	//EncodeOptions configures the result of encoding, e.g. its format
+	EncodeOptions
+	//Algorithm is the name of the algorithm hiding the data, AlgorithmLSB when empty.
+	//Other algorithms are available once the package registering them is imported, see RegisterAlgorithm.
+	Algorithm string
+	//Key encrypts the data with AES-256-GCM using a key derived from the passphrase.
+	//Encrypted data is also authenticated, so decoding with a wrong key or of a modified carrier fails.
+	Key string
+	//ECC adds Reed-Solomon error correction, so damage to the carrier up to the level's limit is repaired
+	ECC ECCLevel
+	//Progress is called as data is hidden or extracted with the number of data bytes done so far
+	//and their total, which is -1 when it is unknown as it is when decoding
+	Progress func(done, total int64)
+	//MaxPixels rejects carriers of more pixels before decoding them, no limit applies when it is 0
+	MaxPixels int64
+}
+
+//EncodeFunc hides data in a single carrier and writes the result, see RegisterAlgorithm
+type EncodeFunc func(ctx context.Context, carrier io.Reader, data io.Reader, result io.Writer, options Options) error
+
+//DecodeFunc extracts the data hidden in a single carrier by the matching EncodeFunc, see RegisterAlgorithm
+type DecodeFunc func(ctx context.Context, carrier io.Reader, result io.Writer, options Options) error
+
+type algorithm struct {
+	encode EncodeFunc
+	decode DecodeFunc
+}
+
+var (
+	algorithmsMutex sync.RWMutex
+	algorithms      = map[string]algorithm{}
+)
+
+func init() {
+	RegisterAlgorithm(AlgorithmLSB, encodeLSB, decodeLSB)
+}
+
+//RegisterAlgorithm makes an algorithm available by name in Options, typically from the init function of the package implementing it.
+//The functions handle a single carrier, splitting data over multiple carriers, encryption, error correction,
+//progress and the pixel limit are taken care of before they are called. They should stop when ctx is done.
+func RegisterAlgorithm(name string, encode EncodeFunc, decode DecodeFunc) {
+	algorithmsMutex.Lock()
+	defer algorithmsMutex.Unlock()
+	algorithms[name] = algorithm{encode: encode, decode: decode}
+}
+
+func lookupAlgorithm(options Options) (algorithm, error) {
+	if !options.ECC.valid() {
+		return algorithm{}, fmt.Errorf("unknown error correction level %d", options.ECC)
+	}
+	name := options.Algorithm
+	if name == "" {
+		name = AlgorithmLSB
+	}
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+	a, ok := algorithms[name]
+	if !ok {
+		return algorithm{}, fmt.Errorf("unknown algorithm %s", name)
+	}
+	return a, nil
+}
+
+//EncodeContext performs steganography encoding of data Reader in carrier and writes it to the result Writer
+//as configured by options. It stops with the context's error once ctx is done.
+func EncodeContext(ctx context.Context, carrier io.Reader, data io.Reader, result io.Writer, options Options) error {
+	a, err := lookupAlgorithm(options)
+	if err != nil {
+		return err
+	}
+	size, _, err := knownSize(data)
+	if err != nil {
+		return err
+	}
+	payload, err := newPayloadReader(ctx, data, size, options)
+	if err != nil {
+		return err
+	}
+	carrier, err = limitPixels(carrier, options.MaxPixels)
+	if err != nil {
+		return err
+	}
+	return a.encode(ctx, carrier, payload, result, options)
+}
+
+//MultiCarrierEncodeContext performs steganography encoding of data Reader in equal pieces in each of the carriers
+//and writes it to the result Writers as configured by options. It stops with the context's error once ctx is done.
+//Splitting data needs its size, see MultiCarrierEncodeWithOptions.
+func MultiCarrierEncodeContext(ctx context.Context, carriers []io.Reader, data io.Reader, results []io.Writer, options Options) error {
+	if len(carriers) != len(results) {
+		return fmt.Errorf("different number of carriers and results")
+	}
+	a, err := lookupAlgorithm(options)
+	if err != nil {
+		return err
+	}
+
+	size, data, cleanup, err := sizeOf(data)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	payload, err := newPayloadReader(ctx, data, size, options)
+	if err != nil {
+		return err
+	}
+
+	payloadSize := eccSize(size, options.ECC)
+	if options.Key != "" {
+		payloadSize = eccSize(encryptedSize(size), options.ECC)
+	}
+	chunkSize := payloadSize / int64(len(carriers))
+	for i := 0; i < len(carriers); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := chunkSize
+		if i == len(carriers)-1 { //the last carrier takes the remainder
+			chunk = payloadSize - chunkSize*int64(len(carriers)-1)
+		}
+		carrier, err := limitPixels(carriers[i], options.MaxPixels)
+		if err != nil {
+			return fmt.Errorf("error encoding chunk with index %d: %w", i, err)
+		}
+		if err := a.encode(ctx, carrier, io.LimitReader(payload, chunk), results[i], options); err != nil {
+			return fmt.Errorf("error encoding chunk with index %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+//DecodeContext performs steganography decoding of Reader with data previously encoded by EncodeContext
+//and writes it to the result Writer. Options must match the ones used for encoding, apart from the encoding only
+//ones such as the result format. It stops with the context's error once ctx is done.
+func DecodeContext(ctx context.Context, carrier io.Reader, result io.Writer, options Options) error {
+	a, err := lookupAlgorithm(options)
+	if err != nil {
+		return err
+	}
+	payload, closers := newPayloadWriter(ctx, result, options)
+	carrier, err = limitPixels(carrier, options.MaxPixels)
+	if err != nil {
+		return err
+	}
+	if err := a.decode(ctx, carrier, payload, options); err != nil {
+		return err
+	}
+	return closeAll(closers)
+}
+
+//MultiCarrierDecodeContext performs steganography decoding of Readers with data chunks previously encoded
+//by MultiCarrierEncodeContext and writes it to the result Writer (see DecodeContext).
+//NOTE: The order of the carriers MUST be the same as the one when encoding.
+func MultiCarrierDecodeContext(ctx context.Context, carriers []io.Reader, result io.Writer, options Options) error {
+	a, err := lookupAlgorithm(options)
+	if err != nil {
+		return err
+	}
+	payload, closers := newPayloadWriter(ctx, result, options)
+	for i := 0; i < len(carriers); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		carrier, err := limitPixels(carriers[i], options.MaxPixels)
+		if err == nil {
+			err = a.decode(ctx, carrier, payload, options)
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding chunk with index %d: %w", i, err)
+		}
+	}
+	return closeAll(closers)
+}
+
+func closeAll(closers []io.Closer) error {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//newPayloadReader returns the reader of the payload hidden for data of the given size, -1 if unknown:
+//the data encrypted and protected by error correction as configured, reporting progress and stopping once ctx is done
+func newPayloadReader(ctx context.Context, data io.Reader, size int64, options Options) (io.Reader, error) {
+	payload := io.Reader(&progressReader{ctx: ctx, reader: data, total: size, progress: options.Progress})
+	if options.Key != "" {
+		encrypted, err := newEncryptReader(payload, options.Key)
+		if err != nil {
+			return nil, err
+		}
+		payload = encrypted
+	}
+	if options.ECC != ECCNone {
+		payload = newECCReader(payload, options.ECC)
+	}
+	return payload, nil
+}
+
+//newPayloadWriter returns the writer reversing newPayloadReader and the closers to call in order once all data is written
+func newPayloadWriter(ctx context.Context, result io.Writer, options Options) (io.Writer, []io.Closer) {
+	payload := io.Writer(&progressWriter{ctx: ctx, writer: result, total: -1, progress: options.Progress})
+	var closers []io.Closer
+	if options.Key != "" {
+		decrypted := newDecryptWriter(payload, options.Key)
+		payload = decrypted
+		closers = append(closers, decrypted)
+	}
+	if options.ECC != ECCNone {
+		corrected := newECCWriter(payload, options.ECC)
+		payload = corrected
+		closers = append([]io.Closer{corrected}, closers...)
+	}
+	return payload, closers
+}
+
+//progressReader reports the progress of reading data and fails with the context's error once it is done
+type progressReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.reader.Read(b)
+	if n > 0 && p.progress != nil {
+		p.done += int64(n)
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
+
+//progressWriter reports the progress of writing data and fails with the context's error once it is done
+type progressWriter struct {
+	ctx      context.Context
+	writer   io.Writer
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.writer.Write(b)
+	if n > 0 && p.progress != nil {
+		p.done += int64(n)
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
+
+//limitPixels rejects carriers of more than maxPixels pixels from their header, before their pixels are decoded.
+//Carriers that are no images are left to the algorithm, which reports them.
+func limitPixels(carrier io.Reader, maxPixels int64) (io.Reader, error) {
+	if maxPixels <= 0 {
+		return carrier, nil
+	}
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(carrier, &header))
+	carrier = io.MultiReader(&header, carrier)
+	if err != nil {
+		return carrier, nil
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxPixels {
+		return nil, fmt.Errorf("carrier of %dx%d pixels exceeds the limit of %d pixels", config.Width, config.Height, maxPixels)
+	}
+	return carrier, nil
+}
@@ -0,0 +1,236 @@
+package steg_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DimitarPetrov/stegify/steg"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestEncodeContextWithOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		carriers int
+		data     []byte
+		options  steg.Options
+	}{
+		{"key", 1, randomData(5000), steg.Options{Key: "secret"}},
+		{"key and empty data", 1, nil, steg.Options{Key: "secret"}},
+		{"ecc low", 1, randomData(5000), steg.Options{ECC: steg.ECCLow}},
+		{"ecc medium", 1, randomData(5000), steg.Options{ECC: steg.ECCMedium}},
+		{"ecc high", 1, randomData(5000), steg.Options{ECC: steg.ECCHigh}},
+		{"key and ecc", 1, randomData(5000), steg.Options{Key: "secret", ECC: steg.ECCHigh}},
+		{"key and ecc over many segments and carriers", 3, randomData(100000), steg.Options{Key: "secret", ECC: steg.ECCLow}},
+		{"alpha and format", 1, randomData(5000), steg.Options{EncodeOptions: steg.EncodeOptions{Format: "bmp", Alpha: true}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			carrier := newGeneratedCarrier(t, 256)
+			carriers := make([]io.Reader, test.carriers)
+			results := make([]io.Writer, test.carriers)
+			buffers := make([]*bytes.Buffer, test.carriers)
+			for i := range carriers {
+				carriers[i] = bytes.NewReader(carrier)
+				buffers[i] = &bytes.Buffer{}
+				results[i] = buffers[i]
+			}
+			data := struct{ io.Reader }{bytes.NewReader(test.data)} //size unknown
+			if err := steg.MultiCarrierEncodeContext(context.Background(), carriers, data, results, test.options); err != nil {
+				t.Fatalf("Error encoding file: %v", err)
+			}
+
+			encoded := make([]io.Reader, test.carriers)
+			for i := range buffers {
+				encoded[i] = buffers[i]
+			}
+			var decodeResult bytes.Buffer
+			if err := steg.MultiCarrierDecodeContext(context.Background(), encoded, &decodeResult, test.options); err != nil {
+				t.Fatalf("Error decoding file: %v", err)
+			}
+			if !bytes.Equal(test.data, decodeResult.Bytes()) {
+				t.Errorf("Decoded data differs from the encoded one: expected %d bytes, got %d", len(test.data), decodeResult.Len())
+			}
+		})
+	}
+}
+
+func TestDecodeContextShouldReturnErrorWhenKeyIsWrong(t *testing.T) {
+	var encodeResult bytes.Buffer
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader([]byte("secret data")), &encodeResult, steg.Options{Key: "right"})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	for _, key := range []string{"wrong", ""} {
+		var decodeResult bytes.Buffer
+		err := steg.DecodeContext(context.Background(), bytes.NewReader(encodeResult.Bytes()), &decodeResult, steg.Options{Key: key})
+		if key != "" && err == nil {
+			t.Errorf("Expected an error when decoding with key %q", key)
+		}
+		if bytes.Contains(decodeResult.Bytes(), []byte("secret data")) {
+			t.Errorf("Decoding with key %q revealed the data", key)
+		}
+	}
+}
+
+//damage flips the last bit of the red sample of every step-th visible pixel after the data size header
+func damage(t *testing.T, encoded []byte, step int) []byte {
+	img, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	damaged := image.NewNRGBA(img.Bounds())
+	draw.Draw(damaged, damaged.Bounds(), img, image.Point{}, draw.Src)
+	for i := 5 * 4; i < len(damaged.Pix); i += 4 * step {
+		damaged.Pix[i] ^= 1
+	}
+	var result bytes.Buffer
+	if err := png.Encode(&result, damaged); err != nil {
+		t.Fatalf("Error encoding damaged result: %v", err)
+	}
+	return result.Bytes()
+}
+
+func TestDecodeContextShouldRepairDamageWithECC(t *testing.T) {
+	data := randomData(20000)
+	for _, options := range []steg.Options{{ECC: steg.ECCHigh}, {ECC: steg.ECCHigh, Key: "secret"}} {
+		var encodeResult bytes.Buffer
+		if err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 256)), bytes.NewReader(data), &encodeResult, options); err != nil {
+			t.Fatalf("Error encoding file: %v", err)
+		}
+		damaged := damage(t, encodeResult.Bytes(), 97)
+
+		var decodeResult bytes.Buffer
+		if err := steg.DecodeContext(context.Background(), bytes.NewReader(damaged), &decodeResult, options); err != nil {
+			t.Fatalf("Error decoding damaged file with %+v: %v", options, err)
+		}
+		if !bytes.Equal(data, decodeResult.Bytes()) {
+			t.Errorf("Damage was not repaired with %+v", options)
+		}
+	}
+
+	var encodeResult, decodeResult bytes.Buffer
+	if err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 256)), bytes.NewReader(data), &encodeResult, steg.Options{}); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	if err := steg.Decode(bytes.NewReader(damage(t, encodeResult.Bytes(), 97)), &decodeResult); err != nil {
+		t.Fatalf("Error decoding damaged file: %v", err)
+	}
+	if bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Expected the damage to corrupt data without error correction")
+	}
+}
+
+func TestEncodeContextShouldStopWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := steg.EncodeContext(ctx, bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader([]byte("data")), &bytes.Buffer{}, steg.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error when encoding, got %v", err)
+	}
+	err = steg.DecodeContext(ctx, bytes.NewReader(newGeneratedCarrier(t, 64)), &bytes.Buffer{}, steg.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error when decoding, got %v", err)
+	}
+}
+
+func TestEncodeContextShouldReportProgress(t *testing.T) {
+	data := randomData(10000)
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+
+	var encodeResult bytes.Buffer
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 256)), bytes.NewReader(data), &encodeResult, steg.Options{Progress: progress})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	if done != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("Expected progress of %d of %d bytes, got %d of %d", len(data), len(data), done, total)
+	}
+
+	err = steg.DecodeContext(context.Background(), &encodeResult, &bytes.Buffer{}, steg.Options{Progress: progress})
+	if err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if done != int64(len(data)) || total != -1 {
+		t.Errorf("Expected progress of %d of unknown bytes, got %d of %d", len(data), done, total)
+	}
+}
+
+func TestContextOf16BitCarrier(t *testing.T) {
+	carrierImage := image.NewNRGBA64(image.Rect(0, 0, 128, 128))
+	for i := range carrierImage.Pix {
+		carrierImage.Pix[i] = byte(i*31) | 0x80
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	data := randomData(20000)
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+
+	var encodeResult bytes.Buffer
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(carrier.Bytes()), bytes.NewReader(data), &encodeResult, steg.Options{Progress: progress})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	if done != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("Expected progress of %d of %d bytes, got %d of %d", len(data), len(data), done, total)
+	}
+
+	var decodeResult bytes.Buffer
+	err = steg.DecodeContext(context.Background(), bytes.NewReader(encodeResult.Bytes()), &decodeResult, steg.Options{Progress: progress})
+	if err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) || done != int64(len(data)) || total != -1 {
+		t.Errorf("Expected %d decoded bytes with progress of unknown total, got %d bytes and progress %d of %d", len(data), decodeResult.Len(), done, total)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = steg.EncodeContext(ctx, bytes.NewReader(carrier.Bytes()), bytes.NewReader(data), &bytes.Buffer{}, steg.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error when encoding, got %v", err)
+	}
+	err = steg.DecodeContext(ctx, bytes.NewReader(encodeResult.Bytes()), &bytes.Buffer{}, steg.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error when decoding, got %v", err)
+	}
+}
+
+func TestEncodeContextShouldRejectInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options steg.Options
+	}{
+		{"too many pixels", steg.Options{MaxPixels: 64*64 - 1}},
+		{"unknown algorithm", steg.Options{Algorithm: "unknown"}},
+		{"unknown error correction level", steg.Options{ECC: steg.ECCHigh + 1}},
+	}
+	for _, test := range tests {
+		err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader([]byte("data")), &bytes.Buffer{}, test.options)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader([]byte("data")), &bytes.Buffer{}, steg.Options{MaxPixels: 64 * 64})
+	if err != nil {
+		t.Errorf("Expected a carrier within the pixel limit to be encoded, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package steg
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//Encrypted data starts with a header of a version byte, the salt of the key derivation and a random nonce prefix.
+//The data follows in segments sealed with AES-256-GCM, so it can be encrypted and decrypted as a stream.
+//The nonce of a segment is the prefix, the segment's counter and a flag marking the last segment,
+//which detects reordered, dropped and truncated segments.
+const (
+	cryptVersion         = 1
+	cryptSaltSize        = 16
+	cryptKeySize         = 32 //AES-256
+	cryptNoncePrefixSize = 7
+	cryptHeaderSize      = 1 + cryptSaltSize + cryptNoncePrefixSize
+	cryptSegmentSize     = 64 * 1024
+	cryptOverhead        = 16 //GCM tag
+	//cryptPBKDF2Iterations follows the OWASP recommendation for PBKDF2-HMAC-SHA256
+	cryptPBKDF2Iterations = 600000
+)
+
+//encryptedSize returns the size of size bytes of data after encryption
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return size
+	}
+	segments := max(1, (size+cryptSegmentSize-1)/cryptSegmentSize)
+	return cryptHeaderSize + size + segments*cryptOverhead
+}
+
+func newSegmentAEAD(key string, salt []byte) (cipher.AEAD, error) {
+	derived, err := pbkdf2.Key(sha256.New, key, salt, cryptPBKDF2Iterations, cryptKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, cryptNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+//encryptReader encrypts the data read from the underlying reader segment by segment
+type encryptReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	segment []byte
+	pending []byte
+	done    bool
+}
+
+func newEncryptReader(r io.Reader, key string) (*encryptReader, error) {
+	header := make([]byte, cryptHeaderSize)
+	header[0] = cryptVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	aead, err := newSegmentAEAD(key, header[1:1+cryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		reader:  bufio.NewReaderSize(r, cryptSegmentSize),
+		aead:    aead,
+		header:  header,
+		segment: make([]byte, cryptSegmentSize, cryptSegmentSize+cryptOverhead),
+		pending: header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.reader, e.segment[:cryptSegmentSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if err == nil { //a full segment is the last one when no data follows
+			if _, err = e.reader.Peek(1); err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+		e.done = err != nil
+		nonce := segmentNonce(e.header[1+cryptSaltSize:], e.counter, e.done)
+		e.pending = e.aead.Seal(e.segment[:0], nonce, e.segment[:n], e.header)
+		e.counter++
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+//decryptWriter decrypts the segments written to it and writes the data to the underlying writer.
+//Close must be called to authenticate the last segment.
+type decryptWriter struct {
+	writer  io.Writer
+	key     string
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	buffer  []byte
+}
+
+func newDecryptWriter(w io.Writer, key string) *decryptWriter {
+	return &decryptWriter{writer: w, key: key, buffer: make([]byte, 0, cryptSegmentSize+cryptOverhead+1)}
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		//a segment is only opened once more data follows, which shows that it is not the last one
+		n := min(len(p), cap(d.buffer)-len(d.buffer))
+		d.buffer = append(d.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+		if d.aead == nil && len(d.buffer) >= cryptHeaderSize {
+			if err := d.readHeader(); err != nil {
+				return written, err
+			}
+		}
+		if d.aead != nil && len(d.buffer) == cap(d.buffer) {
+			if err := d.openSegment(cryptSegmentSize+cryptOverhead, false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (d *decryptWriter) readHeader() error {
+	if d.buffer[0] != cryptVersion {
+		return fmt.Errorf("%w: unknown version of encrypted data", ErrCorruptHeader)
+	}
+	aead, err := newSegmentAEAD(d.key, d.buffer[1:1+cryptSaltSize])
+	if err != nil {
+		return err
+	}
+	d.aead = aead
+	d.header = append([]byte{}, d.buffer[:cryptHeaderSize]...)
+	d.buffer = append(d.buffer[:0], d.buffer[cryptHeaderSize:]...)
+	return nil
+}
+
+func (d *decryptWriter) openSegment(size int, last bool) error {
+	nonce := segmentNonce(d.header[1+cryptSaltSize:], d.counter, last)
+	data, err := d.aead.Open(nil, nonce, d.buffer[:size], d.header)
+	if err != nil {
+		return ErrAuthFailed
+	}
+	if _, err := d.writer.Write(data); err != nil {
+		return err
+	}
+	d.buffer = append(d.buffer[:0], d.buffer[size:]...)
+	d.counter++
+	return nil
+}
+
+func (d *decryptWriter) Close() error {
+	if d.aead == nil || len(d.buffer) < cryptOverhead {
+		return fmt.Errorf("%w: encrypted data is truncated", ErrCorruptHeader)
+	}
+	return d.openSegment(len(d.buffer), true)
+}
@@ -1,6 +1,7 @@
 package steg
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/DimitarPetrov/stegify/bits"
@@ -11,59 +12,73 @@ import (
 
 //Decode performs steganography decoding of Reader with previously encoded data by the Encode function and writes to result Writer.
 func Decode(carrier io.Reader, result io.Writer) error {
-	RGBAImage, _, err := getImageAsRGBA(carrier)
+	return DecodeContext(context.Background(), carrier, result, Options{})
+}
+
+//decodeLSB is the DecodeFunc of AlgorithmLSB
+func decodeLSB(ctx context.Context, carrier io.Reader, result io.Writer, _ Options) error {
+	carrier, isGIF := sniffGIF(carrier)
+	if isGIF {
+		return DecodeGIF(carrier, result)
+	}
+
+	img, _, err := decodeImage(carrier)
 	if err != nil {
-		return fmt.Errorf("error parsing carrier image: %v", err)
+		return fmt.Errorf("error parsing carrier image: %w", err)
 	}
 
-	dx := RGBAImage.Bounds().Dx()
-	dy := RGBAImage.Bounds().Dy()
+	if is16Bit(img) {
+		_, gray := img.(*image.Gray16)
+		return decode16(ctx, toNRGBA64(img), result, gray)
+	}
+
+	NRGBAImage := toNRGBA(img)
 
-	dataBytes := make([]byte, 0, 2048)
-	resultBytes := make([]byte, 0, 2048)
+	dx := NRGBAImage.Bounds().Dx()
+	dy := NRGBAImage.Bounds().Dy()
 
-	dataCount := extractDataCount(RGBAImage)
+	quarters := newQuarterWriter(result)
+
+	dataCount, alpha, err := extractDataCount(NRGBAImage)
+	if err != nil {
+		return err
+	}
+	length := dataCount
 
 	var count int
 
 	for x := 0; x < dx && dataCount > 0; x++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		for y := 0; y < dy && dataCount > 0; y++ {
+			pix := NRGBAImage.Pix[NRGBAImage.PixOffset(x, y):]
+			if pix[3] == 0 {
+				continue
+			}
 			if count >= dataSizeHeaderReservedBytes {
-				c := RGBAImage.RGBAAt(x, y)
-				dataBytes = append(dataBytes, bits.GetLastTwoBits(c.R), bits.GetLastTwoBits(c.G), bits.GetLastTwoBits(c.B))
-				dataCount -= 3
+				for i := 0; i < samplesUsed(pix[3], alpha) && dataCount > 0; i++ {
+					if err := quarters.writeQuarter(bits.GetLastTwoBits(pix[i])); err != nil {
+						return err
+					}
+					dataCount--
+				}
 			} else {
 				count += 4
 			}
 		}
 	}
 
-	if dataCount < 0 {
-		dataBytes = dataBytes[:len(dataBytes)+dataCount] //remove bytes that are not part of data and mistakenly added
-	}
-
-	dataBytes = align(dataBytes) // len(dataBytes) must be aliquot of 4
-
-	for i := 0; i < len(dataBytes); i += 4 {
-		resultBytes = append(resultBytes, bits.ConstructByteOfQuartersAsSlice(dataBytes[i:i+4]))
-	}
-
-	if _, err = result.Write(resultBytes); err != nil {
-		return err
+	if dataCount > 0 {
+		return fmt.Errorf("%w: message length of %d exceeds the carrier", ErrCorruptHeader, length)
 	}
-
-	return nil
+	return quarters.flush()
 }
 
 //MultiCarrierDecode performs steganography decoding of Readers with previously encoded data chunks by the MultiCarrierEncode function and writes to result Writer.
 //NOTE: The order of the carriers MUST be the same as the one when encoding.
 func MultiCarrierDecode(carriers []io.Reader, result io.Writer) error {
-	for i := 0; i < len(carriers); i++ {
-		if err := Decode(carriers[i], result); err != nil {
-			return fmt.Errorf("error decoding chunk with index %d: %v", i, err)
-		}
-	}
-	return nil
+	return MultiCarrierDecodeContext(context.Background(), carriers, result, Options{})
 }
 
 //DecodeByFileNames performs steganography decoding of data previously encoded by the Encode function.
@@ -76,6 +91,14 @@ func DecodeByFileNames(carrierFileName string, resultName string) (err error) {
 //The data is decoded from carrier files and it is saved in separate new file
 //NOTE: The order of the carriers MUST be the same as the one when encoding.
 func MultiCarrierDecodeByFileNames(carrierFileNames []string, resultName string) (err error) {
+	return MultiCarrierDecodeByFileNamesContext(context.Background(), carrierFileNames, resultName, Options{})
+}
+
+//MultiCarrierDecodeByFileNamesContext performs steganography decoding of data previously encoded by the MultiCarrierEncodeContext function
+//as configured by options (see MultiCarrierDecodeContext). The data is decoded from carrier files and it is saved in separate new file,
+//which is removed when decoding fails or is cancelled.
+//NOTE: The order of the carriers MUST be the same as the one when encoding.
+func MultiCarrierDecodeByFileNamesContext(ctx context.Context, carrierFileNames []string, resultName string, options Options) (err error) {
 	if len(carrierFileNames) == 0 {
 		return fmt.Errorf("missing carriers names")
 	}
@@ -84,7 +107,7 @@ func MultiCarrierDecodeByFileNames(carrierFileNames []string, resultName string)
 	for _, name := range carrierFileNames {
 		carrier, err := os.Open(name)
 		if err != nil {
-			return fmt.Errorf("error opening carrier file %s: %v", name, err)
+			return fmt.Errorf("error opening carrier file %s: %w", name, err)
 		}
 		defer func() {
 			closeErr := carrier.Close()
@@ -97,7 +120,7 @@ func MultiCarrierDecodeByFileNames(carrierFileNames []string, resultName string)
 
 	result, err := os.Create(resultName)
 	if err != nil {
-		return fmt.Errorf("error creating result file: %v", err)
+		return fmt.Errorf("error creating result file: %w", err)
 	}
 	defer func() {
 		closeErr := result.Close()
@@ -106,41 +129,37 @@ func MultiCarrierDecodeByFileNames(carrierFileNames []string, resultName string)
 		}
 	}()
 
-	err = MultiCarrierDecode(carriers, result)
+	err = MultiCarrierDecodeContext(ctx, carriers, result, options)
 	if err != nil {
 		_ = os.Remove(resultName)
 	}
 	return err
 }
 
-func align(dataBytes []byte) []byte {
-	switch len(dataBytes) % 4 {
-	case 1:
-		dataBytes = append(dataBytes, byte(0), byte(0), byte(0))
-	case 2:
-		dataBytes = append(dataBytes, byte(0), byte(0))
-	case 3:
-		dataBytes = append(dataBytes, byte(0))
-	}
-	return dataBytes
-}
-
-func extractDataCount(RGBAImage *image.RGBA) int {
+//extractDataCount returns the number of encoded quarters and whether the alpha channel carries data
+func extractDataCount(NRGBAImage *image.NRGBA) (int, bool, error) {
 	dataCountBytes := make([]byte, 0, 16)
 
-	dx := RGBAImage.Bounds().Dx()
-	dy := RGBAImage.Bounds().Dy()
+	dx := NRGBAImage.Bounds().Dx()
+	dy := NRGBAImage.Bounds().Dy()
 
 	count := 0
 
 	for x := 0; x < dx && count < dataSizeHeaderReservedBytes; x++ {
 		for y := 0; y < dy && count < dataSizeHeaderReservedBytes; y++ {
-			c := RGBAImage.RGBAAt(x, y)
+			c := NRGBAImage.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
 			dataCountBytes = append(dataCountBytes, bits.GetLastTwoBits(c.R), bits.GetLastTwoBits(c.G), bits.GetLastTwoBits(c.B))
 			count += 4
 		}
 	}
 
+	if count < dataSizeHeaderReservedBytes {
+		return 0, false, fmt.Errorf("%w: too few visible pixels to hold a header", ErrNoPayload)
+	}
+
 	dataCountBytes = append(dataCountBytes, byte(0))
 
 	var bs = []byte{bits.ConstructByteOfQuartersAsSlice(dataCountBytes[:4]),
@@ -148,5 +167,6 @@ func extractDataCount(RGBAImage *image.RGBA) int {
 		bits.ConstructByteOfQuartersAsSlice(dataCountBytes[8:12]),
 		bits.ConstructByteOfQuartersAsSlice(dataCountBytes[12:])}
 
-	return int(binary.LittleEndian.Uint32(bs))
+	header := binary.LittleEndian.Uint32(bs)
+	return int(header &^ alphaCarrierFlag), header&alphaCarrierFlag != 0, nil
 }
@@ -41,6 +41,21 @@ func BenchmarkDecodeByFileNames(b *testing.B) {
 	}
 }
 
+func BenchmarkDecodeLargeData(b *testing.B) {
+	data := bytes.Repeat([]byte{0x5A}, (2048*2048-5)*3/4) //5 pixels hold the data size
+	var carrier bytes.Buffer
+	if err := steg.Encode(bytes.NewReader(newGeneratedCarrier(b, 2048)), bytes.NewReader(data), &carrier); err != nil {
+		b.Fatalf("Error encoding file: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := steg.Decode(bytes.NewReader(carrier.Bytes()), ioutil.Discard); err != nil {
+			b.Fatalf("Error decoding file: %v", err)
+		}
+	}
+}
+
 func TestDecode(t *testing.T) {
 	AssertDecodedDataMatchesOriginal(t, []string{"../examples/test_decode.jpeg"}, "../examples/lake.jpeg",
 		func(readers []io.Reader, writer io.Writer) {
@@ -0,0 +1,322 @@
+package steg
+
+import (
+	"fmt"
+	"io"
+)
+
+//ECCLevel is the strength of the Reed-Solomon error correction added to the data, see Options
+type ECCLevel int
+
+const (
+	//ECCNone adds no error correction
+	ECCNone ECCLevel = iota
+	//ECCLow corrects up to 4 damaged bytes in every block of 255 bytes, adding 3% to the data
+	ECCLow
+	//ECCMedium corrects up to 8 damaged bytes in every block of 255 bytes, adding 7% to the data
+	ECCMedium
+	//ECCHigh corrects up to 16 damaged bytes in every block of 255 bytes, adding 14% to the data
+	ECCHigh
+)
+
+//eccBlockSize is the size of a Reed-Solomon code word over GF(256), the last block may be shorter
+const eccBlockSize = 255
+
+//paritySize returns the number of parity bytes per block of the level
+func (l ECCLevel) paritySize() int {
+	switch l {
+	case ECCLow:
+		return 8
+	case ECCMedium:
+		return 16
+	case ECCHigh:
+		return 32
+	}
+	return 0
+}
+
+func (l ECCLevel) valid() bool {
+	return l >= ECCNone && l <= ECCHigh
+}
+
+//gfExp and gfLog are the exponent and logarithm tables of GF(256) with the primitive polynomial x^8+x^4+x^3+x^2+1.
+//gfExp is doubled so that products of two exponents need no modulo.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+//gfPow returns α^e of the generator α = 2
+func gfPow(e int) byte {
+	e %= 255
+	if e < 0 {
+		e += 255
+	}
+	return gfExp[e]
+}
+
+//evaluate returns the value of the polynomial with the coefficients of the lowest degree first at x
+func evaluate(poly []byte, x byte) byte {
+	var y byte
+	for i := len(poly) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ poly[i]
+	}
+	return y
+}
+
+//reedSolomon is a systematic Reed-Solomon code with the roots α^0 ... α^(parity-1)
+type reedSolomon struct {
+	parity int
+	//generator holds the coefficients of the generator polynomial, the highest degree first
+	generator []byte
+}
+
+func newReedSolomon(parity int) *reedSolomon {
+	generator := []byte{1}
+	for i := 0; i < parity; i++ {
+		next := make([]byte, len(generator)+1) //generator * (x + α^i)
+		root := gfPow(i)
+		for j, c := range generator {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, root)
+		}
+		generator = next
+	}
+	return &reedSolomon{parity: parity, generator: generator}
+}
+
+//encode returns the parity bytes of data, the remainder of data(x) * x^parity divided by the generator
+func (rs *reedSolomon) encode(data []byte) []byte {
+	remainder := make([]byte, rs.parity)
+	for _, b := range data {
+		feedback := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[rs.parity-1] = 0
+		if feedback != 0 {
+			for j := range remainder {
+				remainder[j] ^= gfMul(rs.generator[j+1], feedback)
+			}
+		}
+	}
+	return remainder
+}
+
+//syndromes returns the values of the code word polynomial at the roots of the generator, all zero when it is intact
+func (rs *reedSolomon) syndromes(codeword []byte) ([]byte, bool) {
+	syndromes := make([]byte, rs.parity)
+	intact := true
+	for i := range syndromes {
+		x := gfPow(i)
+		var s byte
+		for _, c := range codeword {
+			s = gfMul(s, x) ^ c
+		}
+		syndromes[i] = s
+		intact = intact && s == 0
+	}
+	return syndromes, intact
+}
+
+//correct repairs the code word, data followed by its parity, in place.
+//Up to parity/2 damaged bytes are corrected, shortened code words of less than 255 bytes included.
+func (rs *reedSolomon) correct(codeword []byte) error {
+	syndromes, intact := rs.syndromes(codeword)
+	if intact {
+		return nil
+	}
+
+	//Berlekamp-Massey finds the error locator polynomial, lowest degree first
+	locator := []byte{1}
+	previous := []byte{1}
+	errors, shift, lastDiscrepancy := 0, 1, byte(1)
+	for n := 0; n < rs.parity; n++ {
+		discrepancy := syndromes[n]
+		for i := 1; i <= errors && i < len(locator); i++ {
+			discrepancy ^= gfMul(locator[i], syndromes[n-i])
+		}
+		if discrepancy == 0 {
+			shift++
+			continue
+		}
+		factor := gfDiv(discrepancy, lastDiscrepancy)
+		next := make([]byte, max(len(locator), len(previous)+shift))
+		copy(next, locator)
+		for i, c := range previous {
+			next[i+shift] ^= gfMul(factor, c)
+		}
+		if 2*errors <= n {
+			previous = locator
+			errors = n + 1 - errors
+			lastDiscrepancy = discrepancy
+			shift = 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+	if errors > rs.parity/2 {
+		return ErrUncorrectable
+	}
+
+	//Chien search finds the positions whose inverse locations are roots of the locator
+	var positions []int
+	for j := range codeword {
+		if evaluate(locator, gfPow(-(len(codeword)-1-j))) == 0 {
+			positions = append(positions, j)
+		}
+	}
+	if len(positions) != errors {
+		return ErrUncorrectable
+	}
+
+	//Forney's algorithm computes the error values from the evaluator Ω(x) = S(x)Λ(x) mod x^parity
+	evaluator := make([]byte, rs.parity)
+	for i, s := range syndromes {
+		for j, l := range locator {
+			if i+j < rs.parity {
+				evaluator[i+j] ^= gfMul(s, l)
+			}
+		}
+	}
+	derivative := make([]byte, len(locator))
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i-1] = locator[i]
+	}
+	for _, j := range positions {
+		location := gfPow(len(codeword) - 1 - j)
+		inverse := gfPow(-(len(codeword) - 1 - j))
+		denominator := evaluate(derivative, inverse)
+		if denominator == 0 {
+			return ErrUncorrectable
+		}
+		codeword[j] ^= gfMul(location, gfDiv(evaluate(evaluator, inverse), denominator))
+	}
+
+	if _, intact := rs.syndromes(codeword); !intact {
+		return ErrUncorrectable
+	}
+	return nil
+}
+
+//eccSize returns the size of size bytes of data protected by error correction of the level
+func eccSize(size int64, level ECCLevel) int64 {
+	parity := int64(level.paritySize())
+	if parity == 0 || size <= 0 {
+		return size
+	}
+	blockData := eccBlockSize - parity
+	return size + (size+blockData-1)/blockData*parity
+}
+
+//eccReader appends parity bytes to every block of data read from the underlying reader
+type eccReader struct {
+	reader  io.Reader
+	rs      *reedSolomon
+	block   []byte
+	pending []byte
+	err     error
+}
+
+func newECCReader(r io.Reader, level ECCLevel) *eccReader {
+	rs := newReedSolomon(level.paritySize())
+	return &eccReader{reader: r, rs: rs, block: make([]byte, eccBlockSize)}
+}
+
+func (e *eccReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		n, err := io.ReadFull(e.reader, e.block[:eccBlockSize-e.rs.parity])
+		if n > 0 {
+			e.pending = append(e.block[:n], e.rs.encode(e.block[:n])...)
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			e.err = io.EOF
+		default:
+			e.err = err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+//eccWriter corrects the blocks written to it and writes their data to the underlying writer.
+//Close must be called to process the last, possibly shorter block.
+type eccWriter struct {
+	writer io.Writer
+	rs     *reedSolomon
+	block  []byte
+	blocks int
+}
+
+func newECCWriter(w io.Writer, level ECCLevel) *eccWriter {
+	rs := newReedSolomon(level.paritySize())
+	return &eccWriter{writer: w, rs: rs, block: make([]byte, 0, eccBlockSize)}
+}
+
+func (e *eccWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), eccBlockSize-len(e.block))
+		e.block = append(e.block, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(e.block) == eccBlockSize {
+			if err := e.flushBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *eccWriter) flushBlock() error {
+	if len(e.block) <= e.rs.parity {
+		return fmt.Errorf("%w: truncated error correction block", ErrCorruptHeader)
+	}
+	if err := e.rs.correct(e.block); err != nil {
+		return fmt.Errorf("error correcting block %d: %w", e.blocks, err)
+	}
+	if _, err := e.writer.Write(e.block[:len(e.block)-e.rs.parity]); err != nil {
+		return err
+	}
+	e.block = e.block[:0]
+	e.blocks++
+	return nil
+}
+
+func (e *eccWriter) Close() error {
+	if len(e.block) > 0 {
+		return e.flushBlock()
+	}
+	return nil
+}
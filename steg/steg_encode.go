@@ -2,13 +2,18 @@ package steg
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/DimitarPetrov/stegify/bits"
+	"github.com/DimitarPetrov/stegify/formats"
+	_ "github.com/DimitarPetrov/stegify/formats/bmp"  //register bmp image format
+	_ "github.com/DimitarPetrov/stegify/formats/tiff" //register tiff image format
 	"image"
 	"image/draw"
 	_ "image/jpeg" //register jpeg image format
-	"image/png"
+	_ "image/png"  //register png image format
 	"io"
 	"io/ioutil"
 	"os"
@@ -16,21 +21,79 @@ import (
 
 const dataSizeHeaderReservedBytes = 20 // 20 bytes results in 30 usable bits
 
+//maxDataCount bounds the number of quarters the header counts. Its 15 quarters leave out bits 24 and 25
+//of the count, so only counts below 1<<24 survive.
+const maxDataCount = 1 << 24
+
 //Encode performs steganography encoding of data Reader in carrier
-//and writes it to the result Writer encoded as PNG image.
+//and writes it to the result Writer in the carrier's format if it is lossless or as PNG image otherwise.
+//GIF carriers are encoded with EncodeGIF and the result is written as GIF.
 func Encode(carrier io.Reader, data io.Reader, result io.Writer) error {
-	RGBAImage, format, err := getImageAsRGBA(carrier)
+	return EncodeWithFormat(carrier, data, result, "")
+}
+
+//EncodeWithFormat performs steganography encoding of data Reader in carrier
+//and writes it to the result Writer encoded in the given format.
+//An empty format keeps the carrier's format if it is lossless and falls back to PNG otherwise.
+//Lossy formats such as jpeg are rejected because they would destroy the encoded data.
+func EncodeWithFormat(carrier io.Reader, data io.Reader, result io.Writer, format string) error {
+	return EncodeWithOptions(carrier, data, result, EncodeOptions{Format: format})
+}
+
+//EncodeWithOptions performs steganography encoding of data Reader in carrier
+//and writes it to the result Writer as configured by options.
+//Ancillary chunks of PNG carriers such as text, colour profile and timestamps are kept in PNG results.
+//Fully transparent pixels are never modified. Decode detects on its own whether the alpha channel carries data.
+func EncodeWithOptions(carrier io.Reader, data io.Reader, result io.Writer, options EncodeOptions) error {
+	return EncodeContext(context.Background(), carrier, data, result, Options{EncodeOptions: options})
+}
+
+//encodeLSB is the EncodeFunc of AlgorithmLSB
+func encodeLSB(ctx context.Context, carrier io.Reader, data io.Reader, result io.Writer, options Options) error {
+	format := options.Format
+	carrier, isGIF := sniffGIF(carrier)
+	if isGIF && (format == "" || formats.Normalize(format) == formats.GIF) {
+		return EncodeGIF(carrier, data, result)
+	}
+
+	carrierBytes, err := ioutil.ReadAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error reading carrier %w", err)
+	}
+
+	img, carrierFormat, err := decodeImage(bytes.NewReader(carrierBytes))
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+
+	resultFormat, err := formats.Resolve(carrierFormat, format)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := formats.ReadMetadata(carrierBytes, carrierFormat, options.JPEGMetadata)
 	if err != nil {
-		return fmt.Errorf("error parsing carrier image: %v", err)
+		return fmt.Errorf("error reading carrier metadata: %w", err)
+	}
+
+	if is16Bit(img) && formats.IsDeep(resultFormat) {
+		NRGBA64Image := toNRGBA64(img)
+		_, gray := img.(*image.Gray16)
+		if err := encode16(ctx, NRGBA64Image, data, options.Alpha, gray); err != nil {
+			return err
+		}
+		if gray {
+			return formats.EncodeWithMetadata(result, toGray16(NRGBA64Image), resultFormat, metadata)
+		}
+		return formats.EncodeWithMetadata(result, NRGBA64Image, resultFormat, metadata)
 	}
 
-	dataBytes := make(chan byte, 128)
-	errChan := make(chan error)
+	NRGBAImage := toNRGBA(img)
 
-	go readData(data, dataBytes, errChan)
+	quarters := newQuarterReader(data)
 
-	dx := RGBAImage.Bounds().Dx()
-	dy := RGBAImage.Bounds().Dy()
+	dx := NRGBAImage.Bounds().Dx()
+	dy := NRGBAImage.Bounds().Dy()
 
 	hasMoreBytes := true
 
@@ -38,84 +101,75 @@ func Encode(carrier io.Reader, data io.Reader, result io.Writer) error {
 	var dataCount uint32
 
 	for x := 0; x < dx && hasMoreBytes; x++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		for y := 0; y < dy && hasMoreBytes; y++ {
+			pix := NRGBAImage.Pix[NRGBAImage.PixOffset(x, y):]
+			if pix[3] == 0 {
+				continue
+			}
 			if count >= dataSizeHeaderReservedBytes {
-				c := RGBAImage.RGBAAt(x, y)
-				hasMoreBytes, err = setColorSegment(&c.R, dataBytes, errChan)
-				if err != nil {
-					return err
-				}
-				if hasMoreBytes {
+				for i := 0; i < samplesUsed(pix[3], options.Alpha); i++ {
+					var quarter byte
+					quarter, hasMoreBytes, err = quarters.readQuarter()
+					if err != nil {
+						return err
+					}
+					if !hasMoreBytes {
+						break
+					}
+					if dataCount == maxDataCount-1 {
+						return quarters.capacityError((maxDataCount - 1) / 4)
+					}
+					pix[i] = bits.SetLastTwoBits(pix[i], quarter)
 					dataCount++
 				}
-				hasMoreBytes, err = setColorSegment(&c.G, dataBytes, errChan)
-				if err != nil {
-					return err
-				}
-				if hasMoreBytes {
-					dataCount++
-				}
-				hasMoreBytes, err = setColorSegment(&c.B, dataBytes, errChan)
-				if err != nil {
-					return err
-				}
-				if hasMoreBytes {
-					dataCount++
-				}
-				RGBAImage.SetRGBA(x, y, c)
 			} else {
 				count += 4
 			}
 		}
 	}
 
-	select {
-	case _, ok := <-dataBytes: // if there is more data
-		if ok {
-			return fmt.Errorf("data file too large for this carrier")
+	if hasMoreBytes {
+		more, err := quarters.hasMore()
+		if err != nil {
+			return err
+		}
+		if more {
+			return quarters.capacityError(int64(dataCount) / 4)
 		}
-	default:
 	}
 
-	setDataSizeHeader(RGBAImage, quartersOfBytesOf(dataCount))
-
-	switch format {
-	case "png", "jpeg":
-		return png.Encode(result, RGBAImage)
-	default:
-		return fmt.Errorf("unsupported carrier format")
+	header := dataCount
+	if options.Alpha {
+		header |= alphaCarrierFlag
 	}
+	if !setDataSizeHeader(NRGBAImage, quartersOfBytesOf(header)) {
+		return quarters.capacityError(0)
+	}
+
+	return formats.EncodeWithMetadata(result, NRGBAImage, resultFormat, metadata)
 }
 
 //MultiCarrierEncode performs steganography encoding of data Reader in equal pieces in each of the carriers
-//and writes it to the result Writers encoded as PNG images.
+//and writes it to the result Writers in the carriers' formats if they are lossless or as PNG images otherwise.
 func MultiCarrierEncode(carriers []io.Reader, data io.Reader, results []io.Writer) error {
-	if len(carriers) != len(results) {
-		return fmt.Errorf("different number of carriers and results")
-	}
-
-	dataBytes, err := ioutil.ReadAll(data)
-	if err != nil {
-		return fmt.Errorf("error reading data %v", err)
-	}
+	return MultiCarrierEncodeWithFormat(carriers, data, results, "")
+}
 
-	chunkSize := len(dataBytes) / len(carriers)
-	dataChunks := make([]io.Reader, 0, len(carriers))
-	chunksCount := 0
-	for i := 0; i < len(dataBytes) && chunksCount < len(carriers); i += chunkSize {
-		chunksCount++
-		if i+chunkSize >= len(dataBytes) || chunksCount == len(carriers) { // last iteration
-			dataChunks = append(dataChunks, bytes.NewReader(dataBytes[i:]))
-		}
-		dataChunks = append(dataChunks, bytes.NewReader(dataBytes[i:i+chunkSize]))
-	}
+//MultiCarrierEncodeWithFormat performs steganography encoding of data Reader in equal pieces in each of the carriers
+//and writes it to the result Writers encoded in the given format (see EncodeWithFormat).
+func MultiCarrierEncodeWithFormat(carriers []io.Reader, data io.Reader, results []io.Writer, format string) error {
+	return MultiCarrierEncodeWithOptions(carriers, data, results, EncodeOptions{Format: format})
+}
 
-	for i := 0; i < len(carriers); i++ {
-		if err := Encode(carriers[i], dataChunks[i], results[i]); err != nil {
-			return fmt.Errorf("error encoding chunk with index %d: %v", i, err)
-		}
-	}
-	return nil
+//MultiCarrierEncodeWithOptions performs steganography encoding of data Reader in equal pieces in each of the carriers
+//and writes it to the result Writers as configured by options (see EncodeWithOptions).
+//Data is streamed into the carriers one after another. Splitting it needs its size, so data which neither
+//reports its length nor can seek, e.g. standard input, is buffered in a temporary file instead of memory.
+func MultiCarrierEncodeWithOptions(carriers []io.Reader, data io.Reader, results []io.Writer, options EncodeOptions) error {
+	return MultiCarrierEncodeContext(context.Background(), carriers, data, results, Options{EncodeOptions: options})
 }
 
 //EncodeByFileNames performs steganography encoding of data file in carrier file
@@ -127,6 +181,25 @@ func EncodeByFileNames(carrierFileName, dataFileName, resultFileName string) (er
 //MultiCarrierEncodeByFileNames performs steganography encoding of data file in equal pieces in each of the carrier files
 //and saves the steganography encoded product in new set of result files.
 func MultiCarrierEncodeByFileNames(carrierFileNames []string, dataFileName string, resultFileNames []string) (err error) {
+	return MultiCarrierEncodeByFileNamesWithFormat(carrierFileNames, dataFileName, resultFileNames, "")
+}
+
+//MultiCarrierEncodeByFileNamesWithFormat performs steganography encoding of data file in equal pieces in each of the carrier files
+//and saves the steganography encoded product in new set of result files encoded in the given format (see EncodeWithFormat).
+func MultiCarrierEncodeByFileNamesWithFormat(carrierFileNames []string, dataFileName string, resultFileNames []string, format string) (err error) {
+	return MultiCarrierEncodeByFileNamesWithOptions(carrierFileNames, dataFileName, resultFileNames, EncodeOptions{Format: format})
+}
+
+//MultiCarrierEncodeByFileNamesWithOptions performs steganography encoding of data file in equal pieces in each of the carrier files
+//and saves the steganography encoded product in new set of result files as configured by options (see EncodeWithOptions).
+func MultiCarrierEncodeByFileNamesWithOptions(carrierFileNames []string, dataFileName string, resultFileNames []string, options EncodeOptions) (err error) {
+	return MultiCarrierEncodeByFileNamesContext(context.Background(), carrierFileNames, dataFileName, resultFileNames, Options{EncodeOptions: options})
+}
+
+//MultiCarrierEncodeByFileNamesContext performs steganography encoding of data file in equal pieces in each of the carrier files
+//and saves the steganography encoded product in new set of result files as configured by options (see MultiCarrierEncodeContext).
+//The result files are removed when encoding fails or is cancelled.
+func MultiCarrierEncodeByFileNamesContext(ctx context.Context, carrierFileNames []string, dataFileName string, resultFileNames []string, options Options) (err error) {
 	if len(carrierFileNames) == 0 {
 		return fmt.Errorf("missing carriers names")
 	}
@@ -137,7 +210,7 @@ func MultiCarrierEncodeByFileNames(carrierFileNames []string, dataFileName strin
 	for _, name := range carrierFileNames {
 		carrier, err := os.Open(name)
 		if err != nil {
-			return fmt.Errorf("error opening carrier file %s: %v", name, err)
+			return fmt.Errorf("error opening carrier file %s: %w", name, err)
 		}
 		defer func() {
 			closeErr := carrier.Close()
@@ -150,7 +223,7 @@ func MultiCarrierEncodeByFileNames(carrierFileNames []string, dataFileName strin
 
 	data, err := os.Open(dataFileName)
 	if err != nil {
-		return fmt.Errorf("error opening data file %s: %v", dataFileName, err)
+		return fmt.Errorf("error opening data file %s: %w", dataFileName, err)
 	}
 	defer func() {
 		closeErr := data.Close()
@@ -163,7 +236,7 @@ func MultiCarrierEncodeByFileNames(carrierFileNames []string, dataFileName strin
 	for _, name := range resultFileNames {
 		result, err := os.Create(name)
 		if err != nil {
-			return fmt.Errorf("error creating result file %s: %v", name, err)
+			return fmt.Errorf("error creating result file %s: %w", name, err)
 		}
 		defer func() {
 			closeErr := result.Close()
@@ -174,7 +247,7 @@ func MultiCarrierEncodeByFileNames(carrierFileNames []string, dataFileName strin
 		results = append(results, result)
 	}
 
-	err = MultiCarrierEncode(carriers, data, results)
+	err = MultiCarrierEncodeContext(ctx, carriers, data, results, options)
 	if err != nil {
 		for _, name := range resultFileNames {
 			_ = os.Remove(name)
@@ -197,67 +270,52 @@ func quartersOfBytesOf(counter uint32) []byte {
 	return quarters
 }
 
-func setDataSizeHeader(RGBAImage *image.RGBA, dataCountBytes []byte) {
-	dx := RGBAImage.Bounds().Dx()
-	dy := RGBAImage.Bounds().Dy()
+//setDataSizeHeader writes the header to the first non-transparent pixels and reports whether they were enough
+func setDataSizeHeader(NRGBAImage *image.NRGBA, dataCountBytes []byte) bool {
+	dx := NRGBAImage.Bounds().Dx()
+	dy := NRGBAImage.Bounds().Dy()
 
 	count := 0
 
 	for x := 0; x < dx && count < (dataSizeHeaderReservedBytes/4)*3; x++ {
 		for y := 0; y < dy && count < (dataSizeHeaderReservedBytes/4)*3; y++ {
-			c := RGBAImage.RGBAAt(x, y)
+			c := NRGBAImage.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
 			c.R = bits.SetLastTwoBits(c.R, dataCountBytes[count])
 			c.G = bits.SetLastTwoBits(c.G, dataCountBytes[count+1])
 			c.B = bits.SetLastTwoBits(c.B, dataCountBytes[count+2])
-			RGBAImage.SetRGBA(x, y, c)
+			NRGBAImage.SetNRGBA(x, y, c)
 
 			count += 3
 
 		}
 	}
+	return count == (dataSizeHeaderReservedBytes/4)*3
 }
 
-func setColorSegment(colorSegment *byte, data <-chan byte, errChan <-chan error) (hasMoreBytes bool, err error) {
-	select {
-	case byte, ok := <-data:
-		if !ok {
-			return false, nil
+func decodeImage(reader io.Reader) (image.Image, string, error) {
+	img, format, err := image.Decode(reader)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			err = fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
 		}
-		*colorSegment = bits.SetLastTwoBits(*colorSegment, byte)
-		return true, nil
-
-	case err := <-errChan:
-		return false, err
-
+		return nil, format, fmt.Errorf("error decoding carrier image: %w", err)
 	}
+	return img, format, nil
 }
 
-func readData(reader io.Reader, bytes chan<- byte, errChan chan<- error) {
-	b := make([]byte, 1)
-	for {
-		if _, err := reader.Read(b); err != nil {
-			if err == io.EOF {
-				break
-			}
-			errChan <- fmt.Errorf("error reading data %v", err)
-			return
-		}
-		for _, b := range bits.QuartersOfByte(b[0]) {
-			bytes <- b
+//toNRGBA converts the image to non-premultiplied colour, so semi-transparent pixels keep their exact samples
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	NRGBAImage := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if src, ok := img.(*image.NRGBA); ok {
+		for y := 0; y < bounds.Dy(); y++ {
+			copy(NRGBAImage.Pix[y*NRGBAImage.Stride:(y+1)*NRGBAImage.Stride], src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
 		}
-
-	}
-	close(bytes)
-}
-
-func getImageAsRGBA(reader io.Reader) (*image.RGBA, string, error) {
-	img, format, err := image.Decode(reader)
-	if err != nil {
-		return nil, format, fmt.Errorf("error decoding carrier image: %v", err)
+		return NRGBAImage
 	}
-
-	RGBAImage := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
-	draw.Draw(RGBAImage, RGBAImage.Bounds(), img, img.Bounds().Min, draw.Src)
-
-	return RGBAImage, format, nil
+	draw.Draw(NRGBAImage, NRGBAImage.Bounds(), img, bounds.Min, draw.Src)
+	return NRGBAImage
 }
@@ -2,7 +2,13 @@ package steg_test
 
 import (
 	"bytes"
+	"errors"
+	"github.com/DimitarPetrov/stegify/formats"
 	"github.com/DimitarPetrov/stegify/steg"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"os"
@@ -291,3 +297,419 @@ func AssertEncode(t *testing.T, carrierNames []string, dataName string, f func([
 		t.Error("Assertion failed!")
 	}
 }
+
+func TestEncodeShouldReturnErrorWhenDataCountOverflowsHeader(t *testing.T) {
+	carrierImage := image.NewNRGBA(image.Rect(0, 0, 2400, 2400)) //room for more quarters than the header can count
+	for i := 3; i < len(carrierImage.Pix); i += 4 {
+		carrierImage.Pix[i] = 255
+	}
+	var carrier bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	data := make([]byte, 1<<22) //1<<24 quarters
+	err := steg.Encode(&carrier, bytes.NewReader(data), ioutil.Discard)
+	var capacityErr *steg.CapacityError
+	if !errors.Is(err, steg.ErrCapacityExceeded) || !errors.As(err, &capacityErr) || capacityErr.Available != (1<<24-1)/4 {
+		t.Fatalf("Expected data whose size the header can not hold to be rejected, got %v", err)
+	}
+}
+
+func TestEncodeWithFormatShouldReturnErrorWhenFormatIsLossy(t *testing.T) {
+	carrier, err := os.Open("../examples/street.jpeg")
+	if err != nil {
+		t.Fatalf("Error opening carrier file: %v", err)
+	}
+	defer carrier.Close()
+
+	var result bytes.Buffer
+	err = steg.EncodeWithFormat(carrier, bytes.NewReader([]byte("data")), &result, "jpg")
+	if err == nil {
+		t.FailNow()
+	}
+	t.Log(err)
+}
+
+func TestEncodeShouldKeepLosslessCarrierFormat(t *testing.T) {
+	carrierImage := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(carrierImage, carrierImage.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	var carrier bytes.Buffer
+	err := png.Encode(&carrier, carrierImage)
+	if err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	var result bytes.Buffer
+	err = steg.Encode(&carrier, bytes.NewReader([]byte("data")), &result)
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	_, format, err := image.DecodeConfig(&result)
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	if format != "png" {
+		t.Errorf("Expected png result, got %s", format)
+	}
+}
+
+func TestEncode16BitCarrier(t *testing.T) {
+	carrierImage := image.NewRGBA64(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			carrierImage.SetRGBA64(x, y, color.RGBA64{R: uint16(x * 1000), G: uint16(y * 1300), B: uint16(x * y * 17), A: 0xFFFF})
+		}
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	data := make([]byte, 64*48*3-6) // a whole byte per sample, minus the size header
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	var encodeResult bytes.Buffer
+	if err := steg.Encode(&carrier, bytes.NewReader(data), &encodeResult); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	resultImage, err := png.Decode(bytes.NewReader(encodeResult.Bytes()))
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	switch resultImage.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+	default:
+		t.Fatalf("Result is not a 16-bit image: %T", resultImage)
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			r1, g1, b1, _ := carrierImage.At(x, y).RGBA()
+			r2, g2, b2, _ := resultImage.At(x, y).RGBA()
+			if r1>>8 != r2>>8 || g1>>8 != g2>>8 || b1>>8 != b2>>8 {
+				t.Fatalf("High byte of pixel (%d,%d) changed", x, y)
+			}
+		}
+	}
+
+	var decodeResult bytes.Buffer
+	if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Assertion failed!")
+	}
+}
+
+func TestEncodeGray16BitCarrier(t *testing.T) {
+	carrierImage := image.NewGray16(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			carrierImage.SetGray16(x, y, color.Gray16{Y: uint16(x*1000 + y*13)})
+		}
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	data := make([]byte, 64*48-4) // a whole byte per sample, minus the size header
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	var encodeResult bytes.Buffer
+	if err := steg.Encode(&carrier, bytes.NewReader(data), &encodeResult); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	resultImage, err := png.Decode(bytes.NewReader(encodeResult.Bytes()))
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	grayResult, ok := resultImage.(*image.Gray16)
+	if !ok {
+		t.Fatalf("Result is not a 16-bit gray image: %T", resultImage)
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			if carrierImage.Gray16At(x, y).Y>>8 != grayResult.Gray16At(x, y).Y>>8 {
+				t.Fatalf("High byte of pixel (%d,%d) changed", x, y)
+			}
+		}
+	}
+
+	var decodeResult bytes.Buffer
+	if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Assertion failed!")
+	}
+}
+
+func newTranslucentCarrier() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 60; x++ {
+			a := uint8(x * 4)
+			if x%7 == 0 {
+				a = 0 // fully transparent columns with colour data behind them
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x + y), A: a})
+		}
+	}
+	return img
+}
+
+func TestEncodeShouldSkipTransparentPixels(t *testing.T) {
+	carrierImage := newTranslucentCarrier()
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("translucent"), 100)
+	var encodeResult bytes.Buffer
+	if err := steg.Encode(&carrier, bytes.NewReader(data), &encodeResult); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	resultImage, err := png.Decode(bytes.NewReader(encodeResult.Bytes()))
+	if err != nil {
+		t.Fatalf("Error decoding result: %v", err)
+	}
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 60; x++ {
+			c := color.NRGBAModel.Convert(resultImage.At(x, y)).(color.NRGBA)
+			original := carrierImage.NRGBAAt(x, y)
+			if c.A != original.A {
+				t.Fatalf("Alpha of pixel (%d,%d) changed", x, y)
+			}
+			if original.A == 0 && c != original {
+				t.Fatalf("Transparent pixel (%d,%d) changed", x, y)
+			}
+		}
+	}
+
+	var decodeResult bytes.Buffer
+	if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Decoded data differs from the encoded one")
+	}
+}
+
+func TestEncodeWithOptionsAlphaCarrier(t *testing.T) {
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, newTranslucentCarrier()); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+	carrierBytes := carrier.Bytes()
+
+	// one byte takes four samples, so RGB alone can not hold more than 3/4 of a byte per visible pixel
+	data := make([]byte, 60*40*6/7*3/4+50)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+
+	var encodeResult bytes.Buffer
+	if err := steg.Encode(bytes.NewReader(carrierBytes), bytes.NewReader(data), &encodeResult); err == nil {
+		t.Fatal("Expected data not to fit without the alpha channel")
+	}
+
+	encodeResult.Reset()
+	err := steg.EncodeWithOptions(bytes.NewReader(carrierBytes), bytes.NewReader(data), &encodeResult, steg.EncodeOptions{Alpha: true})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	var decodeResult bytes.Buffer
+	if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Decoded data differs from the encoded one")
+	}
+}
+
+func TestEncodeShouldKeepPNGMetadata(t *testing.T) {
+	carrierImage := image.NewRGBA(image.Rect(0, 0, 50, 50))
+	draw.Draw(carrierImage, carrierImage.Bounds(), image.NewUniform(color.Gray{Y: 200}), image.Point{}, draw.Src)
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+	chunks := []formats.PNGChunk{
+		{Type: "gAMA", Data: []byte{0, 0, 0xB1, 0x8F}},
+		{Type: "tEXt", Data: []byte("Comment\x00holiday")},
+	}
+	carrier, err := formats.InsertPNGChunks(encoded.Bytes(), chunks)
+	if err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+
+	var result bytes.Buffer
+	if err := steg.Encode(bytes.NewReader(carrier), bytes.NewReader([]byte("data")), &result); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	resultChunks, err := formats.ReadPNGChunks(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		t.Fatalf("Error reading result chunks: %v", err)
+	}
+	if len(resultChunks) != len(chunks) {
+		t.Fatalf("Expected %d chunks, got %d", len(chunks), len(resultChunks))
+	}
+	for i := range chunks {
+		if resultChunks[i].Type != chunks[i].Type || !bytes.Equal(resultChunks[i].Data, chunks[i].Data) {
+			t.Errorf("Chunk %d differs: expected %v, got %v", i, chunks[i], resultChunks[i])
+		}
+	}
+}
+
+func TestEncodeBMPAndTIFFCarriers(t *testing.T) {
+	carrierImage := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			carrierImage.SetRGBA(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: uint8(x * y), A: 255})
+		}
+	}
+	data := bytes.Repeat([]byte("bmp and tiff "), 50)
+
+	for _, format := range []string{"bmp", "tiff"} {
+		t.Run(format, func(t *testing.T) {
+			var carrier bytes.Buffer
+			if err := formats.Encode(&carrier, carrierImage, format); err != nil {
+				t.Fatalf("Error creating carrier: %v", err)
+			}
+
+			var encodeResult bytes.Buffer
+			if err := steg.Encode(&carrier, bytes.NewReader(data), &encodeResult); err != nil {
+				t.Fatalf("Error encoding file: %v", err)
+			}
+			if _, resultFormat, err := image.DecodeConfig(bytes.NewReader(encodeResult.Bytes())); err != nil || resultFormat != format {
+				t.Fatalf("Expected %s result, got %s (%v)", format, resultFormat, err)
+			}
+
+			var decodeResult bytes.Buffer
+			if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+				t.Fatalf("Error decoding file: %v", err)
+			}
+			if !bytes.Equal(data, decodeResult.Bytes()) {
+				t.Error("Decoded data differs from the encoded one")
+			}
+		})
+	}
+}
+
+func TestEncode16BitCarrierToBMP(t *testing.T) {
+	carrierImage := image.NewNRGBA64(image.Rect(0, 0, 32, 32))
+	for i := range carrierImage.Pix {
+		carrierImage.Pix[i] = byte(i*37) | 0x80
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+	data := []byte("bmp keeps only 8 bits per sample")
+
+	var encodeResult bytes.Buffer
+	if err := steg.EncodeWithFormat(&carrier, bytes.NewReader(data), &encodeResult, "bmp"); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	var decodeResult bytes.Buffer
+	if err := steg.Decode(&encodeResult, &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Decoded data differs from the encoded one")
+	}
+}
+
+func newGeneratedCarrier(t testing.TB, size int) []byte {
+	carrierImage := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := range carrierImage.Pix {
+		carrierImage.Pix[i] = byte(i*31) | 0x80
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+	return carrier.Bytes()
+}
+
+func TestMultiCarrierEncodeSplitsDataOfAnyReader(t *testing.T) {
+	carrier := newGeneratedCarrier(t, 100)
+	data := bytes.Repeat([]byte("streamed data "), 700)
+
+	dataFile, err := ioutil.TempFile("", "stegify-test-data-")
+	if err != nil {
+		t.Fatalf("Error creating data file: %v", err)
+	}
+	defer os.Remove(dataFile.Name())
+	defer dataFile.Close()
+	if _, err := dataFile.Write(data); err != nil {
+		t.Fatalf("Error writing data file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data func() io.Reader
+	}{
+		{"reader with length", func() io.Reader { return bytes.NewReader(data) }},
+		{"seekable file", func() io.Reader { _, _ = dataFile.Seek(0, io.SeekStart); return dataFile }},
+		{"reader of unknown size", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(data)} }},
+		{"empty data", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(nil)} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, err := ioutil.ReadAll(test.data())
+			if err != nil {
+				t.Fatalf("Error reading data: %v", err)
+			}
+
+			carriers := make([]io.Reader, 3)
+			results := make([]io.Writer, 3)
+			buffers := make([]*bytes.Buffer, 3)
+			for i := range carriers {
+				carriers[i] = bytes.NewReader(carrier)
+				buffers[i] = &bytes.Buffer{}
+				results[i] = buffers[i]
+			}
+			if err := steg.MultiCarrierEncode(carriers, test.data(), results); err != nil {
+				t.Fatalf("Error encoding file: %v", err)
+			}
+
+			encoded := make([]io.Reader, 3)
+			for i := range buffers {
+				encoded[i] = buffers[i]
+			}
+			var decodeResult bytes.Buffer
+			if err := steg.MultiCarrierDecode(encoded, &decodeResult); err != nil {
+				t.Fatalf("Error decoding file: %v", err)
+			}
+			if !bytes.Equal(expected, decodeResult.Bytes()) {
+				t.Errorf("Decoded data differs from the encoded one: expected %d bytes, got %d", len(expected), decodeResult.Len())
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeLargeData(b *testing.B) {
+	carrier := newGeneratedCarrier(b, 2048)
+	data := bytes.Repeat([]byte{0x5A}, (2048*2048-5)*3/4) //5 pixels hold the data size
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := steg.Encode(bytes.NewReader(carrier), bytes.NewReader(data), ioutil.Discard); err != nil {
+			b.Fatalf("Error encoding file: %v", err)
+		}
+	}
+}
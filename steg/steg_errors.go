@@ -0,0 +1,43 @@
+package steg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/DimitarPetrov/stegify/formats"
+)
+
+//Errors returned by this package and the algorithms registered in it wrap one of these values when their cause is one of them,
+//so callers can tell causes apart with errors.Is.
+var (
+	//ErrCapacityExceeded is matched by errors of data that does not fit the carriers, which are CapacityError values
+	ErrCapacityExceeded = errors.New("data file too large for this carrier")
+	//ErrNoPayload is returned when a carrier is too small to hold data or holds no data at all
+	ErrNoPayload = errors.New("carrier holds no data")
+	//ErrAuthFailed is returned when encrypted data can not be decrypted because of a wrong or missing key or because it was modified
+	ErrAuthFailed = errors.New("payload authentication failed: wrong key or modified data")
+	//ErrUnsupportedFormat is returned for carriers and results in formats that can not be used
+	ErrUnsupportedFormat = formats.ErrUnsupportedFormat
+	//ErrCorruptHeader is returned when the header or framing of hidden data is invalid,
+	//typically because the carrier holds no data of the algorithm or the options differ from the ones used for encoding
+	ErrCorruptHeader = errors.New("invalid or corrupt header")
+	//ErrShardMissing is returned when data spread over several carriers or frames is missing some of its pieces or they are out of order
+	ErrShardMissing = errors.New("piece of data missing or out of order")
+	//ErrUncorrectable is returned when hidden data is damaged beyond what its error correction repairs
+	ErrUncorrectable = errors.New("data damaged beyond error correction")
+)
+
+//CapacityError reports the number of payload bytes needed to hide data and the number available in the carrier.
+//The payload includes the overhead of encryption and error correction. It matches ErrCapacityExceeded.
+type CapacityError struct {
+	Needed    int64
+	Available int64
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("%v: %d bytes needed, %d available", ErrCapacityExceeded, e.Needed, e.Available)
+}
+
+//Is makes capacity errors match ErrCapacityExceeded
+func (e *CapacityError) Is(target error) bool {
+	return target == ErrCapacityExceeded
+}
@@ -0,0 +1,75 @@
+package steg_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DimitarPetrov/stegify/steg"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+//newUniformCarrier returns a png carrier of size x size pixels of the colour c
+func newUniformCarrier(t *testing.T, size int, c color.NRGBA) []byte {
+	carrierImage := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			carrierImage.SetNRGBA(x, y, c)
+		}
+	}
+	var carrier bytes.Buffer
+	if err := png.Encode(&carrier, carrierImage); err != nil {
+		t.Fatalf("Error creating carrier: %v", err)
+	}
+	return carrier.Bytes()
+}
+
+func TestEncodeShouldReturnCapacityError(t *testing.T) {
+	data := randomData(4000)
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader(data), &bytes.Buffer{}, steg.Options{})
+	if !errors.Is(err, steg.ErrCapacityExceeded) {
+		t.Fatalf("Expected ErrCapacityExceeded, got %v", err)
+	}
+	var capacityErr *steg.CapacityError
+	if !errors.As(err, &capacityErr) {
+		t.Fatalf("Expected a CapacityError, got %T", err)
+	}
+	available := int64(64*64-5) * 3 / 4 //3 samples of two bits per pixel after the header
+	if capacityErr.Needed != int64(len(data)) || capacityErr.Available != available {
+		t.Errorf("Expected %d bytes needed and %d available, got %d and %d", len(data), available, capacityErr.Needed, capacityErr.Available)
+	}
+}
+
+func TestDecodeShouldReturnSentinelErrors(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 64)), bytes.NewReader([]byte("secret data")), &encrypted, steg.Options{Key: "right"})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	var corrected bytes.Buffer
+	err = steg.EncodeContext(context.Background(), bytes.NewReader(newGeneratedCarrier(t, 256)), bytes.NewReader(randomData(20000)), &corrected, steg.Options{ECC: steg.ECCLow})
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		carrier  []byte
+		options  steg.Options
+		expected error
+	}{
+		{"wrong key", encrypted.Bytes(), steg.Options{Key: "wrong"}, steg.ErrAuthFailed},
+		{"carrier too small for a header", newUniformCarrier(t, 2, color.NRGBA{A: 255}), steg.Options{}, steg.ErrNoPayload},
+		{"carrier without data", newUniformCarrier(t, 16, color.NRGBA{R: 255, G: 255, B: 255, A: 255}), steg.Options{}, steg.ErrCorruptHeader},
+		{"unsupported carrier", []byte("not an image"), steg.Options{}, steg.ErrUnsupportedFormat},
+		{"damage beyond error correction", damage(t, corrected.Bytes(), 3), steg.Options{ECC: steg.ECCLow}, steg.ErrUncorrectable},
+	}
+	for _, test := range tests {
+		err := steg.DecodeContext(context.Background(), bytes.NewReader(test.carrier), &bytes.Buffer{}, test.options)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package steg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+const gifFrameHeaderBytes = 8 // frame index (2), frames count (2), chunk length (4)
+
+//gifMaxFrames is the most frames that can carry data, as many as the 16-bit frame index and count of the header address
+const gifMaxFrames = 1<<16 - 1
+
+//paletteOrder maps palette indices to their rank when the palette is sorted by luminance.
+//Entries are paired as ranks (2k, 2k+1), so neighbours in the pair look almost the same.
+type paletteOrder struct {
+	rank   [256]int // rank of a palette index, -1 when the index can not carry data
+	byRank []uint8  // palette index of a rank
+}
+
+func newPaletteOrder(palette color.Palette) paletteOrder {
+	indices := make([]uint8, 0, len(palette))
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			continue // modifying transparent pixels would change nothing visible but is easy to spot
+		}
+		indices = append(indices, uint8(i))
+	}
+
+	luminance := func(i uint8) uint32 {
+		r, g, b, _ := palette[i].RGBA()
+		return 299*(r>>8) + 587*(g>>8) + 114*(b>>8)
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return luminance(indices[i]) < luminance(indices[j])
+	})
+	if len(indices)%2 == 1 {
+		indices = indices[:len(indices)-1] // the last entry has no partner
+	}
+
+	order := paletteOrder{byRank: indices}
+	for i := range order.rank {
+		order.rank[i] = -1
+	}
+	for r, i := range indices {
+		order.rank[i] = r
+	}
+	return order
+}
+
+//gifFrameCapacity returns the number of bits that can be hidden in a frame
+func gifFrameCapacity(frame *image.Paletted, order paletteOrder) int {
+	capacity := 0
+	forEachPixel(frame, func(offset int) {
+		if order.rank[frame.Pix[offset]] >= 0 {
+			capacity++
+		}
+	})
+	return capacity
+}
+
+func forEachPixel(frame *image.Paletted, f func(offset int)) {
+	bounds := frame.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			f(frame.PixOffset(x, y))
+		}
+	}
+}
+
+//EncodeGIF performs EzStego steganography encoding of data Reader in a GIF carrier and writes the result GIF to the result Writer.
+//Every bit is stored in the parity of the luminance rank of a pixel's palette index,
+//so palette, animation and timing of the carrier are preserved.
+//For animated GIFs the data is spread over all frames proportionally to their capacity,
+//using the first 65535 frames that can hold data only.
+func EncodeGIF(carrier io.Reader, data io.Reader, result io.Writer) error {
+	g, err := gif.DecodeAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+
+	orders := make([]paletteOrder, len(g.Image))
+	capacities := make([]int, len(g.Image)) // payload bytes per frame, excluding the header
+	var frames []int
+	totalCapacity := 0
+	for i, frame := range g.Image {
+		orders[i] = newPaletteOrder(frame.Palette)
+		capacities[i] = gifFrameCapacity(frame, orders[i])/8 - gifFrameHeaderBytes
+		if capacities[i] >= 0 && len(frames) < gifMaxFrames {
+			frames = append(frames, i)
+			totalCapacity += capacities[i]
+		}
+	}
+	//reading one byte more than fits is enough to tell that the data is too large
+	dataBytes, err := ioutil.ReadAll(io.LimitReader(data, int64(totalCapacity)+1))
+	if err != nil {
+		return fmt.Errorf("error reading data %w", err)
+	}
+	if len(dataBytes) > totalCapacity {
+		left, err := io.Copy(ioutil.Discard, data)
+		if err != nil {
+			return fmt.Errorf("error reading data %w", err)
+		}
+		return &CapacityError{Needed: int64(len(dataBytes)) + left, Available: int64(totalCapacity)}
+	}
+
+	chunks := make([]int, len(g.Image))
+	assigned := 0
+	for _, i := range frames {
+		if totalCapacity > 0 {
+			chunks[i] = len(dataBytes) * capacities[i] / totalCapacity
+		}
+		assigned += chunks[i]
+	}
+	for _, i := range frames { // hand out the rounding remainder
+		extra := min(len(dataBytes)-assigned, capacities[i]-chunks[i])
+		chunks[i] += extra
+		assigned += extra
+	}
+
+	offset := 0
+	for n, i := range frames {
+		payload := make([]byte, gifFrameHeaderBytes, gifFrameHeaderBytes+chunks[i])
+		binary.BigEndian.PutUint16(payload[0:], uint16(n))
+		binary.BigEndian.PutUint16(payload[2:], uint16(len(frames)))
+		binary.BigEndian.PutUint32(payload[4:], uint32(chunks[i]))
+		payload = append(payload, dataBytes[offset:offset+chunks[i]]...)
+		offset += chunks[i]
+
+		embedInFrame(g.Image[i], orders[i], payload)
+	}
+
+	return gif.EncodeAll(result, g)
+}
+
+func embedInFrame(frame *image.Paletted, order paletteOrder, payload []byte) {
+	bit := 0
+	forEachPixel(frame, func(offset int) {
+		if bit >= len(payload)*8 {
+			return
+		}
+		rank := order.rank[frame.Pix[offset]]
+		if rank < 0 {
+			return
+		}
+		value := (payload[bit/8] >> uint(7-bit%8)) & 1
+		if rank&1 != int(value) {
+			frame.Pix[offset] = order.byRank[rank^1]
+		}
+		bit++
+	})
+}
+
+func extractFromFrame(frame *image.Paletted, order paletteOrder, offsetBytes, n int) []byte {
+	data := make([]byte, n)
+	skip := offsetBytes * 8
+	bit := 0
+	forEachPixel(frame, func(offset int) {
+		if bit >= n*8 {
+			return
+		}
+		rank := order.rank[frame.Pix[offset]]
+		if rank < 0 {
+			return
+		}
+		if skip > 0 {
+			skip--
+			return
+		}
+		data[bit/8] |= byte(rank&1) << uint(7-bit%8)
+		bit++
+	})
+	return data
+}
+
+//DecodeGIF performs steganography decoding of a GIF with data previously encoded by the EncodeGIF function and writes to result Writer.
+func DecodeGIF(carrier io.Reader, result io.Writer) error {
+	g, err := gif.DecodeAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error parsing carrier image: %w", err)
+	}
+
+	n := 0
+	for _, frame := range g.Image {
+		order := newPaletteOrder(frame.Palette)
+		capacity := gifFrameCapacity(frame, order)/8 - gifFrameHeaderBytes
+		if capacity < 0 {
+			continue
+		}
+
+		header := extractFromFrame(frame, order, 0, gifFrameHeaderBytes)
+		index := int(binary.BigEndian.Uint16(header[0:]))
+		count := int(binary.BigEndian.Uint16(header[2:]))
+		length := int(binary.BigEndian.Uint32(header[4:]))
+		if index != n || length > capacity {
+			return fmt.Errorf("%w: frame header in frame %d", ErrCorruptHeader, n)
+		}
+
+		if _, err := result.Write(extractFromFrame(frame, order, gifFrameHeaderBytes, length)); err != nil {
+			return err
+		}
+
+		n++
+		if n == count {
+			return nil
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: no frame can hold data", ErrNoPayload)
+	}
+	return fmt.Errorf("%w: found %d of the frames holding data", ErrShardMissing, n)
+}
+
+//sniffGIF reports whether the reader holds a GIF without consuming it
+func sniffGIF(reader io.Reader) (io.Reader, bool) {
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(6)
+	return buffered, bytes.Equal(magic, []byte("GIF87a")) || bytes.Equal(magic, []byte("GIF89a"))
+}
@@ -0,0 +1,107 @@
+package steg_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/DimitarPetrov/stegify/steg"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncodeGIF(t *testing.T) {
+	carrierBytes, err := ioutil.ReadFile("../examples/video.gif")
+	if err != nil {
+		t.Fatalf("Error reading carrier file: %v", err)
+	}
+	data, err := ioutil.ReadFile("../examples/lake.jpeg")
+	if err != nil {
+		t.Fatalf("Error reading data file: %v", err)
+	}
+
+	var encodeResult bytes.Buffer
+	err = steg.Encode(bytes.NewReader(carrierBytes), bytes.NewReader(data), &encodeResult)
+	if err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+
+	original, err := gif.DecodeAll(bytes.NewReader(carrierBytes))
+	if err != nil {
+		t.Fatalf("Error decoding carrier: %v", err)
+	}
+	encoded, err := gif.DecodeAll(bytes.NewReader(encodeResult.Bytes()))
+	if err != nil {
+		t.Fatalf("Result is not a valid GIF: %v", err)
+	}
+	if len(encoded.Image) != len(original.Image) {
+		t.Fatalf("Frames count changed: %d != %d", len(encoded.Image), len(original.Image))
+	}
+	for i := range original.Image {
+		if encoded.Delay[i] != original.Delay[i] || len(encoded.Image[i].Palette) != len(original.Image[i].Palette) {
+			t.Fatalf("Frame %d timing or palette changed", i)
+		}
+	}
+
+	var decodeResult bytes.Buffer
+	err = steg.Decode(bytes.NewReader(encodeResult.Bytes()), &decodeResult)
+	if err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Assertion failed!")
+	}
+}
+
+func TestEncodeGIFShouldReturnErrorWhenDataFileTooLarge(t *testing.T) {
+	carrier, err := os.Open("../examples/video.gif")
+	if err != nil {
+		t.Fatalf("Error opening carrier file: %v", err)
+	}
+	defer carrier.Close()
+
+	data := bytes.NewReader(make([]byte, 20*1024*1024))
+
+	var result bytes.Buffer
+	err = steg.EncodeGIF(carrier, data, &result)
+	if err == nil {
+		t.FailNow()
+	}
+	t.Log(err)
+}
+
+func TestEncodeGIFUsesAtMost65535Frames(t *testing.T) {
+	//every frame of 9x8 pixels holds its header and a single byte of data
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < 1<<16+1; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 9, 8), palette))
+		g.Delay = append(g.Delay, 0)
+	}
+	var carrier bytes.Buffer
+	if err := gif.EncodeAll(&carrier, g); err != nil {
+		t.Fatalf("Error encoding carrier: %v", err)
+	}
+
+	data := bytes.Repeat([]byte{0xA5}, 1<<16-1)
+	var encodeResult bytes.Buffer
+	if err := steg.EncodeGIF(bytes.NewReader(carrier.Bytes()), bytes.NewReader(data), &encodeResult); err != nil {
+		t.Fatalf("Error encoding file: %v", err)
+	}
+	var decodeResult bytes.Buffer
+	if err := steg.DecodeGIF(bytes.NewReader(encodeResult.Bytes()), &decodeResult); err != nil {
+		t.Fatalf("Error decoding file: %v", err)
+	}
+	if !bytes.Equal(data, decodeResult.Bytes()) {
+		t.Error("Assertion failed!")
+	}
+
+	err := steg.EncodeGIF(bytes.NewReader(carrier.Bytes()), bytes.NewReader(append(data, 0)), ioutil.Discard)
+	var capacityErr *steg.CapacityError
+	if !errors.As(err, &capacityErr) || capacityErr.Available != 1<<16-1 {
+		t.Errorf("Expected data needing more than 65535 frames to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package steg
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/DimitarPetrov/stegify/bits"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//quarterReader streams the quarters of the bytes of a reader, so data never has to be held in memory
+type quarterReader struct {
+	reader   *bufio.Reader
+	quarters [4]byte
+	next     int   //index of the next quarter in quarters, 4 when the next byte has to be read
+	read     int64 //number of bytes read
+}
+
+func newQuarterReader(r io.Reader) *quarterReader {
+	return &quarterReader{reader: bufio.NewReader(r), next: 4}
+}
+
+//readQuarter returns the next quarter of the data and false once the data is exhausted
+func (q *quarterReader) readQuarter() (byte, bool, error) {
+	if q.next == 4 {
+		b, err := q.reader.ReadByte()
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("error reading data: %w", err)
+		}
+		q.quarters = bits.QuartersOfByte(b)
+		q.next = 0
+		q.read++
+	}
+	quarter := q.quarters[q.next]
+	q.next++
+	return quarter, true, nil
+}
+
+//hasMore reports whether there are quarters left without consuming them
+func (q *quarterReader) hasMore() (bool, error) {
+	if q.next < 4 {
+		return true, nil
+	}
+	_, err := q.reader.Peek(1)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading data: %w", err)
+	}
+	return true, nil
+}
+
+//capacityError returns the error of data that does not fit the available bytes.
+//It reads the rest of the data to tell how many bytes are needed.
+func (q *quarterReader) capacityError(available int64) error {
+	left, err := io.Copy(ioutil.Discard, q.reader)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+	return &CapacityError{Needed: q.read + left, Available: available}
+}
+
+//quarterWriter assembles quarters into bytes and writes them through a buffer as soon as they are complete
+type quarterWriter struct {
+	writer   *bufio.Writer
+	quarters [4]byte
+	count    int
+}
+
+func newQuarterWriter(w io.Writer) *quarterWriter {
+	return &quarterWriter{writer: bufio.NewWriter(w)}
+}
+
+func (q *quarterWriter) writeQuarter(quarter byte) error {
+	q.quarters[q.count] = quarter
+	q.count++
+	if q.count < 4 {
+		return nil
+	}
+	q.count = 0
+	return q.writer.WriteByte(bits.ConstructByteOfQuartersAsSlice(q.quarters[:]))
+}
+
+//flush writes an incomplete last byte padded with zero quarters and flushes the buffer
+func (q *quarterWriter) flush() error {
+	if q.count > 0 {
+		for i := q.count; i < 4; i++ {
+			q.quarters[i] = 0
+		}
+		q.count = 0
+		if err := q.writer.WriteByte(bits.ConstructByteOfQuartersAsSlice(q.quarters[:])); err != nil {
+			return err
+		}
+	}
+	return q.writer.Flush()
+}
+
+//knownSize returns the number of bytes left in data if data reports its length or can seek, and -1 otherwise
+func knownSize(data io.Reader) (int64, bool, error) {
+	if l, ok := data.(interface{ Len() int }); ok {
+		return int64(l.Len()), true, nil
+	}
+	if seeker, ok := data.(io.Seeker); ok {
+		if current, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return -1, false, fmt.Errorf("error reading data: %w", err)
+			}
+			if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+				return -1, false, fmt.Errorf("error reading data: %w", err)
+			}
+			return end - current, true, nil
+		}
+	}
+	return -1, false, nil
+}
+
+//sizeOf returns the number of bytes left in data along with a reader of them.
+//Readers that know their length or can seek are used as they are, anything else, e.g. a pipe,
+//is spooled to a temporary file so it can be split without holding it in memory.
+//cleanup removes the temporary file and must be called once the returned reader is no longer used.
+func sizeOf(data io.Reader) (size int64, reader io.Reader, cleanup func(), err error) {
+	cleanup = func() {}
+	size, ok, err := knownSize(data)
+	if err != nil || ok {
+		return size, data, cleanup, err
+	}
+
+	spool, err := ioutil.TempFile("", "stegify-data-")
+	if err != nil {
+		return 0, nil, cleanup, fmt.Errorf("error buffering data %w", err)
+	}
+	cleanup = func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}
+	size, err = io.Copy(spool, data)
+	if err != nil {
+		cleanup()
+		return 0, nil, func() {}, fmt.Errorf("error reading data: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return 0, nil, func() {}, fmt.Errorf("error buffering data %w", err)
+	}
+	return size, spool, cleanup, nil
+}
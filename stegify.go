@@ -2,10 +2,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/DimitarPetrov/stegify/advanced"
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/formats/avi"
 	"github.com/DimitarPetrov/stegify/steg"
+	"github.com/DimitarPetrov/stegify/structural"
+	"image"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
 )
 
@@ -28,6 +37,47 @@ var carrierFiles = flag.String("carriers", "", "carrier files in which the data
 var dataFile = flag.String("data", "", "data file which is being encoded in the carrier")
 var resultFilesSlice sliceFlag
 var resultFiles = flag.String("results", "", "names of the result files (separated by space)")
+var outputFormat = flag.String("output-format", "", "format of the result files when encoding, e.g. png (defaults to the carrier format when it is lossless and png otherwise)")
+var alpha = flag.Bool("alpha", false, "also encode data in the alpha channel of semi-transparent pixels")
+var jpegMetadata = flag.Bool("jpeg-metadata", false, "copy EXIF data and ICC profile of jpeg carriers into the png results")
+var structuralMode = flag.Bool("structural", false, "hide the data in a private png chunk or jpeg APP segment instead of the pixels")
+var key = flag.String("key", "", "encrypt the data with the given passphrase, decoding needs the same passphrase")
+var algorithm = flag.String("algorithm", steg.AlgorithmLSB, "algorithm hiding the data in the pixels: lsb, advanced (edge-adaptive, hides less but is harder to detect) or juniward (in the DCT coefficients of jpeg carriers, writes jpeg results)")
+var ecc = flag.String("ecc", "none", "error correction repairing damaged carriers: none, low, medium or high, decoding needs the same level")
+var maxPixels = flag.Int64("max-pixels", 0, "reject carriers with more pixels (0 for no limit)")
+
+var eccLevels = map[string]steg.ECCLevel{
+	"none":   steg.ECCNone,
+	"low":    steg.ECCLow,
+	"medium": steg.ECCMedium,
+	"high":   steg.ECCHigh,
+}
+
+//exitCodes are the exit codes of errors by their cause, checked in order. Other errors exit with 1.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{steg.ErrCapacityExceeded, 3},
+	{steg.ErrNoPayload, 4},
+	{steg.ErrAuthFailed, 5},
+	{steg.ErrUnsupportedFormat, 6},
+	{steg.ErrCorruptHeader, 7},
+	{steg.ErrShardMissing, 8},
+	{steg.ErrUncorrectable, 9},
+	{context.Canceled, 130},
+}
+
+//mediaEncoders and mediaDecoders handle audio and video carriers by their kind (see mediaKind)
+var mediaEncoders = map[string]func(carrier, data, result string) error{
+	"wav": advanced.AdvancedEncodeWAVByFileNames,
+	"avi": advanced.EncodeAVIByFileNames,
+}
+
+var mediaDecoders = map[string]func(carrier, result string) error{
+	"wav": advanced.AdvancedDecodeWAVByFileNames,
+	"avi": advanced.DecodeAVIByFileNames,
+}
 
 func init() {
 	flag.StringVar(carrierFiles, "c", "", "carrier files in which the data is encoded (separated by space, shorthand for --carriers)")
@@ -38,6 +88,8 @@ func init() {
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stdout, "Usage: stegify [encode/decode] [flags...]")
+		fmt.Fprintln(os.Stdout, "       stegify analyze [--json] [--workers <n>] [--model <file>] <files or directories...>")
+		fmt.Fprintln(os.Stdout, "       stegify visualize --carrier <file> [--cover <file>] [--result <directory>]")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stdout, `NOTE: When multiple carriers are provided with different kinds of flags, the names provided through "carrier" flag are taken first and with "carriers"/"c" flags second. Same goes for the "result"/"results" flags.`)
 		fmt.Fprintln(os.Stdout, `NOTE: When no results are provided a default values will be used for the names of the results.`)
@@ -47,14 +99,22 @@ func init() {
 func main() {
 	operation := parseOperation()
 	flag.Parse()
+	if operation == analyze {
+		runAnalyze()
+		return
+	}
 	carriers := parseCarriers()
 	results := parseResults()
+	if operation == visualize {
+		runVisualize(carriers, results)
+		return
+	}
 
 	switch operation {
 	case encode:
 		if len(results) == 0 { // if no results provided use defaults
-			for i := range carriers {
-				results = append(results, fmt.Sprintf("result%d", i))
+			for i, carrier := range carriers {
+				results = append(results, defaultResult(i, carrier))
 			}
 		}
 		if len(results) != len(carriers) {
@@ -66,11 +126,35 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := steg.MultiCarrierEncodeByFileNames(carriers, *dataFile, results)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		if formats.IsLossy(*outputFormat) && *algorithm != advanced.JPEGAlgorithm {
+			fmt.Fprintf(os.Stderr, "Output format %s is lossy and would destroy the encoded data. Use a lossless format such as png.\n", *outputFormat)
 			os.Exit(1)
 		}
+
+		if *structuralMode {
+			checkStructuralOptions(carriers)
+			if err := structural.EncodeByFileNames(carriers[0], *dataFile, results[0], structural.Options{Key: *key}); err != nil {
+				exit(err)
+			}
+			return
+		}
+		if kind := mediaKind(carriers[0]); kind != "" {
+			checkMediaOptions(kind, carriers)
+			if err := mediaEncoders[kind](carriers[0], *dataFile, results[0]); err != nil {
+				exit(err)
+			}
+			return
+		}
+
+		checkAlgorithmOptions()
+		options := parseOptions()
+		options.EncodeOptions = steg.EncodeOptions{Format: *outputFormat, Alpha: *alpha, JPEGMetadata: *jpegMetadata}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err := steg.MultiCarrierEncodeByFileNamesContext(ctx, carriers, *dataFile, results, options)
+		if err != nil {
+			exit(err)
+		}
 	case decode:
 		if len(results) == 0 { // if no result provided use default
 			results = append(results, "result")
@@ -79,21 +163,38 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Only one result file expected.")
 			os.Exit(1)
 		}
-		err := steg.MultiCarrierDecodeByFileNames(carriers, results[0])
+		if *structuralMode {
+			checkStructuralOptions(carriers)
+			if err := structural.DecodeByFileNames(carriers[0], results[0], structural.Options{Key: *key}); err != nil {
+				exit(err)
+			}
+			return
+		}
+
+		if kind := mediaKind(carriers[0]); kind != "" {
+			checkMediaOptions(kind, carriers)
+			if err := mediaDecoders[kind](carriers[0], results[0]); err != nil {
+				exit(err)
+			}
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err := steg.MultiCarrierDecodeByFileNamesContext(ctx, carriers, results[0], parseOptions())
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exit(err)
 		}
 	}
 }
 
 func parseOperation() string {
 	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Operation must be specified [encode/decode]. Use stegify --help for more information.")
+		fmt.Fprintln(os.Stderr, "Operation must be specified [encode/decode/analyze/visualize]. Use stegify --help for more information.")
 		os.Exit(1)
 	}
 	operation := os.Args[1]
-	if operation != encode && operation != decode {
+	if operation != encode && operation != decode && operation != analyze && operation != visualize {
 		helpFlags := map[string]bool{
 			"--help": true,
 			"-help":  true,
@@ -104,7 +205,7 @@ func parseOperation() string {
 			flag.Parse()
 			os.Exit(0)
 		}
-		fmt.Fprintf(os.Stderr, "Unsupported operation: %s. Only [encode/decode] operations are supported.\n Use stegify --help for more information.", operation)
+		fmt.Fprintf(os.Stderr, "Unsupported operation: %s. Only [encode/decode/analyze/visualize] operations are supported.\n Use stegify --help for more information.", operation)
 		os.Exit(1)
 	}
 
@@ -142,3 +243,125 @@ func parseResults() []string {
 
 	return results
 }
+
+//defaultResult returns the default name of the result of the i-th carrier, which has the extension of the format
+//the result is written in. Results of carriers that can not be read get no extension, encoding reports the error.
+func defaultResult(i int, carrier string) string {
+	name := fmt.Sprintf("result%d", i)
+	if kind := mediaKind(carrier); kind != "" {
+		return name + "." + kind
+	}
+	f, err := os.Open(carrier)
+	if err != nil {
+		return name
+	}
+	defer f.Close()
+
+	_, carrierFormat, err := image.DecodeConfig(f)
+	if err != nil {
+		return name
+	}
+	if *structuralMode { //the carrier is written back in its own format
+		return name + "." + carrierFormat
+	}
+	if *algorithm == advanced.JPEGAlgorithm {
+		return name + "." + formats.JPEG
+	}
+	if carrierFormat == formats.GIF && (*outputFormat == "" || formats.Normalize(*outputFormat) == formats.GIF) {
+		return name + "." + formats.GIF
+	}
+	format, err := formats.Resolve(carrierFormat, *outputFormat)
+	if err != nil {
+		return name
+	}
+	return name + "." + format
+}
+
+//parseOptions returns the options of hiding data in the pixels of image carriers
+func parseOptions() steg.Options {
+	level, ok := eccLevels[*ecc]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unsupported error correction level: %s. Use none, low, medium or high.\n", *ecc)
+		os.Exit(1)
+	}
+	return steg.Options{Algorithm: *algorithm, Key: *key, ECC: level, MaxPixels: *maxPixels}
+}
+
+//checkStructuralOptions exits when structural mode is combined with multiple carriers or options it does not support
+func checkStructuralOptions(carriers []string) {
+	if len(carriers) != 1 {
+		fmt.Fprintln(os.Stderr, "Structural mode supports a single carrier.")
+		os.Exit(1)
+	}
+	if *ecc != "none" || *algorithm != steg.AlgorithmLSB {
+		fmt.Fprintln(os.Stderr, "The ecc and algorithm flags are not supported in structural mode.")
+		os.Exit(1)
+	}
+}
+
+//checkAlgorithmOptions exits when the algorithm does not support the encoding options
+func checkAlgorithmOptions() {
+	if *algorithm == advanced.Algorithm && *alpha {
+		fmt.Fprintln(os.Stderr, "The alpha flag is not supported by the advanced algorithm, which hides data in the red channel only.")
+		os.Exit(1)
+	}
+	if *algorithm == advanced.JPEGAlgorithm {
+		if *alpha || *jpegMetadata {
+			fmt.Fprintln(os.Stderr, "The alpha and jpeg-metadata flags are not supported by the juniward algorithm, which keeps the jpeg carrier.")
+			os.Exit(1)
+		}
+		if *outputFormat != "" && formats.Normalize(*outputFormat) != formats.JPEG {
+			fmt.Fprintf(os.Stderr, "The juniward algorithm writes jpeg results, not %s.\n", *outputFormat)
+			os.Exit(1)
+		}
+	}
+}
+
+//checkMediaOptions exits when audio or video carriers are combined with other carriers or options they do not support
+func checkMediaOptions(kind string, carriers []string) {
+	if len(carriers) != 1 {
+		fmt.Fprintf(os.Stderr, "%s carriers can not be combined with other carriers.\n", kind)
+		os.Exit(1)
+	}
+	if *outputFormat != "" || *alpha || *jpegMetadata || *maxPixels != 0 {
+		fmt.Fprintf(os.Stderr, "Flags --output-format, --alpha, --jpeg-metadata and --max-pixels do not apply to %s carriers.\n", kind)
+		os.Exit(1)
+	}
+	if *key != "" || *ecc != "none" || *algorithm != steg.AlgorithmLSB {
+		fmt.Fprintf(os.Stderr, "The key, ecc and algorithm flags are not supported for %s carriers.\n", kind)
+		os.Exit(1)
+	}
+}
+
+//exit prints err and exits with the code of its cause
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			os.Exit(e.code)
+		}
+	}
+	os.Exit(1)
+}
+
+//mediaKind returns the kind of audio or video carriers and an empty string for images, which are left to steg.
+//Unreadable files are left to steg as well, which reports the error.
+func mediaKind(fileName string) string {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return ""
+	}
+	switch {
+	case advanced.IsWAV(header):
+		return "wav"
+	case avi.IsAVI(header):
+		return "avi"
+	}
+	return ""
+}
@@ -2,11 +2,14 @@ package main_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/DimitarPetrov/stegify/advanced/security"
 	"github.com/DimitarPetrov/stegify/steg"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -76,19 +79,30 @@ func TestEncode(t *testing.T) {
 			name:    "Encode with single carrier should add default result name",
 			args:    []string{"encode", "--carrier", "examples/street.jpeg", "--data", "examples/lake.jpeg"},
 			data:    "examples/lake.jpeg",
-			results: []string{"result0"},
+			results: []string{"result0.png"},
 		},
 		{
 			name:    "Encode with multiple carriers using --carriers should add default result names",
 			args:    []string{"encode", "--carriers", "examples/street.jpeg examples/lake.jpeg", "--data", "examples/video.mp4"},
 			data:    "examples/video.mp4",
-			results: []string{"result0", "result1"},
+			results: []string{"result0.png", "result1.png"},
+		},
+		{
+			name:    "Encode with gif carrier should add default result name with gif extension",
+			args:    []string{"encode", "--carrier", "examples/video.gif", "--data", "examples/lake.jpeg"},
+			data:    "examples/lake.jpeg",
+			results: []string{"result0.gif"},
 		},
 		{
 			name:       "Encode carriers count does not match results count should return an error",
 			args:       []string{"encode", "--carriers", "examples/street.jpeg examples/lake.jpeg", "--data", "examples/video.mp4", "--results", "result1.jpeg"},
 			shouldFail: true,
 		},
+		{
+			name:       "Encode with lossy output format should fail",
+			args:       []string{"encode", "--carrier", "examples/street.jpeg", "--data", "examples/lake.jpeg", "--result", "result.jpeg", "--output-format", "jpeg"},
+			shouldFail: true,
+		},
 		{
 			name:       "Encode without data file should fail",
 			args:       []string{"encode", "--carrier", "examples/street.jpeg", "--result", "result.jpeg"},
@@ -199,6 +213,100 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestEncodeDecodeJUNIWARD(t *testing.T) {
+	if err := ioutil.WriteFile("data.txt", []byte("hidden in the DCT coefficients"), 0644); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+	defer os.Remove("data.txt")
+
+	commands := [][]string{
+		{"encode", "--algorithm", "juniward", "--carrier", "examples/street.jpeg", "--data", "data.txt"},
+		{"decode", "--algorithm", "juniward", "--carrier", "result0.jpeg", "--result", "decode_result"},
+	}
+	defer os.Remove("result0.jpeg")
+	defer os.Remove("decode_result")
+	for _, args := range commands {
+		t.Logf("Executing: stegify %s", strings.Join(args, " "))
+		cmd := exec.Command("./stegify", args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	assertEqualFiles(t, "data.txt", "decode_result")
+}
+
+func TestEncodeMediaCarrierShouldRejectImageFlags(t *testing.T) {
+	headers := map[string]string{
+		"wav": "RIFF\x24\x00\x00\x00WAVE",
+		"avi": "RIFF\x24\x00\x00\x00AVI ",
+	}
+	for kind, header := range headers {
+		carrier := "carrier." + kind
+		if err := ioutil.WriteFile(carrier, []byte(header), 0644); err != nil {
+			t.Fatalf("Error writing carrier: %v", err)
+		}
+		defer os.Remove(carrier)
+
+		for _, flags := range [][]string{{"--output-format", "png"}, {"--alpha"}, {"--jpeg-metadata"}} {
+			args := append([]string{"encode", "--carrier", carrier, "--data", "examples/lake.jpeg", "--result", "result." + kind}, flags...)
+			t.Logf("Executing: stegify %s", strings.Join(args, " "))
+			output, err := exec.Command("./stegify", args...).CombinedOutput()
+			if err == nil || !strings.Contains(string(output), "do not apply to "+kind+" carriers") {
+				t.Errorf("Expected %s to be rejected, got %v: %s", strings.Join(flags, " "), err, output)
+			}
+			if _, err := os.Stat("result." + kind); !os.IsNotExist(err) {
+				t.Errorf("Expected no result to be written, got %v", err)
+				os.Remove("result." + kind)
+			}
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	cmd := exec.Command("./stegify", "analyze", "--json", "examples/lake.jpeg", "examples/test_multi_carrier_decode2.jpeg")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var reports []security.Report
+	if err := json.Unmarshal(output, &reports); err != nil {
+		t.Fatalf("Error parsing report: %v", err)
+	}
+	if len(reports) != 2 || reports[0].Path != "examples/test_multi_carrier_decode2.jpeg" || reports[0].Verdict != security.VerdictStego {
+		t.Errorf("expected the carrier with encoded data ranked first as stego, got %+v", reports)
+	}
+	if reports[1].Verdict != security.VerdictClean {
+		t.Errorf("expected a clean verdict for the clean image, got %s", reports[1].Verdict)
+	}
+
+	if err := exec.Command("./stegify", "analyze").Run(); err == nil {
+		t.Error("expected analyze without files to fail")
+	}
+}
+
+func TestVisualize(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("./stegify", "visualize", "--carrier", "examples/test_multi_carrier_decode2.jpeg", "--cover", "examples/lake.jpeg", "--result", dir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"r-bit0", "b-bit7", "lsb", "costs", "xor"} {
+		if _, err := os.Stat(filepath.Join(dir, "test_multi_carrier_decode2-"+name+".png")); err != nil {
+			t.Errorf("expected the %s image: %v", name, err)
+		}
+	}
+
+	if err := exec.Command("./stegify", "visualize", "--carrier", "examples/street.jpeg", "--cover", "examples/lake.jpeg", "--result", dir).Run(); err == nil {
+		t.Error("expected a cover of another size to fail")
+	}
+}
+
 func assertEqualFiles(t *testing.T, expected string, given string) {
 	expectedReader, err := os.Open(expected)
 	if err != nil {
@@ -0,0 +1,241 @@
+package structural
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+//Finding is a part of an image file's structure which may hide data
+type Finding struct {
+	Format string
+	//Location names the structure: a chunk type, a segment such as "APP15" or "COM", or "trailing data"
+	Location string
+	Offset   int
+	Size     int
+	//Entropy of the content in bits per byte, close to 8 for compressed or encrypted data
+	Entropy float64
+	Reason  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s at offset %d (%d bytes, entropy %.2f): %s", f.Format, f.Location, f.Offset, f.Size, f.Entropy, f.Reason)
+}
+
+const (
+	//textEntropyThreshold separates natural language text, which stays below 5 bits per character,
+	//from data stored as text, e.g. base64 encoded data approaches 6
+	textEntropyThreshold = 5
+	//minSuspiciousText is the size below which text is too short for a meaningful entropy
+	minSuspiciousText = 64
+	//maxCommentBinaryRatio is the fraction of non-printable bytes tolerated in a comment
+	maxCommentBinaryRatio = 0.1
+)
+
+//knownPNGChunks are the chunks of the PNG specification and its registered extensions
+var knownPNGChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "cHRM": true, "gAMA": true, "iCCP": true, "sBIT": true, "sRGB": true,
+	"cICP": true, "mDCV": true, "cLLI": true, "tEXt": true, "zTXt": true, "iTXt": true,
+	"bKGD": true, "hIST": true, "pHYs": true, "sPLT": true, "eXIf": true, "tIME": true,
+	"acTL": true, "fcTL": true, "fdAT": true,
+	"oFFs": true, "pCAL": true, "sCAL": true, "gIFg": true, "gIFx": true, "gIFt": true,
+	"sTER": true, "dSIG": true, "fRAc": true,
+}
+
+//knownJPEGIdentifiers are the identifiers that start well known APPn segments
+var knownJPEGIdentifiers = map[byte][]string{
+	0xE0: {"JFIF\x00", "JFXX\x00", "AVI1"},
+	0xE1: {"Exif\x00", "http://ns.adobe.com/xap/1.0/\x00", "http://ns.adobe.com/xmp/extension/\x00"},
+	0xE2: {"ICC_PROFILE\x00", "MPF\x00", "FPXR\x00"},
+	0xEC: {"Ducky"},
+	0xED: {"Photoshop 3.0\x00"},
+	0xEE: {"Adobe"},
+}
+
+//Detect inspects the structure of a PNG or JPEG file for places that may hide data:
+//private or unknown PNG chunks, APPn segments with unknown identifiers, binary comments,
+//text of unusually high entropy and data following the end of the image.
+//Every file carrying a payload of Encode is reported.
+func Detect(r io.Reader) ([]Finding, error) {
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(file, pngSignature):
+		return detectPNG(file)
+	case bytes.HasPrefix(file, []byte{0xFF, 0xD8}):
+		return detectJPEG(file)
+	}
+	return nil, fmt.Errorf("%w: structural detection supports png and jpeg files", steg.ErrUnsupportedFormat)
+}
+
+func detectPNG(file []byte) ([]Finding, error) {
+	chunks, trailer, err := pngChunks(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	report := func(location string, offset int, content []byte, reason string) {
+		findings = append(findings, Finding{Format: "png", Location: location, Offset: offset, Size: len(content), Entropy: entropy(content), Reason: reason})
+	}
+	for _, c := range chunks {
+		data := c.data(file)
+		switch {
+		case c.chunkType[1]&0x20 != 0: //lowercase second letter
+			report(c.chunkType, c.start, data, "private chunk")
+		case !knownPNGChunks[c.chunkType]:
+			report(c.chunkType, c.start, data, "unknown chunk")
+		case c.chunkType == "tEXt" || c.chunkType == "iTXt":
+			//zTXt and compressed iTXt have a high entropy anyway
+			if text := textValue(c.chunkType, data); len(text) >= minSuspiciousText && entropy(text) > textEntropyThreshold {
+				report(c.chunkType, c.start, data, "text of high entropy")
+			}
+		}
+	}
+	if trailer < len(file) {
+		report("trailing data", trailer, file[trailer:], "data after IEND")
+	}
+	return findings, nil
+}
+
+//textValue returns the text of a tEXt chunk or of an uncompressed iTXt chunk
+func textValue(chunkType string, data []byte) []byte {
+	keyword := bytes.IndexByte(data, 0)
+	if keyword < 0 {
+		return nil
+	}
+	text := data[keyword+1:]
+	if chunkType == "tEXt" {
+		return text
+	}
+	if len(text) < 2 || text[0] != 0 { //compressed
+		return nil
+	}
+	text = text[2:]
+	for i := 0; i < 2; i++ { //language tag and translated keyword
+		end := bytes.IndexByte(text, 0)
+		if end < 0 {
+			return nil
+		}
+		text = text[end+1:]
+	}
+	return text
+}
+
+func detectJPEG(file []byte) ([]Finding, error) {
+	segments, scan, err := jpegSegments(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	report := func(location string, offset int, content []byte, reason string) {
+		findings = append(findings, Finding{Format: "jpeg", Location: location, Offset: offset, Size: len(content), Entropy: entropy(content), Reason: reason})
+	}
+	for _, s := range segments {
+		data := s.data(file)
+		switch {
+		case isPayloadSegment(file, s):
+			report(segmentName(s.marker), s.start, data, "payload of structural.Encode")
+		case s.marker >= 0xE0 && s.marker <= 0xEF && !knownIdentifier(s.marker, data):
+			report(segmentName(s.marker), s.start, data, "segment with unknown identifier")
+		case s.marker == CommentMarker && binaryRatio(data) > maxCommentBinaryRatio:
+			report("COM", s.start, data, "binary comment")
+		case s.marker == CommentMarker && len(data) >= minSuspiciousText && entropy(data) > textEntropyThreshold:
+			report("COM", s.start, data, "comment of high entropy")
+		}
+	}
+
+	end := endOfImage(file, scan)
+	if end < 0 {
+		return nil, fmt.Errorf("jpeg has no EOI marker")
+	}
+	if end < len(file) {
+		report("trailing data", end, file[end:], "data after EOI")
+	}
+	return findings, nil
+}
+
+func segmentName(marker byte) string {
+	if marker == CommentMarker {
+		return "COM"
+	}
+	return fmt.Sprintf("APP%d", marker-0xE0)
+}
+
+func knownIdentifier(marker byte, data []byte) bool {
+	for _, identifier := range knownJPEGIdentifiers[marker] {
+		if bytes.HasPrefix(data, []byte(identifier)) {
+			return true
+		}
+	}
+	return false
+}
+
+//endOfImage returns the position following the EOI marker, skipping the entropy coded data of all scans
+func endOfImage(file []byte, offset int) int {
+	for offset+1 < len(file) {
+		if file[offset] != 0xFF {
+			offset++
+			continue
+		}
+		marker := file[offset+1]
+		switch {
+		case marker == 0xD9:
+			return offset + 2
+		case marker == 0x00 || marker == 0xFF || marker >= 0xD0 && marker <= 0xD7:
+			offset++ //stuffed byte, fill byte or restart marker inside the scan
+		default: //a segment between scans, e.g. DHT or SOS of a progressive image
+			if offset+4 > len(file) {
+				return -1
+			}
+			offset += 2 + int(binary.BigEndian.Uint16(file[offset+2:]))
+		}
+	}
+	return -1
+}
+
+//entropy returns the Shannon entropy of data in bits per byte
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	h := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(data))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+//binaryRatio returns the fraction of bytes which are not part of printable UTF-8 text
+func binaryRatio(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	binaryBytes := 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError || unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			binaryBytes += size
+		}
+		i += size
+	}
+	return float64(binaryBytes) / float64(len(data))
+}
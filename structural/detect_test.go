@@ -0,0 +1,96 @@
+package structural
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/formats"
+)
+
+func TestDetectCleanFiles(t *testing.T) {
+	text := "Comment\x00" + strings.Repeat("A photograph of a quiet street, taken early in the morning. ", 10)
+	withText, err := formats.InsertPNGChunks(newTestPNG(t), []formats.PNGChunk{{Type: "tEXt", Data: []byte(text)}})
+	if err != nil {
+		t.Fatalf("Failed to insert chunk: %v", err)
+	}
+
+	for name, file := range map[string][]byte{"png": newTestPNG(t), "png with long text": withText, "jpeg": newTestJPEG(t)} {
+		findings, err := Detect(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: failed to detect: %v", name, err)
+		}
+		if len(findings) != 0 {
+			t.Errorf("%s: expected no findings, got %v", name, findings)
+		}
+	}
+}
+
+func TestDetectPayloads(t *testing.T) {
+	for _, options := range []Options{{}, {Key: "secret"}, {ChunkType: "prVt"}, {Marker: CommentMarker}, {Marker: 0xE4}} {
+		for name, carrier := range map[string][]byte{"png": newTestPNG(t), "jpeg": newTestJPEG(t)} {
+			var result bytes.Buffer
+			if err := Encode(bytes.NewReader(carrier), bytes.NewReader([]byte("plain text payload")), &result, options); err != nil {
+				t.Fatalf("%s: failed to encode: %v", name, err)
+			}
+			findings, err := Detect(&result)
+			if err != nil {
+				t.Fatalf("%s: failed to detect: %v", name, err)
+			}
+			if len(findings) != 1 {
+				t.Errorf("%s with %+v: expected one finding, got %v", name, options, findings)
+			}
+		}
+	}
+}
+
+func TestDetectSuspiciousStructures(t *testing.T) {
+	highEntropyText := append([]byte("Comment\x00"), []byte(base64Like(512))...)
+	png, err := formats.InsertPNGChunks(newTestPNG(t), []formats.PNGChunk{
+		{Type: "tEXt", Data: highEntropyText},
+		{Type: "uNKn", Data: []byte("unknown public chunk")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert chunks: %v", err)
+	}
+	png = append(png, "appended"...)
+
+	jpeg := newTestJPEG(t)
+	comment := append([]byte{0xFF, 0xFE, 0x00, 0x0A}, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07)
+	app := append([]byte{0xFF, 0xE5, 0x00, 0x08}, "UNKN\x00\x00"...)
+	jpeg = append(append(append(append([]byte{}, jpeg[:2]...), comment...), app...), jpeg[2:]...)
+	jpeg = append(jpeg, "appended"...)
+
+	tests := []struct {
+		name    string
+		file    []byte
+		reasons []string
+	}{
+		{"png", png, []string{"text of high entropy", "unknown chunk", "data after IEND"}},
+		{"jpeg", jpeg, []string{"binary comment", "segment with unknown identifier", "data after EOI"}},
+	}
+	for _, test := range tests {
+		findings, err := Detect(bytes.NewReader(test.file))
+		if err != nil {
+			t.Fatalf("%s: failed to detect: %v", test.name, err)
+		}
+		if len(findings) != len(test.reasons) {
+			t.Fatalf("%s: expected %d findings, got %v", test.name, len(test.reasons), findings)
+		}
+		for i, reason := range test.reasons {
+			if findings[i].Reason != reason {
+				t.Errorf("%s: expected finding %d to be %q, got %q", test.name, i, reason, findings[i].Reason)
+			}
+		}
+	}
+}
+
+//base64Like returns text of the base64 alphabet, which has an entropy of about 6 bits per character
+func base64Like(n int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	data := randomData(n)
+	for i := range data {
+		data[i] = alphabet[data[i]%64]
+	}
+	return string(data)
+}
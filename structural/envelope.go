@@ -0,0 +1,92 @@
+package structural
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const (
+	envelopeVersion = 1
+	flagEncrypted   = 1
+
+	saltSize = 16
+	keySize  = 32 //AES-256
+	//pbkdf2Iterations follows the OWASP recommendation for PBKDF2-HMAC-SHA256
+	pbkdf2Iterations = 600000
+)
+
+//seal wraps data in an envelope of a version byte and a flags byte, followed by the data itself
+//or, when key is set, by a random salt, the nonce and the AES-GCM encrypted data
+func seal(data []byte, key string) ([]byte, error) {
+	if key == "" {
+		return append([]byte{envelopeVersion, 0}, data...), nil
+	}
+
+	header := []byte{envelopeVersion, flagEncrypted}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	envelope := append(append(header, salt...), nonce...)
+	return aead.Seal(envelope, nonce, data, header), nil
+}
+
+//open returns the data of an envelope created by seal
+func open(envelope []byte, key string) ([]byte, error) {
+	if len(envelope) < 2 || envelope[0] != envelopeVersion {
+		return nil, fmt.Errorf("%w: invalid payload envelope", steg.ErrCorruptHeader)
+	}
+	header := envelope[:2]
+	if header[1]&flagEncrypted == 0 {
+		return envelope[2:], nil
+	}
+	if key == "" {
+		return nil, fmt.Errorf("%w: payload is encrypted, a key is required", steg.ErrAuthFailed)
+	}
+
+	body := envelope[2:]
+	if len(body) < saltSize {
+		return nil, fmt.Errorf("%w: invalid payload envelope", steg.ErrCorruptHeader)
+	}
+	aead, err := newAEAD(key, body[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	body = body[saltSize:]
+	if len(body) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: invalid payload envelope", steg.ErrCorruptHeader)
+	}
+
+	data, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+	if err != nil {
+		return nil, steg.ErrAuthFailed
+	}
+	return data, nil
+}
+
+func newAEAD(key string, salt []byte) (cipher.AEAD, error) {
+	derived, err := pbkdf2.Key(sha256.New, key, salt, pbkdf2Iterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
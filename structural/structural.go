@@ -0,0 +1,412 @@
+//Package structural hides data in the file structure of images instead of their pixels:
+//in private ancillary chunks of PNG files and in APPn or COM segments of JPEG files.
+//
+//The pixels stay untouched, so the result decodes to exactly the same image, but the data is
+//easy to find for anyone looking at the structure of the file (see Detect) and lost when the image
+//is re-encoded. Payloads may be encrypted, which hides their content but not their presence.
+package structural
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+const (
+	//DefaultChunkType is the PNG chunk payloads are stored in: ancillary, private and safe to copy
+	DefaultChunkType = "stEg"
+	//DefaultMarker is the JPEG segment payloads are stored in (APP15)
+	DefaultMarker = 0xEF
+	//CommentMarker selects JPEG COM segments
+	CommentMarker = 0xFE
+
+	//maxChunkData limits the size of a single PNG chunk, larger payloads span consecutive chunks
+	maxChunkData = 1 << 20
+	//maxSegmentData is what remains of a JPEG segment after its length, identifier and sequence
+	maxSegmentData = 0xFFFF - 2 - len(segmentIdentifier) - 4
+)
+
+//segmentIdentifier starts JPEG segments written by Encode, like "Exif\x00" starts EXIF segments
+const segmentIdentifier = "stegify\x00"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+//Options configures Encode and Decode
+type Options struct {
+	//Key encrypts the payload with AES-256-GCM when set. Decoding needs the same key.
+	Key string
+	//ChunkType is the PNG chunk the payload is stored in, DefaultChunkType when empty.
+	//It must be an ancillary private chunk type, e.g. "prVt".
+	ChunkType string
+	//Marker is the JPEG segment the payload is stored in: 0xE0 to 0xEF for APP0 to APP15
+	//or CommentMarker, DefaultMarker when zero
+	Marker byte
+}
+
+func (o Options) chunkType() (string, error) {
+	if o.ChunkType == "" {
+		return DefaultChunkType, nil
+	}
+	t := o.ChunkType
+	letter := func(b byte) bool { return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' }
+	if len(t) != 4 || !letter(t[0]) || !letter(t[1]) || !letter(t[2]) || !letter(t[3]) {
+		return "", fmt.Errorf("invalid png chunk type %q", t)
+	}
+	//lowercase first and second letters make a chunk ancillary and private, the third is reserved uppercase
+	if t[0]&0x20 == 0 || t[1]&0x20 == 0 || t[2]&0x20 != 0 {
+		return "", fmt.Errorf("png chunk type %q is not an ancillary private chunk", t)
+	}
+	return t, nil
+}
+
+func (o Options) marker() (byte, error) {
+	switch {
+	case o.Marker == 0:
+		return DefaultMarker, nil
+	case o.Marker >= 0xE0 && o.Marker <= 0xEF || o.Marker == CommentMarker:
+		return o.Marker, nil
+	}
+	return 0, fmt.Errorf("invalid jpeg marker 0x%X, only APPn and COM segments can carry data", o.Marker)
+}
+
+//Encode hides data in the structure of a PNG or JPEG carrier and writes the result in the same format.
+//A payload previously encoded with the same options is replaced.
+func Encode(carrier io.Reader, data io.Reader, result io.Writer, options Options) error {
+	carrierBytes, err := ioutil.ReadAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error reading carrier: %w", err)
+	}
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+	payload, err := seal(dataBytes, options.Key)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch {
+	case bytes.HasPrefix(carrierBytes, pngSignature):
+		chunkType, err := options.chunkType()
+		if err != nil {
+			return err
+		}
+		out, err = encodePNG(carrierBytes, payload, chunkType)
+		if err != nil {
+			return err
+		}
+	case bytes.HasPrefix(carrierBytes, []byte{0xFF, 0xD8}):
+		marker, err := options.marker()
+		if err != nil {
+			return err
+		}
+		out, err = encodeJPEG(carrierBytes, payload, marker)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: structural mode supports png and jpeg carriers", steg.ErrUnsupportedFormat)
+	}
+
+	if _, err := result.Write(out); err != nil {
+		return fmt.Errorf("error writing the result: %w", err)
+	}
+	return nil
+}
+
+//Decode extracts data previously hidden by Encode. PNG payloads are looked up by the chunk type
+//of options, JPEG payloads are found in any APPn or COM segment.
+func Decode(carrier io.Reader, result io.Writer, options Options) error {
+	carrierBytes, err := ioutil.ReadAll(carrier)
+	if err != nil {
+		return fmt.Errorf("error reading carrier: %w", err)
+	}
+
+	var payload []byte
+	switch {
+	case bytes.HasPrefix(carrierBytes, pngSignature):
+		chunkType, err := options.chunkType()
+		if err != nil {
+			return err
+		}
+		payload, err = decodePNG(carrierBytes, chunkType)
+		if err != nil {
+			return err
+		}
+	case bytes.HasPrefix(carrierBytes, []byte{0xFF, 0xD8}):
+		payload, err = decodeJPEG(carrierBytes)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: structural mode supports png and jpeg carriers", steg.ErrUnsupportedFormat)
+	}
+
+	data, err := open(payload, options.Key)
+	if err != nil {
+		return err
+	}
+	if _, err := result.Write(data); err != nil {
+		return fmt.Errorf("error writing the result: %w", err)
+	}
+	return nil
+}
+
+//pngChunk locates a chunk, including its length, type and checksum, in a PNG file
+type pngChunk struct {
+	chunkType  string
+	start, end int
+}
+
+func (c pngChunk) data(file []byte) []byte {
+	return file[c.start+8 : c.end-4]
+}
+
+//pngChunks lists the chunks of a PNG file up to IEND and returns where the data following IEND starts
+func pngChunks(file []byte) ([]pngChunk, int, error) {
+	var chunks []pngChunk
+	for offset := len(pngSignature); offset < len(file); {
+		if len(file)-offset < 12 {
+			return nil, 0, fmt.Errorf("truncated png chunk at offset %d", offset)
+		}
+		length := int64(binary.BigEndian.Uint32(file[offset:]))
+		end := int64(offset) + 12 + length
+		if end > int64(len(file)) {
+			return nil, 0, fmt.Errorf("truncated png chunk at offset %d", offset)
+		}
+		c := pngChunk{chunkType: string(file[offset+4 : offset+8]), start: offset, end: int(end)}
+		chunks = append(chunks, c)
+		offset = c.end
+		if c.chunkType == "IEND" {
+			return chunks, offset, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("png has no IEND chunk")
+}
+
+func encodePNG(file, payload []byte, chunkType string) ([]byte, error) {
+	chunks, trailer, err := pngChunks(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	for _, c := range chunks {
+		if c.chunkType == chunkType {
+			continue //replaced by the new payload
+		}
+		if c.chunkType == "IEND" {
+			for len(payload) > 0 {
+				n := min(len(payload), maxChunkData)
+				if err := formats.WritePNGChunk(&out, chunkType, payload[:n]); err != nil {
+					return nil, err
+				}
+				payload = payload[n:]
+			}
+		}
+		out.Write(file[c.start:c.end])
+	}
+	out.Write(file[trailer:])
+	return out.Bytes(), nil
+}
+
+func decodePNG(file []byte, chunkType string) ([]byte, error) {
+	chunks, _, err := pngChunks(file)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	found := false
+	for _, c := range chunks {
+		if c.chunkType == chunkType {
+			payload = append(payload, c.data(file)...)
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: png has no %s chunk", steg.ErrNoPayload, chunkType)
+	}
+	return payload, nil
+}
+
+//jpegSegment locates a marker segment, including its marker and length, in a JPEG file
+type jpegSegment struct {
+	marker     byte
+	start, end int
+}
+
+func (s jpegSegment) data(file []byte) []byte {
+	return file[s.start+4 : s.end]
+}
+
+//jpegSegments lists the marker segments of a JPEG file preceding the first scan
+//and returns where the first scan starts
+func jpegSegments(file []byte) ([]jpegSegment, int, error) {
+	var segments []jpegSegment
+	for offset := 2; ; {
+		if offset+4 > len(file) || file[offset] != 0xFF {
+			return nil, 0, fmt.Errorf("invalid jpeg marker at offset %d", offset)
+		}
+		marker := file[offset+1]
+		if marker == 0xFF { //fill byte
+			offset++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, offset, nil
+		}
+		end := offset + 2 + int(binary.BigEndian.Uint16(file[offset+2:]))
+		if end > len(file) || end < offset+4 {
+			return nil, 0, fmt.Errorf("invalid jpeg segment length at offset %d", offset)
+		}
+		segments = append(segments, jpegSegment{marker: marker, start: offset, end: end})
+		offset = end
+	}
+}
+
+func isPayloadSegment(file []byte, s jpegSegment) bool {
+	return (s.marker >= 0xE0 && s.marker <= 0xEF || s.marker == CommentMarker) &&
+		bytes.HasPrefix(s.data(file), []byte(segmentIdentifier))
+}
+
+func encodeJPEG(file, payload []byte, marker byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(file)
+	if err != nil {
+		return nil, err
+	}
+
+	count := (len(payload) + maxSegmentData - 1) / maxSegmentData
+	if count > 0xFFFF {
+		return nil, &steg.CapacityError{Needed: int64(len(payload)), Available: 0xFFFF * int64(maxSegmentData)}
+	}
+
+	var out bytes.Buffer
+	out.Write(file[:2])
+	inserted := false
+	for _, s := range segments {
+		if isPayloadSegment(file, s) {
+			continue //replaced by the new payload
+		}
+		//the payload follows the APPn segments such as JFIF and EXIF which have to come first
+		if !inserted && (s.marker < 0xE0 || s.marker > 0xEF) {
+			writePayloadSegments(&out, payload, marker, count)
+			inserted = true
+		}
+		out.Write(file[s.start:s.end])
+	}
+	if !inserted {
+		writePayloadSegments(&out, payload, marker, count)
+	}
+	out.Write(file[scan:])
+	return out.Bytes(), nil
+}
+
+//writePayloadSegments writes payload as segments of the identifier, their sequence number and count, and the data
+func writePayloadSegments(out *bytes.Buffer, payload []byte, marker byte, count int) {
+	for i := 0; i < count; i++ {
+		n := min(len(payload), maxSegmentData)
+		header := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(2+len(segmentIdentifier)+4+n))
+		out.Write(header)
+		out.WriteString(segmentIdentifier)
+		sequence := make([]byte, 4)
+		binary.BigEndian.PutUint16(sequence, uint16(i))
+		binary.BigEndian.PutUint16(sequence[2:], uint16(count))
+		out.Write(sequence)
+		out.Write(payload[:n])
+		payload = payload[n:]
+	}
+}
+
+func decodeJPEG(file []byte) ([]byte, error) {
+	segments, _, err := jpegSegments(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts [][]byte
+	for _, s := range segments {
+		if !isPayloadSegment(file, s) {
+			continue
+		}
+		data := s.data(file)[len(segmentIdentifier):]
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: invalid payload segment at offset %d", steg.ErrCorruptHeader, s.start)
+		}
+		index, count := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+		if parts == nil {
+			parts = make([][]byte, count)
+		}
+		if count != len(parts) || index >= count || parts[index] != nil {
+			return nil, fmt.Errorf("%w: inconsistent payload segment at offset %d", steg.ErrCorruptHeader, s.start)
+		}
+		parts[index] = data[4:]
+	}
+	if parts == nil {
+		return nil, fmt.Errorf("%w: jpeg has no payload segments", steg.ErrNoPayload)
+	}
+	for i, part := range parts {
+		if part == nil {
+			return nil, fmt.Errorf("%w: payload segment %d of %d is missing", steg.ErrShardMissing, i, len(parts))
+		}
+	}
+	return bytes.Join(parts, nil), nil
+}
+
+//EncodeByFileNames performs Encode on files
+func EncodeByFileNames(carrierFileName, dataFileName, resultFileName string, options Options) (err error) {
+	carrier, err := os.Open(carrierFileName)
+	if err != nil {
+		return fmt.Errorf("error opening carrier file %s: %w", carrierFileName, err)
+	}
+	defer carrier.Close()
+
+	data, err := os.Open(dataFileName)
+	if err != nil {
+		return fmt.Errorf("error opening data file %s: %w", dataFileName, err)
+	}
+	defer data.Close()
+
+	result, err := os.Create(resultFileName)
+	if err != nil {
+		return fmt.Errorf("error creating result file: %w", err)
+	}
+	defer func() {
+		closeErr := result.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	return Encode(carrier, data, result, options)
+}
+
+//DecodeByFileNames performs Decode on files
+func DecodeByFileNames(carrierFileName, resultFileName string, options Options) (err error) {
+	carrier, err := os.Open(carrierFileName)
+	if err != nil {
+		return fmt.Errorf("error opening carrier file %s: %w", carrierFileName, err)
+	}
+	defer carrier.Close()
+
+	result, err := os.Create(resultFileName)
+	if err != nil {
+		return fmt.Errorf("error creating result file: %w", err)
+	}
+	defer func() {
+		closeErr := result.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	return Decode(carrier, result, options)
+}
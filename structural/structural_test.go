@@ -0,0 +1,186 @@
+package structural
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/DimitarPetrov/stegify/formats"
+	"github.com/DimitarPetrov/stegify/steg"
+)
+
+func newTestImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 10), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func newTestPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, newTestImage()); err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	withText, err := formats.InsertPNGChunks(buf.Bytes(), []formats.PNGChunk{{Type: "tEXt", Data: []byte("Comment\x00a short description")}})
+	if err != nil {
+		t.Fatalf("Failed to insert chunk: %v", err)
+	}
+	return withText
+}
+
+func newTestJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, newTestImage(), nil); err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func assertSamePixels(t *testing.T, expected, actual []byte) {
+	t.Helper()
+	a, _, err := image.Decode(bytes.NewReader(expected))
+	if err != nil {
+		t.Fatalf("Failed to decode carrier: %v", err)
+	}
+	b, _, err := image.Decode(bytes.NewReader(actual))
+	if err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				t.Fatalf("Pixel (%d, %d) changed", x, y)
+			}
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		carrier []byte
+		data    []byte
+		options Options
+	}{
+		{"png", newTestPNG(t), randomData(1000), Options{}},
+		{"png spanning chunks", newTestPNG(t), randomData(maxChunkData + 10), Options{ChunkType: "prVt"}},
+		{"png encrypted", newTestPNG(t), randomData(100), Options{Key: "secret"}},
+		{"jpeg", newTestJPEG(t), randomData(1000), Options{}},
+		{"jpeg spanning segments", newTestJPEG(t), randomData(3 * maxSegmentData), Options{Marker: 0xE9}},
+		{"jpeg comment", newTestJPEG(t), []byte("plain text in a comment"), Options{Marker: CommentMarker}},
+		{"jpeg encrypted", newTestJPEG(t), randomData(100), Options{Key: "secret"}},
+		{"empty data", newTestPNG(t), nil, Options{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result bytes.Buffer
+			if err := Encode(bytes.NewReader(test.carrier), bytes.NewReader(test.data), &result, test.options); err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			assertSamePixels(t, test.carrier, result.Bytes())
+
+			var decoded bytes.Buffer
+			if err := Decode(bytes.NewReader(result.Bytes()), &decoded, test.options); err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !bytes.Equal(decoded.Bytes(), test.data) {
+				t.Error("Decoded data does not match")
+			}
+		})
+	}
+}
+
+func TestEncodeShouldKeepOtherChunks(t *testing.T) {
+	var result bytes.Buffer
+	if err := Encode(bytes.NewReader(newTestPNG(t)), bytes.NewReader([]byte("data")), &result, Options{}); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	chunks, err := formats.ReadPNGChunks(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		t.Fatalf("Result is not a valid png: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Type != "tEXt" {
+		t.Errorf("Expected the text chunk to be kept, got %v", chunks)
+	}
+}
+
+func TestEncodeShouldReplacePreviousPayload(t *testing.T) {
+	for name, carrier := range map[string][]byte{"png": newTestPNG(t), "jpeg": newTestJPEG(t)} {
+		var first, second bytes.Buffer
+		if err := Encode(bytes.NewReader(carrier), bytes.NewReader(randomData(500)), &first, Options{}); err != nil {
+			t.Fatalf("%s: failed to encode: %v", name, err)
+		}
+		if err := Encode(bytes.NewReader(first.Bytes()), bytes.NewReader([]byte("second")), &second, Options{}); err != nil {
+			t.Fatalf("%s: failed to encode: %v", name, err)
+		}
+		var decoded bytes.Buffer
+		if err := Decode(&second, &decoded, Options{}); err != nil {
+			t.Fatalf("%s: failed to decode: %v", name, err)
+		}
+		if decoded.String() != "second" {
+			t.Errorf("%s: expected the previous payload to be replaced, got %d bytes", name, decoded.Len())
+		}
+	}
+}
+
+func TestDecodeWithWrongKey(t *testing.T) {
+	var result bytes.Buffer
+	if err := Encode(bytes.NewReader(newTestJPEG(t)), bytes.NewReader([]byte("data")), &result, Options{Key: "right"}); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	for _, key := range []string{"wrong", ""} {
+		if err := Decode(bytes.NewReader(result.Bytes()), &bytes.Buffer{}, Options{Key: key}); !errors.Is(err, steg.ErrAuthFailed) {
+			t.Errorf("Expected ErrAuthFailed when decoding with key %q, got %v", key, err)
+		}
+	}
+}
+
+func TestEncodeShouldRejectInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		carrier []byte
+		options Options
+	}{
+		{"critical chunk", newTestPNG(t), Options{ChunkType: "StEg"}},
+		{"public chunk", newTestPNG(t), Options{ChunkType: "sTEg"}},
+		{"invalid chunk name", newTestPNG(t), Options{ChunkType: "s1Eg"}},
+		{"non APP marker", newTestJPEG(t), Options{Marker: 0xDB}},
+		{"gif carrier", []byte("GIF89a"), Options{}},
+	}
+	for _, test := range tests {
+		if err := Encode(bytes.NewReader(test.carrier), bytes.NewReader([]byte("data")), &bytes.Buffer{}, test.options); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDecodeShouldReturnSentinelErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		carrier  []byte
+		expected error
+	}{
+		{"png without payload", newTestPNG(t), steg.ErrNoPayload},
+		{"jpeg without payload", newTestJPEG(t), steg.ErrNoPayload},
+		{"gif carrier", []byte("GIF89a"), steg.ErrUnsupportedFormat},
+	}
+	for _, test := range tests {
+		if err := Decode(bytes.NewReader(test.carrier), &bytes.Buffer{}, Options{}); !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/DimitarPetrov/stegify/advanced/security"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const visualize = "visualize"
+
+var coverFile = flag.String("cover", "", "original carrier compared with the carriers when visualizing, adds their XOR difference")
+
+//runVisualize writes the bit planes, amplified LSBs, cost heatmap and XOR difference with the cover of every carrier
+//as png files named after the carrier into the result directory
+func runVisualize(carriers, results []string) {
+	dir := "."
+	switch len(results) {
+	case 0:
+	case 1:
+		dir = results[0]
+	default:
+		fmt.Fprintln(os.Stderr, "Only one result directory expected.")
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		exit(fmt.Errorf("error creating result directory: %w", err))
+	}
+
+	var cover image.Image
+	if *coverFile != "" {
+		var err error
+		if cover, err = readImage(*coverFile); err != nil {
+			exit(err)
+		}
+	}
+
+	for _, carrier := range carriers {
+		img, err := readImage(carrier)
+		if err != nil {
+			exit(err)
+		}
+		images, err := security.RenderForensics(img, cover)
+		if err != nil {
+			exit(err)
+		}
+		name := strings.TrimSuffix(filepath.Base(carrier), filepath.Ext(carrier))
+		for _, rendered := range images {
+			if err := writePNG(filepath.Join(dir, name+"-"+rendered.Name+".png"), rendered.Image); err != nil {
+				exit(err)
+			}
+		}
+	}
+}
+
+func readImage(fileName string) (image.Image, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image %s: %w", fileName, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image %s: %w", fileName, err)
+	}
+	return img, nil
+}
+
+func writePNG(fileName string, img image.Image) (err error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("error creating result file: %w", err)
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return png.Encode(f, img)
+}